@@ -29,6 +29,21 @@ func init() {
 
 var Host = core.GetApp().Host() + "/api/ssr/v1"
 
+// RejectedError is returned when panel refuse a request, posting it again will not succeed
+type RejectedError struct {
+	Message string
+}
+
+func (e *RejectedError) Error() string {
+	return "panel rejected: " + e.Message
+}
+
+// IsRejected report whether err is a rejection of panel rather than a transport failure
+func IsRejected(err error) bool {
+	_, ok := errors.Cause(err).(*RejectedError)
+	return ok
+}
+
 // implement for vnet api get request
 func get(url string) (result string, err error) {
 	logrus.WithFields(logrus.Fields{"url": url}).Debug("get")
@@ -64,6 +79,10 @@ func post(url, param string) (result string, err error) {
 	if err != nil {
 		return "", errors.Wrap(err, "get request error")
 	}
+	// client errors except timeout and rate limit will be the same when retrying
+	if r.StatusCode() >= 400 && r.StatusCode() < 500 && r.StatusCode() != http.StatusRequestTimeout && r.StatusCode() != http.StatusTooManyRequests {
+		return "", &RejectedError{Message: fmt.Sprintf("post request status: %d body: %s", r.StatusCode(), string(r.Body()))}
+	}
 	if r.StatusCode() != http.StatusOK {
 		return "", errors.New(fmt.Sprintf("get request status: %d body: %s", r.StatusCode(), string(r.Body())))
 	}
@@ -73,8 +92,11 @@ func post(url, param string) (result string, err error) {
 
 /*------------------------------ code below is webapi implement ------------------------------*/
 
+// WebApi is the panel implement which talk to ProxyPanel by http
+type WebApi struct{}
+
 // GetNodeInfo Get Node Info
-func GetNodeInfo() (*model.NodeInfo, error) {
+func (w *WebApi) GetNodeInfo() (*model.NodeInfo, error) {
 	response, err := get(fmt.Sprintf("%s/node/%s", Host, strconv.Itoa(core.GetApp().NodeId())))
 	if err != nil {
 		return nil, err
@@ -96,7 +118,7 @@ func GetNodeInfo() (*model.NodeInfo, error) {
 }
 
 // GetUserList Get User List
-func GetUserList() ([]*model.UserInfo, error) {
+func (w *WebApi) GetUserList() ([]*model.UserInfo, error) {
 	response, err := get(fmt.Sprintf("%s/userList/%s", Host, strconv.Itoa(core.GetApp().NodeId())))
 	if err != nil {
 		return nil, err
@@ -116,7 +138,7 @@ func GetUserList() ([]*model.UserInfo, error) {
 	return result, nil
 }
 
-func PostAllUserTraffic(allUserTraffic []*model.UserTraffic) error {
+func (w *WebApi) PostAllUserTraffic(allUserTraffic []*model.UserTraffic) error {
 	value, err := post(fmt.Sprintf("%s/userTraffic/%s", Host, strconv.Itoa(core.GetApp().NodeId())),
 		string(langx.Must(func() (interface{}, error) {
 			return json.Marshal(allUserTraffic)
@@ -126,12 +148,12 @@ func PostAllUserTraffic(allUserTraffic []*model.UserTraffic) error {
 		return err
 	}
 	if gjson.Get(value, "status").String() != "success" {
-		return errors.New(gjson.Get(value, "message").String())
+		return &RejectedError{Message: gjson.Get(value, "message").String()}
 	}
 	return nil
 }
 
-func PostNodeOnline(nodeOnline []*model.NodeOnline) error {
+func (w *WebApi) PostNodeOnline(nodeOnline []*model.NodeOnline) error {
 	value, err := post(fmt.Sprintf("%s/nodeOnline/%s", Host, strconv.Itoa(core.GetApp().NodeId())),
 		string(langx.Must(func() (interface{}, error) {
 			return json.Marshal(nodeOnline)
@@ -142,12 +164,12 @@ func PostNodeOnline(nodeOnline []*model.NodeOnline) error {
 	}
 
 	if gjson.Get(value, "status").String() != "success" {
-		return errors.New(stringx.UnicodeToUtf8(gjson.Get(value, "message").String()))
+		return &RejectedError{Message: stringx.UnicodeToUtf8(gjson.Get(value, "message").String())}
 	}
 	return nil
 }
 
-func PostNodeStatus(status model.NodeStatus) error {
+func (w *WebApi) PostNodeStatus(status model.NodeStatus) error {
 	value, err := post(fmt.Sprintf("%s/nodeStatus/%s", Host, strconv.Itoa(core.GetApp().NodeId())),
 		string(langx.Must(func() (interface{}, error) {
 			return json.Marshal(status)
@@ -163,7 +185,7 @@ func PostNodeStatus(status model.NodeStatus) error {
 }
 
 // PostTrigger when user trigger audit rules then report
-func PostTrigger(trigger model.Trigger) error {
+func (w *WebApi) PostTrigger(trigger model.Trigger) error {
 	value, err := post(fmt.Sprintf("%s/trigger/%s", Host, strconv.Itoa(core.GetApp().NodeId())),
 		string(langx.Must(func() (interface{}, error) {
 			return json.Marshal(trigger)
@@ -178,8 +200,24 @@ func PostTrigger(trigger model.Trigger) error {
 	return nil
 }
 
+// PostUserQuota report users whose quota is exhausted
+func (w *WebApi) PostUserQuota(userQuota []*model.UserQuota) error {
+	value, err := post(fmt.Sprintf("%s/userQuota/%s", Host, strconv.Itoa(core.GetApp().NodeId())),
+		string(langx.Must(func() (interface{}, error) {
+			return json.Marshal(userQuota)
+		}).([]byte)))
+
+	if err != nil {
+		return err
+	}
+	if gjson.Get(value, "status").String() != "success" {
+		return &RejectedError{Message: stringx.UnicodeToUtf8(gjson.Get(value, "message").String())}
+	}
+	return nil
+}
+
 // GetNodeRule Get Node Rule
-func GetNodeRule() (*model.Rule, error) {
+func (w *WebApi) GetNodeRule() (*model.Rule, error) {
 	response, err := get(fmt.Sprintf("%s/nodeRule/%s", Host, strconv.Itoa(core.GetApp().NodeId())))
 	if err != nil {
 		return nil, err
@@ -0,0 +1,225 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/fsnotify/fsnotify"
+	"github.com/mitchellh/mapstructure"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+// LocalConfig is the content of standalone config file, it can be json or yaml
+type LocalConfig struct {
+	Node  *model.NodeInfo   `json:"node"`
+	Users []*model.UserInfo `json:"users"`
+	Rule  *model.Rule       `json:"rule"`
+	// Report is the file which traffic, online, status and trigger reports append to,
+	// reports will only be logged when it is empty
+	Report string `json:"report"`
+}
+
+// LocalReport is a line written to report file
+type LocalReport struct {
+	Type string      `json:"type"`
+	Time int64       `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// LocalPanel is the panel implement for standalone mode, it reads node settings from
+// a local file and writes reports to a local file instead of ProxyPanel
+type LocalPanel struct {
+	sync.RWMutex
+	path      string
+	config    *LocalConfig
+	reportMu  sync.Mutex
+	onChanges []func(before, after *LocalConfig)
+}
+
+func NewLocalPanel(path string) (*LocalPanel, error) {
+	l := &LocalPanel{path: path}
+	config, err := l.read()
+	if err != nil {
+		return nil, err
+	}
+	l.config = config
+	return l, nil
+}
+
+func (l *LocalPanel) read() (*LocalConfig, error) {
+	v := viper.New()
+	v.SetConfigFile(l.path)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("read standalone config %s error", l.path))
+	}
+	config := new(LocalConfig)
+	if err := v.Unmarshal(config, func(c *mapstructure.DecoderConfig) {
+		c.TagName = "json"
+	}); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("parse standalone config %s error", l.path))
+	}
+	if config.Node == nil {
+		return nil, errors.New(fmt.Sprintf("standalone config %s miss node", l.path))
+	}
+	if config.Rule == nil {
+		config.Rule = &model.Rule{Model: "all"}
+	}
+	uids := make(map[int]bool, len(config.Users))
+	for _, user := range config.Users {
+		if uids[user.Uid] {
+			return nil, errors.New(fmt.Sprintf("standalone config %s uid %v is duplicate", l.path, user.Uid))
+		}
+		uids[user.Uid] = true
+	}
+	return config, nil
+}
+
+// Reload read config file again, registered change handles will be called when it success
+func (l *LocalPanel) Reload() error {
+	config, err := l.read()
+	if err != nil {
+		return err
+	}
+	l.Lock()
+	before := l.config
+	l.config = config
+	handles := l.onChanges
+	l.Unlock()
+	for _, handle := range handles {
+		handle(before, config)
+	}
+	return nil
+}
+
+// Watch reload config when the file is changed
+func (l *LocalPanel) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err := watcher.Add(l.path); err != nil {
+		_ = watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				// editors usually replace the file, so it need to be watched again
+				if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					_ = watcher.Remove(l.path)
+					time.Sleep(100 * time.Millisecond)
+					if err := watcher.Add(l.path); err != nil {
+						log.Error("standalone config %s watch error: %s", l.path, err.Error())
+						return
+					}
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) == 0 {
+					continue
+				}
+				log.Info("standalone config %s changed, reload it", l.path)
+				if err := l.Reload(); err != nil {
+					log.Error("standalone config reload error: %s", err.Error())
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Err(err)
+			}
+		}
+	}()
+	return nil
+}
+
+// OnChange register handle which will be called after config reloaded
+func (l *LocalPanel) OnChange(handle func(before, after *LocalConfig)) {
+	l.Lock()
+	defer l.Unlock()
+	l.onChanges = append(l.onChanges, handle)
+}
+
+func (l *LocalPanel) GetNodeInfo() (*model.NodeInfo, error) {
+	l.RLock()
+	defer l.RUnlock()
+	nodeInfo := *l.config.Node
+	return &nodeInfo, nil
+}
+
+func (l *LocalPanel) GetUserList() ([]*model.UserInfo, error) {
+	l.RLock()
+	defer l.RUnlock()
+	result := make([]*model.UserInfo, 0, len(l.config.Users))
+	for _, user := range l.config.Users {
+		item := *user
+		result = append(result, &item)
+	}
+	return result, nil
+}
+
+func (l *LocalPanel) GetNodeRule() (*model.Rule, error) {
+	l.RLock()
+	defer l.RUnlock()
+	rule := *l.config.Rule
+	rule.Rules = append([]model.RuleItem{}, l.config.Rule.Rules...)
+	return &rule, nil
+}
+
+func (l *LocalPanel) PostAllUserTraffic(allUserTraffic []*model.UserTraffic) error {
+	return l.report("traffic", allUserTraffic)
+}
+
+func (l *LocalPanel) PostNodeOnline(nodeOnline []*model.NodeOnline) error {
+	return l.report("online", nodeOnline)
+}
+
+func (l *LocalPanel) PostNodeStatus(status model.NodeStatus) error {
+	return l.report("status", status)
+}
+
+func (l *LocalPanel) PostTrigger(trigger model.Trigger) error {
+	return l.report("trigger", trigger)
+}
+
+func (l *LocalPanel) PostUserQuota(userQuota []*model.UserQuota) error {
+	return l.report("quota", userQuota)
+}
+
+func (l *LocalPanel) report(reportType string, data interface{}) error {
+	line, err := json.Marshal(LocalReport{
+		Type: reportType,
+		Time: time.Now().Unix(),
+		Data: data,
+	})
+	if err != nil {
+		return err
+	}
+	l.RLock()
+	path := l.config.Report
+	l.RUnlock()
+	if path == "" {
+		log.Info("standalone report %s", string(line))
+		return nil
+	}
+	l.reportMu.Lock()
+	defer l.reportMu.Unlock()
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open report file error")
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return errors.Wrap(err, "write report file error")
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProxyPanel/VNet-SSR/model"
+)
+
+const localJsonConfig = `{
+    "node": {
+        "id": 1,
+        "port": "443",
+        "passwd": "killer",
+        "method": "aes-128-cfb",
+        "protocol": "auth_aes128_md5",
+        "obfs": "plain",
+        "single": 1,
+        "is_udp": 1,
+        "push_port": 8081
+    },
+    "users": [
+        {"uid": 1, "port": 10001, "passwd": "p1", "speed_limit": 1024, "enable": 1},
+        {"uid": 2, "port": 10002, "passwd": "p2", "enable": 1}
+    ],
+    "rule": {
+        "mode": "reject",
+        "rules": [{"id": 1, "type": "domain", "pattern": "example.com"}]
+    }
+}`
+
+const localYamlConfig = `
+node:
+  id: 1
+  port: "443"
+  passwd: killer
+  method: aes-128-cfb
+  protocol: auth_aes128_md5
+  protocol_param: ""
+  obfs: plain
+  single: 1
+users:
+  - uid: 1
+    port: 10001
+    passwd: p1
+    speed_limit: 1024
+    enable: 1
+  - uid: 3
+    port: 10003
+    passwd: p3
+    enable: 0
+`
+
+func writeLocalConfig(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLocalPanel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_panel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	panel, err := NewLocalPanel(writeLocalConfig(t, dir, "config.json", localJsonConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nodeInfo, _ := panel.GetNodeInfo()
+	if nodeInfo.Port != "443" || nodeInfo.Single != 1 || nodeInfo.PushPort != 8081 || nodeInfo.IsUDP != 1 {
+		t.Fatalf("node info is wrong: %+v", nodeInfo)
+	}
+	users, _ := panel.GetUserList()
+	if len(users) != 2 || *users[0] != (model.UserInfo{Uid: 1, Port: 10001, Passwd: "p1", Limit: 1024, Enable: 1}) {
+		t.Fatalf("user list is wrong: %+v", users)
+	}
+	rule, _ := panel.GetNodeRule()
+	if rule.Model != "reject" || len(rule.Rules) != 1 || rule.Rules[0].Pattern != "example.com" {
+		t.Fatalf("rule is wrong: %+v", rule)
+	}
+
+	yamlPanel, err := NewLocalPanel(writeLocalConfig(t, dir, "config.yaml", localYamlConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, _ = yamlPanel.GetUserList()
+	if len(users) != 2 || users[1].Uid != 3 || users[1].Enable != 0 || users[0].Limit != 1024 {
+		t.Fatalf("yaml user list is wrong: %+v", users)
+	}
+	rule, _ = yamlPanel.GetNodeRule()
+	if rule.Model != "all" {
+		t.Fatalf("default rule mode should be all, got %s", rule.Model)
+	}
+}
+
+func TestLocalPanelReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_panel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeLocalConfig(t, dir, "config.json", localJsonConfig)
+	panel, err := NewLocalPanel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed := make(chan *LocalConfig, 1)
+	panel.OnChange(func(before, after *LocalConfig) {
+		changed <- after
+	})
+
+	writeLocalConfig(t, dir, "config.json", `{"users": []}`)
+	if err := panel.Reload(); err == nil {
+		t.Fatal("config without node should be rejected")
+	}
+	if users, _ := panel.GetUserList(); len(users) != 2 {
+		t.Fatal("invalid config should not replace the current one")
+	}
+
+	writeLocalConfig(t, dir, "config.json", `{"node": {"port": "443", "single": 1}, "users": [{"uid": 5, "port": 10005}]}`)
+	if err := panel.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	after := <-changed
+	if len(after.Users) != 1 || after.Users[0].Uid != 5 {
+		t.Fatalf("reload result is wrong: %+v", after.Users)
+	}
+
+	writeLocalConfig(t, dir, "config.json", `{"node": {"port": "443"}, "users": [{"uid": 5}, {"uid": 5}]}`)
+	if err := panel.Reload(); err == nil {
+		t.Fatal("duplicate uid should be rejected")
+	}
+}
+
+func TestLocalPanelReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "local_panel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	report := filepath.Join(dir, "report.log")
+	config := `{"node": {"port": "443"}, "report": "` + filepath.ToSlash(report) + `"}`
+	panel, err := NewLocalPanel(writeLocalConfig(t, dir, "config.json", config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := panel.PostAllUserTraffic([]*model.UserTraffic{{Uid: 1, Upload: 100, Download: 200}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := panel.PostNodeOnline([]*model.NodeOnline{{Uid: 1, IP: "127.0.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	types := make([]string, 0, 2)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := new(LocalReport)
+		if err := json.Unmarshal(scanner.Bytes(), line); err != nil {
+			t.Fatal(err)
+		}
+		types = append(types, line.Type)
+	}
+	if len(types) != 2 || types[0] != "traffic" || types[1] != "online" {
+		t.Fatalf("report lines are wrong: %v", types)
+	}
+}
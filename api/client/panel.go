@@ -0,0 +1,63 @@
+package client
+
+import "github.com/ProxyPanel/VNet-SSR/model"
+
+// Panel is where node gets its settings from and where reports go to
+type Panel interface {
+	GetNodeInfo() (*model.NodeInfo, error)
+	GetUserList() ([]*model.UserInfo, error)
+	GetNodeRule() (*model.Rule, error)
+	PostAllUserTraffic(allUserTraffic []*model.UserTraffic) error
+	PostNodeOnline(nodeOnline []*model.NodeOnline) error
+	PostNodeStatus(status model.NodeStatus) error
+	PostTrigger(trigger model.Trigger) error
+	PostUserQuota(userQuota []*model.UserQuota) error
+}
+
+var panel Panel = new(WebApi)
+
+// SetPanel replace the default webapi panel, eg: LocalPanel for standalone mode
+func SetPanel(p Panel) {
+	panel = p
+}
+
+func GetPanel() Panel {
+	return panel
+}
+
+// GetNodeInfo Get Node Info
+func GetNodeInfo() (*model.NodeInfo, error) {
+	return panel.GetNodeInfo()
+}
+
+// GetUserList Get User List
+func GetUserList() ([]*model.UserInfo, error) {
+	return panel.GetUserList()
+}
+
+// GetNodeRule Get Node Rule
+func GetNodeRule() (*model.Rule, error) {
+	return panel.GetNodeRule()
+}
+
+func PostAllUserTraffic(allUserTraffic []*model.UserTraffic) error {
+	return panel.PostAllUserTraffic(allUserTraffic)
+}
+
+func PostNodeOnline(nodeOnline []*model.NodeOnline) error {
+	return panel.PostNodeOnline(nodeOnline)
+}
+
+func PostNodeStatus(status model.NodeStatus) error {
+	return panel.PostNodeStatus(status)
+}
+
+// PostTrigger when user trigger audit rules then report
+func PostTrigger(trigger model.Trigger) error {
+	return panel.PostTrigger(trigger)
+}
+
+// PostUserQuota report users whose quota is exhausted
+func PostUserQuota(userQuota []*model.UserQuota) error {
+	return panel.PostUserQuota(userQuota)
+}
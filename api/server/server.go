@@ -5,7 +5,7 @@ import (
 	"context"
 	"fmt"
 	"github.com/ProxyPanel/VNet-SSR/common/log"
-	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
 	"github.com/ProxyPanel/VNet-SSR/core"
 	"github.com/ProxyPanel/VNet-SSR/model"
 	"github.com/ProxyPanel/VNet-SSR/service"
@@ -54,6 +54,10 @@ func SetSecret(s string) {
 func secretCheck() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		s := c.GetHeader("secret")
+		// prometheus can only send secret by authorization header
+		if s == "" {
+			s = strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		}
 		if s == secret {
 			c.Next()
 		} else {
@@ -110,6 +114,8 @@ func StopServer() {
 
 func InitRouter() *gin.Engine {
 	r := gin.Default()
+	// metrics is scraped frequently, so it is not logged
+	r.GET("/metrics", secretCheck(), Metrics)
 	r.Use(detailLog())
 	r.Use(secretCheck())
 	r1 := r.Group("/api")
@@ -118,6 +124,11 @@ func InitRouter() *gin.Engine {
 		r1.POST("/user/del/:uid", UserDel)
 		r1.POST("/user/edit", UserEdit)
 		r1.GET("/user/list", UserList)
+		r1.POST("/user/enable/:uid", UserEnable)
+		r1.POST("/user/disable/:uid", UserDisable)
+		r1.GET("/user/devices/:uid", UserDevices)
+		r1.POST("/user/devices/:uid/evict/:client_id", UserDeviceEvict)
+		r1.GET("/capabilities", Capabilities)
 	}
 	r2 := r.Group("/api/v2")
 	{
@@ -195,31 +206,82 @@ func UserEdit(c *gin.Context) {
 
 }
 
+func UserEnable(c *gin.Context) {
+	if err := service.GetSSRManager().EnableUser(langx.FirstResult(strconv.Atoi, c.Param("uid")).(int)); err != nil {
+		fail(c, err)
+		return
+	}
+	success(c)
+}
+
+// UserDisable suspend user, existing connections are closed with ?kill=true
+func UserDisable(c *gin.Context) {
+	kill, _ := strconv.ParseBool(c.DefaultQuery("kill", "false"))
+	if err := service.GetSSRManager().DisableUser(langx.FirstResult(strconv.Atoi, c.Param("uid")).(int), kill); err != nil {
+		fail(c, err)
+		return
+	}
+	success(c)
+}
+
 func UserList(c *gin.Context) {
 	c.JSON(http.StatusOK, service.GetSSRManager().GetUserList())
 }
 
+// UserDevices list clients of user seen by the auth protocols
+func UserDevices(c *gin.Context) {
+	devices, err := service.GetSSRManager().UserDevices(langx.FirstResult(strconv.Atoi, c.Param("uid")).(int))
+	if err != nil {
+		fail(c, err)
+		return
+	}
+	successWithData(c, devices)
+}
+
+// UserDeviceEvict forget a client of user, so another client can take its place
+func UserDeviceEvict(c *gin.Context) {
+	uid := langx.FirstResult(strconv.Atoi, c.Param("uid")).(int)
+	clientID := langx.FirstResult(strconv.Atoi, c.Param("client_id")).(int)
+	if err := service.GetSSRManager().EvictDevice(uid, clientID); err != nil {
+		fail(c, err)
+		return
+	}
+	success(c)
+}
+
+// Capabilities list ciphers, protocols, obfs and modes the node supports
+func Capabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, service.GetCapabilities())
+}
+
 func NodeReload(c *gin.Context) {
 	var nodeInfo model.NodeInfo
 	if err := c.ShouldBind(&nodeInfo); err != nil {
 		fail(c, err)
 		return
 	}
-	core.GetApp().SetNodeInfo(&nodeInfo)
-	core.GetApp().SetObfsProtocolService(obfs.NewObfsAuthChainData(nodeInfo.Protocol))
-	if nodeInfo.ClientLimit != 0 {
-		log.Info("set client limit with %v", nodeInfo.ClientLimit)
-		core.GetApp().GetObfsProtocolService().SetMaxClient(nodeInfo.ClientLimit)
-	} else {
-		log.Info("ignore client limit, because client_limit is zero, use default limit is 64")
-	}
-	if err := service.Reload(); err != nil {
+	before := core.GetApp().NodeInfo()
+	// only servers whose parameters changed are restarted, connections of old servers are drained in background
+	if err := service.ReloadWithNodeInfo(&nodeInfo); err != nil {
 		fail(c, err)
 		return
 	}
 	success(c)
-	httpServerChan <- CLOSE
-	httpServerChan <- START
+	if before == nil || before.PushPort != nodeInfo.PushPort {
+		httpServerChan <- CLOSE
+		httpServerChan <- START
+	} else {
+		SetSecret(nodeInfo.Secret)
+	}
+}
+
+// Metrics export counters in prometheus text format
+func Metrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	if _, err := metrics.WriteTo(c.Writer); err != nil {
+		log.Err(err)
+	}
 }
 
 func fail(c *gin.Context, err error) {
@@ -7,6 +7,11 @@ const (
 	HOST       = "host"
 	NODE_ID    = "node_id"
 	KEY        = "key"
+	STANDALONE = "standalone"
+	JOURNAL    = "journal_dir"
+	DRAIN      = "drain_timeout"
+	SYNC       = "sync_interval"
+	BURST      = "limit_burst"
 )
 
 type FlagSetting struct {
@@ -16,14 +21,17 @@ type FlagSetting struct {
 	Example  string
 	Type     reflect.Kind
 	Required bool
+	// PanelOnly flag is not required in standalone mode
+	PanelOnly bool
 }
 
 var flagConfigs = []FlagSetting{
 	FlagSetting{
-		Type:     reflect.String,
-		Name:     API_HOST,
-		Usage:    "api host example: http://localhost",
-		Required: true,
+		Type:      reflect.String,
+		Name:      API_HOST,
+		Usage:     "api host example: http://localhost",
+		Required:  true,
+		PanelOnly: true,
 	},
 	FlagSetting{
 		Type:     reflect.String,
@@ -33,15 +41,46 @@ var flagConfigs = []FlagSetting{
 		Default:  "0.0.0.0",
 	},
 	FlagSetting{
-		Type:     reflect.Int,
-		Name:     NODE_ID,
-		Usage:    "node_id",
-		Required: true,
+		Type:      reflect.Int,
+		Name:      NODE_ID,
+		Usage:     "node_id",
+		Required:  true,
+		PanelOnly: true,
 	},
 	FlagSetting{
-		Type:     reflect.String,
-		Name:     KEY,
-		Usage:    "key",
-		Required: true,
+		Type:      reflect.String,
+		Name:      KEY,
+		Usage:     "key",
+		Required:  true,
+		PanelOnly: true,
+	},
+	FlagSetting{
+		Type:  reflect.String,
+		Name:  STANDALONE,
+		Usage: "standalone config file(json or yaml), node settings and users are loaded from it instead of panel api",
+	},
+	FlagSetting{
+		Type:    reflect.String,
+		Name:    JOURNAL,
+		Usage:   "directory of report journal, traffic is kept in it until panel accept it. empty to keep in memory only",
+		Default: "journal",
+	},
+	FlagSetting{
+		Type:    reflect.Int,
+		Name:    DRAIN,
+		Usage:   "milliseconds to wait connections finish on shutdown and reload",
+		Default: 30000,
+	},
+	FlagSetting{
+		Type:    reflect.Int,
+		Name:    SYNC,
+		Usage:   "milliseconds between syncing users with panel, 0 to disable",
+		Default: 300000,
+	},
+	FlagSetting{
+		Type:    reflect.Int,
+		Name:    BURST,
+		Usage:   "milliseconds of traffic a speed limit bucket can burst",
+		Default: 1000,
 	},
 }
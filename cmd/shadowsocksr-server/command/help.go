@@ -87,6 +87,9 @@ func Execute(fn func()) {
 
 func checkRequired() bool {
 	for _, item := range flagConfigs {
+		if item.PanelOnly && viper.GetString(STANDALONE) != "" {
+			continue
+		}
 		if item.Required {
 			switch item.Type {
 			case reflect.String:
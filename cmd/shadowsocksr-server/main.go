@@ -1,63 +1,94 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/ProxyPanel/VNet-SSR/api/client"
 	"github.com/ProxyPanel/VNet-SSR/api/server"
 	"github.com/ProxyPanel/VNet-SSR/cmd/shadowsocksr-server/command"
 	"github.com/ProxyPanel/VNet-SSR/common/log"
-	"github.com/ProxyPanel/VNet-SSR/common/obfs"
 	"github.com/ProxyPanel/VNet-SSR/core"
 	"github.com/ProxyPanel/VNet-SSR/service"
 	"github.com/ProxyPanel/VNet-SSR/utils/addrx"
 	"github.com/ProxyPanel/VNet-SSR/utils/osx"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"os"
+	"time"
 )
 
 func main() {
 	logrus.SetLevel(logrus.InfoLevel)
-	ip, err := addrx.GetPublicIp()
-	if err != nil {
-		panic(err)
-	}
 	command.Execute(func() {
 		if err := core.GetApp().Init(); err != nil {
 			panic(err)
 		}
+		standalone := viper.GetString(command.STANDALONE)
+		ip, err := addrx.GetPublicIp()
+		if err != nil {
+			if standalone == "" {
+				panic(err)
+			}
+			log.Warn("get public ip error: %s", err.Error())
+			ip = "127.0.0.1"
+		}
 		core.GetApp().SetApiHost(viper.GetString(command.API_HOST))
 		core.GetApp().SetNodeId(viper.GetInt(command.NODE_ID))
 		core.GetApp().SetKey(viper.GetString(command.KEY))
 		core.GetApp().SetHost(viper.GetString(command.HOST))
+		core.GetApp().SetJournalDir(viper.GetString(command.JOURNAL))
+		core.GetApp().SetDrainTimeout(time.Duration(viper.GetInt(command.DRAIN)) * time.Millisecond)
+		core.GetApp().SetSyncInterval(time.Duration(viper.GetInt(command.SYNC)) * time.Millisecond)
+		core.GetApp().SetLimitBurst(time.Duration(viper.GetInt(command.BURST)) * time.Millisecond)
 		core.GetApp().SetPublicIP(ip)
 		if core.GetApp().GetPublicIP() == "" {
 			panic("get public ip error,please try align")
 		}
 		log.Info("get public ip %s", core.GetApp().GetPublicIP())
 
+		var localPanel *client.LocalPanel
+		if standalone != "" {
+			localPanel, err = client.NewLocalPanel(standalone)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			client.SetPanel(localPanel)
+			log.Info("run in standalone mode with %s", standalone)
+		}
+
 		nodeInfo, err := client.GetNodeInfo()
 		if err != nil {
 			logrus.Fatal(err)
 		}
-		core.GetApp().SetNodeInfo(nodeInfo)
 		logrus.WithFields(logrus.Fields{
 			"nodeInfo": fmt.Sprintf("%+v", nodeInfo),
 		}).Info("get node info success")
-
-		core.GetApp().SetObfsProtocolService(obfs.NewObfsAuthChainData(nodeInfo.Protocol))
-		if nodeInfo.ClientLimit != 0 {
-			log.Info("set client limit with %v", nodeInfo.ClientLimit)
-			core.GetApp().GetObfsProtocolService().SetMaxClient(nodeInfo.ClientLimit)
-		} else {
-			log.Info("ignore client limit, because client_limit is zero, use default limit is 64")
+		if err := service.ValidateNodeInfo(nodeInfo); err != nil {
+			logrus.Fatal(err)
 		}
+		service.SetNodeInfo(nodeInfo)
 
 		if err := service.Start(); err != nil {
 			panic(err)
 			return
 		}
 
+		if localPanel != nil {
+			if err := service.WatchLocalPanel(localPanel); err != nil {
+				log.Error("watch standalone config error: %s", err.Error())
+			}
+		}
+
 		server.StartServer(nodeInfo.PushPort, nodeInfo.Secret)
+		osx.OnShutdown(func(sig os.Signal) {
+			log.Info("receive signal %v, drain connections in %v", sig, core.GetApp().DrainTimeout())
+			ctx, cancel := context.WithTimeout(context.Background(), core.GetApp().DrainTimeout())
+			defer cancel()
+			if err := service.Shutdown(ctx); err != nil {
+				log.Err(err)
+			}
+			server.StopServer()
+		})
 		osx.WaitSignal()
 	})
 }
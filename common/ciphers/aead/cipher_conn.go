@@ -39,6 +39,35 @@ func GetAEADConnCipher(method string) func(string, net.Conn) (net.Conn, error) {
 
 const DataMaxSize = 0x3FFF
 
+// Key return the master key derived from password
+func Key(c IAEADCipher, password string) []byte {
+	return evpBytesToKey(password, c.KeySize())
+}
+
+// HeaderSize return size of the salt and the first encrypted length of a tcp stream
+func HeaderSize(c IAEADCipher) int {
+	a, err := c.NewAEAD(make([]byte, c.KeySize()), make([]byte, c.SaltSize()), 1)
+	if err != nil {
+		return c.SaltSize() + 2 + 16
+	}
+	return c.SaltSize() + 2 + a.Overhead()
+}
+
+// OpenHeader check whether key can open the first length of a tcp stream,
+// servers whose users share a port use it to find the user
+func OpenHeader(c IAEADCipher, key, header []byte) bool {
+	if len(header) < HeaderSize(c) {
+		return false
+	}
+	a, err := c.NewAEAD(key, header[:c.SaltSize()], 1)
+	if err != nil {
+		return false
+	}
+	buf := make([]byte, 0, 2)
+	_, err = a.Open(buf, make([]byte, a.NonceSize()), header[c.SaltSize():HeaderSize(c)], nil)
+	return err == nil
+}
+
 type aeadConn struct {
 	net.Conn
 	IAEADCipher
@@ -50,22 +50,11 @@ func (c *aeadPacket) GetKey() []byte {
 func (c *aeadPacket) WriteTo(data []byte, addr net.Addr) (int, error) {
 	c.Lock()
 	defer c.Unlock()
-	saltSize := c.SaltSize()
-	salt := c.buf[:saltSize]
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return 0, err
-	}
-
-	aead, err := c.NewAEAD(c.key, salt, 0)
-
+	b, err := Pack(c.buf, c.IAEADCipher, c.key, data)
 	if err != nil {
 		return 0, err
 	}
-	if MAX_PACKET_SIZE < c.SaltSize()+len(data)+aead.Overhead() {
-		return 0, errors.WithStack(io.ErrShortBuffer)
-	}
-	b := aead.Seal(c.buf[saltSize:saltSize], _zerononce[:aead.NonceSize()], data, nil)
-	_, err = c.PacketConn.WriteTo(c.buf[:saltSize+len(b)], addr)
+	_, err = c.PacketConn.WriteTo(b, addr)
 	return len(b), err
 }
 
@@ -74,28 +63,52 @@ func (c *aeadPacket) ReadFrom(b []byte) (int, net.Addr, error) {
 	if err != nil {
 		return n, addr, err
 	}
+	// open in place, c.buf is used by WriteTo of other goroutines
+	result, err := Unpack(b[c.SaltSize():], c.IAEADCipher, c.key, b[:n])
+	if err != nil {
+		log.Err(err)
+		return n, addr, err
+	}
+	copy(b, result)
+	return len(result), addr, err
+}
+
+// Pack encrypt payload to dst with a random salt, it return the packet in dst
+func Pack(dst []byte, c IAEADCipher, key, payload []byte) ([]byte, error) {
 	saltSize := c.SaltSize()
-	if len(b) < saltSize {
-		return 0, nil, ErrShortPacket
+	if len(dst) < saltSize {
+		return nil, errors.WithStack(io.ErrShortBuffer)
+	}
+	salt := dst[:saltSize]
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
 	}
-	salt := b[:saltSize]
-	aead, err := c.NewAEAD(c.key, salt, 1)
+	aead, err := c.NewAEAD(key, salt, 0)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
-
-	if len(b) < saltSize+aead.Overhead() {
-		return 0, nil, ErrShortPacket
+	if len(dst) < saltSize+len(payload)+aead.Overhead() {
+		return nil, errors.WithStack(io.ErrShortBuffer)
 	}
+	b := aead.Seal(dst[saltSize:saltSize], _zerononce[:aead.NonceSize()], payload, nil)
+	return dst[:saltSize+len(b)], nil
+}
 
-	if saltSize+len(c.buf)+aead.Overhead() < len(b) {
-		return 0, nil, io.ErrShortBuffer
+// Unpack decrypt pkt to dst, dst and pkt[salt size:] can overlap
+func Unpack(dst []byte, c IAEADCipher, key, pkt []byte) ([]byte, error) {
+	saltSize := c.SaltSize()
+	if len(pkt) < saltSize {
+		return nil, ErrShortPacket
 	}
-	result, err := aead.Open(c.buf[:0], _zerononce[:aead.NonceSize()], b[saltSize:n], nil)
+	aead, err := c.NewAEAD(key, pkt[:saltSize], 1)
 	if err != nil {
-		log.Err(err)
-		return n, addr, err
+		return nil, err
 	}
-	copy(b, result)
-	return len(result), addr, err
+	if len(pkt) < saltSize+aead.Overhead() {
+		return nil, ErrShortPacket
+	}
+	if len(dst)+aead.Overhead() < len(pkt)-saltSize {
+		return nil, errors.WithStack(io.ErrShortBuffer)
+	}
+	return aead.Open(dst[:0], _zerononce[:aead.NonceSize()], pkt[saltSize:], nil)
 }
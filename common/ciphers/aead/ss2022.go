@@ -0,0 +1,196 @@
+package aead
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"lukechampine.com/blake3"
+)
+
+// shadowsocks 2022 (SIP022), the key is a base64 psk instead of a password,
+// sub keys are derived by blake3 and every header carries a timestamp
+func init() {
+	registerAEAD2022Ciphers("2022-blake3-aes-128-gcm", &AEAD2022Cipher{keySize: 16})
+	registerAEAD2022Ciphers("2022-blake3-aes-256-gcm", &AEAD2022Cipher{keySize: 32})
+	registerAEAD2022Ciphers("2022-blake3-chacha20-poly1305", &AEAD2022Cipher{keySize: 32, chacha: true})
+}
+
+const (
+	HeaderTypeClient2022 = 0
+	HeaderTypeServer2022 = 1
+	// MaxPayloadSize2022 is the max size of a chunk, the length is not masked like the classic aead
+	MaxPayloadSize2022   = 0xFFFF
+	MaxPaddingLength2022 = 900
+	// TimestampWindow2022 is the max difference between the timestamp of a header and local time
+	TimestampWindow2022 = 30 * time.Second
+	// IdentityHeaderSize2022 is the size of an extensible identity header
+	IdentityHeaderSize2022 = aes.BlockSize
+	// fixedHeaderSize2022 is type, timestamp and length of the client request header
+	fixedHeaderSize2022 = 1 + 8 + 2
+	tagSize2022         = 16
+)
+
+var (
+	ErrTimestamp2022  = errors.New("shadowsocks 2022 timestamp is out of window")
+	ErrHeaderType2022 = errors.New("shadowsocks 2022 header type mismatch")
+	ErrIdentity2022   = errors.New("shadowsocks 2022 identity header mismatch")
+	ErrPadding2022    = errors.New("shadowsocks 2022 request has neither padding nor initial payload")
+)
+
+// now2022 is the clock of timestamps in headers
+var now2022 = time.Now
+
+var aead2022Ciphers = make(map[string]*AEAD2022Cipher)
+
+func registerAEAD2022Ciphers(method string, c *AEAD2022Cipher) {
+	aead2022Ciphers[method] = c
+}
+
+func GetAEAD2022Ciphers() map[string]*AEAD2022Cipher {
+	return aead2022Ciphers
+}
+
+func GetAEAD2022Cipher(method string) *AEAD2022Cipher {
+	return aead2022Ciphers[method]
+}
+
+// AEAD2022Cipher is a shadowsocks 2022 method, salt size is the same as key size
+type AEAD2022Cipher struct {
+	keySize int
+	chacha  bool
+}
+
+func (c *AEAD2022Cipher) KeySize() int {
+	return c.keySize
+}
+
+func (c *AEAD2022Cipher) SaltSize() int {
+	return c.keySize
+}
+
+func (c *AEAD2022Cipher) NonceSize() int {
+	return 12
+}
+
+// NewAEAD return the aead of a tcp stream or an aes udp session, salt is the session id for udp
+func (c *AEAD2022Cipher) NewAEAD(key []byte, salt []byte, _ int) (cipher.AEAD, error) {
+	subkey := make([]byte, c.KeySize())
+	blake3.DeriveKey(subkey, "shadowsocks 2022 session subkey", append(append([]byte{}, key...), salt...))
+	return c.newAEAD(subkey)
+}
+
+func (c *AEAD2022Cipher) newAEAD(key []byte) (cipher.AEAD, error) {
+	if c.chacha {
+		return chacha20poly1305.New(key)
+	}
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(blk)
+}
+
+// Identity return whether the method supports extensible identity headers, only aes methods do
+func (c *AEAD2022Cipher) Identity() bool {
+	return !c.chacha
+}
+
+// PSK decode password to psk list, identity psks followed by the user psk are separated by ':'
+func (c *AEAD2022Cipher) PSK(password string) ([][]byte, error) {
+	if password == "" {
+		return nil, errors.New("shadowsocks 2022 psk is empty")
+	}
+	items := strings.Split(password, ":")
+	if len(items) > 1 && !c.Identity() {
+		return nil, errors.New("shadowsocks 2022 chacha20 does not support identity psk")
+	}
+	psk := make([][]byte, 0, len(items))
+	for _, item := range items {
+		key, err := base64.StdEncoding.DecodeString(item)
+		if err != nil {
+			return nil, errors.Wrap(err, "shadowsocks 2022 psk is not base64")
+		}
+		if len(key) != c.KeySize() {
+			return nil, errors.New(fmt.Sprintf("shadowsocks 2022 psk length is %v, should be %v", len(key), c.KeySize()))
+		}
+		psk = append(psk, key)
+	}
+	return psk, nil
+}
+
+// HeaderSize return size of the salt, identity headers and the fixed request header of a tcp stream
+func (c *AEAD2022Cipher) HeaderSize(identities int) int {
+	return c.SaltSize() + identities*IdentityHeaderSize2022 + fixedHeaderSize2022 + tagSize2022
+}
+
+// OpenHeader check whether key can open the fixed request header of a tcp stream
+func (c *AEAD2022Cipher) OpenHeader(key, header []byte, identities int) bool {
+	if len(header) < c.HeaderSize(identities) {
+		return false
+	}
+	a, err := c.NewAEAD(key, header[:c.SaltSize()], 1)
+	if err != nil {
+		return false
+	}
+	offset := c.SaltSize() + identities*IdentityHeaderSize2022
+	_, err = a.Open(nil, make([]byte, a.NonceSize()), header[offset:c.HeaderSize(identities)], nil)
+	return err == nil
+}
+
+// IdentityHash return the hash carried by the identity header to find the user
+func IdentityHash(psk []byte) []byte {
+	hash := blake3.Sum256(psk)
+	return hash[:IdentityHeaderSize2022]
+}
+
+// Identify decrypt the first identity header of a tcp stream with identity psk, it return the hash of the next psk
+func (c *AEAD2022Cipher) Identify(ipsk, header []byte) ([]byte, error) {
+	if len(header) < c.SaltSize()+IdentityHeaderSize2022 {
+		return nil, ErrShortPacket
+	}
+	blk, err := c.identityBlock(ipsk, header[:c.SaltSize()])
+	if err != nil {
+		return nil, err
+	}
+	hash := make([]byte, IdentityHeaderSize2022)
+	blk.Decrypt(hash, header[c.SaltSize():c.SaltSize()+IdentityHeaderSize2022])
+	return hash, nil
+}
+
+func (c *AEAD2022Cipher) identityBlock(ipsk, salt []byte) (cipher.Block, error) {
+	subkey := make([]byte, c.KeySize())
+	blake3.DeriveKey(subkey, "shadowsocks 2022 identity subkey", append(append([]byte{}, ipsk...), salt...))
+	return aes.NewCipher(subkey)
+}
+
+// identityHeaders return identity headers of a tcp stream, one for each identity psk
+func (c *AEAD2022Cipher) identityHeaders(psk [][]byte, salt []byte) ([]byte, error) {
+	result := make([]byte, (len(psk)-1)*IdentityHeaderSize2022)
+	for i := 0; i < len(psk)-1; i++ {
+		blk, err := c.identityBlock(psk[i], salt)
+		if err != nil {
+			return nil, err
+		}
+		blk.Encrypt(result[i*IdentityHeaderSize2022:], IdentityHash(psk[i+1]))
+	}
+	return result, nil
+}
+
+func checkTimestamp2022(b []byte) error {
+	diff := now2022().Sub(time.Unix(int64(binary.BigEndian.Uint64(b)), 0))
+	if diff > TimestampWindow2022 || diff < -TimestampWindow2022 {
+		return ErrTimestamp2022
+	}
+	return nil
+}
+
+func putTimestamp2022(b []byte) {
+	binary.BigEndian.PutUint64(b, uint64(now2022().Unix()))
+}
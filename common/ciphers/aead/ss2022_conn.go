@@ -0,0 +1,315 @@
+package aead
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+
+	"github.com/ProxyPanel/VNet-SSR/utils/randomx"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+	"github.com/pkg/errors"
+)
+
+var ErrRequestSalt2022 = errors.New("shadowsocks 2022 request salt mismatch")
+
+// GetAEAD2022ConnCipher return the client side of a shadowsocks 2022 tcp stream
+func GetAEAD2022ConnCipher(method string) func(string, net.Conn) (net.Conn, error) {
+	c, ok := aead2022Ciphers[method]
+	if !ok {
+		return nil
+	}
+	return func(password string, conn net.Conn) (net.Conn, error) {
+		psk, err := c.PSK(password)
+		if err != nil {
+			return nil, err
+		}
+		return newAEAD2022Conn(c, psk, conn, false), nil
+	}
+}
+
+// NewAEAD2022ServerConn return the server side of a shadowsocks 2022 tcp stream,
+// psk is the identity psk followed by the user psk when the client sends an identity header
+func NewAEAD2022ServerConn(c *AEAD2022Cipher, psk [][]byte, conn net.Conn) net.Conn {
+	return newAEAD2022Conn(c, psk, conn, true)
+}
+
+func newAEAD2022Conn(c *AEAD2022Cipher, psk [][]byte, conn net.Conn, server bool) *aead2022Conn {
+	return &aead2022Conn{
+		Conn:           conn,
+		AEAD2022Cipher: c,
+		psk:            psk,
+		server:         server,
+		rNonce:         make([]byte, c.NonceSize()),
+		wNonce:         make([]byte, c.NonceSize()),
+		readBuffer:     new(bytes.Buffer),
+	}
+}
+
+type aead2022Conn struct {
+	net.Conn
+	*AEAD2022Cipher
+	psk         [][]byte
+	server      bool
+	requestSalt []byte
+	rNonce      []byte
+	wNonce      []byte
+	readBuffer  *bytes.Buffer
+	Encrypter   cipher.AEAD
+	Decrypter   cipher.AEAD
+}
+
+// GetKey return the user psk
+func (a *aead2022Conn) GetKey() []byte {
+	return a.psk[len(a.psk)-1]
+}
+
+func (a *aead2022Conn) Read(b []byte) (n int, err error) {
+	if a.readBuffer.Len() > 0 {
+		return a.readBuffer.Read(b)
+	}
+	if a.Decrypter == nil {
+		if a.server {
+			err = a.readRequestHeader()
+		} else {
+			err = a.readResponseHeader()
+		}
+		if err != nil {
+			return 0, err
+		}
+		if a.readBuffer.Len() > 0 {
+			return a.readBuffer.Read(b)
+		}
+	}
+	size, err := a.readChunk(2)
+	if err != nil {
+		return 0, err
+	}
+	data, err := a.readChunk(int(binary.BigEndian.Uint16(size)))
+	if err != nil {
+		return 0, err
+	}
+	n = copy(b, data)
+	a.readBuffer.Write(data[n:])
+	return n, nil
+}
+
+// readRequestHeader read salt, identity headers, the fixed header and the variable header,
+// socks address and initial payload of variable header are left in read buffer
+func (a *aead2022Conn) readRequestHeader() error {
+	salt := make([]byte, a.SaltSize())
+	if _, err := io.ReadFull(a.Conn, salt); err != nil {
+		return err
+	}
+	for i := 0; i < len(a.psk)-1; i++ {
+		eih := make([]byte, IdentityHeaderSize2022)
+		if _, err := io.ReadFull(a.Conn, eih); err != nil {
+			return err
+		}
+		blk, err := a.identityBlock(a.psk[i], salt)
+		if err != nil {
+			return err
+		}
+		blk.Decrypt(eih, eih)
+		if !bytes.Equal(eih, IdentityHash(a.psk[i+1])) {
+			return ErrIdentity2022
+		}
+	}
+	var err error
+	a.Decrypter, err = a.NewAEAD(a.GetKey(), salt, 1)
+	if err != nil {
+		return err
+	}
+	a.requestSalt = salt
+	fixed, err := a.readChunk(fixedHeaderSize2022)
+	if err != nil {
+		return err
+	}
+	if fixed[0] != HeaderTypeClient2022 {
+		return ErrHeaderType2022
+	}
+	if err := checkTimestamp2022(fixed[1:9]); err != nil {
+		return err
+	}
+	variable, err := a.readChunk(int(binary.BigEndian.Uint16(fixed[9:])))
+	if err != nil {
+		return err
+	}
+	addr, err := socksproxy.SplitAddr(variable)
+	if err != nil {
+		return err
+	}
+	rest := variable[len(addr.Raw):]
+	if len(rest) < 2 || len(rest) < 2+int(binary.BigEndian.Uint16(rest)) {
+		return ErrShortPacket
+	}
+	padding := int(binary.BigEndian.Uint16(rest))
+	// a client must pad the request when it has no initial payload
+	if padding == 0 && len(rest) == 2 {
+		return ErrPadding2022
+	}
+	a.readBuffer.Write(addr.Raw)
+	a.readBuffer.Write(rest[2+padding:])
+	return nil
+}
+
+// readResponseHeader read salt and the fixed header which must carry salt of the request
+func (a *aead2022Conn) readResponseHeader() error {
+	if a.requestSalt == nil {
+		return errors.New("shadowsocks 2022 response is read before request is sent")
+	}
+	salt := make([]byte, a.SaltSize())
+	if _, err := io.ReadFull(a.Conn, salt); err != nil {
+		return err
+	}
+	var err error
+	a.Decrypter, err = a.NewAEAD(a.GetKey(), salt, 1)
+	if err != nil {
+		return err
+	}
+	fixed, err := a.readChunk(1 + 8 + a.SaltSize() + 2)
+	if err != nil {
+		return err
+	}
+	if fixed[0] != HeaderTypeServer2022 {
+		return ErrHeaderType2022
+	}
+	if err := checkTimestamp2022(fixed[1:9]); err != nil {
+		return err
+	}
+	if !bytes.Equal(fixed[9:9+a.SaltSize()], a.requestSalt) {
+		return ErrRequestSalt2022
+	}
+	data, err := a.readChunk(int(binary.BigEndian.Uint16(fixed[9+a.SaltSize():])))
+	if err != nil {
+		return err
+	}
+	a.readBuffer.Write(data)
+	return nil
+}
+
+// readChunk read and open a chunk whose plain size is size
+func (a *aead2022Conn) readChunk(size int) ([]byte, error) {
+	buf := make([]byte, size+a.Decrypter.Overhead())
+	if _, err := io.ReadFull(a.Conn, buf); err != nil {
+		return nil, err
+	}
+	result, err := a.Decrypter.Open(buf[:0], a.rNonce, buf, nil)
+	increment(a.rNonce)
+	return result, err
+}
+
+func (a *aead2022Conn) Write(b []byte) (n int, err error) {
+	if a.Encrypter != nil {
+		return a.writeChunks(b)
+	}
+	salt := make([]byte, a.SaltSize())
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return 0, err
+	}
+	a.Encrypter, err = a.NewAEAD(a.GetKey(), salt, 0)
+	if err != nil {
+		return 0, err
+	}
+	var header, rest []byte
+	if a.server {
+		header, rest, err = a.responseHeader(salt, b)
+	} else {
+		header, rest, err = a.requestHeader(salt, b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if _, err = a.Conn.Write(header); err != nil {
+		return 0, err
+	}
+	if _, err = a.writeChunks(rest); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// requestHeader return salt, identity headers, fixed header and variable header with the
+// socks address and initial payload which are at the beginning of b, and the rest of b
+func (a *aead2022Conn) requestHeader(salt, b []byte) ([]byte, []byte, error) {
+	addr, err := socksproxy.SplitAddr(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	a.requestSalt = salt
+	payload := b[len(addr.Raw):]
+	padding := 0
+	if len(payload) == 0 {
+		padding = randomx.RandIntRange(1, MaxPaddingLength2022)
+	}
+	size := len(payload)
+	if max := MaxPayloadSize2022 - len(addr.Raw) - 2 - padding; size > max {
+		size = max
+	}
+	variable := make([]byte, 0, len(addr.Raw)+2+padding+size)
+	variable = append(variable, addr.Raw...)
+	variable = append(variable, byte(padding>>8), byte(padding))
+	variable = append(variable, make([]byte, padding)...)
+	variable = append(variable, payload[:size]...)
+
+	eih, err := a.identityHeaders(a.psk, salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	fixed := make([]byte, fixedHeaderSize2022)
+	fixed[0] = HeaderTypeClient2022
+	putTimestamp2022(fixed[1:9])
+	binary.BigEndian.PutUint16(fixed[9:], uint16(len(variable)))
+
+	header := append(append([]byte{}, salt...), eih...)
+	header = a.sealChunk(header, fixed)
+	header = a.sealChunk(header, variable)
+	return header, payload[size:], nil
+}
+
+// responseHeader return salt, fixed header and the first chunk of b, and the rest of b
+func (a *aead2022Conn) responseHeader(salt, b []byte) ([]byte, []byte, error) {
+	if a.requestSalt == nil {
+		return nil, nil, errors.New("shadowsocks 2022 response is sent before request is read")
+	}
+	size := len(b)
+	if size > MaxPayloadSize2022 {
+		size = MaxPayloadSize2022
+	}
+	fixed := make([]byte, 1+8+a.SaltSize()+2)
+	fixed[0] = HeaderTypeServer2022
+	putTimestamp2022(fixed[1:9])
+	copy(fixed[9:], a.requestSalt)
+	binary.BigEndian.PutUint16(fixed[9+a.SaltSize():], uint16(size))
+
+	header := a.sealChunk(append([]byte{}, salt...), fixed)
+	header = a.sealChunk(header, b[:size])
+	return header, b[size:], nil
+}
+
+func (a *aead2022Conn) writeChunks(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		size := len(b)
+		if size > MaxPayloadSize2022 {
+			size = MaxPayloadSize2022
+		}
+		buf := make([]byte, 0, 2+size+2*a.Encrypter.Overhead())
+		buf = a.sealChunk(buf, []byte{byte(size >> 8), byte(size)})
+		buf = a.sealChunk(buf, b[:size])
+		if _, err = a.Conn.Write(buf); err != nil {
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// sealChunk append the sealed plain to dst
+func (a *aead2022Conn) sealChunk(dst, plain []byte) []byte {
+	result := a.Encrypter.Seal(dst, a.wNonce, plain, nil)
+	increment(a.wNonce)
+	return result
+}
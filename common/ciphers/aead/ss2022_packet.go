@@ -0,0 +1,279 @@
+package aead
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/ProxyPanel/VNet-SSR/common/pool"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// separateHeaderSize2022 is session id and packet id of an udp packet
+const separateHeaderSize2022 = 8 + 8
+
+var ErrSession2022 = errors.New("shadowsocks 2022 client session id mismatch")
+
+// Session2022 is an udp session of shadowsocks 2022, session of server carries the session id of client
+type Session2022 struct {
+	SessionID       []byte
+	ClientSessionID []byte
+	sync.Mutex
+	packetID uint64
+}
+
+func NewSession2022(clientSessionID []byte) *Session2022 {
+	sessionID := make([]byte, 8)
+	_, _ = io.ReadFull(rand.Reader, sessionID)
+	return &Session2022{
+		SessionID:       sessionID,
+		ClientSessionID: clientSessionID,
+	}
+}
+
+func (s *Session2022) nextPacketID() uint64 {
+	s.Lock()
+	defer s.Unlock()
+	id := s.packetID
+	s.packetID++
+	return id
+}
+
+// Packet2022 is a decrypted udp packet of shadowsocks 2022,
+// payload is the socks address followed by data
+type Packet2022 struct {
+	SessionID       []byte
+	PacketID        uint64
+	ClientSessionID []byte
+	Payload         []byte
+}
+
+// PackPacket encrypt payload to dst, header is encrypted by the first psk, body is sealed by the last psk
+// and there is an identity header for each identity psk, payload is sent to client if the session has a client
+func (c *AEAD2022Cipher) PackPacket(dst []byte, psk [][]byte, s *Session2022, payload []byte) ([]byte, error) {
+	body := make([]byte, 0, 1+8+8+2+len(payload))
+	if s.ClientSessionID != nil {
+		body = append(body, HeaderTypeServer2022, 0, 0, 0, 0, 0, 0, 0, 0)
+		body = append(body, s.ClientSessionID...)
+	} else {
+		body = append(body, HeaderTypeClient2022, 0, 0, 0, 0, 0, 0, 0, 0)
+	}
+	putTimestamp2022(body[1:9])
+	body = append(body, 0, 0)
+	body = append(body, payload...)
+
+	header := make([]byte, separateHeaderSize2022)
+	copy(header, s.SessionID)
+	binary.BigEndian.PutUint64(header[8:], s.nextPacketID())
+
+	if c.chacha {
+		size := chacha20poly1305.NonceSizeX + separateHeaderSize2022 + len(body) + tagSize2022
+		if len(dst) < size {
+			return nil, errors.WithStack(io.ErrShortBuffer)
+		}
+		nonce := dst[:chacha20poly1305.NonceSizeX]
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		a, err := chacha20poly1305.NewX(psk[0])
+		if err != nil {
+			return nil, err
+		}
+		return a.Seal(dst[:len(nonce)], nonce, append(header, body...), nil), nil
+	}
+
+	offset := len(psk) * IdentityHeaderSize2022
+	if len(dst) < offset+len(body)+tagSize2022 {
+		return nil, errors.WithStack(io.ErrShortBuffer)
+	}
+	blk, err := aes.NewCipher(psk[0])
+	if err != nil {
+		return nil, err
+	}
+	blk.Encrypt(dst, header)
+	for i := 0; i < len(psk)-1; i++ {
+		blk, err := aes.NewCipher(psk[i])
+		if err != nil {
+			return nil, err
+		}
+		eih := IdentityHash(psk[i+1])
+		for j := range eih {
+			eih[j] ^= header[j]
+		}
+		blk.Encrypt(dst[(i+1)*IdentityHeaderSize2022:], eih)
+	}
+	a, err := c.NewAEAD(psk[len(psk)-1], header[:8], 0)
+	if err != nil {
+		return nil, err
+	}
+	return a.Seal(dst[:offset], header[4:16], body, nil), nil
+}
+
+// UnpackPacket decrypt an udp packet whose header type is headerType, psk is the same as PackPacket
+func (c *AEAD2022Cipher) UnpackPacket(psk [][]byte, pkt []byte, headerType int) (*Packet2022, error) {
+	var header, body []byte
+	if c.chacha {
+		if len(pkt) < chacha20poly1305.NonceSizeX+separateHeaderSize2022+tagSize2022 {
+			return nil, ErrShortPacket
+		}
+		a, err := chacha20poly1305.NewX(psk[0])
+		if err != nil {
+			return nil, err
+		}
+		plain, err := a.Open(nil, pkt[:chacha20poly1305.NonceSizeX], pkt[chacha20poly1305.NonceSizeX:], nil)
+		if err != nil {
+			return nil, err
+		}
+		header, body = plain[:separateHeaderSize2022], plain[separateHeaderSize2022:]
+	} else {
+		offset := len(psk) * IdentityHeaderSize2022
+		if len(pkt) < offset+tagSize2022 {
+			return nil, ErrShortPacket
+		}
+		var err error
+		if header, err = c.DecryptSeparateHeader(psk[0], pkt); err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(psk); i++ {
+			hash, err := c.PacketIdentify(psk[i-1], header, pkt[i*IdentityHeaderSize2022:])
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(hash, IdentityHash(psk[i])) {
+				return nil, ErrIdentity2022
+			}
+		}
+		a, err := c.NewAEAD(psk[len(psk)-1], header[:8], 1)
+		if err != nil {
+			return nil, err
+		}
+		body, err = a.Open(nil, header[4:16], pkt[offset:], nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	p := &Packet2022{
+		SessionID: header[:8],
+		PacketID:  binary.BigEndian.Uint64(header[8:]),
+	}
+	if len(body) < 1+8+2 {
+		return nil, ErrShortPacket
+	}
+	if int(body[0]) != headerType {
+		return nil, ErrHeaderType2022
+	}
+	if err := checkTimestamp2022(body[1:9]); err != nil {
+		return nil, err
+	}
+	body = body[9:]
+	if headerType == HeaderTypeServer2022 {
+		if len(body) < 8+2 {
+			return nil, ErrShortPacket
+		}
+		p.ClientSessionID, body = body[:8], body[8:]
+	}
+	padding := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+padding {
+		return nil, ErrShortPacket
+	}
+	p.Payload = body[2+padding:]
+	return p, nil
+}
+
+// DecryptSeparateHeader decrypt the separate header of an aes udp packet with the first psk
+func (c *AEAD2022Cipher) DecryptSeparateHeader(psk, pkt []byte) ([]byte, error) {
+	if len(pkt) < separateHeaderSize2022 {
+		return nil, ErrShortPacket
+	}
+	blk, err := aes.NewCipher(psk)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, separateHeaderSize2022)
+	blk.Decrypt(header, pkt)
+	return header, nil
+}
+
+// PacketIdentify decrypt an identity header of an aes udp packet, it return the hash of the next psk
+func (c *AEAD2022Cipher) PacketIdentify(ipsk, header, eih []byte) ([]byte, error) {
+	if len(eih) < IdentityHeaderSize2022 {
+		return nil, ErrShortPacket
+	}
+	blk, err := aes.NewCipher(ipsk)
+	if err != nil {
+		return nil, err
+	}
+	hash := make([]byte, IdentityHeaderSize2022)
+	blk.Decrypt(hash, eih)
+	for i := range hash {
+		hash[i] ^= header[i]
+	}
+	return hash, nil
+}
+
+type aead2022Packet struct {
+	net.PacketConn
+	*AEAD2022Cipher
+	sync.Mutex
+	psk     [][]byte
+	session *Session2022
+	buf     []byte
+}
+
+// GetAEAD2022PacketCiphers return the client side of shadowsocks 2022 udp
+func GetAEAD2022PacketCiphers(method string) func(string, net.PacketConn) (net.PacketConn, error) {
+	c, ok := aead2022Ciphers[method]
+	if !ok {
+		return nil
+	}
+	return func(password string, packCon net.PacketConn) (net.PacketConn, error) {
+		psk, err := c.PSK(password)
+		if err != nil {
+			return nil, err
+		}
+		return &aead2022Packet{
+			PacketConn:     packCon,
+			AEAD2022Cipher: c,
+			psk:            psk,
+			session:        NewSession2022(nil),
+			buf:            pool.GetBufBySize(MAX_PACKET_SIZE),
+		}, nil
+	}
+}
+
+func (c *aead2022Packet) GetKey() []byte {
+	return c.psk[len(c.psk)-1]
+}
+
+func (c *aead2022Packet) WriteTo(data []byte, addr net.Addr) (int, error) {
+	c.Lock()
+	defer c.Unlock()
+	b, err := c.PackPacket(c.buf, c.psk, c.session, data)
+	if err != nil {
+		return 0, err
+	}
+	_, err = c.PacketConn.WriteTo(b, addr)
+	return len(b), err
+}
+
+// ReadFrom read packets of server, whose header is encrypted by the user psk
+func (c *aead2022Packet) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err != nil {
+		return n, addr, err
+	}
+	p, err := c.UnpackPacket([][]byte{c.GetKey()}, b[:n], HeaderTypeServer2022)
+	if err != nil {
+		return n, addr, err
+	}
+	if !bytes.Equal(p.ClientSessionID, c.session.SessionID) {
+		return n, addr, ErrSession2022
+	}
+	return copy(b, p.Payload), addr, nil
+}
@@ -0,0 +1,196 @@
+package aead
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// the vectors are built from SIP022 with fixed salts, session ids and the timestamp below,
+// they are checked against an implementation which doesn't share code with this package
+const (
+	timestamp2022 = 1700000000
+	psk16         = "AQIDBAUGBwgJCgsMDQ4PEA=="
+	psk32         = "AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA="
+	ipsk16        = "QUJDREVGR0hJSktMTU5PUA=="
+	ipsk32        = "QUJDREVGR0hJSktMTU5PUFFSU1RVVldYWVpbXF1eX2A="
+	// socks address of 127.0.0.1:80 and 127.0.0.1:53
+	tcpAddr2022 = "017f0000010050"
+	udpAddr2022 = "017f0000010035"
+)
+
+// fixNow2022 fix the clock at the timestamp of vectors, it return a func to restore the clock
+func fixNow2022() func() {
+	now2022 = func() time.Time { return time.Unix(timestamp2022, 0) }
+	return func() { now2022 = time.Now }
+}
+
+// readerConn is a conn which reads from a fixed stream
+type readerConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readerConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func mustPSK(t *testing.T, method, password string) [][]byte {
+	psk, err := GetAEAD2022Cipher(method).PSK(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return psk
+}
+
+func TestAEAD2022TCPRequest(t *testing.T) {
+	defer fixNow2022()()
+	tests := []struct {
+		method   string
+		password string
+		stream   string
+		expected string
+	}{
+		{
+			method:   "2022-blake3-aes-128-gcm",
+			password: psk16,
+			stream:   "a0a1a2a3a4a5a6a7a8a9aaabacadaeaf5ea2abcf8bc589207cb3a634bdf7447421349131ed71afd4a8aabb86f692b1750b5a6ce114da5953e1e8fa7511c0cbdb155cb59005a195e3826f97f9d6ff6ab53f6aa62ac1b4ffc743e11ce8d8c1c7b3ec778418751703735b53454208446445ac83ac183c08b202828119bbaf",
+			expected: tcpAddr2022 + hex.EncodeToString([]byte("GET / HTTP/1.1\r\n\r\nhello")),
+		},
+		{
+			// identity header of a multi user server, no initial payload but a padding
+			method:   "2022-blake3-aes-256-gcm",
+			password: ipsk32 + ":" + psk32,
+			stream:   "a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf0c88ec5dcdcb6f6611911c79280050a997905a8c91d46019daccaddd190c2c4cfae32e4f026383467015e78f094030e6da91a955ef268786c47c099f69eef55655969813fcad934309323c3a2bc1f77b8a1501260b2d35d5af00dadf44c824ee2fe605c70d8ed6806d07f1bcf959a12b805e2591563a2b5156deec",
+			expected: tcpAddr2022 + hex.EncodeToString([]byte("hello")),
+		},
+		{
+			method:   "2022-blake3-chacha20-poly1305",
+			password: psk32,
+			stream:   "a0a1a2a3a4a5a6a7a8a9aaabacadaeafb0b1b2b3b4b5b6b7b8b9babbbcbdbebf90f5cb10825145ecdf1271b2c4fcf49db49177bc6f46ba28ee7e13a34945e196d4764ea2a43055de985bfcf755d7f37d0f4ddc1dfabc2112ae32e4eb846df4cfed19facb81558269e7e380229e7b6f11bf15a18e4fc39b3e430512f603d01682ef14b64ad8653ffbcf6d103708",
+			expected: tcpAddr2022 + hex.EncodeToString([]byte("GET / HTTP/1.1\r\n\r\nhello")),
+		},
+	}
+	for _, test := range tests {
+		c := GetAEAD2022Cipher(test.method)
+		stream, _ := hex.DecodeString(test.stream)
+		conn := NewAEAD2022ServerConn(c, mustPSK(t, test.method, test.password), &readerConn{r: bytes.NewReader(stream)})
+		result, err := ioutil.ReadAll(conn)
+		if err != nil {
+			t.Fatalf("%s read request error: %v", test.method, err)
+		}
+		if hex.EncodeToString(result) != test.expected {
+			t.Fatalf("%s expected %s, got %x", test.method, test.expected, result)
+		}
+	}
+}
+
+func TestAEAD2022TCPRequestPadding(t *testing.T) {
+	defer fixNow2022()()
+	method := "2022-blake3-aes-128-gcm"
+	// a request with neither padding nor initial payload
+	stream, _ := hex.DecodeString("a0a1a2a3a4a5a6a7a8a9aaabacadaeaf5ea2abcf8bc589207cb3b4d4c47ba2a3b74d8b7310a83242a4bdfb86f692b1750b5a6ce1d15b87676a4878d8999eed4823af8b50")
+	conn := NewAEAD2022ServerConn(GetAEAD2022Cipher(method), mustPSK(t, method, psk16), &readerConn{r: bytes.NewReader(stream)})
+	if _, err := conn.Read(make([]byte, 64)); err != ErrPadding2022 {
+		t.Fatalf("request without padding and payload should be rejected, got %v", err)
+	}
+}
+
+func TestAEAD2022TCPResponse(t *testing.T) {
+	defer fixNow2022()()
+	method := "2022-blake3-aes-128-gcm"
+	stream, _ := hex.DecodeString("c0c1c2c3c4c5c6c7c8c9cacbcccdcecf60284ad0c5f64599d74fc809ed8af1326de8c40a388c7ace44b0395be323a1d7723c11b00bb992ee1f77572a32116fac6492fc83150c2bf1db5529a83c3af57d427a390f6158d1e93b6757a3d20fdc2ffcb4a4bfe68db9c3ed77ba6b3bdbc8c34a23376ba7daeacba3242ebec2efd92343d9c6788b")
+	conn := newAEAD2022Conn(GetAEAD2022Cipher(method), mustPSK(t, method, psk16), &readerConn{r: bytes.NewReader(stream)}, false)
+	conn.requestSalt, _ = hex.DecodeString("a0a1a2a3a4a5a6a7a8a9aaabacadaeaf")
+	result, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result) != "HTTP/1.1 200 OK\r\n\r\nworld" {
+		t.Fatalf("wrong response %q", result)
+	}
+
+	conn = newAEAD2022Conn(GetAEAD2022Cipher(method), mustPSK(t, method, psk16), &readerConn{r: bytes.NewReader(stream)}, false)
+	conn.requestSalt = make([]byte, 16)
+	if _, err := conn.Read(make([]byte, 64)); err != ErrRequestSalt2022 {
+		t.Fatalf("response of another request should be rejected, got %v", err)
+	}
+}
+
+func TestAEAD2022UDP(t *testing.T) {
+	defer fixNow2022()()
+	clientSessionID, _ := hex.DecodeString("1011121314151617")
+	serverSessionID, _ := hex.DecodeString("2021222324252627")
+	tests := []struct {
+		method     string
+		password   string
+		session    *Session2022
+		packetID   uint64
+		headerType int
+		packet     string
+		payload    string
+	}{
+		{
+			// identity header of a multi user server
+			method:     "2022-blake3-aes-128-gcm",
+			password:   ipsk16 + ":" + psk16,
+			session:    &Session2022{SessionID: clientSessionID},
+			packetID:   0,
+			headerType: HeaderTypeClient2022,
+			packet:     "57e6c269e9c40a55c6c7b97a37a492fb93fec6c5f9ccac1750ec497125fc3c9fd3b59efb117cf5bbdc0af774967f67ab8024ce02803870742adea5ed9a0d1a3f78554269496da6",
+			payload:    udpAddr2022 + hex.EncodeToString([]byte("query")),
+		},
+		{
+			method:     "2022-blake3-aes-256-gcm",
+			password:   psk32,
+			session:    &Session2022{SessionID: serverSessionID, ClientSessionID: clientSessionID, packetID: 7},
+			packetID:   7,
+			headerType: HeaderTypeServer2022,
+			packet:     "e47a1ec4872c7b5384c3456bb835b752aec71ff5512acb1f4aa00f1166d1f7d9f093c3a6e524510c53dccd2d0e9419be84b904a2f9cabe46073ce6d885ab0e49",
+			payload:    udpAddr2022 + hex.EncodeToString([]byte("answer")),
+		},
+		{
+			// the nonce is random, so only the packet is checked, it has a padding
+			method:     "2022-blake3-chacha20-poly1305",
+			password:   psk32,
+			packetID:   3,
+			headerType: HeaderTypeClient2022,
+			packet:     "303132333435363738393a3b3c3d3e3f404142434445464702078eda7f0bed0d73e4f6363a5b1a7a48902e2881e812f5e994ee4ac1997db765e5e5750a38071f9962711b1547bc44692b68c2bbfdad4bd35fb60a",
+			payload:    udpAddr2022 + hex.EncodeToString([]byte("query")),
+		},
+	}
+	for _, test := range tests {
+		c := GetAEAD2022Cipher(test.method)
+		psk := mustPSK(t, test.method, test.password)
+		packet, _ := hex.DecodeString(test.packet)
+		payload, _ := hex.DecodeString(test.payload)
+		if test.session != nil {
+			result, err := c.PackPacket(make([]byte, MAX_PACKET_SIZE), psk, test.session, payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(result, packet) {
+				t.Fatalf("%s expected packet %x, got %x", test.method, packet, result)
+			}
+		}
+
+		// the server reads the header with the identity psk and the body with the user psk
+		p, err := c.UnpackPacket(psk, packet, test.headerType)
+		if err != nil {
+			t.Fatalf("%s unpack error: %v", test.method, err)
+		}
+		if !bytes.Equal(p.Payload, payload) || p.PacketID != test.packetID {
+			t.Fatalf("%s wrong packet %v %x", test.method, p.PacketID, p.Payload)
+		}
+		if test.headerType == HeaderTypeServer2022 && !bytes.Equal(p.ClientSessionID, clientSessionID) {
+			t.Fatalf("%s wrong client session id %x", test.method, p.ClientSessionID)
+		}
+		if _, err := c.UnpackPacket(psk, packet, 1-test.headerType); err != ErrHeaderType2022 {
+			t.Fatalf("%s packet of the other side should be rejected, got %v", test.method, err)
+		}
+	}
+}
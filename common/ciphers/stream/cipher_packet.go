@@ -89,12 +89,12 @@ func (c *streamPacket) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
 		return n, addr, ErrShortPacket
 	}
 
-	decryptr, err := c.NewStream(c.key, b[:ivLen], 0)
+	decryptr, err := c.NewStream(c.key, b[:ivLen], 1)
 	if err != nil {
 		return n, addr, err
 	}
 
-	decryptr.XORKeyStream(b[ivLen:], b[ivLen:ivLen+n])
+	decryptr.XORKeyStream(b[ivLen:n], b[ivLen:n])
 	copy(b, b[ivLen:])
 	return n - ivLen, addr, err
 }
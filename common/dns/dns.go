@@ -0,0 +1,375 @@
+// Package dns resolve targets of connections and udp packets with configured upstreams,
+// static hosts and a cache which respects the ttl of answers
+package dns
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DefaultTimeout is the timeout of a query to one upstream
+	DefaultTimeout = 5 * time.Second
+	// SystemTTL is how long answers of the system resolver are cached, it does not tell the ttl
+	SystemTTL = 60 * time.Second
+	// MaxTTL limit how long an answer is cached
+	MaxTTL = time.Hour
+
+	PreferIPv4 = "ipv4"
+	PreferIPv6 = "ipv6"
+
+	cacheSize = 4096
+)
+
+// ErrNotFound is returned when a domain has no address
+var ErrNotFound = errors.New("no address is found")
+
+// Config of a resolver
+type Config struct {
+	// Servers are upstreams which are queried in turn until one answers, see ParseUpstream.
+	// The system resolver is used when it is empty
+	Servers []string
+	// Hosts map domains to static addresses, they are not sent to upstreams
+	Hosts map[string][]net.IP
+	// Prefer is PreferIPv4 or PreferIPv6, addresses of the family come first. Empty keep the order of answers
+	Prefer string
+	// Timeout of a query to one upstream, zero means DefaultTimeout
+	Timeout time.Duration
+}
+
+type cacheEntry struct {
+	ips    []net.IP
+	expire time.Time
+}
+
+// Resolver lookup addresses of domains, answers are cached until their ttl is expired
+type Resolver struct {
+	upstreams []Upstream
+	hosts     map[string][]net.IP
+	prefer    string
+	timeout   time.Duration
+	lock      sync.Mutex
+	cache     map[string]cacheEntry
+}
+
+// NewResolver create a resolver of config, it fails when a server or the preference is not valid
+func NewResolver(config Config) (*Resolver, error) {
+	r := &Resolver{
+		hosts:   make(map[string][]net.IP, len(config.Hosts)),
+		prefer:  config.Prefer,
+		timeout: config.Timeout,
+		cache:   make(map[string]cacheEntry),
+	}
+	switch r.prefer {
+	case "", PreferIPv4, PreferIPv6:
+	default:
+		return nil, errors.New(fmt.Sprintf("dns prefer %s is not supported", config.Prefer))
+	}
+	if r.timeout == 0 {
+		r.timeout = DefaultTimeout
+	}
+	for _, server := range config.Servers {
+		upstream, err := ParseUpstream(strings.TrimSpace(server))
+		if err != nil {
+			return nil, err
+		}
+		r.upstreams = append(r.upstreams, upstream)
+	}
+	for host, ips := range config.Hosts {
+		r.hosts[normalize(host)] = ips
+	}
+	return r, nil
+}
+
+var (
+	defaultResolver, _ = NewResolver(Config{})
+	resolver           = defaultResolver
+	resolverLock       sync.RWMutex
+)
+
+// GetResolver return the resolver which is used by the proxy and rules
+func GetResolver() *Resolver {
+	resolverLock.RLock()
+	defer resolverLock.RUnlock()
+	return resolver
+}
+
+// SetResolver replace the resolver, nil restores the system resolver
+func SetResolver(r *Resolver) {
+	if r == nil {
+		r = defaultResolver
+	}
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+	resolver = r
+}
+
+func normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// LookupIP return addresses of host in the order of preference, host can be an ip
+func (r *Resolver) LookupIP(host string) ([]net.IP, error) {
+	host = trimBrackets(host)
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	host = normalize(host)
+	if ips, ok := r.hosts[host]; ok {
+		return r.sort(append([]net.IP{}, ips...)), nil
+	}
+	if len(r.upstreams) == 0 {
+		ips, err := r.cached(host, 0, r.lookupSystem)
+		return r.sort(append([]net.IP{}, ips...)), err
+	}
+
+	var ipv4, ipv6 []net.IP
+	var err4, err6 error
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ipv4, err4 = r.cached(host, dnsmessage.TypeA, r.lookupUpstreams)
+	}()
+	go func() {
+		defer wg.Done()
+		ipv6, err6 = r.cached(host, dnsmessage.TypeAAAA, r.lookupUpstreams)
+	}()
+	wg.Wait()
+	// answers are shared by the cache, so they are copied instead of appended to
+	ips := make([]net.IP, 0, len(ipv4)+len(ipv6))
+	ips = append(append(ips, ipv4...), ipv6...)
+	if len(ips) == 0 {
+		if err4 == nil {
+			err4 = err6
+		}
+		if err4 == nil {
+			err4 = errors.Wrap(ErrNotFound, host)
+		}
+		return nil, err4
+	}
+	return r.sort(ips), nil
+}
+
+// sort put addresses of the preferred family first
+func (r *Resolver) sort(ips []net.IP) []net.IP {
+	if r.prefer == "" || len(ips) < 2 {
+		return ips
+	}
+	preferred := make([]net.IP, 0, len(ips))
+	others := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if isIPv4 := ip.To4() != nil; isIPv4 == (r.prefer == PreferIPv4) {
+			preferred = append(preferred, ip)
+		} else {
+			others = append(others, ip)
+		}
+	}
+	return append(preferred, others...)
+}
+
+// cached return the answer of host and qtype from the cache, or lookup it and cache it with its ttl
+func (r *Resolver) cached(host string, qtype dnsmessage.Type, lookup func(string, dnsmessage.Type) ([]net.IP, time.Duration, error)) ([]net.IP, error) {
+	key := host + "/" + qtype.String()
+	now := time.Now()
+	r.lock.Lock()
+	entry, ok := r.cache[key]
+	r.lock.Unlock()
+	if ok && now.Before(entry.expire) {
+		return entry.ips, nil
+	}
+	ips, ttl, err := lookup(host, qtype)
+	if err != nil || ttl <= 0 {
+		return ips, err
+	}
+	if ttl > MaxTTL {
+		ttl = MaxTTL
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if len(r.cache) >= cacheSize {
+		for key, value := range r.cache {
+			if now.After(value.expire) {
+				delete(r.cache, key)
+			}
+		}
+		if len(r.cache) >= cacheSize {
+			r.cache = make(map[string]cacheEntry)
+		}
+	}
+	r.cache[key] = cacheEntry{ips: ips, expire: now.Add(ttl)}
+	return ips, nil
+}
+
+func (r *Resolver) lookupSystem(host string, _ dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ips, SystemTTL, nil
+}
+
+// lookupUpstreams query upstreams in turn until one of them answers
+func (r *Resolver) lookupUpstreams(host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, upstream := range r.upstreams {
+		ips, ttl, err := r.query(upstream, host, qtype)
+		if err == nil {
+			return ips, ttl, nil
+		}
+		log.Debug("dns query %s %s to %s error: %s", host, qtype.String(), upstream.Name(), err.Error())
+		lastErr = err
+	}
+	return nil, 0, lastErr
+}
+
+// query send a question to upstream, the ttl of the answer is the least ttl of its records.
+// A name without address is cached for the minimum ttl of the SOA in the authority section
+func (r *Resolver) query(upstream Upstream, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(host + ".")
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	id := uint16(rand.Uint32())
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	packet, err := upstream.Exchange(query, r.timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	var response dnsmessage.Message
+	if err := response.Unpack(packet); err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if response.ID != id || !response.Response {
+		return nil, 0, errors.New(fmt.Sprintf("dns server %s replies a wrong message", upstream.Name()))
+	}
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, errors.New(fmt.Sprintf("dns server %s replies %s", upstream.Name(), response.RCode.String()))
+	}
+
+	ips := make([]net.IP, 0, len(response.Answers))
+	ttl := MaxTTL
+	for _, answer := range response.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(append([]byte{}, body.A[:]...)))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(append([]byte{}, body.AAAA[:]...)))
+		default:
+			// CNAMEs are followed by the upstream, their ttl still counts
+		}
+		if recordTTL := time.Duration(answer.Header.TTL) * time.Second; recordTTL < ttl {
+			ttl = recordTTL
+		}
+	}
+	if len(ips) > 0 {
+		return ips, ttl, nil
+	}
+	for _, authority := range response.Authorities {
+		if soa, ok := authority.Body.(*dnsmessage.SOAResource); ok {
+			ttl = time.Duration(soa.MinTTL) * time.Second
+			if recordTTL := time.Duration(authority.Header.TTL) * time.Second; recordTTL < ttl {
+				ttl = recordTTL
+			}
+			return nil, ttl, nil
+		}
+	}
+	return nil, 0, nil
+}
+
+// filter return addresses of the family of local, all addresses when local is nil
+func filter(ips []net.IP, local net.IP) []net.IP {
+	if local == nil || local.IsUnspecified() {
+		return ips
+	}
+	filtered := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (local.To4() != nil) {
+			filtered = append(filtered, ip)
+		}
+	}
+	return filtered
+}
+
+// splitAddress split host:port and parse the port
+func splitAddress(address string) (string, int, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", 0, errors.WithStack(err)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", 0, errors.Wrap(err, fmt.Sprintf("port of %s format error", address))
+	}
+	return host, int(portNum), nil
+}
+
+// ResolveUDPAddr resolve host:port, local is the address packets are sent from, an address of its
+// family is chosen when it is not nil
+func (r *Resolver) ResolveUDPAddr(address string, local net.IP) (*net.UDPAddr, error) {
+	host, port, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	if ips = filter(ips, local); len(ips) == 0 {
+		return nil, errors.Wrap(ErrNotFound, fmt.Sprintf("%s from %s", host, local.String()))
+	}
+	return &net.UDPAddr{IP: ips[0], Port: port}, nil
+}
+
+// Dial connect to host:port with dialer, addresses of host are tried in the order of preference
+// until one of them is connected. Addresses of the other family than the local address of dialer
+// are skipped
+func (r *Resolver) Dial(dialer *net.Dialer, network, address string) (net.Conn, error) {
+	host, port, err := splitAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var local net.IP
+	if addr, ok := dialer.LocalAddr.(*net.TCPAddr); ok {
+		local = addr.IP
+	}
+	if ips = filter(ips, local); len(ips) == 0 {
+		return nil, errors.Wrap(ErrNotFound, fmt.Sprintf("%s from %s", host, local.String()))
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errors.WithStack(err)
+}
@@ -0,0 +1,317 @@
+package dns
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeServer answer A and AAAA questions from records over udp, tcp and https
+type fakeServer struct {
+	sync.Mutex
+	records  map[string][]net.IP
+	ttl      uint32
+	truncate bool
+	// cname put a CNAME before the addresses of every answer
+	cname   bool
+	queries map[string]int
+	udp     net.PacketConn
+	tcp     net.Listener
+}
+
+func startFakeServer(t *testing.T, records map[string][]net.IP, ttl uint32) *fakeServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{records: records, ttl: ttl, queries: make(map[string]int), udp: udp, tcp: tcp}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if response := s.answer(buf[:n], true); response != nil {
+				_, _ = udp.WriteTo(response, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				length := make([]byte, 2)
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				response := s.answer(query, false)
+				binary.BigEndian.PutUint16(length, uint16(len(response)))
+				_, _ = conn.Write(append(length, response...))
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query, _ := ioutil.ReadAll(r.Body)
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/dns-message" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	_, _ = w.Write(s.answer(query, false))
+}
+
+// answer return the response of query, udp responses are truncated when truncate is set
+func (s *fakeServer) answer(query []byte, udp bool) []byte {
+	var message dnsmessage.Message
+	if err := message.Unpack(query); err != nil || len(message.Questions) != 1 {
+		return nil
+	}
+	question := message.Questions[0]
+	s.Lock()
+	s.queries[question.Name.String()+question.Type.String()]++
+	ips, ok := s.records[question.Name.String()]
+	truncate := udp && s.truncate
+	cname := s.cname
+	s.Unlock()
+	message.Response = true
+	message.Truncated = truncate
+	if !ok {
+		message.RCode = dnsmessage.RCodeNameError
+	}
+	if cname && ok && !truncate {
+		message.Answers = append(message.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeCNAME, Class: dnsmessage.ClassINET, TTL: s.ttl},
+			Body:   &dnsmessage.CNAMEResource{CNAME: question.Name},
+		})
+	}
+	header := dnsmessage.ResourceHeader{Name: question.Name, Type: question.Type, Class: dnsmessage.ClassINET, TTL: s.ttl}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && question.Type == dnsmessage.TypeA && !truncate {
+			resource := &dnsmessage.AResource{}
+			copy(resource.A[:], ip4)
+			message.Answers = append(message.Answers, dnsmessage.Resource{Header: header, Body: resource})
+		}
+		if ip.To4() == nil && question.Type == dnsmessage.TypeAAAA && !truncate {
+			resource := &dnsmessage.AAAAResource{}
+			copy(resource.AAAA[:], ip)
+			message.Answers = append(message.Answers, dnsmessage.Resource{Header: header, Body: resource})
+		}
+	}
+	response, _ := message.Pack()
+	return response
+}
+
+func (s *fakeServer) count(name string, qtype dnsmessage.Type) int {
+	s.Lock()
+	defer s.Unlock()
+	return s.queries[name+qtype.String()]
+}
+
+func (s *fakeServer) Close() {
+	_ = s.udp.Close()
+	_ = s.tcp.Close()
+}
+
+func ipsEqual(a []net.IP, b ...string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(net.ParseIP(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseUpstream(t *testing.T) {
+	for raw, name := range map[string]string{
+		"8.8.8.8":                  "udp://8.8.8.8:53",
+		"8.8.8.8:5353":             "udp://8.8.8.8:5353",
+		"2001:db8::1":              "udp://[2001:db8::1]:53",
+		"udp://[2001:db8::1]":      "udp://[2001:db8::1]:53",
+		"tcp://1.1.1.1":            "tcp://1.1.1.1:53",
+		"dns.local:53":             "udp://dns.local:53",
+		"https://dns.google/query": "https://dns.google/query",
+	} {
+		upstream, err := ParseUpstream(raw)
+		if err != nil {
+			t.Fatalf("%s should be parsed: %s", raw, err)
+		}
+		if upstream.Name() != name {
+			t.Fatalf("name of %s should be %s, got %s", raw, name, upstream.Name())
+		}
+	}
+	for _, raw := range []string{"", "tls://1.1.1.1", "[]"} {
+		if _, err := ParseUpstream(raw); err == nil {
+			t.Fatalf("%s should be rejected", raw)
+		}
+	}
+	if _, err := NewResolver(Config{Prefer: "ipv5"}); err == nil {
+		t.Fatal("unknown preference should be rejected")
+	}
+}
+
+func TestResolver(t *testing.T) {
+	server := startFakeServer(t, map[string][]net.IP{
+		"dual.test.": {net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")},
+		"v6.test.":   {net.ParseIP("2001:db8::2")},
+	}, 1)
+	defer server.Close()
+	r, err := NewResolver(Config{
+		Servers: []string{"127.0.0.1:1", server.udp.LocalAddr().String()},
+		Hosts:   map[string][]net.IP{"Static.Test": {net.ParseIP("10.0.0.9")}},
+		Prefer:  PreferIPv6,
+		Timeout: 500 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ips, err := r.LookupIP("dual.test"); err != nil || !ipsEqual(ips, "2001:db8::1", "10.0.0.1") {
+		t.Fatalf("ipv6 should come first: %v %v", ips, err)
+	}
+	if ips, err := r.LookupIP("DUAL.test."); err != nil || !ipsEqual(ips, "2001:db8::1", "10.0.0.1") {
+		t.Fatalf("names should be case insensitive: %v %v", ips, err)
+	}
+	if count := server.count("dual.test.", dnsmessage.TypeA); count != 1 {
+		t.Fatalf("answer should be cached, queried %v times", count)
+	}
+	// the ttl is one second
+	time.Sleep(1100 * time.Millisecond)
+	if _, err := r.LookupIP("dual.test"); err != nil || server.count("dual.test.", dnsmessage.TypeA) != 2 {
+		t.Fatal("expired answer should be queried again")
+	}
+
+	if ips, err := r.LookupIP("static.test"); err != nil || !ipsEqual(ips, "10.0.0.9") {
+		t.Fatalf("static hosts should be used: %v %v", ips, err)
+	}
+	if server.count("static.test.", dnsmessage.TypeA) != 0 {
+		t.Fatal("static hosts should not be queried")
+	}
+	if _, err := r.LookupIP("missing.test"); err == nil {
+		t.Fatal("missing name should fail")
+	}
+	if ips, err := r.LookupIP("[2001:db8::5]"); err != nil || !ipsEqual(ips, "2001:db8::5") {
+		t.Fatalf("ip should not be resolved: %v %v", ips, err)
+	}
+
+	addr, err := r.ResolveUDPAddr("dual.test:53", net.ParseIP("127.0.0.1"))
+	if err != nil || !addr.IP.Equal(net.ParseIP("10.0.0.1")) || addr.Port != 53 {
+		t.Fatalf("address of the local family should be chosen: %v %v", addr, err)
+	}
+	if _, err := r.ResolveUDPAddr("v6.test:53", net.ParseIP("127.0.0.1")); err == nil {
+		t.Fatal("address of the other family should not be chosen")
+	}
+}
+
+func TestResolverTransports(t *testing.T) {
+	server := startFakeServer(t, map[string][]net.IP{"dual.test.": {net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}}, 60)
+	defer server.Close()
+	https := httptest.NewTLSServer(server)
+	defer https.Close()
+
+	tcp, _ := NewResolver(Config{Servers: []string{"tcp://" + server.tcp.Addr().String()}, Prefer: PreferIPv4})
+	truncated, _ := NewResolver(Config{Servers: []string{server.udp.LocalAddr().String()}, Prefer: PreferIPv4})
+	doh, _ := NewResolver(Config{Servers: []string{https.URL + "/dns-query"}, Prefer: PreferIPv4})
+	doh.upstreams[0].(*httpsUpstream).client = https.Client()
+
+	server.Lock()
+	server.truncate = true
+	server.Unlock()
+	for name, r := range map[string]*Resolver{"tcp": tcp, "truncated udp": truncated, "https": doh} {
+		if ips, err := r.LookupIP("dual.test"); err != nil || !ipsEqual(ips, "10.0.0.1", "2001:db8::1") {
+			t.Fatalf("%s should resolve: %v %v", name, ips, err)
+		}
+	}
+}
+
+func TestResolverDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	// the unreachable address is tried first and then the next one
+	r, _ := NewResolver(Config{Hosts: map[string][]net.IP{"echo.test": {net.ParseIP("127.0.0.1"), net.ParseIP("::1")}}, Prefer: PreferIPv6})
+	conn, err := r.Dial(&net.Dialer{Timeout: time.Second}, "tcp", net.JoinHostPort("echo.test", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if _, err := r.Dial(&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP("::1")}}, "tcp", "127.0.0.1:"+port); err == nil {
+		t.Fatal("address of the other family should not be dialed")
+	}
+
+	SetResolver(r)
+	if GetResolver() != r {
+		t.Fatal("resolver should be replaced")
+	}
+	SetResolver(nil)
+	if GetResolver() != defaultResolver {
+		t.Fatal("system resolver should be restored")
+	}
+}
+
+func TestResolverConcurrent(t *testing.T) {
+	server := startFakeServer(t, map[string][]net.IP{"dual.test.": {net.ParseIP("10.0.0.1"), net.ParseIP("2001:db8::1")}}, 60)
+	defer server.Close()
+	server.Lock()
+	server.cname = true
+	server.Unlock()
+	r, _ := NewResolver(Config{Servers: []string{server.udp.LocalAddr().String()}})
+	if _, err := r.LookupIP("dual.test"); err != nil {
+		t.Fatal(err)
+	}
+	// cached answers have spare capacity after the CNAME, lookups must not append into them
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				ips, err := r.LookupIP("dual.test")
+				if err != nil || !ipsEqual(ips, "10.0.0.1", "2001:db8::1") {
+					t.Errorf("cached answer should not be changed: %v %v", ips, err)
+					return
+				}
+				ips[0] = nil
+			}
+		}()
+	}
+	wg.Wait()
+}
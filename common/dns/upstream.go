@@ -0,0 +1,180 @@
+package dns
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	SchemeUDP   = "udp"
+	SchemeTCP   = "tcp"
+	SchemeHTTPS = "https"
+)
+
+// maxUDPSize is the size of udp responses, larger responses are truncated and retried with tcp
+const maxUDPSize = 4096
+
+// Upstream send a dns query and return the response
+type Upstream interface {
+	// Name identify the upstream in logs
+	Name() string
+	Exchange(query []byte, timeout time.Duration) ([]byte, error)
+}
+
+// ParseUpstream create an upstream from udp://host[:port], tcp://host[:port], https://host/path
+// or host[:port] which is udp, the port of udp and tcp is 53 by default
+func ParseUpstream(raw string) (Upstream, error) {
+	if raw == "" {
+		return nil, errors.New("dns server is empty")
+	}
+	scheme, host := SchemeUDP, raw
+	if u, err := url.Parse(raw); err == nil && u.Scheme != "" && u.Host != "" {
+		scheme, host = u.Scheme, u.Host
+	}
+	switch scheme {
+	case SchemeUDP, SchemeTCP:
+		addr, err := withPort(host, "53")
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("dns server %s format error", raw))
+		}
+		if scheme == SchemeTCP {
+			return &tcpUpstream{addr: addr}, nil
+		}
+		return &udpUpstream{addr: addr}, nil
+	case SchemeHTTPS:
+		return &httpsUpstream{url: raw, client: http.DefaultClient}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("dns server scheme %s is not supported", scheme))
+	}
+}
+
+// withPort add port to host when it has none, ipv6 hosts without port may be in brackets or not
+func withPort(host, port string) (string, error) {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host, nil
+	}
+	host = trimBrackets(host)
+	if host == "" {
+		return "", errors.New("host is empty")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func trimBrackets(host string) string {
+	if len(host) > 1 && host[0] == '[' && host[len(host)-1] == ']' {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+type udpUpstream struct {
+	addr string
+}
+
+func (u *udpUpstream) Name() string {
+	return SchemeUDP + "://" + u.addr
+}
+
+func (u *udpUpstream) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", u.addr, timeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	buf := make([]byte, maxUDPSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		// responses of other queries are skipped, the id is checked by the resolver
+		if n < 2 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		if truncated(buf[:n]) {
+			return (&tcpUpstream{addr: u.addr}).Exchange(query, timeout)
+		}
+		return buf[:n], nil
+	}
+}
+
+// truncated report whether the TC bit of the response header is set
+func truncated(response []byte) bool {
+	return len(response) > 2 && response[2]&0x02 != 0
+}
+
+type tcpUpstream struct {
+	addr string
+}
+
+func (t *tcpUpstream) Name() string {
+	return SchemeTCP + "://" + t.addr
+}
+
+func (t *tcpUpstream) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", t.addr, timeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	// messages over tcp are prefixed with their length
+	packet := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(packet, uint16(len(query)))
+	copy(packet[2:], query)
+	if _, err := conn.Write(packet); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := io.ReadFull(conn, packet[:2]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	response := make([]byte, binary.BigEndian.Uint16(packet[:2]))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return response, nil
+}
+
+// httpsUpstream send queries with dns over https POST requests
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpsUpstream) Name() string {
+	return h.url
+}
+
+func (h *httpsUpstream) Exchange(query []byte, timeout time.Duration) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	request.Header.Set("Content-Type", "application/dns-message")
+	request.Header.Set("Accept", "application/dns-message")
+	client := *h.client
+	client.Timeout = timeout
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("dns server %s replies %s", h.url, response.Status))
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, 65535))
+	return body, errors.WithStack(err)
+}
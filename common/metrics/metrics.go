@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	typeCounter = "counter"
+	typeGauge   = "gauge"
+)
+
+var (
+	registry = NewRegistry()
+
+	UserBytes = NewCounter("vnet_user_bytes_total",
+		"bytes transferred by user", "uid", "direction")
+	ActiveTCP = NewGauge("vnet_tcp_active_connections",
+		"active tcp connections", "port")
+	UDPNatEntries = NewGauge("vnet_udp_nat_entries",
+		"udp nat entries", "port")
+	HandshakeFailures = NewCounter("vnet_handshake_failures_total",
+		"connections which fail before target address is decoded", "obfs", "protocol")
+	RuleRejections = NewCounter("vnet_rule_rejections_total",
+		"connections rejected by audit rules", "rule_id")
+	LimiterWait = NewCounter("vnet_limiter_wait_seconds_total",
+		"time waited in speed limiter", "uid", "direction")
+	ReplayRejections = NewCounter("vnet_replay_rejections_total",
+		"handshakes rejected because their iv or salt was seen", "port", "network")
+	Fallbacks = NewCounter("vnet_fallback_total",
+		"failed handshakes forwarded to the fallback", "port")
+	UDPDrops = NewCounter("vnet_udp_dropped_total",
+		"udp packets dropped by the relay", "port", "reason")
+)
+
+// Registry is a set of metrics which can be written in prometheus text format
+type Registry struct {
+	sync.Mutex
+	vecs []*Vec
+}
+
+func NewRegistry() *Registry {
+	return new(Registry)
+}
+
+func (r *Registry) Register(vec *Vec) *Vec {
+	r.Lock()
+	defer r.Unlock()
+	r.vecs = append(r.vecs, vec)
+	return vec
+}
+
+// WriteTo write all metrics in prometheus text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.Lock()
+	vecs := append([]*Vec{}, r.vecs...)
+	r.Unlock()
+	var total int64
+	for _, vec := range vecs {
+		n, err := vec.WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// NewCounter create a counter in default registry
+func NewCounter(name, help string, labels ...string) *Vec {
+	return registry.Register(NewVec(typeCounter, name, help, labels...))
+}
+
+// NewGauge create a gauge in default registry
+func NewGauge(name, help string, labels ...string) *Vec {
+	return registry.Register(NewVec(typeGauge, name, help, labels...))
+}
+
+// WriteTo write default registry
+func WriteTo(w io.Writer) (int64, error) {
+	return registry.WriteTo(w)
+}
+
+// Vec is a metric partitioned by label values
+type Vec struct {
+	sync.Mutex
+	kind   string
+	name   string
+	help   string
+	labels []string
+	values map[string]*sample
+}
+
+type sample struct {
+	labelValues []string
+	value       float64
+}
+
+func NewVec(kind, name, help string, labels ...string) *Vec {
+	return &Vec{
+		kind:   kind,
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]*sample),
+	}
+}
+
+func (v *Vec) Add(value float64, labelValues ...string) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s need %v label values, got %v", v.name, len(v.labels), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	v.Lock()
+	defer v.Unlock()
+	s := v.values[key]
+	if s == nil {
+		s = &sample{labelValues: append([]string{}, labelValues...)}
+		v.values[key] = s
+	}
+	s.value += value
+}
+
+func (v *Vec) Inc(labelValues ...string) {
+	v.Add(1, labelValues...)
+}
+
+// Dec is only meaningful for gauge, a deleted sample is not created again by Dec,
+// so connections which outlive their user don't leave a negative sample
+func (v *Vec) Dec(labelValues ...string) {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s need %v label values, got %v", v.name, len(v.labels), len(labelValues)))
+	}
+	v.Lock()
+	defer v.Unlock()
+	if s := v.values[strings.Join(labelValues, "\xff")]; s != nil {
+		s.value--
+	}
+}
+
+func (v *Vec) Get(labelValues ...string) float64 {
+	v.Lock()
+	defer v.Unlock()
+	if s := v.values[strings.Join(labelValues, "\xff")]; s != nil {
+		return s.value
+	}
+	return 0
+}
+
+// Delete remove the sample, eg: user is deleted
+func (v *Vec) Delete(labelValues ...string) {
+	v.Lock()
+	defer v.Unlock()
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+func (v *Vec) WriteTo(w io.Writer) (int64, error) {
+	v.Lock()
+	samples := make([]*sample, 0, len(v.values))
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		samples = append(samples, &sample{labelValues: v.values[key].labelValues, value: v.values[key].value})
+	}
+	v.Unlock()
+
+	builder := new(strings.Builder)
+	fmt.Fprintf(builder, "# HELP %s %s\n", v.name, v.help)
+	fmt.Fprintf(builder, "# TYPE %s %s\n", v.name, v.kind)
+	for _, s := range samples {
+		builder.WriteString(v.name)
+		if len(v.labels) > 0 {
+			builder.WriteByte('{')
+			for i, label := range v.labels {
+				if i > 0 {
+					builder.WriteByte(',')
+				}
+				fmt.Fprintf(builder, "%s=\"%s\"", label, escape(s.labelValues[i]))
+			}
+			builder.WriteByte('}')
+		}
+		builder.WriteByte(' ')
+		builder.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+		builder.WriteByte('\n')
+	}
+	n, err := io.WriteString(w, builder.String())
+	return int64(n), err
+}
+
+func escape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVecWriteTo(t *testing.T) {
+	registry := NewRegistry()
+	bytesTotal := registry.Register(NewVec(typeCounter, "test_bytes_total", "bytes", "uid", "direction"))
+	active := registry.Register(NewVec(typeGauge, "test_active", "active connections", "port"))
+	bytesTotal.Add(100, "2", "up")
+	bytesTotal.Add(50, "1", "down")
+	bytesTotal.Add(100, "2", "up")
+	active.Inc("443")
+	active.Inc("443")
+	active.Dec("443")
+	active.Inc(`a"b\`)
+
+	buf := new(bytes.Buffer)
+	if _, err := registry.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP test_bytes_total bytes
+# TYPE test_bytes_total counter
+test_bytes_total{uid="1",direction="down"} 50
+test_bytes_total{uid="2",direction="up"} 200
+# HELP test_active active connections
+# TYPE test_active gauge
+test_active{port="443"} 1
+test_active{port="a\"b\\"} 1
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+	if bytesTotal.Get("2", "up") != 200 {
+		t.Fatalf("get value error: %v", bytesTotal.Get("2", "up"))
+	}
+	active.Delete("443")
+	if active.Get("443") != 0 {
+		t.Fatal("deleted sample should be zero")
+	}
+	active.Dec("443")
+	if active.Get("443") != 0 {
+		t.Fatal("deleted sample should not be created again by dec")
+	}
+}
+
+func TestVecLabelMismatch(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("label mismatch should panic")
+		}
+	}()
+	NewVec(typeCounter, "test_total", "test", "uid").Inc()
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 
 	"github.com/ProxyPanel/VNet-SSR/common/ciphers/aead"
+	"github.com/ProxyPanel/VNet-SSR/common/ciphers/block"
 	"github.com/ProxyPanel/VNet-SSR/common/ciphers/stream"
 )
 
@@ -18,6 +19,10 @@ func CipherDecorate(password, method string, conn net.Conn) (net.Conn, error) {
 	if d != nil {
 		return d(password, conn)
 	}
+	d = aead.GetAEAD2022ConnCipher(method)
+	if d != nil {
+		return d(password, conn)
+	}
 	return nil, fmt.Errorf("[SS Cipher] not support : %s", method)
 }
 
@@ -30,6 +35,10 @@ func CipherPacketDecorate(password, method string, conn net.PacketConn) (net.Pac
 	if d != nil {
 		return d(password, conn)
 	}
+	d = aead.GetAEAD2022PacketCiphers(method)
+	if d != nil {
+		return d(password, conn)
+	}
 	return nil, fmt.Errorf("[SS Cipher] not support : %s", method)
 }
 
@@ -43,5 +52,14 @@ func GetSupportCiphers() []string {
 	for k, _ := range aeas {
 		list = append(list, k)
 	}
+	for k := range aead.GetAEAD2022Ciphers() {
+		list = append(list, k)
+	}
 	return list
 }
+
+// IsSupportCipher report whether method is a registered cipher, block ciphers are only supported by shadowsocksr
+func IsSupportCipher(method string) bool {
+	return stream.GetStreamCipher(method) != nil || aead.GetAEADCipher(method) != nil ||
+		aead.GetAEAD2022Cipher(method) != nil || block.GetBlockCipher(method) != nil
+}
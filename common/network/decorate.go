@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"github.com/ProxyPanel/VNet-SSR/common"
 	"github.com/ProxyPanel/VNet-SSR/common/ciphers"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
 	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/common/replay"
 	"github.com/ProxyPanel/VNet-SSR/utils/addrx"
 	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -35,6 +38,7 @@ func NewShadowsocksRDecorate(request *Request, obfsMethod, cryptMethod, key, pro
 		Users:         users,
 		single:        single,
 		recvBuf:       new(bytes.Buffer),
+		Mutex:         new(sync.Mutex),
 	}
 
 	// init obfs protocol encrypto component
@@ -75,23 +79,40 @@ type ShadowsocksRDecorate struct {
 	Port          int
 	ObfsParam     string
 	ProtocolParam string
+	// Users are uid packs and passwords of a single port, they must not be changed once they are set.
+	// UsersFunc return the current users instead when it is set, so long lived decorates see new users
 	Users         map[string]string
+	UsersFunc     func() map[string]string
 	Overhead      int
 	ISLocal       bool
 	recvBuf       *bytes.Buffer
 	upload        int64
 	download      int64
 	single        int
+	replayChecked bool
+	disposed      int32
 	common.TrafficReport
 	ILimiter
 	*sync.Mutex
 }
 
+// Close close the connection, clients held by the protocol are released once
+func (ssrd *ShadowsocksRDecorate) Close() error {
+	if atomic.CompareAndSwapInt32(&ssrd.disposed, 0, 1) {
+		ssrd.protocol.Dispose()
+		ssrd.obfs.Dispose()
+	}
+	return ssrd.Request.Close()
+}
+
 func (ssrd *ShadowsocksRDecorate) SetLimter(limiter ILimiter) {
 	ssrd.ILimiter = limiter
 }
 
 func (ssrd *ShadowsocksRDecorate) Read(buf []byte) (n int, err error) {
+	if ssrd.ISLocal {
+		return ssrd.localRead(buf)
+	}
 	defer func() {
 		if ssrd.ILimiter != nil {
 			if err := ssrd.ILimiter.UpLimit(ssrd.UID, n); err != nil {
@@ -143,7 +164,10 @@ func (ssrd *ShadowsocksRDecorate) Read(buf []byte) (n int, err error) {
 			return 0, errors.Wrap(err, fmt.Sprintf("[%s] ShadowsocksRDecorate obfs sendback error.", ssrd.RequestID))
 		}
 		atomic.AddInt64(&ssrd.download, int64(n))
-		return ssrd.Read(buf)
+		// data may come with the handshake, e.g. tls1.2_ticket_fastauth
+		if len(unobfsData) == 0 {
+			return ssrd.Read(buf)
+		}
 	}
 
 	if needDecrypt {
@@ -151,6 +175,17 @@ func (ssrd *ShadowsocksRDecorate) Read(buf []byte) (n int, err error) {
 		if ssrd.protocol.GetServerInfo().GetRecvIv() == nil || len(ssrd.protocol.GetServerInfo().GetRecvIv()) == 0 {
 			ssrd.protocol.GetServerInfo().SetRecvIv(ssrd.encryptor.IVIn)
 		}
+		if !ssrd.replayChecked && len(ssrd.encryptor.IVIn) > 0 {
+			ssrd.replayChecked = true
+			if !replay.GetFilter().Check(ssrd.encryptor.IVIn) {
+				metrics.ReplayRejections.Inc(strconv.Itoa(ssrd.Port), "tcp")
+				logrus.WithFields(logrus.Fields{
+					"requestId": ssrd.RequestID,
+					"client":    ssrd.RemoteAddr().String(),
+				}).Info("shadowsocksr replayed iv, reject the connection")
+				return 0, ErrReplay
+			}
+		}
 		if logrus.GetLevel() == logrus.DebugLevel {
 			logrus.WithFields(logrus.Fields{
 				"cleartextHexEncode": hex.EncodeToString(cleartext),
@@ -234,6 +269,9 @@ func (ssrd *ShadowsocksRDecorate) Read(buf []byte) (n int, err error) {
 }
 
 func (ssrd *ShadowsocksRDecorate) Write(buf []byte) (n int, err error) {
+	if ssrd.ISLocal {
+		return ssrd.localWrite(buf)
+	}
 	defer func() {
 		if ssrd.ILimiter != nil {
 			if err := ssrd.ILimiter.DownLimit(ssrd.UID, n); err != nil {
@@ -293,6 +331,11 @@ func (ssrd *ShadowsocksRDecorate) ReadFrom() (data, uid []byte, addr net.Addr, e
 	if err != nil {
 		return nil, nil, nil, err
 	}
+	// only packets which pass the protocol are remembered, so junk can not flush the filter
+	if len(result) > 0 && !replay.GetUDPFilter().Check(iv) {
+		metrics.ReplayRejections.Inc(strconv.Itoa(ssrd.Port), "udp")
+		return nil, nil, addr, ErrReplay
+	}
 	// update upload traffic
 	if ssrd.single == 1 && ssrd.TrafficReport != nil {
 		ssrd.TrafficReport.Upload(int(binaryx.LEBytesToUInt32([]byte(uidPack))), int64(n))
@@ -321,13 +364,108 @@ func (ssrd *ShadowsocksRDecorate) WriteTo(p, uid []byte, addr net.Addr) error {
 	return err
 }
 
+// localRead is the client side of Read, data from server is decoded by
+// ClientDecode, decrypted and then unpacked by ClientPostDecrypt
+func (ssrd *ShadowsocksRDecorate) localRead(buf []byte) (n int, err error) {
+	for ssrd.recvBuf.Len() == 0 {
+		bufTmp := make([]byte, 4*1024)
+		n, err = ssrd.Conn.Read(bufTmp)
+		if err != nil {
+			return 0, err
+		}
+		unobfsData, needSendBack, err := ssrd.obfs.ClientDecode(bufTmp[:n])
+		if err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("[%s] ShadowsocksRDecorate obfs client decode error.", ssrd.RequestID))
+		}
+		if needSendBack {
+			ssrd.Lock()
+			backdata, err := ssrd.obfs.ClientEncode([]byte{})
+			if err == nil {
+				_, err = ssrd.Conn.Write(backdata)
+			}
+			ssrd.Unlock()
+			if err != nil {
+				return 0, errors.Wrap(err, fmt.Sprintf("[%s] ShadowsocksRDecorate obfs client sendback error.", ssrd.RequestID))
+			}
+		}
+		cleartext, err := ssrd.encryptor.Decrypt(unobfsData)
+		if err != nil && strings.Contains(err.Error(), "buf is too short") {
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("[%s] ShadowsocksRDecorate encryptor decrypt error.", ssrd.RequestID))
+		}
+		data, err := ssrd.protocol.ClientPostDecrypt(cleartext)
+		if err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("[%s] ShadowsocksRDecorate protocol client post decrypt error.", ssrd.RequestID))
+		}
+		ssrd.recvBuf.Write(data)
+	}
+	return ssrd.recvBuf.Read(buf)
+}
+
+// localWrite is the client side of Write, the order is ClientPreEncrypt, Encrypt and ClientEncode
+func (ssrd *ShadowsocksRDecorate) localWrite(buf []byte) (n int, err error) {
+	data, err := ssrd.protocol.ClientPreEncrypt(buf)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("[%s] ShadowsocksRDecorate protocol client pre encrypt error.", ssrd.RequestID))
+	}
+	data, err = ssrd.encryptor.Encrypt(data)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("[%s] ShadowsocksRDecorate encryptor encrypt error.", ssrd.RequestID))
+	}
+	// obfs handshake may be finished by localRead, so encode and write must be atomic
+	ssrd.Lock()
+	defer ssrd.Unlock()
+	data, err = ssrd.obfs.ClientEncode(data)
+	if err != nil {
+		return 0, errors.Wrap(err, fmt.Sprintf("[%s] ShadowsocksRDecorate obfs client encode error.", ssrd.RequestID))
+	}
+	if _, err = ssrd.Conn.Write(data); err != nil {
+		return 0, err
+	}
+	return len(buf), nil
+}
+
+// LocalReadFrom read a udp packet from server, it returns socks address and payload
+func (ssrd *ShadowsocksRDecorate) LocalReadFrom() (data []byte, addr net.Addr, err error) {
+	p := make([]byte, obfs.UDP_MAX_BUF_SIZE)
+	n, addr, err := ssrd.PacketConn.ReadFrom(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, _, err = ssrd.encryptor.DecryptAll(p[:n])
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err = ssrd.protocol.ClientUDPPostDecrypt(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, addr, nil
+}
+
+// LocalWriteTo send socks address and payload to server with a new iv
+func (ssrd *ShadowsocksRDecorate) LocalWriteTo(p []byte, addr net.Addr) error {
+	data, err := ssrd.protocol.ClientUDPPreEncrypt(p)
+	if err != nil {
+		return err
+	}
+	data, err = ssrd.encryptor.EncryptAll(data, ssrd.encryptor.MustNewIV())
+	if err != nil {
+		return err
+	}
+	_, err = ssrd.Request.WriteTo(data, addr)
+	return err
+}
+
 func (ssrd *ShadowsocksRDecorate) getServerInfo(isObfs bool) obfs.ServerInfo {
 	serverInfo := obfs.NewServerInfo()
 	serverInfo.SetHost(ssrd.Host)
 	serverInfo.SetPort(ssrd.Port)
 	if ssrd.Conn != nil {
 		serverInfo.SetClient(net.ParseIP(addrx.GetIPFromAddr(ssrd.Conn.RemoteAddr())))
-		serverInfo.SetPort(addrx.GetPortFromAddr(ssrd.Conn.RemoteAddr()))
+		serverInfo.SetClientPort(addrx.GetPortFromAddr(ssrd.Conn.RemoteAddr()))
 	}
 	if isObfs {
 		serverInfo.SetObfsParam(ssrd.ObfsParam)
@@ -347,9 +485,18 @@ func (ssrd *ShadowsocksRDecorate) getServerInfo(isObfs bool) obfs.ServerInfo {
 	serverInfo.SetOverhead(ssrd.Overhead)
 	serverInfo.SetUpdateUserFunc(ssrd.UpdateUser)
 	serverInfo.SetUsers(ssrd.Users)
+	serverInfo.SetUsersFunc(ssrd.GetUsers)
 	return serverInfo
 }
 
+// GetUsers return users of UsersFunc when it is set, otherwise Users
+func (ssrd *ShadowsocksRDecorate) GetUsers() map[string]string {
+	if ssrd.UsersFunc != nil {
+		return ssrd.UsersFunc()
+	}
+	return ssrd.Users
+}
+
 func (ssrd *ShadowsocksRDecorate) UpdateUser(uid []byte) {
 	if ssrd.single == 1 {
 		uidInt := binaryx.LEBytesToUInt32(uid)
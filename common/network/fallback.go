@@ -0,0 +1,58 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"sync"
+)
+
+// MaxFallbackRecord is the max bytes of a handshake kept for the fallback, a connection
+// which sends more before it is established can not be forwarded to the fallback
+const MaxFallbackRecord = 64 * 1024
+
+// RecordConn keep bytes read from a connection until it is established, so a failed
+// handshake can be replayed to the fallback as if it had been sent there
+type RecordConn struct {
+	net.Conn
+	sync.Mutex
+	record *bytes.Buffer
+}
+
+func NewRecordConn(conn net.Conn) *RecordConn {
+	return &RecordConn{
+		Conn:   conn,
+		record: new(bytes.Buffer),
+	}
+}
+
+func (r *RecordConn) Read(b []byte) (n int, err error) {
+	n, err = r.Conn.Read(b)
+	r.Lock()
+	defer r.Unlock()
+	if r.record != nil && n > 0 {
+		if r.record.Len()+n > MaxFallbackRecord {
+			r.record = nil
+		} else {
+			r.record.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+// Established stop recording and drop the recorded bytes
+func (r *RecordConn) Established() {
+	r.Lock()
+	defer r.Unlock()
+	r.record = nil
+}
+
+// Recorded return bytes read before the connection is established, ok is false
+// when the connection is established or it has sent more than MaxFallbackRecord
+func (r *RecordConn) Recorded() (data []byte, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	if r.record == nil {
+		return nil, false
+	}
+	return r.record.Bytes(), true
+}
@@ -0,0 +1,37 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRecordConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		_, _ = client.Write([]byte("hello"))
+		_, _ = client.Write(make([]byte, MaxFallbackRecord))
+	}()
+	record := NewRecordConn(server)
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(record, buf); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := record.Recorded(); !ok || !bytes.Equal(data, []byte("hello")) {
+		t.Fatal("bytes read before established should be recorded")
+	}
+	if _, err := io.ReadFull(record, make([]byte, MaxFallbackRecord)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := record.Recorded(); ok {
+		t.Fatal("handshake larger than MaxFallbackRecord should not be recorded")
+	}
+
+	record = NewRecordConn(server)
+	record.Established()
+	if _, ok := record.Recorded(); ok {
+		t.Fatal("established connection should not be recorded")
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"net"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,7 +25,67 @@ type Listener struct {
 	Timeout time.Duration
 	TCP     *net.TCPListener
 	UDP     net.PacketConn
+	// ProxyProtocol read PROXY protocol headers of tcp connections when it is not nil
+	ProxyProtocol *ProxyProtocol
 	context.Context
+	connsLock sync.Mutex
+	conns     map[*Request]struct{}
+}
+
+func (l *Listener) track(request *Request) {
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	if l.conns == nil {
+		l.conns = make(map[*Request]struct{})
+	}
+	l.conns[request] = struct{}{}
+}
+
+func (l *Listener) untrack(request *Request) {
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	delete(l.conns, request)
+}
+
+// Active return number of tcp connections which are still being handled
+func (l *Listener) Active() int {
+	l.connsLock.Lock()
+	defer l.connsLock.Unlock()
+	return len(l.conns)
+}
+
+// Drain wait tcp connections to finish, connections which are still alive
+// when ctx is done will be closed
+func (l *Listener) Drain(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for l.Active() > 0 {
+		select {
+		case <-ctx.Done():
+			l.connsLock.Lock()
+			log.Warn("listener %s drain timeout, close %v connections", l.Addr, len(l.conns))
+			for request := range l.conns {
+				_ = request.Close()
+			}
+			l.connsLock.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Shutdown stop accepting new connections and drain the existing ones,
+// udp is kept open until drain is finished
+func (l *Listener) Shutdown(ctx context.Context) error {
+	if err := l.CloseTCP(); err != nil {
+		return err
+	}
+	err := l.Drain(ctx)
+	if closeErr := l.closeUDP(); err == nil {
+		err = closeErr
+	}
+	return err
 }
 
 func (l *Listener) ListenTCP(fn func(request *Request)) error {
@@ -37,7 +98,8 @@ func (l *Listener) ListenTCP(fn func(request *Request)) error {
 		return err
 	}
 	logrus.Infof("Listener listen on: %s", l.Addr)
-	l.TCP = listen.(*net.TCPListener)
+	tcp := listen.(*net.TCPListener)
+	l.TCP = tcp
 	go func() {
 		defer func() {
 			if e := recover(); e != nil {
@@ -46,7 +108,7 @@ func (l *Listener) ListenTCP(fn func(request *Request)) error {
 		}()
 		for {
 
-			con, err := l.TCP.Accept()
+			con, err := tcp.Accept()
 			// TODO: https://liudanking.com/network/go-%E4%B8%AD%E5%A6%82%E4%BD%95%E5%87%86%E7%A1%AE%E5%9C%B0%E5%88%A4%E6%96%AD%E5%92%8C%E8%AF%86%E5%88%AB%E5%90%84%E7%A7%8D%E7%BD%91%E7%BB%9C%E9%94%99%E8%AF%AF/
 			if err != nil {
 				errString := err.Error()
@@ -68,7 +130,22 @@ func (l *Listener) ListenTCP(fn func(request *Request)) error {
 						logrus.WithFields(logrus.Fields{}).Errorf("connection handle crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
 					}
 				}()
-				fn(NewRequestWithTCP(con))
+				// it is tracked before the PROXY header is read, so drain can close a slow proxy
+				request := NewRequestWithTCP(con)
+				l.track(request)
+				defer l.untrack(request)
+				if l.ProxyProtocol != nil {
+					proxyCon, err := l.ProxyProtocol.Accept(con)
+					if err != nil {
+						log.Warn("listener %s reject connection: %v", l.Addr, err)
+						_ = con.Close()
+						return
+					}
+					l.connsLock.Lock()
+					request.Conn = proxyCon
+					l.connsLock.Unlock()
+				}
+				fn(request)
 			}()
 		}
 	}()
@@ -98,21 +175,33 @@ func (l *Listener) ListenUDP(fn func(request *Request)) error {
 }
 
 func (l *Listener) Close() error {
+	if err := l.CloseTCP(); err != nil {
+		return err
+	}
+	return l.closeUDP()
+}
+
+// CloseTCP stop accepting tcp connections, udp is still served
+func (l *Listener) CloseTCP() error {
 	if l.TCP != nil {
 		if err := l.TCP.Close(); err != nil {
 			log.Error("listener close tcp error: %+v", err)
 			return err
 		}
 		log.Info("listener %s tcp close", l.Addr)
+		l.TCP = nil
 	}
+	return nil
+}
 
+func (l *Listener) closeUDP() error {
 	if l.UDP != nil {
 		if err := l.UDP.Close(); err != nil {
 			log.Error("listener close udp error: %+v", err)
 			return err
 		}
 		log.Info("listener %s udp close", l.Addr)
+		l.UDP = nil
 	}
-
 	return nil
 }
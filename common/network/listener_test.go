@@ -4,7 +4,11 @@ import (
 	"context"
 	"github.com/ProxyPanel/VNet-SSR/common/log"
 	"github.com/ProxyPanel/VNet-SSR/utils/osx"
+	"io"
+	"io/ioutil"
+	"net"
 	"strings"
+	"testing"
 	"time"
 )
 
@@ -77,4 +81,176 @@ func ExampleListener(){
 	listener.Close()
 	osx.WaitSignal()
 	//Output:
-}
\ No newline at end of file
+}
+
+func TestListenerDrain(t *testing.T) {
+	listener := NewListener("127.0.0.1:0", 5*time.Second)
+	if err := listener.ListenTCP(func(request *Request) {
+		_, _ = io.Copy(request, request)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.TCP.Addr().String()
+	con, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := con.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(con, buf); err != nil {
+		t.Fatal(err)
+	}
+	if listener.Active() != 1 {
+		t.Fatalf("active connections should be 1, got %v", listener.Active())
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Shutdown(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("listener should stop accepting")
+	}
+	// existing connection still works during drain
+	if _, err := con.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(con, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("connection should work while draining: %v", err)
+	}
+	_ = con.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain should finish after connection closed")
+	}
+}
+
+func TestListenerDrainTimeout(t *testing.T) {
+	listener := NewListener("127.0.0.1:0", 5*time.Second)
+	if err := listener.ListenTCP(func(request *Request) {
+		_, _ = io.Copy(ioutil.Discard, request)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	con, err := net.Dial("tcp", listener.TCP.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	for listener.Active() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := listener.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("drain should timeout, got %v", err)
+	}
+	_ = con.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := con.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection should be closed by drain, got %v", err)
+	}
+}
+
+func TestListenerShutdownKeepUDP(t *testing.T) {
+	listener := NewListener("127.0.0.1:0", 5*time.Second)
+	if err := listener.ListenTCP(func(request *Request) {
+		_, _ = io.Copy(ioutil.Discard, request)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	listener.Addr = listener.TCP.Addr().String()
+	if err := listener.ListenUDP(func(request *Request) {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := request.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = request.WriteTo(buf[:n], addr)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	udp := listener.UDP
+	con, err := net.Dial("tcp", listener.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for listener.Active() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- listener.Shutdown(context.Background())
+	}()
+	time.Sleep(200 * time.Millisecond)
+	pc, err := net.Dial("udp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	_ = pc.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := pc.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := pc.Read(buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("udp should be served while draining: %v", err)
+	}
+	_ = con.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain should finish after connection closed")
+	}
+	if _, _, err := udp.ReadFrom(buf); err == nil {
+		t.Fatal("udp should be closed after drain")
+	}
+}
+
+func TestListenerDrainProxyProtocol(t *testing.T) {
+	listener := NewListener("127.0.0.1:0", 5*time.Second)
+	proxyProtocol, err := NewProxyProtocol([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener.ProxyProtocol = proxyProtocol
+	if err := listener.ListenTCP(func(request *Request) {
+		_, _ = io.Copy(ioutil.Discard, request)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// a proxy which doesn't send the header
+	con, err := net.Dial("tcp", listener.TCP.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	deadline := time.Now().Add(3 * time.Second)
+	for listener.Active() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if listener.Active() != 1 {
+		t.Fatal("connection should be tracked before the PROXY header is read")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := listener.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("drain should timeout, got %v", err)
+	}
+	_ = con.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := con.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("connection should be closed by drain, got %v", err)
+	}
+}
@@ -0,0 +1,214 @@
+package network
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// ProxyHeaderTimeout is how long a trusted proxy has to send the PROXY protocol header
+	ProxyHeaderTimeout = 5 * time.Second
+
+	proxyV1Prefix = "PROXY "
+	// proxyV1MaxLength is the max length of a v1 header including CRLF
+	proxyV1MaxLength = 107
+)
+
+var (
+	// ErrUntrustedProxy is returned when a connection does not come from a trusted proxy
+	ErrUntrustedProxy = errors.New("connection is not from a trusted proxy")
+
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// ProxyProtocol accept connections from trusted proxies which send a HAProxy PROXY
+// protocol v1 or v2 header, the client address in the header is used as remote address
+type ProxyProtocol struct {
+	trusted []*net.IPNet
+}
+
+// NewProxyProtocol create a ProxyProtocol trusting the ips or cidrs in trusted
+func NewProxyProtocol(trusted []string) (*ProxyProtocol, error) {
+	p := new(ProxyProtocol)
+	for _, item := range trusted {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("trusted proxy %s is not an ip or cidr", item))
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			p.trusted = append(p.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("trusted proxy %s is not an ip or cidr", item))
+		}
+		p.trusted = append(p.trusted, ipNet)
+	}
+	if len(p.trusted) == 0 {
+		return nil, errors.New("proxy protocol needs at least one trusted proxy")
+	}
+	return p, nil
+}
+
+// Trusted report whether addr is a trusted proxy
+func (p *ProxyProtocol) Trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, ipNet := range p.trusted {
+		if ipNet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept read the PROXY protocol header of conn, the returned connection reports the client
+// in the header as its remote address. Connections from untrusted sources are rejected
+func (p *ProxyProtocol) Accept(conn net.Conn) (net.Conn, error) {
+	if !p.Trusted(conn.RemoteAddr()) {
+		return nil, errors.WithStack(ErrUntrustedProxy)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	reader := bufio.NewReader(conn)
+	remote, err := readProxyHeader(reader)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("read proxy protocol header from %s", conn.RemoteAddr().String()))
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &ProxyConn{Conn: conn, reader: reader, remote: remote}, nil
+}
+
+// ProxyConn is a connection accepted by ProxyProtocol
+type ProxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+	remote net.Addr
+}
+
+// Read read bytes buffered while the header is read before the connection
+func (c *ProxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr return the client address sent by the proxy
+func (c *ProxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ProxyAddr return the address of the proxy
+func (c *ProxyConn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyHeader read a v1 or v2 header, the address is nil when the header
+// does not carry one, e.g. a v2 LOCAL command sent by health checks
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	head, err := r.Peek(len(proxyV1Prefix))
+	if err != nil {
+		return nil, err
+	}
+	if string(head) == proxyV1Prefix {
+		return readProxyHeaderV1(r)
+	}
+	head, err = r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head, proxyV2Signature) {
+		return readProxyHeaderV2(r)
+	}
+	return nil, errors.New("proxy protocol header is missing")
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLength)
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyV1MaxLength {
+			return nil, errors.New("proxy protocol v1 header is too long")
+		}
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("proxy protocol v1 header does not end with CRLF")
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New(fmt.Sprintf("proxy protocol v1 header %q is invalid", line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, errors.New(fmt.Sprintf("proxy protocol v1 header %q is invalid", line))
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errors.New(fmt.Sprintf("proxy protocol version %v is not supported", header[12]>>4))
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	switch header[12] & 0x0f {
+	case 0x0:
+		// LOCAL, the connection is made by the proxy itself
+		return nil, nil
+	case 0x1:
+	default:
+		return nil, errors.New(fmt.Sprintf("proxy protocol v2 command %v is invalid", header[12]&0x0f))
+	}
+	switch header[13] {
+	case 0x11:
+		if len(payload) < 12 {
+			return nil, errors.New("proxy protocol v2 address is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}, nil
+	case 0x21:
+		if len(payload) < 36 {
+			return nil, errors.New("proxy protocol v2 address is too short")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}, nil
+	default:
+		// unspecified or non tcp family, the address is ignored
+		return nil, nil
+	}
+}
@@ -0,0 +1,110 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func proxyHeaderV2(command, family byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+// acceptWith send data from 127.0.0.1 and accept it with p
+func acceptWith(t *testing.T, p *ProxyProtocol, data []byte) (net.Conn, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		con, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		_, _ = con.Write(data)
+		_ = con.Close()
+	}()
+	con, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.Accept(con)
+}
+
+func TestProxyProtocol(t *testing.T) {
+	p, err := NewProxyProtocol([]string{"10.0.0.0/8", " 127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v4 := append(net.ParseIP("203.0.113.7").To4(), net.ParseIP("10.0.0.1").To4()...)
+	v4 = append(v4, 0x30, 0x39, 0x01, 0xbb)
+	v6 := append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...)
+	v6 = append(v6, 0x30, 0x39, 0x01, 0xbb)
+	tests := []struct {
+		name   string
+		header []byte
+		remote string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 443\r\n"), "203.0.113.7:12345"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 443\r\n"), "[2001:db8::1]:12345"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 tcp4", proxyHeaderV2(1, 0x11, v4), "203.0.113.7:12345"},
+		{"v2 tcp6", proxyHeaderV2(1, 0x21, v6), "[2001:db8::1]:12345"},
+		{"v2 local", proxyHeaderV2(0, 0x11, v4), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			con, err := acceptWith(t, p, append(tt.header, "hello"...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer con.Close()
+			remote := con.RemoteAddr().String()
+			if tt.remote == "" {
+				// the address of the proxy is kept
+				remote, _, _ = net.SplitHostPort(remote)
+				tt.remote = "127.0.0.1"
+			}
+			if remote != tt.remote {
+				t.Fatalf("remote address should be %s but %s", tt.remote, remote)
+			}
+			data, err := ioutil.ReadAll(con)
+			if err != nil || !bytes.Equal(data, []byte("hello")) {
+				t.Fatalf("data after header should be kept: %q %v", data, err)
+			}
+		})
+	}
+
+	for name, header := range map[string][]byte{
+		"missing header":  []byte("GET / HTTP/1.1\r\n\r\n"),
+		"bad v1 ip":       []byte("PROXY TCP4 2001:db8::1 10.0.0.1 12345 443\r\n"),
+		"bad v1 port":     []byte("PROXY TCP4 203.0.113.7 10.0.0.1 123456 443\r\n"),
+		"v1 without crlf": []byte("PROXY TCP4 203.0.113.7 10.0.0.1 12345 443\n"),
+		"long v1":         append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), proxyV1MaxLength)...),
+		"short v2":        proxyHeaderV2(1, 0x11, v4[:8]),
+		"bad v2 command":  proxyHeaderV2(2, 0x11, v4),
+	} {
+		if _, err := acceptWith(t, p, header); err == nil {
+			t.Fatalf("%s should be rejected", name)
+		}
+	}
+
+	untrusted, err := NewProxyProtocol([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acceptWith(t, untrusted, []byte("PROXY UNKNOWN\r\n")); err == nil {
+		t.Fatal("connection from untrusted source should be rejected")
+	}
+	for _, trusted := range [][]string{nil, {""}, {"localhost"}, {"10.0.0.0/33"}} {
+		if _, err := NewProxyProtocol(trusted); err == nil {
+			t.Fatalf("trusted proxies %q should be rejected", trusted)
+		}
+	}
+}
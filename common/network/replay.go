@@ -0,0 +1,22 @@
+package network
+
+import (
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ReplayTimeout is how long a connection whose iv is replayed is held before it is closed
+const ReplayTimeout = 30 * time.Second
+
+var ErrReplay = errors.New("iv or salt is replayed")
+
+// Discard read and drop data of the request until the client closes it or timeout, a rejected
+// connection looks like a connection waiting for more data instead of being closed at once
+func Discard(request *Request, timeout time.Duration) error {
+	_ = request.SetReadDeadline(time.Now().Add(timeout))
+	_, _ = io.Copy(ioutil.Discard, request.Conn)
+	return io.EOF
+}
@@ -0,0 +1,62 @@
+package network
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/ProxyPanel/VNet-SSR/common"
+	"github.com/sirupsen/logrus"
+)
+
+// ShadowsocksDecorate count traffic and apply limit of a plain shadowsocks connection.
+// it is under the cipher, so traffic is counted on the wire like ShadowsocksRDecorate,
+// header which is read to find the user is replayed to the cipher
+type ShadowsocksDecorate struct {
+	*Request
+	UID    int
+	reader io.Reader
+	common.TrafficReport
+	ILimiter
+}
+
+func NewShadowsocksDecorate(request *Request, header []byte, uid int) *ShadowsocksDecorate {
+	return &ShadowsocksDecorate{
+		Request: request,
+		UID:     uid,
+		reader:  io.MultiReader(bytes.NewReader(header), request.Conn),
+	}
+}
+
+func (ssd *ShadowsocksDecorate) SetLimter(limiter ILimiter) {
+	ssd.ILimiter = limiter
+}
+
+func (ssd *ShadowsocksDecorate) Read(buf []byte) (n int, err error) {
+	n, err = ssd.reader.Read(buf)
+	if n > 0 {
+		if ssd.TrafficReport != nil {
+			ssd.TrafficReport.Upload(ssd.UID, int64(n))
+		}
+		if ssd.ILimiter != nil {
+			if err := ssd.ILimiter.UpLimit(ssd.UID, n); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+	return n, err
+}
+
+func (ssd *ShadowsocksDecorate) Write(buf []byte) (n int, err error) {
+	n, err = ssd.Conn.Write(buf)
+	if n > 0 {
+		if ssd.TrafficReport != nil {
+			ssd.TrafficReport.Download(ssd.UID, int64(n))
+		}
+		if ssd.ILimiter != nil {
+			if err := ssd.ILimiter.DownLimit(ssd.UID, n); err != nil {
+				logrus.Error(err)
+			}
+		}
+	}
+	return n, err
+}
@@ -384,7 +384,7 @@ func (a *AuthAes128Sha1) ServerPostDecrypt(buf []byte) (result []byte, sendback
 				hex.EncodeToString(head))
 			result, sendback = a.NotMatchReturn(a.RecvBuf)
 			return result, sendback, nil
-		} else if core.GetApp().GetObfsProtocolService().Insert(a.UserID, int(clientId), int(connectionId)) {
+		} else if core.GetApp().GetObfsProtocolService().Insert(a.UserID, a.GetServerInfo().GetPort(), int(clientId), int(connectionId)) {
 			a.HasRecvHeader = true
 			result = a.RecvBuf[31+rndLen : length-4]
 			a.ClientID = int(clientId)
@@ -453,7 +453,7 @@ func (a *AuthAes128Sha1) ServerPostDecrypt(buf []byte) (result []byte, sendback
 		}
 	}
 	if len(result) > 0 {
-		core.GetApp().GetObfsProtocolService().Update(a.UserID, a.ClientID, a.ConnectionID)
+		core.GetApp().GetObfsProtocolService().Update(a.UserID, a.GetServerInfo().GetPort(), a.ClientID, a.ConnectionID)
 	}
 	return result, sendback, nil
 }
@@ -483,6 +483,12 @@ func (a *AuthAes128Sha1) ClientUDPPreEncrypt(buf []byte) ([]byte, error) {
 	return bytesx.ContactSlice(buf, hmacSum(a.UserKey, buf, a.HashFunc)[:4]), nil
 }
 
+func (a *AuthAes128Sha1) Dispose() {
+	if a.HasRecvHeader {
+		core.GetApp().GetObfsProtocolService().Remove(string(a.UserID), a.GetServerInfo().GetPort(), a.ClientID)
+	}
+}
+
 func (a *AuthAes128Sha1) ClientUDPPostDecrypt(buf []byte) ([]byte, error) {
 	userKey := a.GetServerInfo().GetKey()
 	macData := hmacSum(userKey, buf[0:len(buf)-4], a.HashFunc)[:4]
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/md5"
 	"fmt"
+	"github.com/ProxyPanel/VNet-SSR/core"
 	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
 	"github.com/sirupsen/logrus"
 	"net"
@@ -56,6 +57,8 @@ func TestAuthAes128(t *testing.T){
 
 
 func GetAuthAes128() Plain{
+	// the factory refuses to build the protocol without a protocol service
+	core.GetApp().SetObfsProtocolService(NewObfsAuthChainData("auth_aes128_md5"))
 	auth, _ := AuthAes128Md5Factory("auth_aes128_md5")
 	serverInfo := NewServerInfo()
 	serverInfo.GetUsers()[string(binaryx.LEUint32ToBytes(1024))] = "killer"
@@ -3,11 +3,13 @@ package obfs
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"github.com/ProxyPanel/VNet-SSR/core"
 	"github.com/ProxyPanel/VNet-SSR/utils/langx"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -29,6 +31,11 @@ const (
 
 func init() {
 	registerMethod("auth_chain_a", NewAuthChainA)
+	registerMethod("auth_chain_b", NewAuthChainB)
+	registerMethod("auth_chain_c", NewAuthChainC)
+	registerMethod("auth_chain_d", NewAuthChainD)
+	registerMethod("auth_chain_e", NewAuthChainE)
+	registerMethod("auth_chain_f", NewAuthChainF)
 }
 
 type XorShift128Plus struct {
@@ -94,16 +101,23 @@ type AuthChainA struct {
 	RandomClient   *XorShift128Plus
 	RandomServer   *XorShift128Plus
 	Encryptor      *ciphers.Encryptor
+	// rndDataLenFunc replace the padding schedule of auth_chain_a, eg: auth_chain_b
+	rndDataLenFunc func(bufSize int, lastHash []byte, random *XorShift128Plus) int
 }
 
 func NewAuthChainA(method string) (Plain, error) {
+	return newAuthChain("auth_chain_a")
+}
+
+// newAuthChain create auth chain with the salt of method
+func newAuthChain(method string) (*AuthChainA, error) {
 	authBase, err := NewAuthBase(method)
 	if err != nil {
 		return nil, err
 	}
 	authBase.RawTrans = false
 	authBase.Overhead = 4
-	authBase.NoCompatibleMethod = "auth_chain_a"
+	authBase.NoCompatibleMethod = method
 	return &AuthChainA{
 		AuthBase:       authBase,
 		RecvBuf:        []byte{},
@@ -113,7 +127,7 @@ func NewAuthChainA(method string) (Plain, error) {
 		ClientID:       0,
 		ConnectionID:   0,
 		MaxTimeDif:     60 * 60 * 24,
-		Salt:           []byte("auth_chain_a"),
+		Salt:           []byte(method),
 		PackID:         1,
 		RecvID:         1,
 		UserIDNum:      0,
@@ -307,7 +321,7 @@ func (a *AuthChainA) ServerPostDecrypt(buf []byte) (result []byte, sendback bool
 			logrus.Errorf("%s data uncorrect auth HMAC-MD5 from %s:%v, data %s",
 				a.NoCompatibleMethod, a.GetServerInfo().
 					GetClient().String(),
-				a.GetServerInfo().GetPort(),
+				a.GetServerInfo().GetClientPort(),
 				hex.EncodeToString(a.RecvBuf))
 			if len(a.RecvBuf) < 36 {
 				return []byte{}, false, nil
@@ -339,7 +353,7 @@ func (a *AuthChainA) ServerPostDecrypt(buf []byte) (result []byte, sendback bool
 				hex.EncodeToString(head))
 			result, sendback = a.NotMatchReturn(a.RecvBuf)
 			return result, sendback, nil
-		} else if core.GetApp().GetObfsProtocolService().Insert(a.UserID, int(clientId), int(connectionId)) {
+		} else if core.GetApp().GetObfsProtocolService().Insert(a.UserID, a.GetServerInfo().GetPort(), int(clientId), int(connectionId)) {
 			a.HasRecvHeader = true
 			a.ClientID = int(clientId)
 			a.ConnectionID = int(connectionId)
@@ -410,7 +424,7 @@ func (a *AuthChainA) ServerPostDecrypt(buf []byte) (result []byte, sendback bool
 	}
 
 	if len(result) > 0 {
-		core.GetApp().GetObfsProtocolService().Update(a.UserID, a.ClientID, a.ConnectionID)
+		core.GetApp().GetObfsProtocolService().Update(a.UserID, a.GetServerInfo().GetPort(), a.ClientID, a.ConnectionID)
 	}
 	return result, sendback, nil
 }
@@ -553,7 +567,7 @@ func (a *AuthChainA) ServerUDPPostDecrypt(buf []byte) ([]byte, string, error) {
 }
 
 func (a *AuthChainA) Dispose() {
-	core.GetApp().GetObfsProtocolService().Remove(string(a.UserID), a.ClientID)
+	core.GetApp().GetObfsProtocolService().Remove(string(a.UserID), a.GetServerInfo().GetPort(), a.ClientID)
 }
 
 func (a *AuthChainA) trapezoidRandomFloat(d float64) float64 {
@@ -571,6 +585,9 @@ func (a *AuthChainA) trapezoidRandomInt(maxVal, d float64) int {
 }
 
 func (a *AuthChainA) rndDataLen(bufSize int, lastHash []byte, random *XorShift128Plus) int {
+	if a.rndDataLenFunc != nil {
+		return a.rndDataLenFunc(bufSize, lastHash, random)
+	}
 	if bufSize > 1440 {
 		return 0
 	}
@@ -706,3 +723,239 @@ func (a *AuthChainA) packAuthData(authData, buf []byte) (result []byte, err erro
 	}
 	return bytesx.ContactSlice(data, packClientData), nil
 }
+
+// randomDataSize generate a data size in [0, 1440) like python version
+func randomDataSize(random *XorShift128Plus) int {
+	return int(random.Next() % 2340 % 2040 % 1440)
+}
+
+/*----------------------------------AuthChainB----------------------------------*/
+type AuthChainB struct {
+	*AuthChainA
+	DataSizeList  []int
+	DataSizeList2 []int
+}
+
+func NewAuthChainB(method string) (Plain, error) {
+	authChainA, err := newAuthChain("auth_chain_b")
+	if err != nil {
+		return nil, err
+	}
+	b := &AuthChainB{AuthChainA: authChainA}
+	authChainA.rndDataLenFunc = b.rndDataLen
+	return b, nil
+}
+
+func (b *AuthChainB) SetServerInfo(s ServerInfo) {
+	b.AuthChainA.SetServerInfo(s)
+	b.initDataSize(s.GetKey())
+}
+
+func (b *AuthChainB) initDataSize(key []byte) {
+	random := NewXorShift128Plus()
+	random.InitFromBin(key)
+	listLen := int(random.Next()%8 + 4)
+	b.DataSizeList = make([]int, 0, listLen)
+	for i := 0; i < listLen; i++ {
+		b.DataSizeList = append(b.DataSizeList, randomDataSize(random))
+	}
+	sort.Ints(b.DataSizeList)
+	listLen = int(random.Next()%16 + 8)
+	b.DataSizeList2 = make([]int, 0, listLen)
+	for i := 0; i < listLen; i++ {
+		b.DataSizeList2 = append(b.DataSizeList2, randomDataSize(random))
+	}
+	sort.Ints(b.DataSizeList2)
+}
+
+func (b *AuthChainB) rndDataLen(bufSize int, lastHash []byte, random *XorShift128Plus) int {
+	if bufSize >= 1440 {
+		return 0
+	}
+	random.InitFromBinLen(lastHash, bufSize)
+	overhead := b.GetServerInfo().GetOverhead()
+	pos := sort.SearchInts(b.DataSizeList, bufSize+overhead)
+	finalPos := pos + int(random.Next()%uint64(len(b.DataSizeList)))
+	if finalPos < len(b.DataSizeList) {
+		return b.DataSizeList[finalPos] - bufSize - overhead
+	}
+
+	pos = sort.SearchInts(b.DataSizeList2, bufSize+overhead)
+	finalPos = pos + int(random.Next()%uint64(len(b.DataSizeList2)))
+	if finalPos < len(b.DataSizeList2) {
+		return b.DataSizeList2[finalPos] - bufSize - overhead
+	}
+	if finalPos < pos+len(b.DataSizeList2)-1 {
+		return 0
+	}
+
+	if bufSize > 1300 {
+		return int(random.Next() % 31)
+	}
+	if bufSize > 900 {
+		return int(random.Next() % 127)
+	}
+	if bufSize > 400 {
+		return int(random.Next() % 521)
+	}
+	return int(random.Next() % 1021)
+}
+
+/*----------------------------------AuthChainC----------------------------------*/
+type AuthChainC struct {
+	*AuthChainA
+	DataSizeList0 []int
+}
+
+func NewAuthChainC(method string) (Plain, error) {
+	return newAuthChainC("auth_chain_c")
+}
+
+func newAuthChainC(method string) (*AuthChainC, error) {
+	authChainA, err := newAuthChain(method)
+	if err != nil {
+		return nil, err
+	}
+	c := &AuthChainC{AuthChainA: authChainA}
+	authChainA.rndDataLenFunc = c.rndDataLen
+	return c, nil
+}
+
+func (c *AuthChainC) SetServerInfo(s ServerInfo) {
+	c.AuthChainA.SetServerInfo(s)
+	c.initDataSize(s.GetKey())
+}
+
+// initDataSize generate 12~35 data sizes
+func (c *AuthChainC) initDataSize(key []byte) {
+	random := NewXorShift128Plus()
+	random.InitFromBin(key)
+	listLen := int(random.Next()%(8+16) + (4 + 8))
+	c.DataSizeList0 = make([]int, 0, listLen)
+	for i := 0; i < listLen; i++ {
+		c.DataSizeList0 = append(c.DataSizeList0, randomDataSize(random))
+	}
+	sort.Ints(c.DataSizeList0)
+}
+
+// rndDataLen pad to a random data size which is not less than the data
+func (c *AuthChainC) rndDataLen(bufSize int, lastHash []byte, random *XorShift128Plus) int {
+	otherDataSize := bufSize + c.GetServerInfo().GetOverhead()
+	// no padding when data is larger than the biggest data size
+	if otherDataSize >= c.DataSizeList0[len(c.DataSizeList0)-1] {
+		return 0
+	}
+	random.InitFromBinLen(lastHash, bufSize)
+	pos := sort.SearchInts(c.DataSizeList0, otherDataSize)
+	finalPos := pos + int(random.Next()%uint64(len(c.DataSizeList0)-pos))
+	return c.DataSizeList0[finalPos] - otherDataSize
+}
+
+/*----------------------------------AuthChainD----------------------------------*/
+type AuthChainD struct {
+	*AuthChainC
+}
+
+func NewAuthChainD(method string) (Plain, error) {
+	return newAuthChainD("auth_chain_d")
+}
+
+func newAuthChainD(method string) (*AuthChainD, error) {
+	authChainC, err := newAuthChainC(method)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthChainD{AuthChainC: authChainC}, nil
+}
+
+func (d *AuthChainD) SetServerInfo(s ServerInfo) {
+	d.AuthChainA.SetServerInfo(s)
+	d.initDataSize(s.GetKey())
+}
+
+// initDataSize generate 12~35 data sizes like auth_chain_c, then append sizes until one of them is big enough
+func (d *AuthChainD) initDataSize(key []byte) {
+	random := NewXorShift128Plus()
+	random.InitFromBin(key)
+	listLen := int(random.Next()%(8+16) + (4 + 8))
+	d.DataSizeList0 = make([]int, 0, listLen)
+	for i := 0; i < listLen; i++ {
+		d.DataSizeList0 = append(d.DataSizeList0, randomDataSize(random))
+	}
+	sort.Ints(d.DataSizeList0)
+	// the biggest size at first, then the last appended size, at most 64 sizes
+	for d.DataSizeList0[len(d.DataSizeList0)-1] < 1300 && len(d.DataSizeList0) < 64 {
+		d.DataSizeList0 = append(d.DataSizeList0, randomDataSize(random))
+	}
+	if len(d.DataSizeList0) != listLen {
+		sort.Ints(d.DataSizeList0)
+	}
+}
+
+/*----------------------------------AuthChainE----------------------------------*/
+type AuthChainE struct {
+	*AuthChainD
+}
+
+func NewAuthChainE(method string) (Plain, error) {
+	return newAuthChainE("auth_chain_e")
+}
+
+func newAuthChainE(method string) (*AuthChainE, error) {
+	authChainD, err := newAuthChainD(method)
+	if err != nil {
+		return nil, err
+	}
+	e := &AuthChainE{AuthChainD: authChainD}
+	authChainD.AuthChainA.rndDataLenFunc = e.rndDataLen
+	return e, nil
+}
+
+// rndDataLen pad to the smallest data size which is not less than the data
+func (e *AuthChainE) rndDataLen(bufSize int, lastHash []byte, random *XorShift128Plus) int {
+	random.InitFromBinLen(lastHash, bufSize)
+	otherDataSize := bufSize + e.GetServerInfo().GetOverhead()
+	if otherDataSize >= e.DataSizeList0[len(e.DataSizeList0)-1] {
+		return 0
+	}
+	return e.DataSizeList0[sort.SearchInts(e.DataSizeList0, otherDataSize)] - otherDataSize
+}
+
+/*----------------------------------AuthChainF----------------------------------*/
+type AuthChainF struct {
+	*AuthChainE
+	// KeyChangeInterval is seconds after which data sizes are changed, it is the second
+	// part of protocol param, eg: 64#3600
+	KeyChangeInterval int64
+	now               func() time.Time
+}
+
+func NewAuthChainF(method string) (Plain, error) {
+	authChainE, err := newAuthChainE("auth_chain_f")
+	if err != nil {
+		return nil, err
+	}
+	return &AuthChainF{
+		AuthChainE:        authChainE,
+		KeyChangeInterval: 60 * 60 * 24,
+		now:               time.Now,
+	}, nil
+}
+
+func (f *AuthChainF) SetServerInfo(s ServerInfo) {
+	f.AuthChainA.SetServerInfo(s)
+	params := strings.Split(s.GetProtocolParam(), "#")
+	if len(params) > 1 {
+		if interval, err := strconv.ParseInt(params[1], 10, 64); err == nil && interval > 0 {
+			f.KeyChangeInterval = interval
+		}
+	}
+	// key is changed with time, so data sizes are different in every interval
+	keyChangeDatetimeKey := make([]byte, 8)
+	binary.BigEndian.PutUint64(keyChangeDatetimeKey, uint64(f.now().Unix()/f.KeyChangeInterval))
+	key := append([]byte{}, s.GetKey()...)
+	for i := 0; i < 8 && i < len(key); i++ {
+		key[i] ^= keyChangeDatetimeKey[i]
+	}
+	f.initDataSize(key)
+}
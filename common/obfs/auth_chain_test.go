@@ -5,9 +5,12 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"github.com/ProxyPanel/VNet-SSR/core"
 	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
 	"net"
+	"sort"
 	"testing"
+	"time"
 )
 
 func ExampleAuthChain() {
@@ -152,3 +155,170 @@ func GetAuth() Plain {
 	authChainA.SetServerInfo(serverInfo)
 	return authChainA
 }
+
+func newTestAuthChain(t *testing.T, method string) Plain {
+	plain, err := GetObfs(method)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverInfo := GetAuth().GetServerInfo()
+	serverInfo.SetProtocolParam("1024:killer")
+	plain.SetServerInfo(serverInfo)
+	return plain
+}
+
+func TestAuthChainDataSize(t *testing.T) {
+	b := newTestAuthChain(t, "auth_chain_b").(*AuthChainB)
+	if len(b.DataSizeList) < 4 || len(b.DataSizeList) > 11 || len(b.DataSizeList2) < 8 || len(b.DataSizeList2) > 23 {
+		t.Fatalf("auth_chain_b data size list length error: %v %v", b.DataSizeList, b.DataSizeList2)
+	}
+	c := newTestAuthChain(t, "auth_chain_c").(*AuthChainC)
+	if len(c.DataSizeList0) < 12 || len(c.DataSizeList0) > 35 {
+		t.Fatalf("auth_chain_c data size list length error: %v", c.DataSizeList0)
+	}
+	d := newTestAuthChain(t, "auth_chain_d").(*AuthChainD)
+	last := d.DataSizeList0[len(d.DataSizeList0)-1]
+	if last < 1300 && len(d.DataSizeList0) != 64 {
+		t.Fatalf("auth_chain_d data size list should be patched: %v", d.DataSizeList0)
+	}
+	for _, list := range [][]int{b.DataSizeList, b.DataSizeList2, c.DataSizeList0, d.DataSizeList0} {
+		if !sort.IntsAreSorted(list) || list[0] < 0 || list[len(list)-1] >= 1440 {
+			t.Fatalf("data size list error: %v", list)
+		}
+	}
+
+	// auth_chain_e always pad to the smallest data size
+	e := newTestAuthChain(t, "auth_chain_e").(*AuthChainE)
+	overhead := e.GetServerInfo().GetOverhead()
+	for bufSize := 0; bufSize < 1440; bufSize++ {
+		randLen := e.rndDataLen(bufSize, MustHexDecode("1c61777508c444705f7ec9092de53b7e"), NewXorShift128Plus())
+		size := bufSize + overhead + randLen
+		if randLen == 0 {
+			continue
+		}
+		pos := sort.SearchInts(e.DataSizeList0, bufSize+overhead)
+		if e.DataSizeList0[pos] != size {
+			t.Fatalf("auth_chain_e buf size %v should be padded to %v, got %v", bufSize, e.DataSizeList0[pos], size)
+		}
+	}
+
+	// auth_chain_f change data sizes with time
+	f := newTestAuthChain(t, "auth_chain_f").(*AuthChainF)
+	f.now = func() time.Time { return time.Unix(3600, 0) }
+	f.GetServerInfo().SetProtocolParam("1024:killer#3600")
+	f.SetServerInfo(f.GetServerInfo())
+	before := append([]int{}, f.DataSizeList0...)
+	f.now = func() time.Time { return time.Unix(3600*2-1, 0) }
+	f.SetServerInfo(f.GetServerInfo())
+	if f.KeyChangeInterval != 3600 || fmt.Sprint(before) != fmt.Sprint(f.DataSizeList0) {
+		t.Fatal("auth_chain_f data sizes should not change in an interval")
+	}
+	f.now = func() time.Time { return time.Unix(3600*2, 0) }
+	f.SetServerInfo(f.GetServerInfo())
+	if fmt.Sprint(before) == fmt.Sprint(f.DataSizeList0) {
+		t.Fatal("auth_chain_f data sizes should change after interval")
+	}
+}
+
+// TestAuthChainDDataSizeVector check data sizes against the init_data_size of the python reference
+// auth_chain_d, the second key needs sizes appended until one of them reaches 1300
+func TestAuthChainDDataSizeVector(t *testing.T) {
+	vectors := []struct {
+		key   string
+		sizes []int
+	}{
+		{"01010101010101010101010101010101", []int{30, 31, 34, 46, 87, 140, 163, 171, 192, 339, 398, 402, 504, 548, 802,
+			805, 845, 943, 1047, 1061, 1097, 1197, 1199, 1238, 1242, 1307, 1349, 1379, 1394}},
+		{"005a005a005a005a005a005a005a005a", []int{17, 25, 35, 50, 63, 94, 111, 134, 136, 137, 143, 155, 161, 179, 242,
+			293, 323, 324, 393, 413, 422, 422, 431, 436, 458, 524, 563, 565, 575, 590, 596, 619, 623, 628, 663, 703, 704,
+			704, 739, 815, 885, 980, 1054, 1067, 1077, 1152, 1162, 1239, 1256, 1280, 1426}},
+	}
+	d := newTestAuthChain(t, "auth_chain_d").(*AuthChainD)
+	for _, vector := range vectors {
+		d.initDataSize(MustHexDecode(vector.key))
+		if fmt.Sprint(d.DataSizeList0) != fmt.Sprint(vector.sizes) {
+			t.Fatalf("auth_chain_d data sizes of key %s error, want %v got %v", vector.key, vector.sizes, d.DataSizeList0)
+		}
+	}
+}
+
+func TestAuthChainTCP(t *testing.T) {
+	for _, method := range []string{"auth_chain_a", "auth_chain_b", "auth_chain_c", "auth_chain_d", "auth_chain_e", "auth_chain_f"} {
+		t.Run(method, func(t *testing.T) {
+			core.GetApp().SetObfsProtocolService(NewObfsAuthChainData(method))
+			client := newTestAuthChain(t, method)
+			server := newTestAuthChain(t, method)
+			for _, size := range []int{5, 100, 1000, 1400, 3000} {
+				data := bytes.Repeat([]byte{byte(size)}, size)
+				ciphertext, err := client.ClientPreEncrypt(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				result, _, err := server.ServerPostDecrypt(ciphertext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, result) {
+					t.Fatalf("server decrypt %v bytes error", size)
+				}
+
+				ciphertext, err = server.ServerPreEncrypt(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				result, err = client.ClientPostDecrypt(ciphertext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, result) {
+					t.Fatalf("client decrypt %v bytes error", size)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthChainUDP(t *testing.T) {
+	for _, method := range []string{"auth_chain_b", "auth_chain_c", "auth_chain_d", "auth_chain_e", "auth_chain_f"} {
+		t.Run(method, func(t *testing.T) {
+			client := newTestAuthChain(t, method)
+			server := newTestAuthChain(t, method)
+			result, err := client.ClientUDPPreEncrypt([]byte("hello"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, uid, err := server.ServerUDPPostDecrypt(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(result) != "hello" || binaryx.LEBytesToUInt32([]byte(uid)) != 1024 {
+				t.Fatalf("server udp decrypt error: %s %v", result, binaryx.LEBytesToUInt32([]byte(uid)))
+			}
+			result, err = server.ServerUDPPreEncrypt([]byte("world"), []byte(uid))
+			if err != nil {
+				t.Fatal(err)
+			}
+			result, err = client.ClientUDPPostDecrypt(result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(result) != "world" {
+				t.Fatalf("client udp decrypt error: %s", result)
+			}
+		})
+	}
+}
+
+func TestAuthChainMismatch(t *testing.T) {
+	core.GetApp().SetObfsProtocolService(NewObfsAuthChainData("auth_chain_c"))
+	client := newTestAuthChain(t, "auth_chain_b")
+	server := newTestAuthChain(t, "auth_chain_c")
+	ciphertext, err := client.ClientPreEncrypt([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, _, _ := server.ServerPostDecrypt(ciphertext)
+	if bytes.Equal(result, []byte("hello")) {
+		t.Fatal("auth_chain_c should not decrypt auth_chain_b")
+	}
+}
@@ -0,0 +1,278 @@
+package obfs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/adler32"
+	"hash/crc32"
+	"math"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
+	"github.com/ProxyPanel/VNet-SSR/utils/bytesx"
+	"github.com/ProxyPanel/VNet-SSR/utils/randomx"
+	"github.com/pkg/errors"
+)
+
+// authSha1V4UserID is the key of clients in the protocol service, auth_sha1_v4 does not carry user
+var authSha1V4UserID = make([]byte, 4)
+
+func init() {
+	registerMethod("auth_sha1_v4", NewAuthSha1V4)
+	registerMethod("auth_sha1_v4_compatible", NewAuthSha1V4)
+}
+
+/*----------------------------------AuthSha1V4----------------------------------*/
+// AuthSha1V4 is the legacy protocol of old clients, auth_sha1_v4_compatible falls back
+// to origin when the client is not authenticated
+type AuthSha1V4 struct {
+	*AuthBase
+	RecvBuf          []byte
+	UnitLen          int
+	DecryptPacketNum int
+	HasSentHeader    bool
+	HasRecvHeader    bool
+	ClientID         int
+	ConnectionID     int
+	MaxTimeDif       int
+	now              func() time.Time
+}
+
+func NewAuthSha1V4(method string) (Plain, error) {
+	authBase, err := NewAuthBase(method)
+	if err != nil {
+		return nil, err
+	}
+	authBase.NoCompatibleMethod = "auth_sha1_v4"
+	authBase.Overhead = 7
+	return &AuthSha1V4{
+		AuthBase:   authBase,
+		RecvBuf:    []byte{},
+		UnitLen:    8100,
+		MaxTimeDif: 60 * 60 * 24,
+		now:        time.Now,
+	}, nil
+}
+
+func (a *AuthSha1V4) SetServerInfo(s ServerInfo) {
+	a.AuthBase.SetServerInfo(s)
+}
+
+func (a *AuthSha1V4) rndData(bufSize int) []byte {
+	if bufSize > 1200 {
+		return []byte{0x01}
+	}
+	var rndData []byte
+	if bufSize > 400 {
+		rndData = randomx.RandomBytes(int(randomx.Uint8()))
+	} else {
+		rndData = randomx.RandomBytes(int(randomx.Uint16() % 512))
+	}
+	if len(rndData) < 128 {
+		return bytesx.ContactSlice([]byte{byte(len(rndData) + 1)}, rndData)
+	}
+	return bytesx.ContactSlice([]byte{255}, beUint16ToBytes(uint16(len(rndData)+3)), rndData)
+}
+
+func beUint16ToBytes(data uint16) []byte {
+	result := make([]byte, 2)
+	binary.BigEndian.PutUint16(result, data)
+	return result
+}
+
+func (a *AuthSha1V4) packData(buf []byte) []byte {
+	data := bytesx.ContactSlice(a.rndData(len(buf)), buf)
+	dataLen := len(data) + 8
+	crc := crc32.ChecksumIEEE(beUint16ToBytes(uint16(dataLen))) & 0xFFFF
+	data = bytesx.ContactSlice(beUint16ToBytes(uint16(dataLen)), binaryx.LEUInt16ToBytes(uint16(crc)), data)
+	return bytesx.ContactSlice(data, binaryx.LEUint32ToBytes(adler32.Checksum(data)))
+}
+
+func (a *AuthSha1V4) packAuthData(buf []byte) []byte {
+	if len(buf) == 0 {
+		return []byte{}
+	}
+	data := bytesx.ContactSlice(a.rndData(len(buf)), buf)
+	dataLen := len(data) + 16
+	crc := crc32.ChecksumIEEE(bytesx.ContactSlice(beUint16ToBytes(uint16(dataLen)), a.GetServerInfo().GetKey()))
+	data = bytesx.ContactSlice(beUint16ToBytes(uint16(dataLen)), binaryx.LEUint32ToBytes(crc), data)
+	macKey := bytesx.ContactSlice(a.GetServerInfo().GetIv(), a.GetServerInfo().GetKey())
+	return bytesx.ContactSlice(data, hmacSum(macKey, data, sha1.New)[:10])
+}
+
+func (a *AuthSha1V4) ClientPreEncrypt(buf []byte) ([]byte, error) {
+	result := []byte{}
+	if !a.HasSentHeader {
+		headSize := a.GetHeadSize(buf, 30)
+		dataLen := int(math.Min(float64(len(buf)), float64(randomx.RandIntRange(0, 31)+headSize)))
+		result = bytesx.ContactSlice(result, a.packAuthData(bytesx.ContactSlice(core.GetApp().GetObfsProtocolService().AuthData(), buf[:dataLen])))
+		buf = buf[dataLen:]
+		a.HasSentHeader = true
+	}
+	for len(buf) > a.UnitLen {
+		result = bytesx.ContactSlice(result, a.packData(buf[:a.UnitLen]))
+		buf = buf[a.UnitLen:]
+	}
+	return bytesx.ContactSlice(result, a.packData(buf)), nil
+}
+
+// unpackData read data frames from RecvBuf, it return the payload of frames and whether
+// a frame without payload is received
+func (a *AuthSha1V4) unpackData() (result []byte, empty bool, err error) {
+	result = []byte{}
+	for len(a.RecvBuf) > 4 {
+		crc := crc32.ChecksumIEEE(a.RecvBuf[:2]) & 0xFFFF
+		if !bytes.Equal(binaryx.LEUInt16ToBytes(uint16(crc)), a.RecvBuf[2:4]) {
+			a.RawTrans = true
+			a.RecvBuf = []byte{}
+			return nil, false, errors.New("auth_sha1_v4 data uncorrect crc")
+		}
+		length := int(binary.BigEndian.Uint16(a.RecvBuf[:2]))
+		if length >= 8192 || length < 7 {
+			a.RawTrans = true
+			a.RecvBuf = []byte{}
+			return nil, false, errors.New("auth_sha1_v4 data error")
+		}
+		if length > len(a.RecvBuf) {
+			break
+		}
+		if !bytes.Equal(binaryx.LEUint32ToBytes(adler32.Checksum(a.RecvBuf[:length-4])), a.RecvBuf[length-4:length]) {
+			log.Info("auth_sha1_v4: checksum error, data %s", hex.EncodeToString(a.RecvBuf[:length]))
+			a.RawTrans = true
+			a.RecvBuf = []byte{}
+			return nil, false, errors.New("auth_sha1_v4 data uncorrect checksum")
+		}
+		pos := int(a.RecvBuf[4])
+		if pos < 255 {
+			pos += 4
+		} else {
+			pos = int(binary.BigEndian.Uint16(a.RecvBuf[5:7])) + 4
+		}
+		if pos > length-4 {
+			a.RawTrans = true
+			a.RecvBuf = []byte{}
+			return nil, false, errors.New("auth_sha1_v4 data error")
+		}
+		result = bytesx.ContactSlice(result, a.RecvBuf[pos:length-4])
+		if pos == length-4 {
+			empty = true
+		}
+		a.RecvBuf = a.RecvBuf[length:]
+	}
+	return result, empty, nil
+}
+
+func (a *AuthSha1V4) ClientPostDecrypt(buf []byte) ([]byte, error) {
+	if a.RawTrans {
+		return buf, nil
+	}
+	a.RecvBuf = bytesx.ContactSlice(a.RecvBuf, buf)
+	result, _, err := a.unpackData()
+	if err != nil {
+		return nil, err
+	}
+	if len(result) > 0 {
+		a.DecryptPacketNum++
+	}
+	return result, nil
+}
+
+func (a *AuthSha1V4) ServerPreEncrypt(buf []byte) ([]byte, error) {
+	if a.RawTrans {
+		return buf, nil
+	}
+	result := []byte{}
+	for len(buf) > a.UnitLen {
+		result = bytesx.ContactSlice(result, a.packData(buf[:a.UnitLen]))
+		buf = buf[a.UnitLen:]
+	}
+	return bytesx.ContactSlice(result, a.packData(buf)), nil
+}
+
+func (a *AuthSha1V4) ServerPostDecrypt(buf []byte) ([]byte, bool, error) {
+	if a.RawTrans {
+		return buf, false, nil
+	}
+	a.RecvBuf = bytesx.ContactSlice(a.RecvBuf, buf)
+	result := []byte{}
+	sendback := false
+
+	if !a.HasRecvHeader {
+		if len(a.RecvBuf) <= 6 {
+			return []byte{}, false, nil
+		}
+		crc := crc32.ChecksumIEEE(bytesx.ContactSlice(a.RecvBuf[:2], a.GetServerInfo().GetKey()))
+		if !bytes.Equal(binaryx.LEUint32ToBytes(crc), a.RecvBuf[2:6]) {
+			result, sendback = a.NotMatchReturn(a.RecvBuf)
+			return result, sendback, nil
+		}
+		length := int(binary.BigEndian.Uint16(a.RecvBuf[:2]))
+		if length > len(a.RecvBuf) {
+			return []byte{}, false, nil
+		}
+		macKey := bytesx.ContactSlice(a.GetServerInfo().GetRecvIv(), a.GetServerInfo().GetKey())
+		if length < 16 || !bytes.Equal(hmacSum(macKey, a.RecvBuf[:length-10], sha1.New)[:10], a.RecvBuf[length-10:length]) {
+			log.Error("auth_sha1_v4 data uncorrect auth HMAC-SHA1")
+			result, sendback = a.NotMatchReturn(a.RecvBuf)
+			return result, sendback, nil
+		}
+		pos := int(a.RecvBuf[6])
+		if pos < 255 {
+			pos += 6
+		} else {
+			pos = int(binary.BigEndian.Uint16(a.RecvBuf[7:9])) + 6
+		}
+		if pos+12 > length-10 {
+			log.Info("auth_sha1_v4: too short, data %s", hex.EncodeToString(a.RecvBuf))
+			result, sendback = a.NotMatchReturn(a.RecvBuf)
+			return result, sendback, nil
+		}
+		head := a.RecvBuf[pos : length-10]
+		utcTime := binaryx.LEBytesToUInt32(head[:4])
+		clientID := binaryx.LEBytesToUInt32(head[4:8])
+		connectionID := binaryx.LEBytesToUInt32(head[8:12])
+		timeDif := int(int32(utcTime - uint32(a.now().Unix()&0xFFFFFFFF)))
+		if timeDif < -a.MaxTimeDif || timeDif > a.MaxTimeDif {
+			log.Info("auth_sha1_v4: wrong timestamp, time_dif %v, data %s", timeDif, hex.EncodeToString(head))
+			result, sendback = a.NotMatchReturn(a.RecvBuf)
+			return result, sendback, nil
+		}
+		if !core.GetApp().GetObfsProtocolService().Insert(authSha1V4UserID, a.GetServerInfo().GetPort(), int(clientID), int(connectionID)) {
+			log.Info("auth_sha1_v4: auth fail, data %s", hex.EncodeToString(head))
+			result, sendback = a.NotMatchReturn(a.RecvBuf)
+			return result, sendback, nil
+		}
+		a.ClientID = int(clientID)
+		a.ConnectionID = int(connectionID)
+		result = bytesx.ContactSlice(result, head[12:])
+		a.RecvBuf = a.RecvBuf[length:]
+		a.HasRecvHeader = true
+		sendback = true
+	}
+
+	data, empty, err := a.unpackData()
+	if err != nil {
+		if a.DecryptPacketNum == 0 {
+			log.Info("auth_sha1_v4: %s", err.Error())
+			return bytes.Repeat([]byte{'E'}, 2048), false, nil
+		}
+		return nil, false, errors.WithStack(err)
+	}
+	result = bytesx.ContactSlice(result, data)
+	if empty {
+		sendback = true
+	}
+	if len(result) > 0 {
+		core.GetApp().GetObfsProtocolService().Update(authSha1V4UserID, a.GetServerInfo().GetPort(), a.ClientID, a.ConnectionID)
+		a.DecryptPacketNum++
+	}
+	return result, sendback, nil
+}
+
+func (a *AuthSha1V4) Dispose() {
+	core.GetApp().GetObfsProtocolService().Remove(string(authSha1V4UserID), a.GetServerInfo().GetPort(), a.ClientID)
+}
@@ -0,0 +1,93 @@
+package obfs
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/core"
+)
+
+func newTestAuthSha1V4(t *testing.T, method string) *AuthSha1V4 {
+	core.GetApp().SetObfsProtocolService(NewObfsAuthChainData(method))
+	core.GetApp().GetObfsProtocolService().SetMaxClient(64)
+	a := newTestAuthChain(t, method).(*AuthSha1V4)
+	a.now = func() time.Time { return time.Unix(1600000000, 0) }
+	return a
+}
+
+func TestAuthSha1V4ServerDecrypt(t *testing.T) {
+	server := newTestAuthSha1V4(t, "auth_sha1_v4")
+	// header and a data frame packed by the python implementation at utc 1600000000
+	header := MustHexDecode("002b1e0bae6403aabb00105e5f4433221107000000017f0000010050474554202fbf99949f5db6608672ce")
+	frame := MustHexDecode("0012b7630120485454502f312e314d03e718")
+
+	result, sendback, err := server.ServerPostDecrypt(header[:10])
+	if err != nil || len(result) != 0 {
+		t.Fatalf("partial header should wait, got %v %v", result, err)
+	}
+	result, sendback, err = server.ServerPostDecrypt(bytes.Join([][]byte{header[10:], frame}, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := bytes.Join([][]byte{MustHexDecode("017f0000010050"), []byte("GET / HTTP/1.1")}, nil)
+	if !bytes.Equal(result, expected) || !sendback {
+		t.Fatalf("expected %x, got %x", expected, result)
+	}
+	if server.ClientID != 0x11223344 || server.ConnectionID != 7 {
+		t.Fatalf("wrong client %x connection %v", server.ClientID, server.ConnectionID)
+	}
+}
+
+func TestAuthSha1V4TCP(t *testing.T) {
+	for _, size := range []int{5, 100, 1000, 1400, 9000} {
+		client := newTestAuthSha1V4(t, "auth_sha1_v4")
+		server := newTestAuthSha1V4(t, "auth_sha1_v4")
+		client.now = time.Now
+		server.now = time.Now
+		plaintext := bytes.Join([][]byte{MustHexDecode("017f0000010050"), bytes.Repeat([]byte{'a'}, size)}, nil)
+		ciphertext, err := client.ClientPreEncrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, _, err := server.ServerPostDecrypt(ciphertext)
+		if err != nil || !bytes.Equal(result, plaintext) {
+			t.Fatalf("size %v server decrypt error: %v", size, err)
+		}
+		ciphertext, err = server.ServerPreEncrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err = client.ClientPostDecrypt(ciphertext)
+		if err != nil || !bytes.Equal(result, plaintext) {
+			t.Fatalf("size %v client decrypt error: %v", size, err)
+		}
+	}
+}
+
+func TestAuthSha1V4Compatible(t *testing.T) {
+	plaintext := bytes.Join([][]byte{MustHexDecode("017f0000010050"), []byte("GET / HTTP/1.1")}, nil)
+
+	compatible := newTestAuthSha1V4(t, "auth_sha1_v4_compatible")
+	result, _, err := compatible.ServerPostDecrypt(plaintext)
+	if err != nil || !bytes.Equal(result, plaintext) {
+		t.Fatalf("auth_sha1_v4_compatible should fall back to origin, got %x %v", result, err)
+	}
+	if result, _, _ = compatible.ServerPostDecrypt([]byte("next")); !bytes.Equal(result, []byte("next")) {
+		t.Fatal("auth_sha1_v4_compatible should keep raw after fall back")
+	}
+
+	strict := newTestAuthSha1V4(t, "auth_sha1_v4")
+	result, _, _ = strict.ServerPostDecrypt(plaintext)
+	if !bytes.Equal(result, bytes.Repeat([]byte{'E'}, 2048)) {
+		t.Fatalf("auth_sha1_v4 should reject origin, got %x", result)
+	}
+
+	// header out of time
+	expired := newTestAuthSha1V4(t, "auth_sha1_v4")
+	expired.now = func() time.Time { return time.Unix(1600000000+2*86400, 0) }
+	header := MustHexDecode("002b1e0bae6403aabb00105e5f4433221107000000017f0000010050474554202fbf99949f5db6608672ce")
+	if result, _, _ = expired.ServerPostDecrypt(header); !bytes.Equal(result, bytes.Repeat([]byte{'E'}, 2048)) {
+		t.Fatalf("expired header should be rejected, got %x", result)
+	}
+}
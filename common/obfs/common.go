@@ -12,10 +12,10 @@ import (
 	"github.com/ProxyPanel/VNet-SSR/utils/randomx"
 	"hash"
 	"math"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/ProxyPanel/VNet-SSR/common/cache"
 	"github.com/ProxyPanel/VNet-SSR/common/log"
 )
 
@@ -191,92 +191,215 @@ func (c *ClientQueue) Insert(connectionID int) bool {
 
 /* ---------------------------- ObfsAuthChainData ---------------------------- */
 
+// clientTTL is how long a client without connections is remembered
+const clientTTL = 60 * time.Second
+
+// Device is a client of a user seen by the auth protocols, port is zero unless clients are counted per port
+type Device struct {
+	UID         int       `json:"uid"`
+	Port        int       `json:"port"`
+	ClientID    int       `json:"client_id"`
+	Connections int       `json:"connections"`
+	LastUpdate  time.Time `json:"last_update"`
+	Active      bool      `json:"active"`
+}
+
+type deviceScope struct {
+	userID string
+	port   int
+}
+
+// ObfsAuthChainData track clients of users for the auth protocols, it is shared by all connections.
+// a user can have MaxClient clients unless the user has its own limit, clients are counted
+// per port when per port is set
 type ObfsAuthChainData struct {
+	sync.Mutex
 	Name          string
-	UserID        map[string]*cache.LRU
 	LocalClientId []byte
 	ConnectionID  int
 	MaxClient     int
 	MaxBuffer     int
+	perPort       bool
+	clients       map[deviceScope]map[int]*ClientQueue
+	userMaxClient map[int]int
 }
 
 func NewObfsAuthChainData(name string) *ObfsAuthChainData {
 	result := &ObfsAuthChainData{
 		Name:          name,
-		UserID:        make(map[string]*cache.LRU),
 		LocalClientId: []byte{},
 		ConnectionID:  0,
+		clients:       make(map[deviceScope]map[int]*ClientQueue),
+		userMaxClient: make(map[int]int),
 	}
 	result.SetMaxClient(64)
 	return result
 }
 
-func (o *ObfsAuthChainData) Update(userID []byte, clientID, connectionID int) {
-	if o.UserID[string(userID)] == nil {
-		o.UserID[string(userID)] = cache.NewLruCache(60 * time.Second)
-	}
-	localClientID := o.UserID[string(userID)]
-	var r *ClientQueue = nil
-	if localClientID != nil {
-		r, _ = localClientID.Get(clientID).(*ClientQueue)
+func (o *ObfsAuthChainData) scope(userID []byte, port int) deviceScope {
+	if !o.perPort {
+		port = 0
 	}
-	if r != nil {
+	return deviceScope{userID: string(userID), port: port}
+}
+
+func (o *ObfsAuthChainData) Update(userID []byte, port, clientID, connectionID int) {
+	o.Lock()
+	defer o.Unlock()
+	if r := o.clients[o.scope(userID, port)][clientID]; r != nil {
 		r.Update()
 	}
 }
 
 func (o *ObfsAuthChainData) SetMaxClient(maxClient int) {
+	o.Lock()
+	defer o.Unlock()
 	o.MaxClient = maxClient
 	o.MaxBuffer = int(math.Max(float64(maxClient), 1024))
 }
 
-func (o *ObfsAuthChainData) Insert(userID []byte, clientID, connectionID int) bool {
-	if o.UserID[string(userID)] == nil {
-		o.UserID[string(userID)] = cache.NewLruCache(60 * time.Second)
+// SetName set the protocol which clients are tracked for, clients and limits are kept
+func (o *ObfsAuthChainData) SetName(name string) {
+	o.Lock()
+	defer o.Unlock()
+	o.Name = name
+}
+
+// SetUserMaxClient set the max client of user, zero means MaxClient
+func (o *ObfsAuthChainData) SetUserMaxClient(uid, maxClient int) {
+	o.Lock()
+	defer o.Unlock()
+	if maxClient == 0 {
+		delete(o.userMaxClient, uid)
+		return
 	}
-	localClientID := o.UserID[string(userID)]
-	var r, _ = localClientID.Get(clientID).(*ClientQueue)
-	if r == nil || !r.Enable {
-		if localClientID.First() == nil || localClientID.Len() < o.MaxClient {
-			log.Info("new client: %d, user: %d", clientID, binaryx.LEBytesToUInt32(userID))
-			if !localClientID.IsExist(clientID) {
-				// TODO check
-				localClientID.Put(clientID, NewClientQueue(connectionID))
-			} else {
-				localClientID.Get(clientID).(*ClientQueue).ReEnable(connectionID)
-			}
-			return localClientID.Get(clientID).(*ClientQueue).Insert(connectionID)
+	o.userMaxClient[uid] = maxClient
+}
+
+// SetPerPort set whether clients of a user are counted per port, clients are forgotten when it is changed
+func (o *ObfsAuthChainData) SetPerPort(perPort bool) {
+	o.Lock()
+	defer o.Unlock()
+	if o.perPort != perPort {
+		o.perPort = perPort
+		o.clients = make(map[deviceScope]map[int]*ClientQueue)
+	}
+}
+
+func (o *ObfsAuthChainData) maxClient(userID []byte) int {
+	if len(userID) == 4 {
+		if maxClient, ok := o.userMaxClient[int(binaryx.LEBytesToUInt32(userID))]; ok {
+			return maxClient
 		}
+	}
+	return o.MaxClient
+}
 
-		localClientIDFirst := localClientID.First()
-		if localClientIDFirst != nil && !localClientID.Get(localClientIDFirst).(*ClientQueue).IsActive() {
-			localClientID.Delete(localClientIDFirst)
-			if !localClientID.IsExist(clientID) {
-				// TODO check
-				localClientID.Put(clientID, NewClientQueue(connectionID))
-			} else {
-				localClientID.Get(clientID).(*ClientQueue).ReEnable(connectionID)
+func (o *ObfsAuthChainData) Insert(userID []byte, port, clientID, connectionID int) bool {
+	o.Lock()
+	defer o.Unlock()
+	key := o.scope(userID, port)
+	clients := o.clients[key]
+	if clients == nil {
+		clients = make(map[int]*ClientQueue)
+		o.clients[key] = clients
+	}
+	for id, r := range clients {
+		if r.Ref == 0 && time.Since(r.LastUpdate) > clientTTL {
+			delete(clients, id)
+		}
+	}
+	if r := clients[clientID]; r != nil && r.Enable {
+		return r.Insert(connectionID)
+	}
+	if len(clients) >= o.maxClient(userID) {
+		// the client which has been inactive for the longest time gives way to the new one
+		inactive := -1
+		for id, r := range clients {
+			if id != clientID && !r.IsActive() && (inactive == -1 || r.LastUpdate.Before(clients[inactive].LastUpdate)) {
+				inactive = id
 			}
-			return localClientID.Get(clientID).(*ClientQueue).Insert(connectionID)
 		}
-
-		log.Warn("uid: %d, clientId: %d - %s: no inactive client", binaryx.LEBytesToUInt32(userID), clientID, o.Name)
-		return false
+		if inactive == -1 {
+			log.Warn("uid: %d, clientId: %d - %s: no inactive client", binaryx.LEBytesToUInt32(userID), clientID, o.Name)
+			return false
+		}
+		delete(clients, inactive)
+	}
+	log.Info("new client: %d, user: %d", clientID, binaryx.LEBytesToUInt32(userID))
+	if r := clients[clientID]; r != nil {
+		r.ReEnable(connectionID)
 	} else {
-		return localClientID.Get(clientID).(*ClientQueue).Insert(connectionID)
+		clients[clientID] = NewClientQueue(connectionID)
+	}
+	return clients[clientID].Insert(connectionID)
+}
+
+func (o *ObfsAuthChainData) Remove(userID string, port, clientID int) {
+	o.Lock()
+	defer o.Unlock()
+	if r := o.clients[o.scope([]byte(userID), port)][clientID]; r != nil {
+		r.DelRef()
+		r.Update()
 	}
 }
 
-func (o *ObfsAuthChainData) Remove(userID string, clientID int) {
-	localClientID := o.UserID[string(userID)]
-	if localClientID != nil {
-		if localClientID.IsExist(clientID) {
-			localClientID.Get(clientID).(*ClientQueue).DelRef()
+// Devices return clients of uid which are remembered, all users when uid is negative
+func (o *ObfsAuthChainData) Devices(uid int) []*Device {
+	o.Lock()
+	defer o.Unlock()
+	result := make([]*Device, 0)
+	for key, clients := range o.clients {
+		if len(key.userID) != 4 {
+			continue
+		}
+		owner := int(binaryx.LEBytesToUInt32([]byte(key.userID)))
+		if uid >= 0 && owner != uid {
+			continue
+		}
+		for id, r := range clients {
+			result = append(result, &Device{
+				UID:         owner,
+				Port:        key.port,
+				ClientID:    id,
+				Connections: r.Ref,
+				LastUpdate:  r.LastUpdate,
+				Active:      r.IsActive(),
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Port != result[j].Port {
+			return result[i].Port < result[j].Port
+		}
+		return result[i].ClientID < result[j].ClientID
+	})
+	return result
+}
+
+// Evict forget client of uid on all ports, so another client can take its place.
+// connections of the client are not closed, it return whether the client is found
+func (o *ObfsAuthChainData) Evict(uid, clientID int) bool {
+	o.Lock()
+	defer o.Unlock()
+	userID := string(binaryx.LEUint32ToBytes(uint32(uid)))
+	found := false
+	for key, clients := range o.clients {
+		if key.userID != userID {
+			continue
+		}
+		if r := clients[clientID]; r != nil {
+			r.Enable = false
+			delete(clients, clientID)
+			found = true
 		}
 	}
+	return found
 }
 
 func (o *ObfsAuthChainData) AuthData() []byte {
+	o.Lock()
+	defer o.Unlock()
 	utcTime := uint32(time.Now().Unix() & 0xFFFFFFFF)
 	if o.ConnectionID > 0xFF000000 {
 		o.LocalClientId = []byte{}
@@ -295,17 +418,25 @@ func (o *ObfsAuthChainData) AuthData() []byte {
 }
 
 func (o *ObfsAuthChainData) GetConnectionID() int {
+	o.Lock()
+	defer o.Unlock()
 	return o.ConnectionID
 }
 
 func (o *ObfsAuthChainData) SetConnectionID(connectionID int) {
+	o.Lock()
+	defer o.Unlock()
 	o.ConnectionID = connectionID
 }
 
 func (o *ObfsAuthChainData) SetClientID(clientID []byte) {
+	o.Lock()
+	defer o.Unlock()
 	o.LocalClientId = clientID
 }
 
 func (o *ObfsAuthChainData) GetClientID() []byte {
+	o.Lock()
+	defer o.Unlock()
 	return o.LocalClientId
 }
@@ -0,0 +1,111 @@
+package obfs
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
+)
+
+func TestObfsAuthChainDataLimit(t *testing.T) {
+	o := NewObfsAuthChainData("auth_chain_a")
+	o.SetMaxClient(2)
+	user := binaryx.LEUint32ToBytes(10001)
+	if !o.Insert(user, 443, 1, 100) || !o.Insert(user, 443, 2, 100) {
+		t.Fatal("clients under the limit should be accepted")
+	}
+	if o.Insert(user, 443, 3, 100) {
+		t.Fatal("client over the limit should be rejected")
+	}
+	if !o.Insert(user, 443, 1, 101) {
+		t.Fatal("new connection of a known client should be accepted")
+	}
+	if o.Insert(user, 443, 1, 101) {
+		t.Fatal("replayed connection id should be rejected")
+	}
+
+	// a client without connections gives way to a new one
+	o.Remove(string(user), 443, 2)
+	if !o.Insert(user, 443, 3, 100) {
+		t.Fatal("inactive client should give way to a new client")
+	}
+	devices := o.Devices(10001)
+	if len(devices) != 2 || devices[0].ClientID != 1 || devices[0].Connections != 2 || devices[1].ClientID != 3 {
+		t.Fatalf("devices are wrong: %+v", devices)
+	}
+
+	// user limit overrides node limit
+	o.SetUserMaxClient(10001, 3)
+	if !o.Insert(user, 443, 4, 100) {
+		t.Fatal("user limit should override node limit")
+	}
+	o.SetUserMaxClient(10001, 0)
+	if o.Insert(user, 443, 5, 100) {
+		t.Fatal("node limit should be used after user limit is cleared")
+	}
+
+	if !o.Evict(10001, 4) || o.Evict(10001, 4) {
+		t.Fatal("evict should forget the client once")
+	}
+	if o.Insert(user, 443, 5, 100) {
+		t.Fatal("active clients should still count after another is evicted")
+	}
+	if !o.Evict(10001, 3) || !o.Insert(user, 443, 5, 100) {
+		t.Fatal("evicted client should give way to a new client")
+	}
+	if len(o.Devices(10002)) != 0 || len(o.Devices(-1)) != 2 {
+		t.Fatal("devices should be filtered by uid")
+	}
+}
+
+func TestObfsAuthChainDataPerPort(t *testing.T) {
+	o := NewObfsAuthChainData("auth_chain_a")
+	o.SetMaxClient(1)
+	user := binaryx.LEUint32ToBytes(10001)
+	if !o.Insert(user, 443, 1, 100) || o.Insert(user, 8443, 2, 100) {
+		t.Fatal("clients should be counted per node by default")
+	}
+	o.SetPerPort(true)
+	if !o.Insert(user, 443, 1, 100) || !o.Insert(user, 8443, 2, 100) {
+		t.Fatal("clients should be counted per port")
+	}
+	if o.Insert(user, 8443, 3, 100) {
+		t.Fatal("client over the limit of the port should be rejected")
+	}
+	devices := o.Devices(10001)
+	if len(devices) != 2 || devices[0].Port != 443 || devices[1].Port != 8443 {
+		t.Fatalf("devices should carry port: %+v", devices)
+	}
+	if !o.Evict(10001, 2) || len(o.Devices(10001)) != 1 {
+		t.Fatal("evict should work on all ports")
+	}
+}
+
+func TestObfsAuthChainDataConcurrent(t *testing.T) {
+	o := NewObfsAuthChainData("auth_chain_a")
+	o.SetMaxClient(8)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := binaryx.LEUint32ToBytes(uint32(10000 + i%4))
+			for j := 0; j < 200; j++ {
+				clientID := j % 8
+				if o.Insert(user, 443, clientID, 1000+i*200+j) {
+					o.Update(user, 443, clientID, 0)
+					o.Remove(string(user), 443, clientID)
+				}
+				_ = o.AuthData()
+				_ = o.Devices(-1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for _, device := range o.Devices(-1) {
+		if device.Connections != 0 || time.Since(device.LastUpdate) > time.Minute {
+			t.Fatalf("connections should be released: %+v", device)
+		}
+	}
+}
@@ -14,7 +14,8 @@ import (
 )
 
 func init() {
-	registerMethod("http_simple", NewHttpSimple)
+	registerObfs("http_simple", NewHttpSimple)
+	registerObfs("http_post", NewHttpSimple)
 }
 
 var USER_AGENT = []string{
@@ -32,6 +33,8 @@ var USER_AGENT = []string{
 	"Mozilla/5.0 (iPhone; CPU iPhone OS 5_0 like Mac OS X) AppleWebKit/534.46 (KHTML, like Gecko) Version/5.1 Mobile/9A334 Safari/7534.48.3",
 }
 
+const BOUNDARY_CHARS = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
 func strMatchBegin(str1, str2 string) bool {
 	if len(str1) >= len(str2) {
 		if str1[:len(str2)] == str2 {
@@ -119,10 +122,19 @@ func (h *HttpSimple) getHostFromHttpHeader(buf []byte) string {
 	return ""
 }
 
+// boundary return a random multipart boundary for http_post
+func (h *HttpSimple) boundary() []byte {
+	result := make([]byte, 32)
+	for i := range result {
+		result[i] = BOUNDARY_CHARS[randomx.RandIntRange(0, len(BOUNDARY_CHARS)-1)]
+	}
+	return result
+}
+
 func (h *HttpSimple) notMatchReturn(buf []byte) ([]byte, bool, bool, error) {
 	h.hasSentHeader = true
 	h.hasRecvHeader = true
-	if h.GetMethod() == "http_simple" {
+	if arrayx.FindStringInArray(h.GetMethod(), []string{"http_simple", "http_post"}) {
 		return bytes.Repeat([]byte("E"), 2048), false, false, nil
 	}
 	return buf, true, false, nil
@@ -167,7 +179,12 @@ func (h *HttpSimple) ClientEncode(buf []byte) ([]byte, error) {
 	}
 	hostArr := strings.Split(hosts, ",")
 	host := randomx.RandomStringsChoice(hostArr)
-	httpHead := bytesx.ContactSlice([]byte("GET /"), h.encodeHead(headData), []byte(" HTTP/1.1\r\n"))
+	// http_post send the head in a POST request instead of a GET
+	verb := []byte("GET /")
+	if h.GetMethod() == "http_post" {
+		verb = []byte("POST /")
+	}
+	httpHead := bytesx.ContactSlice(verb, h.encodeHead(headData), []byte(" HTTP/1.1\r\n"))
 	httpHead = bytesx.ContactSlice(httpHead, []byte("Host: "), []byte(host), port, []byte("\r\n"))
 	if len(body) > 0 {
 		httpHead = bytesx.ContactSlice(httpHead, body, []byte("\r\n\r\n"))
@@ -175,7 +192,11 @@ func (h *HttpSimple) ClientEncode(buf []byte) ([]byte, error) {
 		httpHead = bytesx.ContactSlice(httpHead, []byte("User-Agent: "),
 			[]byte(randomx.RandomStringsChoice(USER_AGENT)),
 			[]byte("\r\n"))
-		httpHead = bytesx.ContactSlice(httpHead, []byte("Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\nAccept-Language: en-US,en;q=0.8\r\nAccept-Encoding: gzip, deflate\r\nDNT: 1\r\nConnection: keep-alive\r\n\r\n"))
+		httpHead = bytesx.ContactSlice(httpHead, []byte("Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\nAccept-Language: en-US,en;q=0.8\r\nAccept-Encoding: gzip, deflate\r\n"))
+		if h.GetMethod() == "http_post" {
+			httpHead = bytesx.ContactSlice(httpHead, []byte("Content-Type: multipart/form-data; boundary="), h.boundary(), []byte("\r\n"))
+		}
+		httpHead = bytesx.ContactSlice(httpHead, []byte("DNT: 1\r\nConnection: keep-alive\r\n\r\n"))
 	}
 	h.hasSentHeader = true
 	return bytesx.ContactSlice(httpHead, buf), nil
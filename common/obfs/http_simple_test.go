@@ -1,14 +1,50 @@
 package obfs
 
 import (
+	"bytes"
 	"encoding/hex"
 	"fmt"
+	"testing"
 )
 
-func ExampleClientEncode(){
-	h := NewHttpSimple("http_simple").(*HttpSimple)
+func ExampleClientEncode() {
+	plain, _ := NewHttpSimple("http_simple")
+	h := plain.(*HttpSimple)
 	data := h.encodeHead([]byte("helloa"))
 	fmt.Printf(hex.EncodeToString(data))
 	//Output:
 	//253638253635253663253663253666
 }
+
+func TestHttpPost(t *testing.T) {
+	serverInfo := GetAuth().GetServerInfo()
+	serverInfo.SetObfsParam("www.example.com")
+	client, _ := GetObfs("http_post")
+	client.SetServerInfo(serverInfo)
+	server, _ := GetObfs("http_post")
+	server.SetServerInfo(serverInfo)
+
+	plaintext := bytes.Repeat([]byte{'a'}, 200)
+	data, err := client.ClientEncode(plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("POST /%61")) || !bytes.Contains(data, []byte("Host: www.example.com:8080\r\n")) ||
+		!bytes.Contains(data, []byte("Content-Type: multipart/form-data; boundary=")) {
+		t.Fatalf("wrong http_post head: %q", data)
+	}
+	result, needDecrypt, _, err := server.ServerDecode(data)
+	if err != nil || !needDecrypt || !bytes.Equal(result, plaintext) {
+		t.Fatalf("http_post decode error: %q %v", result, err)
+	}
+
+	// host not in obfs_param is rejected
+	serverInfo = GetAuth().GetServerInfo()
+	serverInfo.SetObfsParam("www.example.org")
+	strict, _ := GetObfs("http_post")
+	strict.SetServerInfo(serverInfo)
+	result, _, _, _ = strict.ServerDecode(data)
+	if !bytes.Equal(result, bytes.Repeat([]byte("E"), 2048)) {
+		t.Fatalf("http_post should reject wrong host, got %q", result)
+	}
+}
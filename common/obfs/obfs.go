@@ -1,5 +1,12 @@
 package obfs
 
+import (
+	"fmt"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
 type PlainFactory func(string) (Plain,error)
 
 // Plain interface
@@ -29,12 +36,56 @@ type Plain interface {
 
 var (
 	method_supported = make(map[string]PlainFactory)
+	obfs_supported   = make(map[string]bool)
 )
 
+// registerMethod register a protocol
 func registerMethod(method string, factory PlainFactory) {
 	method_supported[method] = factory
 }
 
+// registerObfs register an obfs, obfs and protocols share the same factories
+func registerObfs(method string, factory PlainFactory) {
+	registerMethod(method, factory)
+	obfs_supported[method] = true
+}
+
+// IsProtocol report whether method is a registered protocol
+func IsProtocol(method string) bool {
+	return method_supported[method] != nil && !obfs_supported[method]
+}
+
+// IsObfs report whether method is a registered obfs
+func IsObfs(method string) bool {
+	return obfs_supported[method]
+}
+
 func GetObfs(method string) (Plain,error){
-	return method_supported[method](method)
+	factory := method_supported[method]
+	if factory == nil {
+		return nil, errors.New(fmt.Sprintf("obfs or protocol %s is not supported", method))
+	}
+	return factory(method)
+}
+
+// GetSupportProtocols return names of registered protocols in order
+func GetSupportProtocols() []string {
+	list := make([]string, 0, len(method_supported))
+	for method := range method_supported {
+		if !obfs_supported[method] {
+			list = append(list, method)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// GetSupportObfs return names of registered obfs in order
+func GetSupportObfs() []string {
+	list := make([]string, 0, len(obfs_supported))
+	for method := range obfs_supported {
+		list = append(list, method)
+	}
+	sort.Strings(list)
+	return list
 }
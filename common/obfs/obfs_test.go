@@ -2,7 +2,10 @@ package obfs
 
 import (
 	"fmt"
+	"testing"
 	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/core"
 )
 
 func ExampleTime() {
@@ -14,4 +17,18 @@ func ExampleTime() {
 func ExampleGetObfs(){
 	GetObfs("obfs")
 	//Output:
-}
\ No newline at end of file
+}
+func TestGetObfs(t *testing.T) {
+	if _, err := GetObfs("obfs"); err == nil {
+		t.Fatal("unknown obfs should return an error")
+	}
+	core.GetApp().SetObfsProtocolService(NewObfsAuthChainData("auth_chain_a"))
+	for _, method := range append(GetSupportProtocols(), GetSupportObfs()...) {
+		if _, err := GetObfs(method); err != nil {
+			t.Fatalf("%s should be supported: %s", method, err)
+		}
+	}
+	if !IsProtocol("origin") || IsProtocol("plain") || !IsObfs("plain") || IsObfs("origin") {
+		t.Fatal("protocols and obfs should be told apart")
+	}
+}
@@ -28,7 +28,8 @@ var (
 )
 
 func init() {
-	registerMethod("tls1.2_ticket_auth", NewObfsTLS)
+	registerObfs("tls1.2_ticket_auth", NewObfsTLS)
+	registerObfs("tls1.2_ticket_fastauth", NewObfsTLS)
 }
 
 type ObfsAuthData struct {
@@ -165,13 +166,15 @@ func (otls *ObfsTLS) ClientEncode(buf []byte) ([]byte, error) {
 
 		result := conbineToBytes([]byte{0x01, 0x00}, uint16(data.Len()), data.Bytes())
 		result = conbineToBytes([]byte{0x16, 0x03, 0x01}, uint16(len(result)), result)
+		// fastauth send finished and data without waiting server hello,
+		// status 8|2 means server hello is not verified yet
+		if otls.Plain.GetMethod() == "tls1.2_ticket_fastauth" {
+			result = conbineToBytes(result, otls.clientFinished())
+			otls.HandshakeStatus = 8 | 2
+		}
 		return result, nil
 	} else if otls.HandshakeStatus == 1 && len(buf) == 0 {
-		data := conbineToBytes(byte(0x14), otls.TLSVersion, []byte{0x00, 0x01, 0x01}) //ChangeCipherSpec
-		data = conbineToBytes(data, byte(0x16), otls.TLSVersion, []byte{0x00, 0x20}, randomx.RandomBytes(22))
-		data = conbineToBytes(data, hmacsha1(conbineToBytes(otls.GetServerInfo().GetKey(), otls.ObfsAuthData.ClientID), data)[:10])
-		ret := conbineToBytes(data, otls.SendBuffer)
-		otls.SendBuffer = []byte{}
+		ret := otls.clientFinished()
 		otls.HandshakeStatus = 8
 		return ret, nil
 	}
@@ -179,6 +182,55 @@ func (otls *ObfsTLS) ClientEncode(buf []byte) ([]byte, error) {
 	return []byte{}, nil
 }
 
+// clientFinished return ChangeCipherSpec, Finished and the buffered data
+func (otls *ObfsTLS) clientFinished() []byte {
+	data := conbineToBytes(byte(0x14), otls.TLSVersion, []byte{0x00, 0x01, 0x01}) //ChangeCipherSpec
+	data = conbineToBytes(data, byte(0x16), otls.TLSVersion, []byte{0x00, 0x20}, randomx.RandomBytes(22))
+	data = conbineToBytes(data, hmacsha1(conbineToBytes(otls.GetServerInfo().GetKey(), otls.ObfsAuthData.ClientID), data)[:10])
+	ret := conbineToBytes(data, otls.SendBuffer)
+	otls.SendBuffer = []byte{}
+	return ret
+}
+
+// verifyServerHello check hmac of server hello and the whole handshake
+func (otls *ObfsTLS) verifyServerHello(buf []byte) error {
+	if len(buf) < 11+32+1+32 {
+		return errors.New("client_decode data error")
+	}
+	key := conbineToBytes(otls.GetServerInfo().GetKey(), otls.ObfsAuthData.ClientID)
+	if !bytes.Equal(hmacsha1(key, buf[11:33])[:10], buf[33:43]) {
+		return errors.New("client_decode data error")
+	}
+	if !bytes.Equal(hmacsha1(key, buf[:len(buf)-10])[:10], buf[len(buf)-10:]) {
+		return errors.New("client_decode data error")
+	}
+	return nil
+}
+
+// serverHandshakeLen return length of server handshake records ended by Finished,
+// zero means the handshake is not received completely
+func (otls *ObfsTLS) serverHandshakeLen(buf []byte) (int, error) {
+	pos := 0
+	changeCipherSpec := false
+	for len(buf) >= pos+5 {
+		size := int(binary.BigEndian.Uint16(buf[pos+3 : pos+5]))
+		if len(buf) < pos+5+size {
+			break
+		}
+		recordType := buf[pos]
+		pos += 5 + size
+		switch {
+		case recordType == 0x14:
+			changeCipherSpec = true
+		case recordType == 0x16 && changeCipherSpec:
+			return pos, nil
+		case recordType != 0x16:
+			return 0, errors.New("client_decode data error")
+		}
+	}
+	return 0, nil
+}
+
 //ClientDecode buffer_to_recv, is_need_to_encode_and_send_back
 func (otls *ObfsTLS) ClientDecode(buf []byte) ([]byte, bool, error) {
 	if otls.HandshakeStatus == -1 {
@@ -203,16 +255,25 @@ func (otls *ObfsTLS) ClientDecode(buf []byte) ([]byte, bool, error) {
 		return ret.Bytes(), false, nil
 	}
 
-	if len(buf) < 11+32+1+32 {
-		return nil, false, errors.New("client_decode data error")
+	if otls.HandshakeStatus == 8|2 {
+		otls.RecvBuffer = conbineToBytes(otls.RecvBuffer, buf)
+		handshakeLen, err := otls.serverHandshakeLen(otls.RecvBuffer)
+		if err != nil {
+			return nil, false, err
+		}
+		if handshakeLen == 0 {
+			return []byte{}, false, nil
+		}
+		if err := otls.verifyServerHello(otls.RecvBuffer[:handshakeLen]); err != nil {
+			return nil, false, err
+		}
+		otls.RecvBuffer = otls.RecvBuffer[handshakeLen:]
+		otls.HandshakeStatus = 8
+		return otls.ClientDecode([]byte{})
 	}
 
-	verify := buf[11:33]
-	if !bytes.Equal(hmacsha1(conbineToBytes(otls.GetServerInfo().GetKey(), otls.ObfsAuthData.ClientID), verify)[:10], buf[33:43]) {
-		return nil, false, errors.New("client_decode data error")
-	}
-	if !bytes.Equal(hmacsha1(conbineToBytes(otls.GetServerInfo().GetKey(), otls.ObfsAuthData.ClientID), buf[:len(buf)-10])[:10], buf[len(buf)-10:]) {
-		return nil, false, errors.New("client_decode data error")
+	if err := otls.verifyServerHello(buf); err != nil {
+		return nil, false, err
 	}
 	return []byte{}, true, nil
 }
@@ -248,7 +309,7 @@ func (otls *ObfsTLS) ServerEncode(buf []byte) ([]byte, error) {
 	data = conbineToBytes(byte(0x16), otls.TLSVersion, uint16(len(data)), data)
 	if int(randomx.Float64Range(0, 8)) < 1 {
 		ticket := randomx.RandomBytes(int((randomx.Uint16()%164)*2) + 64)
-		ticket = conbineToBytes(uint16(len(ticket)+4), []byte{0x04, 0x00}, len(ticket), ticket)
+		ticket = conbineToBytes(uint16(len(ticket)+4), []byte{0x04, 0x00}, uint16(len(ticket)), ticket)
 		data = conbineToBytes(data, byte(0x16), otls.TLSVersion, ticket) // New session ticket
 	}
 	data = conbineToBytes(data, byte(0x14), otls.TLSVersion, []byte{0x00, 0x01, 0x01}) // ChangeCipherSpec
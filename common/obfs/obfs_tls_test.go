@@ -334,3 +334,51 @@ func InitObfs() *ObfsTLS {
 	}
 	return otls
 }
+
+func TestObfsTLSFastAuth(t *testing.T) {
+	serverInfo := GetAuth().GetServerInfo()
+	client, _ := GetObfs("tls1.2_ticket_fastauth")
+	client.SetServerInfo(serverInfo)
+	server, _ := GetObfs("tls1.2_ticket_fastauth")
+	server.SetServerInfo(serverInfo)
+
+	// client hello, finished and data are sent together
+	data, err := client.ClientEncode([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, needDecrypt, needSendBack, err := server.ServerDecode(data)
+	if err != nil || !needDecrypt || !needSendBack || string(result) != "request" {
+		t.Fatalf("server should receive data with client hello, got %q %v", result, err)
+	}
+	handshake, err := server.ServerEncode([]byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, _ := server.ServerEncode([]byte("reply"))
+	data = append(handshake, reply...)
+
+	// server hello may be split
+	result, needSendBack, err = client.ClientDecode(data[:20])
+	if err != nil || len(result) != 0 || needSendBack {
+		t.Fatalf("client should wait server hello, got %q %v", result, err)
+	}
+	result, needSendBack, err = client.ClientDecode(data[20:])
+	if err != nil || needSendBack || string(result) != "reply" {
+		t.Fatalf("client should receive reply, got %q %v", result, err)
+	}
+
+	data, _ = client.ClientEncode([]byte("next"))
+	if result, _, _, _ = server.ServerDecode(data); string(result) != "next" {
+		t.Fatalf("server should receive next data, got %q", result)
+	}
+
+	// tampered server hello is rejected
+	client, _ = GetObfs("tls1.2_ticket_fastauth")
+	client.SetServerInfo(serverInfo)
+	_, _ = client.ClientEncode([]byte("request"))
+	handshake[20] ^= 0xFF
+	if _, _, err = client.ClientDecode(handshake); err == nil {
+		t.Fatal("client should reject tampered server hello")
+	}
+}
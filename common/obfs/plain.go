@@ -1,7 +1,7 @@
 package obfs
 
 func init() {
-	registerMethod("plain", NewPlain)
+	registerObfs("plain", NewPlain)
 	registerMethod("origin", NewPlain)
 }
 
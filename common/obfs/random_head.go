@@ -0,0 +1,92 @@
+package obfs
+
+import (
+	"bytes"
+	"hash/crc32"
+
+	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
+	"github.com/ProxyPanel/VNet-SSR/utils/bytesx"
+	"github.com/ProxyPanel/VNet-SSR/utils/randomx"
+	"github.com/sirupsen/logrus"
+)
+
+func init() {
+	registerObfs("random_head", NewRandomHead)
+}
+
+// RandomHead exchange a random head before the stream, the head of client ends with
+// a checksum which make crc32 of the whole head be 0xffffffff
+type RandomHead struct {
+	Plain
+	hasSentHeader bool
+	hasRecvHeader bool
+	rawTransSent  bool
+	rawTransRecv  bool
+	sendBuf       []byte
+}
+
+func NewRandomHead(method string) (Plain, error) {
+	newPlain, err := NewPlain(method)
+	if err != nil {
+		return nil, err
+	}
+	return &RandomHead{
+		Plain:   newPlain,
+		sendBuf: []byte{},
+	}, nil
+}
+
+func (r *RandomHead) ClientEncode(buf []byte) ([]byte, error) {
+	if r.rawTransSent {
+		return buf, nil
+	}
+	r.sendBuf = bytesx.ContactSlice(r.sendBuf, buf)
+	if !r.hasSentHeader {
+		r.hasSentHeader = true
+		data := randomx.RandomBytes(int(randomx.Uint8())%96 + 4)
+		crc := 0xFFFFFFFF - crc32.ChecksumIEEE(data)
+		return bytesx.ContactSlice(data, binaryx.LEUint32ToBytes(crc)), nil
+	}
+	// data is sent after the head of server is received
+	if r.rawTransRecv {
+		result := r.sendBuf
+		r.sendBuf = []byte{}
+		r.rawTransSent = true
+		return result, nil
+	}
+	return []byte{}, nil
+}
+
+// ClientDecode buffer_to_recv, is_need_to_encode_and_send_back
+func (r *RandomHead) ClientDecode(buf []byte) ([]byte, bool, error) {
+	if r.rawTransRecv {
+		return buf, false, nil
+	}
+	r.rawTransRecv = true
+	return []byte{}, true, nil
+}
+
+func (r *RandomHead) ServerEncode(buf []byte) ([]byte, error) {
+	if r.hasSentHeader {
+		return buf, nil
+	}
+	r.hasSentHeader = true
+	return randomx.RandomBytes(int(randomx.Uint8())%96 + 4), nil
+}
+
+// ServerDecode return buffer_to_recv, is_need_decrypt, is_need_to_encode_and_send_back
+func (r *RandomHead) ServerDecode(buf []byte) ([]byte, bool, bool, error) {
+	if r.hasRecvHeader {
+		return buf, true, false, nil
+	}
+	r.hasRecvHeader = true
+	if crc32.ChecksumIEEE(buf) != 0xFFFFFFFF {
+		logrus.Warning("random_head: wrong crc")
+		r.hasSentHeader = true
+		if r.GetMethod() == "random_head" {
+			return bytes.Repeat([]byte("E"), 2048), false, false, nil
+		}
+		return buf, true, false, nil
+	}
+	return []byte{}, false, true, nil
+}
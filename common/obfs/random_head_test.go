@@ -0,0 +1,45 @@
+package obfs
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+)
+
+func TestRandomHead(t *testing.T) {
+	client, _ := GetObfs("random_head")
+	server, _ := GetObfs("random_head")
+
+	head, err := client.ClientEncode([]byte("first"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(head) < 8 || crc32.ChecksumIEEE(head) != 0xFFFFFFFF {
+		t.Fatalf("wrong random head: %x", head)
+	}
+	result, needDecrypt, needSendBack, err := server.ServerDecode(head)
+	if err != nil || len(result) != 0 || needDecrypt || !needSendBack {
+		t.Fatal("server should send back its head")
+	}
+	serverHead, _ := server.ServerEncode([]byte{})
+	if len(serverHead) < 4 {
+		t.Fatal("server should send a random head")
+	}
+	if data, _ := client.ClientEncode([]byte("second")); len(data) != 0 {
+		t.Fatal("client should buffer data before server head")
+	}
+
+	result, needSendBack, _ = client.ClientDecode(serverHead)
+	if len(result) != 0 || !needSendBack {
+		t.Fatal("client should skip server head and send buffered data")
+	}
+	data, _ := client.ClientEncode([]byte{})
+	if result, needDecrypt, _, _ = server.ServerDecode(data); !needDecrypt || string(result) != "firstsecond" {
+		t.Fatalf("server should receive buffered data, got %q", result)
+	}
+
+	strict, _ := GetObfs("random_head")
+	if result, _, _, _ = strict.ServerDecode([]byte("GET / HTTP/1.1\r\n")); !bytes.Equal(result, bytes.Repeat([]byte("E"), 2048)) {
+		t.Fatal("random_head should reject wrong head")
+	}
+}
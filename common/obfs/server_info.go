@@ -41,6 +41,8 @@ type ServerInfo interface {
 	GetOverhead() int
 	GetUsers() map[string]string
 	SetUsers(users map[string]string)
+	// SetUsersFunc make GetUsers return the current users of the func instead of the set ones
+	SetUsersFunc(func() map[string]string)
 	UpdateUser(uid []byte)
 	SetUpdateUserFunc(func(uid []byte))
 }
@@ -61,6 +63,7 @@ type serverInfo struct {
 	BufferSize    int
 	Overhead      int
 	Users         map[string]string
+	usersFunc     func() map[string]string
 	updateUser    func(uid []byte)
 }
 
@@ -186,9 +189,16 @@ func (s *serverInfo) GetOverhead() int {
 }
 
 func (s *serverInfo) GetUsers() map[string]string {
+	if s.usersFunc != nil {
+		return s.usersFunc()
+	}
 	return s.Users
 }
 
+func (s *serverInfo) SetUsersFunc(users func() map[string]string) {
+	s.usersFunc = users
+}
+
 func (s *serverInfo) SetUsers(users map[string]string) {
 	s.Users = users
 }
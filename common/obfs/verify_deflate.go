@@ -0,0 +1,116 @@
+package obfs
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+
+	"github.com/ProxyPanel/VNet-SSR/utils/bytesx"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	registerMethod("verify_deflate", NewVerifyDeflate)
+}
+
+/*----------------------------------VerifyDeflate----------------------------------*/
+// VerifyDeflate compress every frame with zlib, the zlib header is replaced by frame length
+type VerifyDeflate struct {
+	*AuthBase
+	RecvBuf []byte
+	UnitLen int
+}
+
+func NewVerifyDeflate(method string) (Plain, error) {
+	authBase, err := NewAuthBase(method)
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyDeflate{
+		AuthBase: authBase,
+		RecvBuf:  []byte{},
+		UnitLen:  32700,
+	}, nil
+}
+
+func (v *VerifyDeflate) packData(buf []byte) ([]byte, error) {
+	if len(buf) == 0 {
+		return []byte{}, nil
+	}
+	compressed := new(bytes.Buffer)
+	writer := zlib.NewWriter(compressed)
+	if _, err := writer.Write(buf); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	data := compressed.Bytes()
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(data)))
+	return bytesx.ContactSlice(length, data[2:]), nil
+}
+
+func (v *VerifyDeflate) pack(buf []byte) ([]byte, error) {
+	result := []byte{}
+	for len(buf) > v.UnitLen {
+		data, err := v.packData(buf[:v.UnitLen])
+		if err != nil {
+			return nil, err
+		}
+		result = bytesx.ContactSlice(result, data)
+		buf = buf[v.UnitLen:]
+	}
+	data, err := v.packData(buf)
+	if err != nil {
+		return nil, err
+	}
+	return bytesx.ContactSlice(result, data), nil
+}
+
+func (v *VerifyDeflate) unpack(buf []byte) ([]byte, error) {
+	v.RecvBuf = bytesx.ContactSlice(v.RecvBuf, buf)
+	result := []byte{}
+	for len(v.RecvBuf) > 2 {
+		length := int(binary.BigEndian.Uint16(v.RecvBuf[:2]))
+		if length >= 32768 || length < 6 {
+			v.RecvBuf = []byte{}
+			return nil, errors.New("verify_deflate data error")
+		}
+		if length > len(v.RecvBuf) {
+			break
+		}
+		reader, err := zlib.NewReader(bytes.NewReader(bytesx.ContactSlice([]byte{0x78, 0x9c}, v.RecvBuf[2:length])))
+		if err != nil {
+			v.RecvBuf = []byte{}
+			return nil, errors.Wrap(err, "verify_deflate data error")
+		}
+		data, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			v.RecvBuf = []byte{}
+			return nil, errors.Wrap(err, "verify_deflate data error")
+		}
+		result = bytesx.ContactSlice(result, data)
+		v.RecvBuf = v.RecvBuf[length:]
+	}
+	return result, nil
+}
+
+func (v *VerifyDeflate) ClientPreEncrypt(buf []byte) ([]byte, error) {
+	return v.pack(buf)
+}
+
+func (v *VerifyDeflate) ClientPostDecrypt(buf []byte) ([]byte, error) {
+	return v.unpack(buf)
+}
+
+func (v *VerifyDeflate) ServerPreEncrypt(buf []byte) ([]byte, error) {
+	return v.pack(buf)
+}
+
+func (v *VerifyDeflate) ServerPostDecrypt(buf []byte) ([]byte, bool, error) {
+	data, err := v.unpack(buf)
+	return data, false, err
+}
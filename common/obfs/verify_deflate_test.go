@@ -0,0 +1,40 @@
+package obfs
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVerifyDeflate(t *testing.T) {
+	server, err := GetObfs("verify_deflate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// zlib.compress(b'hello world') of python with the header replaced by length
+	frame := MustHexDecode("0013cb48cdc9c95728cf2fca4901001a0b045d")
+	result, _, err := server.ServerPostDecrypt(frame[:7])
+	if err != nil || len(result) != 0 {
+		t.Fatalf("partial frame should wait, got %v %v", result, err)
+	}
+	result, _, err = server.ServerPostDecrypt(frame[7:])
+	if err != nil || string(result) != "hello world" {
+		t.Fatalf("expected hello world, got %q %v", result, err)
+	}
+
+	client, _ := GetObfs("verify_deflate")
+	for _, size := range []int{1, 1000, 70000} {
+		plaintext := bytes.Repeat([]byte("verify_deflate"), size)
+		ciphertext, err := server.ServerPreEncrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := client.ClientPostDecrypt(ciphertext)
+		if err != nil || !bytes.Equal(result, plaintext) {
+			t.Fatalf("size %v decrypt error: %v", size, err)
+		}
+	}
+
+	if _, _, err = server.ServerPostDecrypt([]byte{0x00, 0x02, 0x00}); err == nil {
+		t.Fatal("frame shorter than 6 should be rejected")
+	}
+}
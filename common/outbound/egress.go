@@ -0,0 +1,80 @@
+package outbound
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// EgressFixed send every user from one address of the pool, chosen by the uid
+	EgressFixed = "fixed"
+	// EgressRoundRobin send every connection and udp session from the next address of the pool
+	EgressRoundRobin = "round_robin"
+	// EgressInbound send connections from the address the client connected to, when it is in the pool
+	EgressInbound = "inbound"
+)
+
+// SourceSelector choose the local address direct connections of uid are sent from, inbound is
+// the address of this node the client connected to. nil means the default source of the kernel
+type SourceSelector interface {
+	Source(uid int, inbound net.IP) net.IP
+}
+
+// Egress choose source addresses from a pool of local addresses
+type Egress struct {
+	mode string
+	pool []net.IP
+	next uint32
+}
+
+// NewEgress create an egress of mode with the pool ips, the pool of inbound mode can be empty,
+// then every inbound address is used as the source
+func NewEgress(mode string, ips []string) (*Egress, error) {
+	pool := make([]net.IP, 0, len(ips))
+	for _, item := range ips {
+		ip := net.ParseIP(strings.TrimSpace(item))
+		if ip == nil {
+			return nil, errors.New(fmt.Sprintf("egress ip %s format error", item))
+		}
+		pool = append(pool, ip)
+	}
+	switch mode {
+	case EgressFixed, EgressRoundRobin:
+		if len(pool) == 0 {
+			return nil, errors.New(fmt.Sprintf("egress mode %s needs egress ips", mode))
+		}
+	case EgressInbound:
+	default:
+		return nil, errors.New(fmt.Sprintf("egress mode %s is not supported", mode))
+	}
+	return &Egress{mode: mode, pool: pool}, nil
+}
+
+func (e *Egress) Source(uid int, inbound net.IP) net.IP {
+	switch e.mode {
+	case EgressFixed:
+		if uid < 0 {
+			uid = -uid
+		}
+		return e.pool[uid%len(e.pool)]
+	case EgressRoundRobin:
+		return e.pool[(atomic.AddUint32(&e.next, 1)-1)%uint32(len(e.pool))]
+	default:
+		if inbound == nil || inbound.IsUnspecified() {
+			return nil
+		}
+		if len(e.pool) == 0 {
+			return inbound
+		}
+		for _, ip := range e.pool {
+			if ip.Equal(inbound) {
+				return ip
+			}
+		}
+		return nil
+	}
+}
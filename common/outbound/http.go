@@ -0,0 +1,71 @@
+package outbound
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// HTTP connect targets through a http proxy with CONNECT, it can not relay udp
+type HTTP struct {
+	Addr     string
+	Username string
+	Password string
+	name     string
+}
+
+func (h *HTTP) Name() string {
+	return h.name
+}
+
+func (h *HTTP) Dial(target string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", h.Addr, DialTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(DialTimeout))
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if h.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		request += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", auth)
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.New(fmt.Sprintf("http proxy %s replies %s to CONNECT %s", h.Addr, response.Status, target))
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+func (h *HTTP) ListenPacket() (net.PacketConn, error) {
+	return nil, ErrUDPNotSupported
+}
+
+// bufferedConn read bytes the proxy sent right after the response before the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,198 @@
+package outbound
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/ProxyPanel/VNet-SSR/common/network"
+	"github.com/ProxyPanel/VNet-SSR/common/network/ciphers"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+	"github.com/pkg/errors"
+)
+
+// Shadowsocks connect targets through a shadowsocks server
+type Shadowsocks struct {
+	Addr     string
+	Method   string
+	Password string
+	name     string
+}
+
+func (s *Shadowsocks) Name() string {
+	return s.name
+}
+
+func (s *Shadowsocks) Dial(target string) (net.Conn, error) {
+	addr := socksproxy.ParseAddr(target)
+	if addr == nil {
+		return nil, errors.New(fmt.Sprintf("target address %s format error", target))
+	}
+	conn, err := net.DialTimeout("tcp", s.Addr, DialTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c, err := ciphers.CipherDecorate(s.Password, s.Method, conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if _, err := c.Write(addr.Raw); err != nil {
+		_ = c.Close()
+		return nil, errors.WithStack(err)
+	}
+	return c, nil
+}
+
+func (s *Shadowsocks) ListenPacket() (net.PacketConn, error) {
+	server, err := net.ResolveUDPAddr("udp", s.Addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	c, err := ciphers.CipherPacketDecorate(s.Password, s.Method, pc)
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	return &shadowsocksPacketConn{PacketConn: c, server: server}, nil
+}
+
+// shadowsocksPacketConn send packets with the socks address of their target to the server
+type shadowsocksPacketConn struct {
+	net.PacketConn
+	server net.Addr
+}
+
+func (c *shadowsocksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target := socksproxy.ParseAddr(addr.String())
+	if target == nil {
+		return 0, errors.New(fmt.Sprintf("target address %s format error", addr.String()))
+	}
+	if _, err := c.PacketConn.WriteTo(append(append([]byte{}, target.Raw...), b...), c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *shadowsocksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+socksproxy.MaxAddrLen)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		addr, err := socksproxy.SplitAddr(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[len(addr.Raw):n]), Addr(addr.String()), nil
+	}
+}
+
+// ShadowsocksR connect targets through a shadowsocksr server
+type ShadowsocksR struct {
+	Addr          string
+	Method        string
+	Password      string
+	Protocol      string
+	ProtocolParam string
+	Obfs          string
+	ObfsParam     string
+	name          string
+}
+
+func (s *ShadowsocksR) Name() string {
+	return s.name
+}
+
+func (s *ShadowsocksR) decorate(request *network.Request) (*network.ShadowsocksRDecorate, error) {
+	host, port, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return network.NewShadowsocksRDecorate(request,
+		s.Obfs, s.Method,
+		s.Password, s.Protocol,
+		s.ObfsParam, s.ProtocolParam,
+		host, portNum,
+		true,
+		0,
+		nil)
+}
+
+func (s *ShadowsocksR) Dial(target string) (net.Conn, error) {
+	addr := socksproxy.ParseAddr(target)
+	if addr == nil {
+		return nil, errors.New(fmt.Sprintf("target address %s format error", target))
+	}
+	conn, err := net.DialTimeout("tcp", s.Addr, DialTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ssrd, err := s.decorate(network.NewRequestWithTCP(conn))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if _, err := ssrd.Write(addr.Raw); err != nil {
+		_ = ssrd.Close()
+		return nil, errors.WithStack(err)
+	}
+	return ssrd, nil
+}
+
+func (s *ShadowsocksR) ListenPacket() (net.PacketConn, error) {
+	server, err := net.ResolveUDPAddr("udp", s.Addr)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	ssrd, err := s.decorate(network.NewRequestWithUDP(pc))
+	if err != nil {
+		_ = pc.Close()
+		return nil, err
+	}
+	return &shadowsocksRPacketConn{ShadowsocksRDecorate: ssrd, server: server}, nil
+}
+
+// shadowsocksRPacketConn send packets with the socks address of their target to the server
+type shadowsocksRPacketConn struct {
+	*network.ShadowsocksRDecorate
+	server net.Addr
+}
+
+func (c *shadowsocksRPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target := socksproxy.ParseAddr(addr.String())
+	if target == nil {
+		return 0, errors.New(fmt.Sprintf("target address %s format error", addr.String()))
+	}
+	if err := c.LocalWriteTo(append(append([]byte{}, target.Raw...), b...), c.server); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *shadowsocksRPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		data, _, err := c.LocalReadFrom()
+		if err != nil {
+			return 0, nil, err
+		}
+		addr, err := socksproxy.SplitAddr(data)
+		if err != nil {
+			continue
+		}
+		return copy(b, data[len(addr.Raw):]), Addr(addr.String()), nil
+	}
+}
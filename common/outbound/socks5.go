@@ -0,0 +1,155 @@
+package outbound
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+	"github.com/pkg/errors"
+)
+
+// Socks5 connect targets through a socks5 proxy, udp is relayed with udp associate
+type Socks5 struct {
+	Addr     string
+	Username string
+	Password string
+	name     string
+}
+
+func (s *Socks5) Name() string {
+	return s.name
+}
+
+func (s *Socks5) Dial(target string) (net.Conn, error) {
+	addr := socksproxy.ParseAddr(target)
+	if addr == nil {
+		return nil, errors.New(fmt.Sprintf("target address %s format error", target))
+	}
+	conn, err := net.DialTimeout("tcp", s.Addr, DialTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := s.handshake(conn, socksproxy.CmdConnect, addr); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (s *Socks5) ListenPacket() (net.PacketConn, error) {
+	conn, err := net.DialTimeout("tcp", s.Addr, DialTimeout)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	relay, err := s.handshake(conn, socksproxy.CmdUDPAssociate, socksproxy.ParseAddr("0.0.0.0:0"))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	relayAddr, err := net.ResolveUDPAddr("udp", relay.String())
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	// the proxy may answer an unspecified address, which means the address of the proxy
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = conn.RemoteAddr().(*net.TCPAddr).IP
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		_ = conn.Close()
+		return nil, errors.WithStack(err)
+	}
+	return &socks5PacketConn{PacketConn: pc, control: conn, relay: relayAddr}, nil
+}
+
+// handshake negotiate the method and send cmd, it return the bound address in the reply
+func (s *Socks5) handshake(conn net.Conn, cmd byte, addr *socksproxy.Socks5Addr) (*socksproxy.Socks5Addr, error) {
+	_ = conn.SetDeadline(time.Now().Add(DialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	method := byte(0)
+	if s.Username != "" {
+		method = 2
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	buf := make([]byte, socksproxy.MaxAddrLen)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if buf[0] != 5 || buf[1] != method {
+		return nil, errors.New(fmt.Sprintf("socks5 proxy %s does not accept method %v", s.Addr, method))
+	}
+	if method == 2 {
+		auth := append([]byte{1, byte(len(s.Username))}, s.Username...)
+		auth = append(append(auth, byte(len(s.Password))), s.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if buf[1] != 0 {
+			return nil, errors.New(fmt.Sprintf("socks5 proxy %s rejects the user %s", s.Addr, s.Username))
+		}
+	}
+	if _, err := conn.Write(append([]byte{5, cmd, 0}, addr.Raw...)); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if _, err := io.ReadFull(conn, buf[:3]); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if buf[1] != 0 {
+		return nil, errors.New(fmt.Sprintf("socks5 proxy %s replies error %v", s.Addr, buf[1]))
+	}
+	bound, err := socksproxy.ReadAddr(conn)
+	return bound, errors.WithStack(err)
+}
+
+// socks5PacketConn send packets to the udp relay of a socks5 proxy, the session is alive
+// as long as the control connection
+type socks5PacketConn struct {
+	net.PacketConn
+	control net.Conn
+	relay   net.Addr
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	target := socksproxy.ParseAddr(addr.String())
+	if target == nil {
+		return 0, errors.New(fmt.Sprintf("target address %s format error", addr.String()))
+	}
+	// RSV(2) FRAG(1) ADDR DATA
+	packet := append(append([]byte{0, 0, 0}, target.Raw...), b...)
+	if _, err := c.PacketConn.WriteTo(packet, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+3+socksproxy.MaxAddrLen)
+	for {
+		n, _, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// fragments are not supported
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		addr, err := socksproxy.SplitAddr(buf[3:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[3+len(addr.Raw):n]), Addr(addr.String()), nil
+	}
+}
+
+func (c *socks5PacketConn) Close() error {
+	_ = c.control.Close()
+	return c.PacketConn.Close()
+}
@@ -15,34 +15,32 @@ func init() {
 	getBufLock = new(sync.Mutex)
 }
 
-func GetBuf() []byte {
-	pool := poolMap[BufferSize]
+// getPool return the pool of size, it is created when there is none
+func getPool(size int) *sync.Pool {
+	getBufLock.Lock()
+	defer getBufLock.Unlock()
+	pool := poolMap[size]
 	if pool == nil {
-		getBufLock.Lock()
-		poolMap[BufferSize] = &sync.Pool{
-			New: createAllocFunc(BufferSize),
+		pool = &sync.Pool{
+			New: createAllocFunc(size),
 		}
-		getBufLock.Unlock()
+		poolMap[size] = pool
 	}
-	buf := poolMap[BufferSize].Get().([]byte)
-	buf = buf[:cap(buf)]
-	return buf
+	return pool
+}
+
+func GetBuf() []byte {
+	return GetBufBySize(BufferSize)
 }
 
 func GetBufBySize(size int) []byte {
-	pool := poolMap[size]
-	if pool == nil {
-		poolMap[size] = &sync.Pool{
-			New: createAllocFunc(size),
-		}
-	}
-	buf := poolMap[size].Get().([]byte)
+	buf := getPool(size).Get().([]byte)
 	buf = buf[:cap(buf)]
 	return buf
 }
 
 func PutBuf(buf []byte) {
-	poolMap[cap(buf)].Put(buf)
+	getPool(cap(buf)).Put(buf)
 }
 
 func createAllocFunc(size int) func() interface{} {
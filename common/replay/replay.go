@@ -0,0 +1,187 @@
+package replay
+
+import (
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCapacity is the number of ivs a generation holds before it is rotated
+	DefaultCapacity = 1000000
+	// DefaultFalsePositive is the false positive rate of a full generation
+	DefaultFalsePositive = 1e-6
+	// DefaultWindow is the lifetime of a generation, an iv is remembered for one to two windows
+	DefaultWindow = 10 * time.Minute
+	// WindowSize is the number of packet ids before the latest one a Window remembers
+	WindowSize = 1024
+)
+
+var (
+	filter        *Filter
+	filterOnce    sync.Once
+	udpFilter     *Filter
+	udpFilterOnce sync.Once
+)
+
+// GetFilter return the filter of tcp handshakes shared by all servers
+func GetFilter() *Filter {
+	filterOnce.Do(func() {
+		filter = NewFilter(DefaultCapacity, DefaultFalsePositive, DefaultWindow)
+	})
+	return filter
+}
+
+// GetUDPFilter return the filter of udp packets shared by all servers, it is apart from the tcp
+// filter so busy udp users which rotate it quickly don't shorten the window of tcp handshakes
+func GetUDPFilter() *Filter {
+	udpFilterOnce.Do(func() {
+		udpFilter = NewFilter(DefaultCapacity, DefaultFalsePositive, DefaultWindow)
+	})
+	return udpFilter
+}
+
+// Filter is a rotating bloom filter of ivs and salts. There are two generations, ivs are
+// added to the current one and looked up in both, the current one becomes the previous one
+// when it is full or older than window, so memory is bounded by capacity
+type Filter struct {
+	sync.Mutex
+	capacity int
+	window   time.Duration
+	current  *bloom
+	previous *bloom
+	rotated  time.Time
+	now      func() time.Time
+	seed1    maphash.Seed
+	seed2    maphash.Seed
+}
+
+func NewFilter(capacity int, falsePositive float64, window time.Duration) *Filter {
+	return &Filter{
+		capacity: capacity,
+		window:   window,
+		current:  newBloom(capacity, falsePositive),
+		previous: newBloom(capacity, falsePositive),
+		rotated:  time.Now(),
+		now:      time.Now,
+		seed1:    maphash.MakeSeed(),
+		seed2:    maphash.MakeSeed(),
+	}
+}
+
+// Check add iv to the filter, it return false if iv has been seen
+func (f *Filter) Check(iv []byte) bool {
+	if len(iv) == 0 {
+		return true
+	}
+	f.Lock()
+	defer f.Unlock()
+	if elapsed := f.now().Sub(f.rotated); f.current.count >= f.capacity || elapsed >= f.window {
+		f.current, f.previous = f.previous, f.current
+		f.current.reset()
+		if elapsed >= 2*f.window {
+			f.previous.reset()
+		}
+		f.rotated = f.now()
+	}
+	h1, h2 := f.hash(iv)
+	if f.current.test(h1, h2) || f.previous.test(h1, h2) {
+		return false
+	}
+	f.current.add(h1, h2)
+	return true
+}
+
+// hash return two hashes of iv with random seeds, so ivs which collide can not be made up
+func (f *Filter) hash(iv []byte) (uint64, uint64) {
+	var h maphash.Hash
+	h.SetSeed(f.seed1)
+	_, _ = h.Write(iv)
+	h1 := h.Sum64()
+	h.SetSeed(f.seed2)
+	_, _ = h.Write(iv)
+	return h1, h.Sum64() | 1
+}
+
+// bloom is a bloom filter whose k hashes are derived from two hashes
+type bloom struct {
+	bits  []uint64
+	k     uint64
+	m     uint64
+	count int
+}
+
+func newBloom(capacity int, falsePositive float64) *bloom {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositive) / (math.Ln2 * math.Ln2)))
+	k := uint64(math.Ceil(float64(m) / float64(capacity) * math.Ln2))
+	return &bloom{
+		bits: make([]uint64, (m+63)/64),
+		k:    k,
+		m:    m,
+	}
+}
+
+func (b *bloom) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) add(h1, h2 uint64) {
+	for i := uint64(0); i < b.k; i++ {
+		bit := (h1 + i*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+	b.count++
+}
+
+func (b *bloom) reset() {
+	for i := range b.bits {
+		b.bits[i] = 0
+	}
+	b.count = 0
+}
+
+// Window is a sliding window of packet ids of an udp session, a packet id is accepted once
+// and ids older than WindowSize before the latest one are rejected. The zero value is ready to use
+type Window struct {
+	sync.Mutex
+	// last is the latest packet id plus one, so zero means nothing is seen
+	last   uint64
+	bitmap [WindowSize / 64]uint64
+}
+
+// Check add id to the window, it return false if id has been seen or is too old
+func (w *Window) Check(id uint64) bool {
+	counter := id + 1
+	if counter == 0 {
+		return false
+	}
+	w.Lock()
+	defer w.Unlock()
+	if counter > w.last {
+		// clear bits of ids between the latest one and this one
+		clear := counter - w.last
+		if clear > WindowSize {
+			clear = WindowSize
+		}
+		for i := uint64(1); i <= clear; i++ {
+			bit := (w.last + i) % WindowSize
+			w.bitmap[bit/64] &^= 1 << (bit % 64)
+		}
+		w.last = counter
+	} else if w.last-counter >= WindowSize {
+		return false
+	}
+	bit := counter % WindowSize
+	if w.bitmap[bit/64]&(1<<(bit%64)) != 0 {
+		return false
+	}
+	w.bitmap[bit/64] |= 1 << (bit % 64)
+	return true
+}
@@ -0,0 +1,84 @@
+package replay
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func TestFilter(t *testing.T) {
+	f := NewFilter(100, 1e-6, time.Minute)
+	now := time.Now()
+	f.now = func() time.Time { return now }
+	if !f.Check([]byte("iv1")) {
+		t.Fatal("new iv should pass")
+	}
+	if f.Check([]byte("iv1")) {
+		t.Fatal("replayed iv should be rejected")
+	}
+	if !f.Check(nil) || !f.Check(nil) {
+		t.Fatal("empty iv should always pass")
+	}
+
+	// iv is still remembered by the previous generation after one rotation
+	now = now.Add(time.Minute)
+	if f.Check([]byte("iv1")) {
+		t.Fatal("iv should be remembered in the previous generation")
+	}
+	now = now.Add(time.Minute)
+	if !f.Check([]byte("iv2")) {
+		t.Fatal("new iv should pass")
+	}
+	now = now.Add(time.Minute)
+	if !f.Check([]byte("iv1")) {
+		t.Fatal("iv should be forgotten after two windows")
+	}
+	now = now.Add(3 * time.Minute)
+	if !f.Check([]byte("iv2")) {
+		t.Fatal("both generations should be reset after a long idle")
+	}
+}
+
+func TestFilterCapacity(t *testing.T) {
+	f := NewFilter(100, 1e-6, time.Hour)
+	iv := make([]byte, 8)
+	for i := 0; i < 250; i++ {
+		binary.BigEndian.PutUint64(iv, uint64(i))
+		if !f.Check(iv) {
+			t.Fatalf("iv %v should pass", i)
+		}
+	}
+	if f.current.count > 100 || f.previous.count > 100 {
+		t.Fatal("generation should be rotated when it is full")
+	}
+	binary.BigEndian.PutUint64(iv, 249)
+	if f.Check(iv) {
+		t.Fatal("recent iv should be rejected")
+	}
+	binary.BigEndian.PutUint64(iv, 0)
+	if !f.Check(iv) {
+		t.Fatal("iv of the dropped generation should pass")
+	}
+}
+
+func TestWindow(t *testing.T) {
+	var w Window
+	if !w.Check(0) || w.Check(0) {
+		t.Fatal("packet id 0 should pass once")
+	}
+	if !w.Check(3) || !w.Check(1) || w.Check(1) || w.Check(3) {
+		t.Fatal("out of order packet ids should pass once")
+	}
+	if !w.Check(WindowSize + 2) {
+		t.Fatal("new packet id should pass")
+	}
+	if w.Check(1) {
+		t.Fatal("packet id out of window should be rejected")
+	}
+	if !w.Check(3+1) || w.Check(WindowSize+2) {
+		t.Fatal("packet id in window should pass once")
+	}
+	if !w.Check(10*WindowSize) || !w.Check(10*WindowSize-1) || w.Check(WindowSize+2) {
+		t.Fatal("window should move after a jump")
+	}
+}
@@ -1,6 +1,9 @@
 package core
 
 import (
+	"sync"
+	"time"
+
 	"github.com/ProxyPanel/VNet-SSR/model"
 	"github.com/robfig/cron"
 	"github.com/stackimpact/stackimpact-go"
@@ -22,16 +25,22 @@ func GetApp() *App {
 }
 
 type App struct {
-	nodeInfo            *model.NodeInfo
-	userInfos           []*model.UserInfo
-	nodeId              int
-	apiHost             string
-	key                 string
-	host                string
-	publicIP            string
-	cron                *cron.Cron
-	agent               *stackimpact.Agent
-	obfsProtocolService ObfsProtocolService
+	nodeInfo     *model.NodeInfo
+	userInfos    []*model.UserInfo
+	nodeId       int
+	apiHost      string
+	key          string
+	host         string
+	publicIP     string
+	journalDir   string
+	drainTimeout time.Duration
+	syncInterval time.Duration
+	limitBurst   time.Duration
+	cron         *cron.Cron
+	agent        *stackimpact.Agent
+	// obfsProtocolService is replaced while connections are using it
+	obfsProtocolServiceLock sync.RWMutex
+	obfsProtocolService     ObfsProtocolService
 }
 
 func (a *App) Init() error {
@@ -102,6 +111,47 @@ func (a *App) GetPublicIP() string {
 	return a.publicIP
 }
 
+func (a *App) SetJournalDir(journalDir string) {
+	a.journalDir = journalDir
+}
+
+func (a *App) JournalDir() string {
+	return a.journalDir
+}
+
+func (a *App) SetDrainTimeout(drainTimeout time.Duration) {
+	a.drainTimeout = drainTimeout
+}
+
+// DrainTimeout is how long connections can live after their server is closed
+func (a *App) DrainTimeout() time.Duration {
+	if a.drainTimeout == 0 {
+		return 30 * time.Second
+	}
+	return a.drainTimeout
+}
+
+func (a *App) SetSyncInterval(syncInterval time.Duration) {
+	a.syncInterval = syncInterval
+}
+
+// SyncInterval is how often users are synced with panel, zero means never
+func (a *App) SyncInterval() time.Duration {
+	return a.syncInterval
+}
+
+func (a *App) SetLimitBurst(limitBurst time.Duration) {
+	a.limitBurst = limitBurst
+}
+
+// LimitBurst is how long traffic a speed limit bucket can hold
+func (a *App) LimitBurst() time.Duration {
+	if a.limitBurst == 0 {
+		return time.Second
+	}
+	return a.limitBurst
+}
+
 func (a *App) SetAgent(agent *stackimpact.Agent) {
 	a.agent = agent
 }
@@ -111,9 +161,13 @@ func (a *App) GetAgent() *stackimpact.Agent {
 }
 
 func (a *App) SetObfsProtocolService(obfsProtocolService ObfsProtocolService) {
+	a.obfsProtocolServiceLock.Lock()
+	defer a.obfsProtocolServiceLock.Unlock()
 	a.obfsProtocolService = obfsProtocolService
 }
 
 func (a *App) GetObfsProtocolService() ObfsProtocolService {
+	a.obfsProtocolServiceLock.RLock()
+	defer a.obfsProtocolServiceLock.RUnlock()
 	return a.obfsProtocolService
 }
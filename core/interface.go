@@ -16,10 +16,17 @@ type HostFirewall interface {
 	JudgeHostWithReport(ipOrDomain string, uid int) bool
 }
 
+// UserFirewall judge whether a user is allowed to open new connections, uid is the
+// user port as it is in protocol
+type UserFirewall interface {
+	JudgeUser(uid int) bool
+}
+
+// ObfsProtocolService track clients of users for the auth protocols, port is the server port
 type ObfsProtocolService interface {
-	Update(userID []byte, clientID, connectionID int);
+	Update(userID []byte, port, clientID, connectionID int);
 	SetMaxClient(maxClient int);
-	Insert(userID []byte, clientID, connectionID int) bool;
-	Remove(userID string, clientID int);
+	Insert(userID []byte, port, clientID, connectionID int) bool;
+	Remove(userID string, port, clientID int);
 	AuthData() []byte;
 }
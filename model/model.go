@@ -1,5 +1,7 @@
 package model
 
+import "encoding/json"
+
 type NodeInfo struct {
 	ID            int    `json:"id"`
 	Port          string `json:"port"`
@@ -15,6 +17,37 @@ type NodeInfo struct {
 	SpeedLimit    uint64 `json:"speed_limit"`
 	IsUDP         int    `json:"is_udp"`
 	ClientLimit   int    `json:"client_limit"`
+	// ClientLimitPerPort counts clients of a user per port instead of per node when it is 1
+	ClientLimitPerPort int `json:"client_limit_per_port"`
+	// NodeUpLimit and NodeDownLimit cap total bytes per second of the node, zero means unlimited
+	NodeUpLimit   uint64 `json:"node_speed_limit_up"`
+	NodeDownLimit uint64 `json:"node_speed_limit_down"`
+	// Mode is "ssr" for shadowsocksr or "ss" for plain shadowsocks aead, empty means "ssr"
+	Mode string `json:"mode"`
+	// Fallback is the address failed handshakes are forwarded to, e.g. a local web server, empty means close them
+	Fallback string `json:"fallback"`
+	// UDPTimeout is seconds a udp session is kept without packets, zero means the default of 60 seconds
+	UDPTimeout int `json:"udp_timeout"`
+	// UDPSessionLimit is the max number of udp sessions of a user on a port, zero means unlimited
+	UDPSessionLimit int `json:"udp_session_limit"`
+	// ProxyProtocol is 1 when tcp connections come through a load balancer sending PROXY protocol headers
+	ProxyProtocol int `json:"proxy_protocol"`
+	// TrustedProxies is comma separated ips or cidrs of the load balancers, other sources are rejected
+	TrustedProxies string `json:"trusted_proxies"`
+	// Outbound is the url of the upstream proxy targets are connected through, empty means direct
+	Outbound string `json:"outbound"`
+	// EgressMode is how the source address of direct connections is chosen from EgressIPs,
+	// "fixed", "round_robin" or "inbound", empty means the default source of the kernel
+	EgressMode string `json:"egress_mode"`
+	// EgressIPs is comma separated local addresses direct connections can be sent from
+	EgressIPs string `json:"egress_ips"`
+	// DNSServers is comma separated upstreams targets are resolved with, udp://host[:port],
+	// tcp://host[:port], https://host/path or host[:port], empty means the system resolver
+	DNSServers string `json:"dns_servers"`
+	// DNSHosts map domains to comma separated static addresses
+	DNSHosts map[string]string `json:"dns_hosts"`
+	// DNSPrefer is "ipv4" or "ipv6", addresses of the family are tried first, empty keeps the order of answers
+	DNSPrefer string `json:"dns_prefer"`
 }
 
 type UserInfo struct {
@@ -22,7 +55,40 @@ type UserInfo struct {
 	Port   int    `json:"port"`
 	Passwd string `json:"passwd"`
 	Limit  uint64 `json:"speed_limit"`
-	Enable int    `json:"enable"`
+	// UpLimit and DownLimit override Limit for one direction when they are not zero
+	UpLimit   uint64 `json:"speed_limit_up"`
+	DownLimit uint64 `json:"speed_limit_down"`
+	Enable    int    `json:"enable"`
+	// Quota is bytes the user can transfer on this node, zero means unlimited
+	Quota int64 `json:"quota"`
+	// QuotaPeriod is seconds after which used quota is reset, zero means quota is a total
+	QuotaPeriod int64 `json:"quota_period"`
+	// Mode overrides mode of node in multi port mode when it is not empty
+	Mode string `json:"mode"`
+	// Method, Protocol and Obfs override the node's in multi port mode when they are not empty,
+	// ProtocolParam and ObfsParam are used instead of the node's when Protocol and Obfs are overridden
+	Method        string `json:"method"`
+	Protocol      string `json:"protocol"`
+	ProtocolParam string `json:"protocol_param"`
+	Obfs          string `json:"obfs"`
+	ObfsParam     string `json:"obfs_param"`
+	// ClientLimit overrides client limit of node when it is not zero
+	ClientLimit int `json:"client_limit"`
+	// Outbound overrides outbound of node when it is not empty
+	Outbound string `json:"outbound"`
+	// EgressIP is the local address direct connections of user are sent from, it overrides egress of node
+	EgressIP string `json:"egress_ip"`
+}
+
+// UnmarshalJSON decode user, a user without enable is enabled
+func (u *UserInfo) UnmarshalJSON(data []byte) error {
+	type userInfo UserInfo
+	user := userInfo{Enable: 1}
+	if err := json.Unmarshal(data, &user); err != nil {
+		return err
+	}
+	*u = UserInfo(user)
+	return nil
 }
 
 type UserTraffic struct {
@@ -55,6 +121,17 @@ type RuleItem struct {
 	Id      int    `json:"id"`
 	Type    string `json:"type"`
 	Pattern string `json:"pattern"`
+	// Outbound makes the rule route matched targets through the outbound instead of allowing or rejecting them
+	Outbound string `json:"outbound"`
+}
+
+// UserQuota is reported when user exhausts quota
+type UserQuota struct {
+	Uid    int   `json:"uid"`
+	Quota  int64 `json:"quota"`
+	Used   int64 `json:"used"`
+	Period int64 `json:"period"`
+	Time   int64 `json:"time"`
 }
 
 type Trigger struct {
@@ -62,3 +139,20 @@ type Trigger struct {
 	RuleId int    `json:"rule_id"`
 	Reason string `json:"reason"`
 }
+
+// Capabilities is what the node supports, settings of node and users must be in it
+type Capabilities struct {
+	Ciphers   CipherCapabilities `json:"ciphers"`
+	Protocols []string           `json:"protocols"`
+	Obfs      []string           `json:"obfs"`
+	Modes     []string           `json:"modes"`
+}
+
+// CipherCapabilities is supported ciphers by kind, block ciphers are only supported in shadowsocksr
+// mode and aead ciphers are required in shadowsocks mode
+type CipherCapabilities struct {
+	Stream   []string `json:"stream"`
+	AEAD     []string `json:"aead"`
+	AEAD2022 []string `json:"aead_2022"`
+	Block    []string `json:"block"`
+}
@@ -50,3 +50,15 @@ func TestRuleConvert(t *testing.T){
 	}
 	fmt.Printf("%+v\n",rule)
 }
+
+func TestUserInfoEnable(t *testing.T) {
+	var users []*UserInfo
+	if err := json.Unmarshal([]byte(`[{"uid": 1}, {"uid": 2, "enable": 0}, {"uid": 3, "enable": 1}]`), &users); err != nil {
+		t.Fatal(err)
+	}
+	for i, enable := range []int{1, 0, 1} {
+		if users[i].Enable != enable {
+			t.Fatalf("user %v enable should be %v, got %v", users[i].Uid, enable, users[i].Enable)
+		}
+	}
+}
@@ -1,5 +1,26 @@
 package client
 
+import (
+	"fmt"
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/network"
+	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/utils/goroutine"
+	"github.com/ProxyPanel/VNet-SSR/utils/netx"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ShadowsocksClient is a local socks5 proxy, every tcp connection and udp associate
+// accepted by it will be tunneled through the shadowsocksr server
 type ShadowsocksClient struct {
 	Host          string
 	Port          int
@@ -9,9 +30,203 @@ type ShadowsocksClient struct {
 	ProtocolParam string
 	Obfs          string
 	ObfsParam     string
+	UDPTimeout    time.Duration
+	*network.Listener
+}
+
+// Proxy start a socks5 server on host:port
+func (s *ShadowsocksClient) Proxy(host string, port int) error {
+	if core.GetApp().GetObfsProtocolService() == nil {
+		core.GetApp().SetObfsProtocolService(obfs.NewObfsAuthChainData(s.Protocol))
+	}
+	if s.UDPTimeout == 0 {
+		s.UDPTimeout = 30 * time.Second
+	}
+	s.Listener = network.NewListener(fmt.Sprintf("%s:%v", host, port), 5*time.Second)
+	if err := s.ListenTCP(s.handleTCP); err != nil {
+		return err
+	}
+	if err := s.ListenUDP(s.handleUDP); err != nil {
+		_ = s.Listener.Close()
+		return err
+	}
+	return nil
+}
+
+// Dial open a tcp tunnel to addr through the shadowsocksr server
+func (s *ShadowsocksClient) Dial(addr string) (*network.ShadowsocksRDecorate, error) {
+	target := socksproxy.ParseAddr(addr)
+	if target == nil {
+		return nil, errors.New(fmt.Sprintf("target address %s format error", addr))
+	}
+	request, err := network.DialTcp(s.server())
+	if err != nil {
+		return nil, err
+	}
+	ssrd, err := s.decorate(request)
+	if err != nil {
+		_ = request.Close()
+		return nil, err
+	}
+	if _, err := ssrd.Write(target.Raw); err != nil {
+		_ = ssrd.Close()
+		return nil, err
+	}
+	return ssrd, nil
+}
+
+func (s *ShadowsocksClient) server() string {
+	return net.JoinHostPort(s.Host, fmt.Sprintf("%v", s.Port))
+}
+
+func (s *ShadowsocksClient) decorate(request *network.Request) (*network.ShadowsocksRDecorate, error) {
+	return network.NewShadowsocksRDecorate(request,
+		s.Obfs, s.Method,
+		s.Passwd, s.Protocol,
+		s.ObfsParam, s.ProtocolParam,
+		s.Host, s.Port,
+		true,
+		0,
+		nil)
 }
 
-func (s *ShadowsocksClient) Proxy(host string,port int){
+func (s *ShadowsocksClient) handleTCP(request *network.Request) {
+	defer request.Close()
+	addr, err := socksproxy.Handshake(request)
+	if err == socksproxy.InfoUDPAssociate {
+		// udp associate is alive as long as the tcp connection
+		_, _ = io.Copy(ioutil.Discard, request)
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"requestId": request.RequestID,
+			"error":     err,
+		}).Error("shadowsocksr client socks handshake error")
+		return
+	}
+	remote, err := s.Dial(addr.String())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"requestId": request.RequestID,
+			"target":    addr.String(),
+			"error":     err,
+		}).Error("shadowsocksr client dial server error")
+		return
+	}
+	defer remote.Close()
+	log.Info("shadowsocksr client proxy %s requestId: %s", addr.String(), request.RequestID)
+	if _, _, err = netx.DuplexCopyTcp(request, remote); err != nil {
+		log.Debug("shadowsocksr client proxy %s closed: %v", addr.String(), err)
+	}
+}
+
+func (s *ShadowsocksClient) handleUDP(request *network.Request) {
+	serverAddr, err := net.ResolveUDPAddr("udp", s.server())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"server": s.server(),
+			"error":  err,
+		}).Error("shadowsocksr client resolve server error")
+		return
+	}
+	nat := newUDPNat()
+	buf := make([]byte, obfs.UDP_MAX_BUF_SIZE)
+	for {
+		n, clientAddr, err := request.ReadFrom(buf)
+		if err != nil {
+			if strings.Contains(err.Error(), " use of closed network connection") {
+				nat.closeAll()
+				return
+			}
+			log.Err(err)
+			continue
+		}
+		// RSV(2) FRAG(1), fragment is not supported
+		if n < 3 || buf[2] != 0 {
+			continue
+		}
+		remote := nat.get(clientAddr.String())
+		if remote == nil {
+			pc, err := net.ListenPacket("udp", "")
+			if err != nil {
+				log.Err(err)
+				continue
+			}
+			remote, err = s.decorate(network.NewRequestWithUDP(pc))
+			if err != nil {
+				_ = pc.Close()
+				log.Err(err)
+				continue
+			}
+			nat.set(clientAddr.String(), remote)
+			go goroutine.Protect(func() {
+				s.udpCopy(request, clientAddr, remote)
+				if pc := nat.del(clientAddr.String()); pc != nil {
+					_ = pc.Close()
+				}
+			})
+		}
+		if err := remote.LocalWriteTo(buf[3:n], serverAddr); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"client": clientAddr.String(),
+				"error":  err,
+			}).Error("shadowsocksr client write udp error")
+		}
+	}
+}
 
+// udpCopy copy packets from server back to local client until timeout
+func (s *ShadowsocksClient) udpCopy(local *network.Request, client net.Addr, remote *network.ShadowsocksRDecorate) {
+	for {
+		_ = remote.SetReadDeadline(time.Now().Add(s.UDPTimeout))
+		data, _, err := remote.LocalReadFrom()
+		if err != nil {
+			return
+		}
+		if len(data) == 0 {
+			continue
+		}
+		if _, err := local.WriteTo(append([]byte{0, 0, 0}, data...), client); err != nil {
+			return
+		}
+	}
 }
 
+type udpNat struct {
+	sync.Mutex
+	m map[string]*network.ShadowsocksRDecorate
+}
+
+func newUDPNat() *udpNat {
+	return &udpNat{m: make(map[string]*network.ShadowsocksRDecorate)}
+}
+
+func (n *udpNat) get(key string) *network.ShadowsocksRDecorate {
+	n.Lock()
+	defer n.Unlock()
+	return n.m[key]
+}
+
+func (n *udpNat) set(key string, ssrd *network.ShadowsocksRDecorate) {
+	n.Lock()
+	defer n.Unlock()
+	n.m[key] = ssrd
+}
+
+func (n *udpNat) del(key string) *network.ShadowsocksRDecorate {
+	n.Lock()
+	defer n.Unlock()
+	ssrd := n.m[key]
+	delete(n.m, key)
+	return ssrd
+}
+
+func (n *udpNat) closeAll() {
+	n.Lock()
+	defer n.Unlock()
+	for key, ssrd := range n.m {
+		_ = ssrd.Close()
+		delete(n.m, key)
+	}
+}
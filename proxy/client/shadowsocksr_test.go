@@ -0,0 +1,185 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/proxy/server"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startShadowsocksR(t *testing.T, method, protocol, obfsMethod string, single int) *server.ShadowsocksRProxy {
+	ssr := &server.ShadowsocksRProxy{
+		Host:             "127.0.0.1",
+		Port:             echo.FreePort(t),
+		Method:           method,
+		Password:         "killer",
+		Protocol:         protocol,
+		Obfs:             obfsMethod,
+		Single:           single,
+		ShadowsocksRArgs: &server.ShadowsocksRArgs{},
+	}
+	if single == 1 {
+		ssr.AddUser(1024, "user-password")
+	}
+	if err := ssr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return ssr
+}
+
+func socksConnect(t *testing.T, proxy, target string) net.Conn {
+	con, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = con.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := con.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(con, reply[:2]); err != nil {
+		t.Fatal(err)
+	}
+	request := append([]byte{5, socksproxy.CmdConnect, 0}, socksproxy.ParseAddr(target).Raw...)
+	if _, err := con.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(con, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply[1] != 0 {
+		t.Fatalf("socks connect reply %v", reply[1])
+	}
+	return con
+}
+
+func socksUDPAssociate(t *testing.T, proxy string) (net.Conn, *net.UDPAddr) {
+	con, err := net.DialTimeout("tcp", proxy, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = con.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := con.Write([]byte{5, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 3)
+	if _, err := io.ReadFull(con, reply[:2]); err != nil {
+		t.Fatal(err)
+	}
+	request := append([]byte{5, socksproxy.CmdUDPAssociate, 0}, socksproxy.ParseAddr("0.0.0.0:0").Raw...)
+	if _, err := con.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(con, reply); err != nil {
+		t.Fatal(err)
+	}
+	bind, err := socksproxy.ReadAddr(con)
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", bind.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return con, udpAddr
+}
+
+func TestShadowsocksClient(t *testing.T) {
+	core.GetApp().SetObfsProtocolService(obfs.NewObfsAuthChainData("auth_chain_a"))
+	echoTCP, echoUDP := echo.Start(t)
+	defer echoTCP.Close()
+	defer echoUDP.Close()
+
+	tests := []struct {
+		method   string
+		protocol string
+		obfs     string
+		single   int
+	}{
+		{"aes-128-cfb", "origin", "plain", 0},
+		{"chacha20-ietf", "origin", "http_simple", 0},
+		{"aes-256-cfb", "origin", "tls1.2_ticket_auth", 0},
+		{"rc4-md5", "auth_aes128_md5", "plain", 1},
+		{"none", "auth_chain_a", "tls1.2_ticket_auth", 1},
+		{"aes-128-cfb", "auth_chain_b", "plain", 1},
+		{"aes-256-cfb", "auth_chain_c", "http_simple", 1},
+		{"chacha20-ietf", "auth_chain_d", "plain", 1},
+		{"rc4-md5", "auth_chain_e", "tls1.2_ticket_auth", 1},
+		{"none", "auth_chain_f", "plain", 1},
+		{"aes-128-cfb", "auth_sha1_v4", "plain", 0},
+		{"chacha20-ietf", "auth_sha1_v4_compatible", "http_simple", 0},
+		{"rc4-md5", "verify_deflate", "tls1.2_ticket_auth", 0},
+		{"aes-128-cfb", "origin", "http_post", 0},
+		{"chacha20-ietf", "auth_chain_a", "random_head", 1},
+		{"aes-256-cfb", "auth_aes128_md5", "tls1.2_ticket_fastauth", 1},
+	}
+	for _, tt := range tests {
+		name := fmt.Sprintf("%s_%s_%s", tt.method, tt.protocol, tt.obfs)
+		t.Run(name, func(t *testing.T) {
+			ssr := startShadowsocksR(t, tt.method, tt.protocol, tt.obfs, tt.single)
+			defer ssr.Close()
+			c := &ShadowsocksClient{
+				Host:     ssr.Host,
+				Port:     ssr.Port,
+				Passwd:   ssr.Password,
+				Method:   tt.method,
+				Protocol: tt.protocol,
+				Obfs:     tt.obfs,
+			}
+			if tt.single == 1 {
+				c.ProtocolParam = "1024:user-password"
+			}
+			port := echo.FreePort(t)
+			if err := c.Proxy("127.0.0.1", port); err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			proxy := fmt.Sprintf("127.0.0.1:%v", port)
+
+			con := socksConnect(t, proxy, echoTCP.Addr().String())
+			defer con.Close()
+			for i := 0; i < 3; i++ {
+				data := bytes.Repeat([]byte{byte('a' + i)}, 3000*(i+1))
+				if _, err := con.Write(data); err != nil {
+					t.Fatal(err)
+				}
+				result := make([]byte, len(data))
+				if _, err := io.ReadFull(con, result); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(data, result) {
+					t.Fatal("tcp echo data is not equal")
+				}
+			}
+
+			ctrl, udpAddr := socksUDPAssociate(t, proxy)
+			defer ctrl.Close()
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer pc.Close()
+			packet := append([]byte{0, 0, 0}, socksproxy.ParseAddr(echoUDP.LocalAddr().String()).Raw...)
+			packet = append(packet, []byte("hello udp")...)
+			if _, err := pc.WriteTo(packet, udpAddr); err != nil {
+				t.Fatal(err)
+			}
+			_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			buf := make([]byte, 2048)
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], packet) {
+				t.Fatalf("udp echo data is not equal: %v", buf[:n])
+			}
+		})
+	}
+}
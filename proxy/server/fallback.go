@@ -0,0 +1,55 @@
+package server
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/common/network"
+	"github.com/ProxyPanel/VNet-SSR/utils/netx"
+	"github.com/sirupsen/logrus"
+)
+
+// recordHandshake record bytes read from request for the fallback, it return nil when there is no fallback
+func (ssr *ShadowsocksRProxy) recordHandshake(request *network.Request) *network.RecordConn {
+	if ssr.Fallback == "" {
+		return nil
+	}
+	record := network.NewRecordConn(request.Conn)
+	request.Conn = record
+	return record
+}
+
+// fallback forward request whose handshake failed to the fallback, bytes already read are replayed
+// and the rest is spliced, so the port looks like the fallback to a prober. it return false when
+// there is no fallback, the handshake is too large to replay or the fallback can't be reached
+func (ssr *ShadowsocksRProxy) fallback(request *network.Request, record *network.RecordConn) bool {
+	if record == nil {
+		return false
+	}
+	data, ok := record.Recorded()
+	if !ok {
+		return false
+	}
+	record.Established()
+	log.Info("forward %s to fallback %s requestId: %s", request.RemoteAddr().String(), ssr.Fallback, request.RequestID)
+	req, err := network.DialTcp(ssr.Fallback)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"requestId": request.RequestID,
+		}).Errorf("fallback dial error %s", err)
+		return false
+	}
+	defer req.Close()
+	if _, err := req.Write(data); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"requestId": request.RequestID,
+		}).Errorf("fallback write error %s", err)
+		return false
+	}
+	metrics.Fallbacks.Inc(strconv.Itoa(ssr.Port))
+	_ = request.SetDeadline(time.Time{})
+	_, _, _ = netx.DuplexCopyTcp(request, req)
+	return true
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/common/network"
+	"github.com/ProxyPanel/VNet-SSR/common/outbound"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+	"github.com/pkg/errors"
+)
+
+var direct = new(outbound.Direct)
+
+// outbound return the outbound of a connection of uid to host, it is direct without a router.
+// inbound is the local address the client connected to, direct connections are sent from the
+// source the selector chooses for it
+func (ssr *ShadowsocksRProxy) outbound(uid int, host string, inbound net.Addr) outbound.Outbound {
+	o := ssr.route(uid, host)
+	if outbound.IsDirect(o) {
+		return ssr.direct(uid, inbound)
+	}
+	return o
+}
+
+// route return the outbound the router chooses for uid and host, it is direct without a router
+func (ssr *ShadowsocksRProxy) route(uid int, host string) outbound.Outbound {
+	if ssr.Router != nil {
+		if routed := ssr.Router.Route(uid, host); routed != nil {
+			return routed
+		}
+	}
+	return direct
+}
+
+// direct return the direct outbound of uid with the source the selector chooses for inbound
+func (ssr *ShadowsocksRProxy) direct(uid int, inbound net.Addr) outbound.Outbound {
+	if ssr.SourceSelector == nil {
+		return direct
+	}
+	if source := ssr.SourceSelector.Source(uid, addrIP(inbound)); source != nil {
+		return &outbound.Direct{Source: source}
+	}
+	return direct
+}
+
+// addrIP return the ip of a tcp or udp address
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+// boundIP return the ip a packet connection is bound to, nil when it listens on all addresses
+func boundIP(addr net.Addr) net.IP {
+	if ip := addrIP(addr); ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	return nil
+}
+
+// dial open a tcp connection of uid to addr through its outbound
+func (ssr *ShadowsocksRProxy) dial(uid int, inbound net.Addr, addr *socksproxy.Socks5Addr) (*network.Request, error) {
+	o := ssr.outbound(uid, addr.GetAddress(), inbound)
+	conn, err := o.Dial(addr.String())
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("dial %s through %s", addr.String(), o.Name()))
+	}
+	return network.NewRequestWithTCP(conn), nil
+}
+
+// openUDPSession return the session of client and uid which sends packets to remoteAddr through its
+// outbound, and the address packets are written to. The session is nil when the packet is dropped,
+// a created session is returned with a nil target when the target can not be resolved, the caller
+// relays it and drops the packet. The outbound is set in key so it can be used to relay the session.
+// The source of a direct session is chosen once when it is created, so sources which change per
+// connection do not split the packets of a client into several sessions
+func (ssr *ShadowsocksRProxy) openUDPSession(udpMap *ShadowsocksRUDPMap, key *udpSessionKey, inbound net.Addr, remoteAddr *socksproxy.Socks5Addr) (item *ShadowsocksRUDPMapItem, target net.Addr, created bool, err error) {
+	o := ssr.route(key.uid, remoteAddr.GetAddress())
+	listen := o.ListenPacket
+	if outbound.IsDirect(o) {
+		listen = func() (net.PacketConn, error) {
+			return ssr.direct(key.uid, inbound).ListenPacket()
+		}
+	}
+	key.outbound = o.Name()
+	item, created, err = udpMap.Open(*key, listen)
+	switch errors.Cause(err) {
+	case nil:
+		if !outbound.IsDirect(o) {
+			return item, outbound.Addr(remoteAddr.String()), created, nil
+		}
+		// the target is resolved to the family of the address the session is bound to
+		if target, err = udpMap.Resolve(remoteAddr.String(), boundIP(item.LocalAddr())); err != nil {
+			metrics.UDPDrops.Inc(udpMap.port, "resolve")
+			return item, nil, created, err
+		}
+		return item, target, created, nil
+	case ErrUDPSessionLimit:
+		metrics.UDPDrops.Inc(udpMap.port, "session_limit")
+		log.Debug("user %v has too many udp sessions, drop udp packet from %s", key.uid, key.client)
+		return nil, nil, false, nil
+	case outbound.ErrUDPNotSupported:
+		metrics.UDPDrops.Inc(udpMap.port, "outbound")
+		log.Debug("outbound %s of user %v can not relay udp, drop udp packet from %s", o.Name(), key.uid, key.client)
+		return nil, nil, false, nil
+	default:
+		return nil, nil, false, err
+	}
+}
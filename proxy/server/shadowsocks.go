@@ -0,0 +1,511 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/ciphers/aead"
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/common/network"
+	"github.com/ProxyPanel/VNet-SSR/common/network/ciphers"
+	"github.com/ProxyPanel/VNet-SSR/common/pool"
+	"github.com/ProxyPanel/VNet-SSR/common/replay"
+	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
+	"github.com/ProxyPanel/VNet-SSR/utils/netx"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// shadowsocksHandshakeTimeout is the time to wait the header of a plain shadowsocks connection
+const shadowsocksHandshakeTimeout = 30 * time.Second
+
+// shadowsocksUser is a user can be served by a plain shadowsocks port
+type shadowsocksUser struct {
+	uid      int
+	password string
+	key      []byte
+	// identity is the identity hash of key when the port has an identity psk
+	identity string
+}
+
+// shadowsocksUsers are users of a port with their keys, they are built when users change
+// and must not be changed after
+type shadowsocksUsers struct {
+	list       []*shadowsocksUser
+	uids       map[int]*shadowsocksUser
+	identities map[string]*shadowsocksUser
+}
+
+// shadowsocksPacket is a decrypted udp packet of client
+type shadowsocksPacket struct {
+	payload []byte
+	// sessionID and packetID are set by shadowsocks 2022, sessionID is nil for classic aead
+	sessionID []byte
+	packetID  uint64
+}
+
+// shadowsocksCipher is the part differs between classic aead and shadowsocks 2022 methods
+type shadowsocksCipher interface {
+	// SaltSize is the size of salt at the beginning of tcp streams and udp packets, it is checked by the replay filter
+	SaltSize() int
+	// newUser return the user of password with its key, users whose password is not a valid key are skipped
+	newUser(uid int, password string) (*shadowsocksUser, error)
+	// headerSize is the size to read from a tcp stream to find the user
+	headerSize() int
+	matchUser(users *shadowsocksUsers, header []byte) *shadowsocksUser
+	serverConn(user *shadowsocksUser, conn net.Conn) (net.Conn, error)
+	// unpack find the user of an udp packet and decrypt it
+	unpack(users *shadowsocksUsers, packet []byte) (*shadowsocksUser, *shadowsocksPacket)
+	// open decrypt an udp packet of user
+	open(user *shadowsocksUser, packet []byte) (*shadowsocksPacket, error)
+	pack(dst []byte, item *ShadowsocksRUDPMapItem, payload []byte) ([]byte, error)
+}
+
+// newShadowsocksCipher return the cipher of method, password of the port is the identity psk
+// of shadowsocks 2022 in single port mode
+func (ssr *ShadowsocksRProxy) newShadowsocksCipher() (shadowsocksCipher, error) {
+	if c := aead.GetAEADCipher(ssr.Method); c != nil {
+		return &classicCipher{IAEADCipher: c, method: ssr.Method}, nil
+	}
+	c := aead.GetAEAD2022Cipher(ssr.Method)
+	if c == nil {
+		return nil, errors.New(fmt.Sprintf("method %s is not a shadowsocks aead cipher", ssr.Method))
+	}
+	sc := &ss2022Cipher{AEAD2022Cipher: c}
+	if ssr.Single == 1 && ssr.Password != "" && c.Identity() {
+		psk, err := c.PSK(ssr.Password)
+		if err != nil {
+			return nil, err
+		}
+		sc.ipsk = psk[0]
+	}
+	return sc, nil
+}
+
+// newShadowsocksUsers derive keys of users of the port, all users of node in single port mode,
+// otherwise the owner of the port
+func (ssr *ShadowsocksRProxy) newShadowsocksUsers(c shadowsocksCipher, current map[string]string) *shadowsocksUsers {
+	passwords := map[int]string{ssr.Port: ssr.Password}
+	if ssr.Single == 1 {
+		passwords = make(map[int]string, len(current))
+		for uidPack, password := range current {
+			passwords[int(binaryx.LEBytesToUInt32([]byte(uidPack)))] = password
+		}
+	}
+	users := &shadowsocksUsers{
+		list:       make([]*shadowsocksUser, 0, len(passwords)),
+		uids:       make(map[int]*shadowsocksUser, len(passwords)),
+		identities: make(map[string]*shadowsocksUser),
+	}
+	for uid, password := range passwords {
+		user, err := c.newUser(uid, password)
+		if err != nil {
+			log.Debug("shadowsocks user %v is skipped: %s", uid, err)
+			continue
+		}
+		users.list = append(users.list, user)
+		users.uids[uid] = user
+		if user.identity != "" {
+			users.identities[user.identity] = user
+		}
+	}
+	return users
+}
+
+// shadowsocksUsers return users of the port with their keys
+func (ssr *ShadowsocksRProxy) shadowsocksUsers() *shadowsocksUsers {
+	users, _ := ssr.ssUsers.Load().(*shadowsocksUsers)
+	if users == nil {
+		return &shadowsocksUsers{}
+	}
+	return users
+}
+
+// classicCipher is aead cipher whose key is derived from password, user is found by trial decryption
+type classicCipher struct {
+	aead.IAEADCipher
+	method string
+}
+
+func (c *classicCipher) newUser(uid int, password string) (*shadowsocksUser, error) {
+	return &shadowsocksUser{uid: uid, password: password, key: aead.Key(c, password)}, nil
+}
+
+func (c *classicCipher) headerSize() int {
+	return aead.HeaderSize(c)
+}
+
+func (c *classicCipher) matchUser(users *shadowsocksUsers, header []byte) *shadowsocksUser {
+	for _, user := range users.list {
+		if aead.OpenHeader(c, user.key, header) {
+			return user
+		}
+	}
+	return nil
+}
+
+func (c *classicCipher) serverConn(user *shadowsocksUser, conn net.Conn) (net.Conn, error) {
+	return ciphers.CipherDecorate(user.password, c.method, conn)
+}
+
+func (c *classicCipher) unpack(users *shadowsocksUsers, packet []byte) (*shadowsocksUser, *shadowsocksPacket) {
+	for _, user := range users.list {
+		if p, err := c.open(user, packet); err == nil {
+			return user, p
+		}
+	}
+	return nil, nil
+}
+
+func (c *classicCipher) open(user *shadowsocksUser, packet []byte) (*shadowsocksPacket, error) {
+	data, err := aead.Unpack(make([]byte, len(packet)), c, user.key, packet)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowsocksPacket{payload: data}, nil
+}
+
+func (c *classicCipher) pack(dst []byte, item *ShadowsocksRUDPMapItem, payload []byte) ([]byte, error) {
+	return aead.Pack(dst, c, item.Key, payload)
+}
+
+// ss2022Cipher is shadowsocks 2022 cipher, user is found by the identity header if the port has
+// an identity psk, otherwise by trial decryption
+type ss2022Cipher struct {
+	*aead.AEAD2022Cipher
+	ipsk []byte
+}
+
+func (c *ss2022Cipher) newUser(uid int, password string) (*shadowsocksUser, error) {
+	psk, err := c.PSK(password)
+	if err != nil {
+		return nil, err
+	}
+	user := &shadowsocksUser{uid: uid, password: password, key: psk[len(psk)-1]}
+	if c.ipsk != nil {
+		user.identity = string(aead.IdentityHash(user.key))
+	}
+	return user, nil
+}
+
+func (c *ss2022Cipher) identities() int {
+	if c.ipsk != nil {
+		return 1
+	}
+	return 0
+}
+
+func (c *ss2022Cipher) psk(user *shadowsocksUser) [][]byte {
+	if c.ipsk != nil {
+		return [][]byte{c.ipsk, user.key}
+	}
+	return [][]byte{user.key}
+}
+
+func (c *ss2022Cipher) headerSize() int {
+	return c.HeaderSize(c.identities())
+}
+
+func (c *ss2022Cipher) matchUser(users *shadowsocksUsers, header []byte) *shadowsocksUser {
+	if c.ipsk != nil {
+		hash, err := c.Identify(c.ipsk, header)
+		if err != nil {
+			return nil
+		}
+		return users.identities[string(hash)]
+	}
+	for _, user := range users.list {
+		if c.OpenHeader(user.key, header, 0) {
+			return user
+		}
+	}
+	return nil
+}
+
+func (c *ss2022Cipher) serverConn(user *shadowsocksUser, conn net.Conn) (net.Conn, error) {
+	return aead.NewAEAD2022ServerConn(c.AEAD2022Cipher, c.psk(user), conn), nil
+}
+
+func (c *ss2022Cipher) unpack(users *shadowsocksUsers, packet []byte) (*shadowsocksUser, *shadowsocksPacket) {
+	candidates := users.list
+	if c.ipsk != nil {
+		header, err := c.DecryptSeparateHeader(c.ipsk, packet)
+		if err != nil {
+			return nil, nil
+		}
+		hash, err := c.PacketIdentify(c.ipsk, header, packet[len(header):])
+		if err != nil {
+			return nil, nil
+		}
+		candidates = nil
+		if user := users.identities[string(hash)]; user != nil {
+			candidates = []*shadowsocksUser{user}
+		}
+	}
+	for _, user := range candidates {
+		if p, err := c.open(user, packet); err == nil {
+			return user, p
+		}
+	}
+	return nil, nil
+}
+
+func (c *ss2022Cipher) open(user *shadowsocksUser, packet []byte) (*shadowsocksPacket, error) {
+	p, err := c.UnpackPacket(c.psk(user), packet, aead.HeaderTypeClient2022)
+	if err != nil {
+		return nil, err
+	}
+	return &shadowsocksPacket{payload: p.Payload, sessionID: p.SessionID, packetID: p.PacketID}, nil
+}
+
+// pack reply of server, the header is encrypted by the user psk without identity header
+func (c *ss2022Cipher) pack(dst []byte, item *ShadowsocksRUDPMapItem, payload []byte) ([]byte, error) {
+	return c.PackPacket(dst, [][]byte{item.Key}, item.Session, payload)
+}
+
+// StartShadowsocksTCP serve plain shadowsocks aead tcp, user is found by the key which opens the header
+func (ssr *ShadowsocksRProxy) StartShadowsocksTCP() error {
+	c := ssr.ssCipher
+	return ssr.ListenTCP(func(request *network.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"requestId": request.RequestID,
+				}).Errorf("shadowsocks connection read error :%v stack: %s", err, string(debug.Stack()))
+			}
+		}()
+		defer request.Close()
+		metrics.ActiveTCP.Inc(strconv.Itoa(ssr.Port))
+		defer metrics.ActiveTCP.Dec(strconv.Itoa(ssr.Port))
+
+		record := ssr.recordHandshake(request)
+		header := make([]byte, c.headerSize())
+		_ = request.SetReadDeadline(time.Now().Add(shadowsocksHandshakeTimeout))
+		if _, err := io.ReadFull(request, header); err != nil {
+			// a short probe waiting for a response is answered by the fallback
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				ssr.fallback(request, record)
+			}
+			return
+		}
+		_ = request.SetReadDeadline(time.Time{})
+		user := c.matchUser(ssr.shadowsocksUsers(), header)
+		if user == nil {
+			metrics.HandshakeFailures.Inc(ModeShadowsocks, ssr.Method)
+			log.Info("shadowsocks no user match %s requestId: %s", request.RemoteAddr().String(), request.RequestID)
+			ssr.fallback(request, record)
+			return
+		}
+		if !replay.GetFilter().Check(header[:c.SaltSize()]) {
+			metrics.ReplayRejections.Inc(strconv.Itoa(ssr.Port), "tcp")
+			log.Info("shadowsocks replayed salt from %s, reject the connection requestId: %s", request.RemoteAddr().String(), request.RequestID)
+			if !ssr.fallback(request, record) {
+				_ = network.Discard(request, network.ReplayTimeout)
+			}
+			return
+		}
+
+		ssd := network.NewShadowsocksDecorate(request, header, user.uid)
+		ssd.TrafficReport = ssr.TrafficReport
+		ssd.SetLimter(ssr.ILimiter)
+		cipherConn, err := c.serverConn(user, ssd)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"requestId": request.RequestID,
+				"error":     err,
+			}).Error("shadowsocks cipher error")
+			return
+		}
+		conn := &network.Request{
+			ISStream:    true,
+			Conn:        cipherConn,
+			RequestID:   request.RequestID,
+			RequestTime: request.RequestTime,
+		}
+
+		addr, err := socksproxy.ReadAddr(conn)
+		if err != nil {
+			if err != io.EOF {
+				metrics.HandshakeFailures.Inc(ModeShadowsocks, ssr.Method)
+				logrus.WithFields(logrus.Fields{
+					"requestId": request.RequestID,
+				}).Errorf("shadowsocks read address error %s", err)
+				ssr.fallback(request, record)
+			}
+			return
+		}
+		if record != nil {
+			record.Established()
+		}
+		if ssr.UserFirewall != nil && !ssr.UserFirewall.JudgeUser(user.uid) {
+			log.Info("user %v is disabled, reject %s", user.uid, request.RemoteAddr().String())
+			return
+		}
+		ssr.addSession(user.uid, conn)
+		defer ssr.delSession(user.uid, conn)
+		ssr.handleStageAddr(user.uid, request.RemoteAddr().String(), request.LocalAddr().String(), addr.String(), "tcp")
+		log.Info("reslove addr success: %s requestId: %s", addr.String(), request.RequestID)
+
+		if ssr.HostFirewall != nil && !ssr.HostFirewall.JudgeHostWithReport(addr.GetAddress(), user.uid) {
+			writeReject(conn, addr.String())
+			return
+		}
+
+		req, err := ssr.dial(user.uid, request.LocalAddr(), addr)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"requestId": request.RequestID,
+			}).Errorf("shadowsocks proxy remote error %s", err)
+			return
+		}
+		defer req.Close()
+		_ = req.SetKeepAlive(true)
+		if _, _, err = netx.DuplexCopyTcp(conn, req); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"requestId": request.RequestID,
+			}).Errorf("shadowsocks proxy process error %s", err)
+		}
+	})
+}
+
+// StartShadowsocksUDP serve plain shadowsocks aead udp, user is found by the key which opens the packet
+func (ssr *ShadowsocksRProxy) StartShadowsocksUDP() error {
+	c := ssr.ssCipher
+	return ssr.ListenUDP(func(request *network.Request) {
+		go func() {
+			defer func() {
+				if e := recover(); e != nil {
+					logrus.Errorf("shadowsocks udp listener crashed , err : %s , \ntrace:%s", e, string(debug.Stack()))
+				}
+			}()
+			udpMap := ssr.newUDPMap()
+			defer udpMap.CloseAll()
+			buf := make([]byte, aead.MAX_PACKET_SIZE)
+			for {
+				n, addr, err := request.PacketConn.ReadFrom(buf)
+				if err != nil {
+					if strings.Contains(err.Error(), " use of closed network connection") {
+						logrus.WithFields(logrus.Fields{
+							"port": ssr.Port,
+						}).Info("udp close")
+						return
+					}
+					logrus.WithFields(logrus.Fields{
+						"err": err,
+					}).Error("shadowsocks read udp error")
+					continue
+				}
+				if err := ssr.handleShadowsocksPacket(c, request.PacketConn, udpMap, buf[:n], addr); err != nil {
+					logrus.WithFields(logrus.Fields{
+						"clientAddr": addr.String(),
+						"err":        err,
+					}).Error("shadowsocks udp proxy error")
+				}
+			}
+		}()
+	})
+}
+
+// unpackShadowsocksPacket find the user of a packet, the user of the latest session of the client
+// is tried first so packets of a session do not try every user
+func (ssr *ShadowsocksRProxy) unpackShadowsocksPacket(c shadowsocksCipher, udpMap *ShadowsocksRUDPMap, packet []byte, addr net.Addr) (*shadowsocksUser, *shadowsocksPacket) {
+	users := ssr.shadowsocksUsers()
+	if uid, ok := udpMap.ClientUser(addr.String()); ok {
+		if user := users.uids[uid]; user != nil {
+			if p, err := c.open(user, packet); err == nil {
+				return user, p
+			}
+		}
+	}
+	return c.unpack(users, packet)
+}
+
+func (ssr *ShadowsocksRProxy) handleShadowsocksPacket(c shadowsocksCipher, server net.PacketConn, udpMap *ShadowsocksRUDPMap, packet []byte, addr net.Addr) error {
+	user, p := ssr.unpackShadowsocksPacket(c, udpMap, packet, addr)
+	if user == nil {
+		return errors.New("no user match")
+	}
+	// shadowsocks 2022 packets are checked by packet id of the session, the head of them is not a salt
+	if p.sessionID == nil && !replay.GetUDPFilter().Check(packet[:c.SaltSize()]) {
+		metrics.ReplayRejections.Inc(strconv.Itoa(ssr.Port), "udp")
+		log.Debug("shadowsocks drop replayed udp packet from %s", addr.String())
+		return nil
+	}
+	data := p.payload
+	if ssr.TrafficReport != nil {
+		ssr.TrafficReport.Upload(user.uid, int64(len(packet)))
+	}
+	if ssr.UserFirewall != nil && !ssr.UserFirewall.JudgeUser(user.uid) {
+		log.Debug("user %v is disabled, drop udp packet from %s", user.uid, addr.String())
+		return nil
+	}
+	remoteAddr, err := socksproxy.SplitAddr(data)
+	if err != nil {
+		return err
+	}
+	ssr.handleStageAddr(user.uid, addr.String(), server.LocalAddr().String(), remoteAddr.String(), "udp")
+	if ssr.HostFirewall != nil && !ssr.HostFirewall.JudgeHostWithReport(remoteAddr.GetAddress(), user.uid) {
+		metrics.UDPDrops.Inc(udpMap.port, "rule")
+		log.Debug("udp packet from %s to %s is rejected", addr.String(), remoteAddr.String())
+		return nil
+	}
+
+	key := udpSessionKey{client: addr.String(), uid: user.uid, session: string(p.sessionID)}
+	remotePacketConn, target, created, err := ssr.openUDPSession(udpMap, &key, server.LocalAddr(), remoteAddr)
+	if remotePacketConn == nil {
+		return err
+	}
+	if p.sessionID != nil && !remotePacketConn.Window.Check(p.packetID) {
+		metrics.ReplayRejections.Inc(strconv.Itoa(ssr.Port), "udp")
+		log.Debug("shadowsocks drop replayed udp packet %v of session from %s", p.packetID, addr.String())
+		return nil
+	}
+	if created {
+		remotePacketConn.Key = user.key
+		if p.sessionID != nil {
+			remotePacketConn.Session = aead.NewSession2022(p.sessionID)
+		}
+		udpMap.Relay(key, remotePacketConn, func(item *ShadowsocksRUDPMapItem) error {
+			return ssr.shadowsocksTimedCopy(c, server, addr, udpMap, item)
+		})
+	}
+	if target == nil {
+		return err
+	}
+	_, err = remotePacketConn.WriteTo(data[len(remoteAddr.Raw):], target)
+	return errors.WithStack(err)
+}
+
+// shadowsocksTimedCopy copy packets from targets back to client until the session is idle
+func (ssr *ShadowsocksRProxy) shadowsocksTimedCopy(c shadowsocksCipher, dst net.PacketConn, target net.Addr, udpMap *ShadowsocksRUDPMap, src *ShadowsocksRUDPMapItem) error {
+	buf := pool.GetBuf()
+	defer pool.PutBuf(buf)
+	packet := make([]byte, aead.MAX_PACKET_SIZE)
+	uid := int(binaryx.LEBytesToUInt32(src.Uid))
+	for {
+		n, raddr, err := udpMap.ReadFrom(src, buf)
+		if err != nil {
+			return errors.Cause(err)
+		}
+		srcAddr := socksproxy.ParseAddr(raddr.String())
+		data := append(append(make([]byte, 0, len(srcAddr.Raw)+n), srcAddr.Raw...), buf[:n]...)
+		result, err := c.pack(packet, src, data)
+		if err != nil {
+			return err
+		}
+		n, err = dst.WriteTo(result, target)
+		if err != nil {
+			return errors.Cause(err)
+		}
+		if ssr.TrafficReport != nil {
+			ssr.TrafficReport.Download(uid, int64(n))
+		}
+	}
+}
@@ -0,0 +1,513 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/common/network/ciphers"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+)
+
+type trafficRecorder struct {
+	sync.Mutex
+	upload   map[int]int64
+	download map[int]int64
+}
+
+func (r *trafficRecorder) Upload(uid int, n int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.upload[uid] += n
+}
+
+func (r *trafficRecorder) Download(uid int, n int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.download[uid] += n
+}
+
+func (r *trafficRecorder) traffic(uid int) (int64, int64) {
+	r.Lock()
+	defer r.Unlock()
+	return r.upload[uid], r.download[uid]
+}
+
+func startShadowsocks(t *testing.T, single int, method, password string, users map[int]string) (*ShadowsocksRProxy, *trafficRecorder) {
+	recorder := &trafficRecorder{upload: make(map[int]int64), download: make(map[int]int64)}
+	ss := &ShadowsocksRProxy{
+		Host:             "127.0.0.1",
+		Port:             echo.FreePort(t),
+		Method:           method,
+		Password:         password,
+		Single:           single,
+		Mode:             ModeShadowsocks,
+		TrafficReport:    recorder,
+		ShadowsocksRArgs: &ShadowsocksRArgs{},
+	}
+	for uid, passwd := range users {
+		ss.AddUser(uid, passwd)
+	}
+	if err := ss.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return ss, recorder
+}
+
+func shadowsocksEcho(t *testing.T, port int, method, password, target string, data []byte) error {
+	con, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+	_ = con.SetDeadline(time.Now().Add(3 * time.Second))
+	c, err := ciphers.CipherDecorate(password, method, con)
+	if err != nil {
+		return err
+	}
+	if _, err := c.Write(append(socksproxy.ParseAddr(target).Raw, data...)); err != nil {
+		return err
+	}
+	result := make([]byte, len(data))
+	if _, err := io.ReadFull(c, result); err != nil {
+		return err
+	}
+	if !bytes.Equal(result, data) {
+		t.Fatal("tcp echo data is not equal")
+	}
+	return nil
+}
+
+func shadowsocksUDPEcho(t *testing.T, port int, method, password, target string, data []byte) error {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer pc.Close()
+	c, err := ciphers.CipherPacketDecorate(password, method, pc)
+	if err != nil {
+		return err
+	}
+	server := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}
+	packet := append(socksproxy.ParseAddr(target).Raw, data...)
+	if _, err := c.WriteTo(packet, server); err != nil {
+		return err
+	}
+	_ = c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := c.ReadFrom(buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(buf[:n], packet) {
+		t.Fatalf("udp echo data is not equal: %x", buf[:n])
+	}
+	return nil
+}
+
+func TestShadowsocksSinglePort(t *testing.T) {
+	echoTCP, echoUDP := echo.Start(t)
+	defer echoTCP.Close()
+	defer echoUDP.Close()
+	for _, method := range []string{"aes-128-gcm", "aes-256-gcm", "chacha20-ietf-poly1305"} {
+		ss, recorder := startShadowsocks(t, 1, method, "", map[int]string{10001: "p1", 10002: "p2"})
+		data := bytes.Repeat([]byte{'a'}, 20000)
+		if err := shadowsocksEcho(t, ss.Port, method, "p2", echoTCP.Addr().String(), data); err != nil {
+			t.Fatal(err)
+		}
+		if err := shadowsocksUDPEcho(t, ss.Port, method, "p1", echoUDP.LocalAddr().String(), []byte("hello udp")); err != nil {
+			t.Fatal(err)
+		}
+		if up, down := recorder.traffic(10002); up < int64(len(data)) || down < int64(len(data)) {
+			t.Fatalf("%s traffic should be counted to user 10002, got %v %v", method, up, down)
+		}
+		if up, down := recorder.traffic(10001); up == 0 || down == 0 {
+			t.Fatalf("%s udp traffic should be counted to user 10001", method)
+		}
+		if err := shadowsocksEcho(t, ss.Port, method, "unknown", echoTCP.Addr().String(), []byte("x")); err == nil {
+			t.Fatal("unknown password should be rejected")
+		}
+		_ = ss.Close()
+	}
+}
+
+func TestShadowsocksMultiPort(t *testing.T) {
+	echoTCP, echoUDP := echo.Start(t)
+	defer echoTCP.Close()
+	defer echoUDP.Close()
+	ss, recorder := startShadowsocks(t, 0, "aes-256-gcm", "p1", nil)
+	defer ss.Close()
+	if err := shadowsocksEcho(t, ss.Port, "aes-256-gcm", "p1", echoTCP.Addr().String(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if up, _ := recorder.traffic(ss.Port); up == 0 {
+		t.Fatal("traffic should be counted to owner of the port")
+	}
+
+	stream := &ShadowsocksRProxy{Host: "127.0.0.1", Port: echo.FreePort(t), Method: "aes-128-cfb", Mode: ModeShadowsocks, ShadowsocksRArgs: &ShadowsocksRArgs{}}
+	if err := stream.Start(); err == nil {
+		_ = stream.Close()
+		t.Fatal("stream cipher should be rejected in shadowsocks mode")
+	}
+}
+
+func psk2022(b byte, size int) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, size))
+}
+
+func TestShadowsocks2022(t *testing.T) {
+	echoTCP, echoUDP := echo.Start(t)
+	defer echoTCP.Close()
+	defer echoUDP.Close()
+	for _, item := range []struct {
+		method  string
+		size    int
+		ipsk    string
+		unknown string
+	}{
+		{"2022-blake3-aes-128-gcm", 16, psk2022(9, 16), psk2022(9, 16) + ":" + psk2022(3, 16)},
+		{"2022-blake3-aes-256-gcm", 32, psk2022(9, 32), psk2022(1, 32) + ":" + psk2022(2, 32)},
+		{"2022-blake3-chacha20-poly1305", 32, "", psk2022(3, 32)},
+	} {
+		k1, k2 := psk2022(1, item.size), psk2022(2, item.size)
+		p1, p2 := k1, k2
+		if item.ipsk != "" {
+			p1, p2 = item.ipsk+":"+k1, item.ipsk+":"+k2
+		}
+		ss, recorder := startShadowsocks(t, 1, item.method, item.ipsk, map[int]string{10001: k1, 10002: k2, 10003: "not a psk"})
+		data := bytes.Repeat([]byte{'a'}, 100000)
+		if err := shadowsocksEcho(t, ss.Port, item.method, p2, echoTCP.Addr().String(), data); err != nil {
+			t.Fatalf("%s %s", item.method, err)
+		}
+		if err := shadowsocksUDPEcho(t, ss.Port, item.method, p1, echoUDP.LocalAddr().String(), []byte("hello udp")); err != nil {
+			t.Fatalf("%s %s", item.method, err)
+		}
+		if up, down := recorder.traffic(10002); up < int64(len(data)) || down < int64(len(data)) {
+			t.Fatalf("%s traffic should be counted to user 10002, got %v %v", item.method, up, down)
+		}
+		if up, down := recorder.traffic(10001); up == 0 || down == 0 {
+			t.Fatalf("%s udp traffic should be counted to user 10001", item.method)
+		}
+		if err := shadowsocksEcho(t, ss.Port, item.method, item.unknown, echoTCP.Addr().String(), []byte("x")); err == nil {
+			t.Fatalf("%s unknown psk should be rejected", item.method)
+		}
+		if item.ipsk != "" {
+			if err := shadowsocksUDPEcho(t, ss.Port, item.method, item.unknown, echoUDP.LocalAddr().String(), []byte("x")); err == nil {
+				t.Fatalf("%s unknown identity should be rejected by udp", item.method)
+			}
+		}
+		_ = ss.Close()
+	}
+
+	method, key := "2022-blake3-aes-256-gcm", psk2022(1, 32)
+	ss, recorder := startShadowsocks(t, 0, method, key, nil)
+	defer ss.Close()
+	if err := shadowsocksEcho(t, ss.Port, method, key, echoTCP.Addr().String(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := shadowsocksUDPEcho(t, ss.Port, method, key, echoUDP.LocalAddr().String(), []byte("hello udp")); err != nil {
+		t.Fatal(err)
+	}
+	if up, down := recorder.traffic(ss.Port); up == 0 || down == 0 {
+		t.Fatal("traffic should be counted to owner of the port")
+	}
+
+	ssr := &ShadowsocksRProxy{Host: "127.0.0.1", Port: echo.FreePort(t), Method: method, Password: key, ShadowsocksRArgs: &ShadowsocksRArgs{}}
+	if err := ssr.Start(); err == nil {
+		_ = ssr.Close()
+		t.Fatal("shadowsocks 2022 method should be rejected in shadowsocksr mode")
+	}
+}
+
+// recordConn record the stream written by client
+type recordConn struct {
+	net.Conn
+	stream bytes.Buffer
+}
+
+func (r *recordConn) Write(b []byte) (int, error) {
+	r.stream.Write(b)
+	return r.Conn.Write(b)
+}
+
+// recordPacketConn record the last packet written by client
+type recordPacketConn struct {
+	net.PacketConn
+	packet []byte
+}
+
+func (r *recordPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	r.packet = append([]byte{}, b...)
+	return r.PacketConn.WriteTo(b, addr)
+}
+
+func TestShadowsocksReplay(t *testing.T) {
+	echoTCP, echoUDP := echo.Start(t)
+	defer echoTCP.Close()
+	defer echoUDP.Close()
+	for _, mode := range []string{ModeShadowsocksR, ModeShadowsocks} {
+		for _, method := range []string{"aes-128-cfb", "aes-128-gcm", "2022-blake3-aes-128-gcm"} {
+			if (mode == ModeShadowsocksR) == (method != "aes-128-cfb") {
+				continue
+			}
+			password := psk2022(7, 16)
+			ss := &ShadowsocksRProxy{
+				Host:             "127.0.0.1",
+				Port:             echo.FreePort(t),
+				Method:           method,
+				Password:         password,
+				Protocol:         "origin",
+				Obfs:             "plain",
+				Mode:             mode,
+				ShadowsocksRArgs: &ShadowsocksRArgs{},
+			}
+			if err := ss.Start(); err != nil {
+				t.Fatal(err)
+			}
+			server := net.JoinHostPort("127.0.0.1", strconv.Itoa(ss.Port))
+
+			con, err := net.Dial("tcp", server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := &recordConn{Conn: con}
+			c, err := ciphers.CipherDecorate(password, method, record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+			if _, err := c.Write(append(socksproxy.ParseAddr(echoTCP.Addr().String()).Raw, "hello"...)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+				t.Fatalf("%s %s", method, err)
+			}
+			_ = con.Close()
+
+			replayed, err := net.Dial("tcp", server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := replayed.Write(record.stream.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			_ = replayed.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			_, err = replayed.Read(make([]byte, 1))
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				t.Fatalf("%s replayed connection should be held without response, got %v", method, err)
+			}
+			_ = replayed.Close()
+			if metrics.ReplayRejections.Get(strconv.Itoa(ss.Port), "tcp") != 1 {
+				t.Fatalf("%s replayed tcp should be counted", method)
+			}
+
+			pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			recordPacket := &recordPacketConn{PacketConn: pc}
+			p, err := ciphers.CipherPacketDecorate(password, method, recordPacket)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serverAddr := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: ss.Port}
+			if _, err := p.WriteTo(append(socksproxy.ParseAddr(echoUDP.LocalAddr().String()).Raw, "hello"...), serverAddr); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 2048)
+			_ = pc.SetReadDeadline(time.Now().Add(3 * time.Second))
+			if _, _, err := pc.ReadFrom(buf); err != nil {
+				t.Fatalf("%s %s", method, err)
+			}
+			if _, err := pc.WriteTo(recordPacket.packet, serverAddr); err != nil {
+				t.Fatal(err)
+			}
+			_ = pc.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			if _, _, err := pc.ReadFrom(buf); err == nil {
+				t.Fatalf("%s replayed udp packet should be dropped", method)
+			}
+			_ = pc.Close()
+			if metrics.ReplayRejections.Get(strconv.Itoa(ss.Port), "udp") != 1 {
+				t.Fatalf("%s replayed udp should be counted", method)
+			}
+			_ = ss.Close()
+		}
+	}
+}
+
+func TestShadowsocksFallback(t *testing.T) {
+	echoTCP, echoUDP := echo.Start(t)
+	defer echoTCP.Close()
+	defer echoUDP.Close()
+	probe := []byte("GET / HTTP/1.1\r\nHost: www.example.com\r\nUser-Agent: curl/7.68.0\r\nAccept: */*\r\n\r\n")
+	for _, method := range []string{"aes-128-cfb", "aes-128-gcm", "2022-blake3-aes-128-gcm"} {
+		for _, protocol := range []string{"origin", "auth_sha1_v4"} {
+			mode := ModeShadowsocks
+			if method == "aes-128-cfb" {
+				mode = ModeShadowsocksR
+			} else if protocol != "origin" {
+				continue
+			}
+			password := psk2022(9, 16)
+			ss := &ShadowsocksRProxy{
+				Host:             "127.0.0.1",
+				Port:             echo.FreePort(t),
+				Method:           method,
+				Password:         password,
+				Protocol:         protocol,
+				Obfs:             "plain",
+				Mode:             mode,
+				Fallback:         echoTCP.Addr().String(),
+				ShadowsocksRArgs: &ShadowsocksRArgs{},
+			}
+			if err := ss.Start(); err != nil {
+				t.Fatal(err)
+			}
+			server := net.JoinHostPort("127.0.0.1", strconv.Itoa(ss.Port))
+
+			// the probe is answered by the fallback as if it was sent there
+			if err := fallbackEcho(server, probe); err != nil {
+				t.Fatalf("%s %s probe should be forwarded to fallback, %s", method, protocol, err)
+			}
+			if metrics.Fallbacks.Get(strconv.Itoa(ss.Port)) != 1 {
+				t.Fatalf("%s %s fallback should be counted", method, protocol)
+			}
+			if protocol != "origin" {
+				_ = ss.Close()
+				continue
+			}
+
+			// a client with the right key is not affected, and its replay goes to the fallback
+			con, err := net.Dial("tcp", server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			record := &recordConn{Conn: con}
+			c, err := ciphers.CipherDecorate(password, method, record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+			if _, err := c.Write(append(socksproxy.ParseAddr(echoTCP.Addr().String()).Raw, "hello"...)); err != nil {
+				t.Fatal(err)
+			}
+			result := make([]byte, 5)
+			if _, err := io.ReadFull(c, result); err != nil || string(result) != "hello" {
+				t.Fatalf("%s client should be proxied, %v", method, err)
+			}
+			_ = con.Close()
+			if err := fallbackEcho(server, record.stream.Bytes()); err != nil {
+				t.Fatalf("%s replay should be forwarded to fallback, %s", method, err)
+			}
+			if metrics.Fallbacks.Get(strconv.Itoa(ss.Port)) != 2 {
+				t.Fatalf("%s replay fallback should be counted", method)
+			}
+			_ = ss.Close()
+		}
+	}
+}
+
+func TestShadowsocksFallbackUnreachable(t *testing.T) {
+	echoTCP, echoUDP := echo.Start(t)
+	defer echoTCP.Close()
+	defer echoUDP.Close()
+	unreachable := net.JoinHostPort("127.0.0.1", strconv.Itoa(echo.FreePort(t)))
+	for _, method := range []string{"aes-128-cfb", "aes-128-gcm"} {
+		mode := ModeShadowsocks
+		if method == "aes-128-cfb" {
+			mode = ModeShadowsocksR
+		}
+		password := psk2022(11, 16)
+		ss := &ShadowsocksRProxy{
+			Host:             "127.0.0.1",
+			Port:             echo.FreePort(t),
+			Method:           method,
+			Password:         password,
+			Protocol:         "origin",
+			Obfs:             "plain",
+			Mode:             mode,
+			Fallback:         unreachable,
+			ShadowsocksRArgs: &ShadowsocksRArgs{},
+		}
+		if err := ss.Start(); err != nil {
+			t.Fatal(err)
+		}
+		server := net.JoinHostPort("127.0.0.1", strconv.Itoa(ss.Port))
+
+		con, err := net.Dial("tcp", server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := &recordConn{Conn: con}
+		c, err := ciphers.CipherDecorate(password, method, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = c.SetDeadline(time.Now().Add(3 * time.Second))
+		if _, err := c.Write(append(socksproxy.ParseAddr(echoTCP.Addr().String()).Raw, "hello"...)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, make([]byte, 5)); err != nil {
+			t.Fatalf("%s %s", method, err)
+		}
+		_ = con.Close()
+
+		// the replay is discarded as if there was no fallback
+		replayed, err := net.Dial("tcp", server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := replayed.Write(record.stream.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		_ = replayed.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		_, err = replayed.Read(make([]byte, 1))
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Fatalf("%s replayed connection should be held when fallback is unreachable, got %v", method, err)
+		}
+		_ = replayed.Close()
+		if metrics.Fallbacks.Get(strconv.Itoa(ss.Port)) != 0 {
+			t.Fatalf("%s unreachable fallback should not be counted", method)
+		}
+		_ = ss.Close()
+	}
+}
+
+// fallbackEcho send data to server whose fallback is an echo server, data and what is
+// sent after it should be echoed
+func fallbackEcho(server string, data []byte) error {
+	con, err := net.Dial("tcp", server)
+	if err != nil {
+		return err
+	}
+	defer con.Close()
+	_ = con.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := con.Write(data); err != nil {
+		return err
+	}
+	result := make([]byte, len(data))
+	if _, err := io.ReadFull(con, result); err != nil {
+		return err
+	}
+	if !bytes.Equal(result, data) {
+		return errors.New("fallback does not receive the data")
+	}
+	if _, err := con.Write([]byte("more")); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(con, result[:4]); err != nil {
+		return err
+	}
+	if string(result[:4]) != "more" {
+		return errors.New("connection is not spliced to fallback")
+	}
+	return nil
+}
@@ -5,12 +5,14 @@ import (
 	"encoding/hex"
 	"fmt"
 	"github.com/ProxyPanel/VNet-SSR/common"
+	"github.com/ProxyPanel/VNet-SSR/common/ciphers/aead"
 	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
 	"github.com/ProxyPanel/VNet-SSR/common/network"
+	"github.com/ProxyPanel/VNet-SSR/common/outbound"
 	"github.com/ProxyPanel/VNet-SSR/common/pool"
 	"github.com/ProxyPanel/VNet-SSR/core"
 	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
-	"github.com/ProxyPanel/VNet-SSR/utils/goroutine"
 	"github.com/ProxyPanel/VNet-SSR/utils/netx"
 	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
 	"github.com/pkg/errors"
@@ -20,11 +22,20 @@ import (
 	"net"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// ModeShadowsocksR serve shadowsocksr with protocol and obfs, it is the default mode
+	ModeShadowsocksR = "ssr"
+	// ModeShadowsocks serve plain shadowsocks aead without protocol and obfs
+	ModeShadowsocks = "ss"
+)
+
 // ShadowsocksProxy is respect shadowsocks proxy service
 // it have Start and Stop method to control proxy
 type ShadowsocksRProxy struct {
@@ -40,11 +51,33 @@ type ShadowsocksRProxy struct {
 	Users             map[string]string `json:"users,omitempty"`
 	Status            string            `json:"status,omitempty"`
 	Single            int               `json:"single,omitempty"`
+	Mode              string            `json:"mode,omitempty"`
+	Fallback          string            `json:"fallback,omitempty"`
+	// UDPTimeout is how long a udp session is kept without packets, zero means DefaultUDPTimeout
+	UDPTimeout time.Duration `json:"udp_timeout,omitempty"`
+	// UDPSessionLimit is the max number of udp sessions of a user on the port, zero means unlimited
+	UDPSessionLimit int `json:"udp_session_limit,omitempty"`
+	// ProxyProtocol read PROXY protocol headers of tcp connections, they must come from TrustedProxies
+	ProxyProtocol  bool     `json:"proxy_protocol,omitempty"`
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
 	network.ILimiter
 	core.HostFirewall
-	common.TrafficReport `json:"-"`
-	common.OnlineReport  `json:"-"`
+	core.UserFirewall
+	common.TrafficReport    `json:"-"`
+	common.OnlineReport     `json:"-"`
+	outbound.Router         `json:"-"`
+	outbound.SourceSelector `json:"-"`
 	*ShadowsocksRArgs
+	sessions     map[int]map[net.Conn]struct{}
+	sessionsLock sync.Mutex
+	// usersLock serialize changes of Users, every change replaces Users with a new map which is also
+	// stored in currentUsers, connections read a snapshot of it without the lock
+	usersLock    sync.Mutex
+	currentUsers atomic.Value
+	// ssCipher is the cipher of shadowsocks mode, ssUsers is the *shadowsocksUsers of currentUsers
+	// with their keys, it is replaced with currentUsers
+	ssCipher shadowsocksCipher
+	ssUsers  atomic.Value
 }
 
 // ShadowsocksArgs is ShadowsocksProxy arguments
@@ -55,17 +88,59 @@ type ShadowsocksRArgs struct {
 
 // Start tcp and udp according to the configuration
 func (ssr *ShadowsocksRProxy) Start() error {
+	if ssr.Mode == ModeShadowsocks {
+		c, err := ssr.newShadowsocksCipher()
+		if err != nil {
+			return err
+		}
+		ssr.usersLock.Lock()
+		ssr.ssCipher = c
+		ssr.usersLock.Unlock()
+	}
+	ssr.updateUsers(func(map[string]string) {})
 	ssr.Listener = network.NewListener(fmt.Sprintf("%s:%v", ssr.Host, ssr.Port), 5*time.Second)
+	if ssr.Mode != ModeShadowsocks && aead.GetAEAD2022Cipher(ssr.Method) != nil {
+		return errors.New(fmt.Sprintf("method %s is only supported in shadowsocks mode", ssr.Method))
+	}
+	if ssr.Fallback != "" {
+		if _, _, err := net.SplitHostPort(ssr.Fallback); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("fallback %s is not a valid address", ssr.Fallback))
+		}
+	}
+	if ssr.ProxyProtocol {
+		proxyProtocol, err := network.NewProxyProtocol(ssr.TrustedProxies)
+		if err != nil {
+			return err
+		}
+		ssr.Listener.ProxyProtocol = proxyProtocol
+	}
+	return ssr.listen()
+}
+
+// Relisten listen again on the listener which is closed, connections accepted before are still
+// tracked by it, so they can be drained and killed together with new ones
+func (ssr *ShadowsocksRProxy) Relisten() error {
+	if ssr.Listener == nil {
+		return errors.New(fmt.Sprintf("server %v is not started", ssr.Port))
+	}
+	return ssr.listen()
+}
+
+func (ssr *ShadowsocksRProxy) listen() error {
+	startTCP, startUDP := ssr.StartTCP, ssr.StartUDP
+	if ssr.Mode == ModeShadowsocks {
+		startTCP, startUDP = ssr.StartShadowsocksTCP, ssr.StartShadowsocksUDP
+	}
 	var err error
 	if ssr.ShadowsocksRArgs.TCPSwitch != "false" {
-		err = ssr.StartTCP()
+		err = startTCP()
 		if err != nil {
 			return err
 		}
 	}
 
 	if ssr.ShadowsocksRArgs.UDPSwitch != "false" {
-		err = ssr.StartUDP()
+		err = startUDP()
 		if err != nil {
 			return err
 		}
@@ -75,6 +150,7 @@ func (ssr *ShadowsocksRProxy) Start() error {
 
 func (ssr *ShadowsocksRProxy) StartTCP() error {
 	return ssr.ListenTCP(func(request *network.Request) {
+		record := ssr.recordHandshake(request)
 		ssrd, err := network.NewShadowsocksRDecorate(request,
 			ssr.Obfs, ssr.Method,
 			ssr.Password, ssr.Protocol,
@@ -82,7 +158,7 @@ func (ssr *ShadowsocksRProxy) StartTCP() error {
 			ssr.Host, ssr.Port,
 			false,
 			ssr.Single,
-			ssr.Users)
+			ssr.GetUsers())
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"requestId": request.RequestID,
@@ -92,7 +168,8 @@ func (ssr *ShadowsocksRProxy) StartTCP() error {
 		}
 		ssrd.TrafficReport = ssr.TrafficReport
 		ssrd.SetLimter(ssr.ILimiter)
-		go func() {
+		// handle in listener goroutine, so the listener knows when connection is finished
+		func() {
 			defer func() {
 				if err := recover(); err != nil {
 					logrus.WithFields(logrus.Fields{
@@ -101,34 +178,43 @@ func (ssr *ShadowsocksRProxy) StartTCP() error {
 				}
 			}()
 			defer ssrd.Close()
+			metrics.ActiveTCP.Inc(strconv.Itoa(ssr.Port))
+			defer metrics.ActiveTCP.Dec(strconv.Itoa(ssr.Port))
 			addr, err := socksproxy.ReadAddr(ssrd)
-			if err != nil && err != io.EOF {
-				logrus.WithFields(logrus.Fields{
-					"requestId": ssrd.RequestID,
-				}).Errorf("shadowsocksr read address error %s", err)
+			if err != nil {
+				if errors.Cause(err) == network.ErrReplay {
+					if !ssr.fallback(request, record) {
+						_ = network.Discard(request, network.ReplayTimeout)
+					}
+					return
+				}
+				if err != io.EOF {
+					metrics.HandshakeFailures.Inc(ssr.Obfs, ssr.Protocol)
+					logrus.WithFields(logrus.Fields{
+						"requestId": ssrd.RequestID,
+					}).Errorf("shadowsocksr read address error %s", err)
+					ssr.fallback(request, record)
+				}
+				return
+			}
+			if record != nil {
+				record.Established()
+			}
+			if ssr.UserFirewall != nil && !ssr.UserFirewall.JudgeUser(ssrd.UID) {
+				log.Info("user %v is disabled, reject %s", ssrd.UID, ssrd.RemoteAddr().String())
 				return
 			}
+			ssr.addSession(ssrd.UID, ssrd)
+			defer ssr.delSession(ssrd.UID, ssrd)
 			ssr.handleStageAddr(ssrd.UID, ssrd.RemoteAddr().String(), ssrd.LocalAddr().String(), addr.String(), "tcp")
 			log.Info("reslove addr success: %s requestId: %s", addr.String(), ssrd.GetRequestId())
 
 			if ssr.HostFirewall != nil && !ssr.HostFirewall.JudgeHostWithReport(addr.GetAddress(), ssrd.UID) {
-				log.Info("%s is reject", addr.String())
-				body := fmt.Sprintf("%s is reject", addr.String())
-				t := &http.Response{
-					Status:        "200 OK",
-					StatusCode:    200,
-					Proto:         "HTTP/1.1",
-					ProtoMajor:    1,
-					ProtoMinor:    1,
-					Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
-					ContentLength: int64(len(body)),
-					Header:        make(http.Header, 0),
-				}
-				_ = t.Write(ssrd)
+				writeReject(ssrd, addr.String())
 				return
 			}
 
-			req, err := network.DialTcp(addr.String())
+			req, err := ssr.dial(ssrd.UID, ssrd.LocalAddr(), addr)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"requestId": ssrd.RequestID,
@@ -165,18 +251,25 @@ func (ssr *ShadowsocksRProxy) StartUDP() error {
 				ssr.Host, ssr.Port,
 				false,
 				ssr.Single,
-				ssr.Users)
-			ssrd.TrafficReport = ssr.TrafficReport
+				nil)
 			if err != nil {
 				logrus.WithFields(logrus.Fields{
 					"requestId": request.RequestID,
 					"error":     err,
 				}).Error("shadowsocksr NewShadowsocksRDecorate error")
+				return
 			}
-			// TODO UDP TIMEOUT
-			udpMap := NewShadowsocksRUDPMap(30)
+			// the udp decorate lives as long as the port, it reads the current users of every packet
+			ssrd.UsersFunc = ssr.GetUsers
+			ssrd.TrafficReport = ssr.TrafficReport
+			udpMap := ssr.newUDPMap()
+			defer udpMap.CloseAll()
 			for {
 				data, uid, addr, err := ssrd.ReadFrom()
+				if err == network.ErrReplay {
+					log.Debug("shadowsocksr drop replayed udp packet from %s", addr.String())
+					continue
+				}
 				if err != nil {
 					if strings.Contains(err.Error(), " use of closed network connection") {
 						logrus.WithFields(logrus.Fields{
@@ -189,68 +282,16 @@ func (ssr *ShadowsocksRProxy) StartUDP() error {
 					}).Error("ShadowsocksRDecrate read udp error")
 					continue
 				}
-				remoteAddr, err := socksproxy.SplitAddr(data)
-				if err != nil && err != io.EOF {
-					logrus.WithFields(logrus.Fields{
-						"requestId": ssrd.RequestID,
-					}).Errorf("shadowsocksr read address error %s", err)
+				if len(data) == 0 {
 					continue
 				}
-				logrus.WithFields(logrus.Fields{
-					"remoteAddr": remoteAddr.String(),
-					"serverAddr": ssrd.PacketConn.LocalAddr().String(),
-					"clientAddr": addr.String(),
-					"uid":        binaryx.LEBytesToUInt32(uid),
-				}).Info("recive udp proxy")
-				data = data[len(remoteAddr.Raw):]
-				remotePacketConn := udpMap.Get(addr.String())
-				if remotePacketConn == nil {
-					remotePacketConn = &ShadowsocksRUDPMapItem{}
-					remotePacketConn.Uid = uid
-					remotePacketConn.PacketConn, err = net.ListenPacket("udp", "")
-					if err != nil {
-						logrus.WithFields(logrus.Fields{
-							"remoteAddr": remoteAddr.String(),
-							"serverAddr": ssrd.PacketConn.LocalAddr().String(),
-							"clientAddr": addr.String(),
-							"uid":        binaryx.LEBytesToUInt32(uid),
-							"err":        err,
-						}).Error("shadowoscksr listenPacket udp error")
-						continue
-					}
-					udpMap.Add(addr, ssrd, remotePacketConn)
-				}
-				remoteAddrResolve, err := net.ResolveUDPAddr("udp", remoteAddr.String())
-				if err != nil {
+				if err := ssr.handleShadowsocksRPacket(ssrd, udpMap, data, int(binaryx.LEBytesToUInt32(uid)), addr); err != nil {
 					logrus.WithFields(logrus.Fields{
-						"remoteAddr": remoteAddr.String(),
 						"serverAddr": ssrd.PacketConn.LocalAddr().String(),
 						"clientAddr": addr.String(),
 						"uid":        binaryx.LEBytesToUInt32(uid),
 						"err":        err,
-					}).Error("shadowoscksr listenPacket udp error")
-					continue
-				}
-				ssr.handleStageAddr(int(binaryx.LEBytesToUInt32(uid)), addr.String(), ssrd.PacketConn.LocalAddr().String(), remoteAddr.String(), "udp")
-
-				if ssr.HostFirewall != nil && !ssr.HostFirewall.JudgeHostWithReport(addr.String(), int(binaryx.LEBytesToUInt32(uid))) {
-					return
-				}
-
-				//udpMap.Add(addr, ssrd, remotePacketConn)
-				_, err = remotePacketConn.WriteTo(data, remoteAddrResolve)
-				if err != nil {
-					if err != nil {
-						logrus.WithFields(logrus.Fields{
-							"remoteAddr": remoteAddr.String(),
-							"serverAddr": ssrd.PacketConn.LocalAddr().String(),
-							"clientAddr": addr.String(),
-							"uid":        binaryx.LEBytesToUInt32(uid),
-							"err":        err,
-						}).Error("shadowoscksr listenPacket udp error")
-						continue
-					}
-					//udpMap.Add(addr, ssrd, remotePacketConn)
+					}).Error("shadowsocksr udp proxy error")
 				}
 			}
 		}()
@@ -258,6 +299,45 @@ func (ssr *ShadowsocksRProxy) StartUDP() error {
 	return err
 }
 
+// newUDPMap create the udp NAT table of the port with the configured timeout and session limit
+func (ssr *ShadowsocksRProxy) newUDPMap() *ShadowsocksRUDPMap {
+	return NewShadowsocksRUDPMap(ssr.Port, ssr.UDPTimeout, ssr.UDPSessionLimit)
+}
+
+// handleShadowsocksRPacket send a decrypted packet of uid to its target, packets which
+// are rejected by the firewalls or over the session limit are dropped without an error
+func (ssr *ShadowsocksRProxy) handleShadowsocksRPacket(ssrd *network.ShadowsocksRDecorate, udpMap *ShadowsocksRUDPMap, data []byte, uid int, addr net.Addr) error {
+	remoteAddr, err := socksproxy.SplitAddr(data)
+	if err != nil {
+		return err
+	}
+	if ssr.UserFirewall != nil && !ssr.UserFirewall.JudgeUser(uid) {
+		log.Debug("user %v is disabled, drop udp packet from %s", uid, addr.String())
+		return nil
+	}
+	ssr.handleStageAddr(uid, addr.String(), ssrd.PacketConn.LocalAddr().String(), remoteAddr.String(), "udp")
+	if ssr.HostFirewall != nil && !ssr.HostFirewall.JudgeHostWithReport(remoteAddr.GetAddress(), uid) {
+		metrics.UDPDrops.Inc(udpMap.port, "rule")
+		log.Debug("udp packet from %s to %s is rejected", addr.String(), remoteAddr.String())
+		return nil
+	}
+	key := udpSessionKey{client: addr.String(), uid: uid}
+	item, target, created, err := ssr.openUDPSession(udpMap, &key, ssrd.PacketConn.LocalAddr(), remoteAddr)
+	if item == nil {
+		return err
+	}
+	if created {
+		udpMap.Relay(key, item, func(item *ShadowsocksRUDPMapItem) error {
+			return shadowsocksRTimedCopy(ssrd, addr, udpMap, item)
+		})
+	}
+	if target == nil {
+		return err
+	}
+	_, err = item.WriteTo(data[len(remoteAddr.Raw):], target)
+	return errors.WithStack(err)
+}
+
 func (ssr *ShadowsocksRProxy) handleStageAddr(uid int, client, server, proxyTarget, network string) {
 	if uid == 0 {
 		logrus.WithFields(logrus.Fields{
@@ -273,106 +353,123 @@ func (ssr *ShadowsocksRProxy) handleStageAddr(uid int, client, server, proxyTarg
 	}
 }
 
-func (ssr *ShadowsocksRProxy) AddUser(uid int, password string) {
-	if ssr.Users == nil {
-		ssr.Users = make(map[string]string)
+// writeReject answer a http response through the tunnel when target is rejected by rules
+func writeReject(w io.Writer, addr string) {
+	log.Info("%s is reject", addr)
+	body := fmt.Sprintf("%s is reject", addr)
+	t := &http.Response{
+		Status:        "200 OK",
+		StatusCode:    200,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Header:        make(http.Header, 0),
 	}
-	uidPack := binaryx.LEUint32ToBytes(uint32(uid))
-	logrus.Debugf("shadowsocksr adduser uidPack: %s", hex.EncodeToString(uidPack))
-	uidPackStr := string(uidPack)
-	ssr.Users[uidPackStr] = password
+	_ = t.Write(w)
 }
 
-func (ssr *ShadowsocksRProxy) DelUser(uid int) {
-	if ssr.Users == nil {
-		return
+func (ssr *ShadowsocksRProxy) addSession(uid int, conn net.Conn) {
+	ssr.sessionsLock.Lock()
+	defer ssr.sessionsLock.Unlock()
+	if ssr.sessions == nil {
+		ssr.sessions = make(map[int]map[net.Conn]struct{})
 	}
-	uidPack := string(binaryx.LEUint32ToBytes(uint32(uid)))
-	delete(ssr.Users, uidPack)
+	if ssr.sessions[uid] == nil {
+		ssr.sessions[uid] = make(map[net.Conn]struct{})
+	}
+	ssr.sessions[uid][conn] = struct{}{}
 }
 
-func (ssr *ShadowsocksRProxy) Reload(users map[string]string) {
-	ssr.Users = users
+func (ssr *ShadowsocksRProxy) delSession(uid int, conn net.Conn) {
+	ssr.sessionsLock.Lock()
+	defer ssr.sessionsLock.Unlock()
+	delete(ssr.sessions[uid], conn)
+	if len(ssr.sessions[uid]) == 0 {
+		delete(ssr.sessions, uid)
+	}
 }
 
-type ShadowsocksRUDPMapItem struct {
-	net.PacketConn
-	Uid []byte
+// Sessions return the number of tcp connections of uid
+func (ssr *ShadowsocksRProxy) Sessions(uid int) int {
+	ssr.sessionsLock.Lock()
+	defer ssr.sessionsLock.Unlock()
+	return len(ssr.sessions[uid])
 }
 
-// Packet NAT table
-type ShadowsocksRUDPMap struct {
-	sync.RWMutex
-	m       map[string]*ShadowsocksRUDPMapItem
-	timeout time.Duration
+// KillUser close all tcp connections of uid, it return the number of closed connections
+func (ssr *ShadowsocksRProxy) KillUser(uid int) int {
+	ssr.sessionsLock.Lock()
+	sessions := ssr.sessions[uid]
+	delete(ssr.sessions, uid)
+	ssr.sessionsLock.Unlock()
+	for conn := range sessions {
+		_ = conn.Close()
+	}
+	return len(sessions)
 }
 
-func NewShadowsocksRUDPMap(timeout time.Duration) *ShadowsocksRUDPMap {
-	m := &ShadowsocksRUDPMap{}
-	m.m = make(map[string]*ShadowsocksRUDPMapItem)
-	m.timeout = timeout
-	return m
+// GetUsers return a snapshot of users, it must not be changed
+func (ssr *ShadowsocksRProxy) GetUsers() map[string]string {
+	users, _ := ssr.currentUsers.Load().(map[string]string)
+	return users
 }
 
-func (m *ShadowsocksRUDPMap) Get(key string) *ShadowsocksRUDPMapItem {
-	m.RLock()
-	defer m.RUnlock()
-	return m.m[key]
+// updateUsers apply update to a copy of users and publish it, readers keep the snapshot they have
+func (ssr *ShadowsocksRProxy) updateUsers(update func(users map[string]string)) {
+	ssr.usersLock.Lock()
+	defer ssr.usersLock.Unlock()
+	users := make(map[string]string, len(ssr.Users)+1)
+	for uidPack, password := range ssr.Users {
+		users[uidPack] = password
+	}
+	update(users)
+	ssr.Users = users
+	ssr.currentUsers.Store(users)
+	if ssr.ssCipher != nil {
+		ssr.ssUsers.Store(ssr.newShadowsocksUsers(ssr.ssCipher, users))
+	}
 }
 
-func (m *ShadowsocksRUDPMap) Set(key string, pc *ShadowsocksRUDPMapItem) {
-	m.Lock()
-	defer m.Unlock()
-	m.m[key] = pc
+func (ssr *ShadowsocksRProxy) AddUser(uid int, password string) {
+	uidPack := binaryx.LEUint32ToBytes(uint32(uid))
+	logrus.Debugf("shadowsocksr adduser uidPack: %s", hex.EncodeToString(uidPack))
+	ssr.updateUsers(func(users map[string]string) {
+		users[string(uidPack)] = password
+	})
 }
 
-func (m *ShadowsocksRUDPMap) Del(key string) *ShadowsocksRUDPMapItem {
-	m.Lock()
-	defer m.Unlock()
-
-	pc, ok := m.m[key]
-	if ok {
-		delete(m.m, key)
-		return pc
-	}
-	return nil
+func (ssr *ShadowsocksRProxy) DelUser(uid int) {
+	uidPack := string(binaryx.LEUint32ToBytes(uint32(uid)))
+	ssr.updateUsers(func(users map[string]string) {
+		delete(users, uidPack)
+	})
 }
 
-func (m *ShadowsocksRUDPMap) Add(client net.Addr, server *network.ShadowsocksRDecorate, remoteServer *ShadowsocksRUDPMapItem) {
-	m.Set(client.String(), remoteServer)
-	go goroutine.Protect(func() {
-		//TODO defer recover
-		_ = ShadowsocksRMapTimeCopy(server, client, remoteServer, m.timeout)
-		if pc := m.Del(client.String()); pc != nil {
-			_ = pc.Close()
+func (ssr *ShadowsocksRProxy) Reload(users map[string]string) {
+	ssr.updateUsers(func(current map[string]string) {
+		for uidPack := range current {
+			delete(current, uidPack)
+		}
+		for uidPack, password := range users {
+			current[uidPack] = password
 		}
 	})
 }
 
-// copy from src to dst at target with read timeout
-func ShadowsocksRMapTimeCopy(dst *network.ShadowsocksRDecorate, target net.Addr, src *ShadowsocksRUDPMapItem, timeout time.Duration) error {
+// shadowsocksRTimedCopy copy packets from targets back to client until the session is idle
+func shadowsocksRTimedCopy(dst *network.ShadowsocksRDecorate, target net.Addr, udpMap *ShadowsocksRUDPMap, src *ShadowsocksRUDPMapItem) error {
 	buf := pool.GetBuf()
 	defer pool.PutBuf(buf)
-	defer func() {
-		if e := recover(); e != nil {
-			log.Error("panic in timedCopy:%v %s", e, string(debug.Stack()))
-		}
-	}()
-
 	for {
-		_ = src.SetReadDeadline(time.Now().Add(timeout * time.Second))
-		n, raddr, err := src.ReadFrom(buf)
+		n, raddr, err := udpMap.ReadFrom(src, buf)
 		if err != nil {
 			return errors.Cause(err)
 		}
-
-		srcAddr := socksproxy.ParseAddr(raddr.String())
-		srcAddrByte := srcAddr.Raw
-		copy(buf[len(srcAddrByte):], buf[:n])
-		copy(buf, srcAddrByte)
-		err = dst.WriteTo(buf[:len(srcAddrByte)+n], src.Uid, target)
-
-		if err != nil {
+		srcAddrByte := socksproxy.ParseAddr(raddr.String()).Raw
+		data := append(append(make([]byte, 0, len(srcAddrByte)+n), srcAddrByte...), buf[:n]...)
+		if err = dst.WriteTo(data, src.Uid, target); err != nil {
 			return errors.Cause(err)
 		}
 	}
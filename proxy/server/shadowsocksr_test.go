@@ -3,10 +3,18 @@ package server
 import (
 	"fmt"
 	"github.com/ProxyPanel/VNet-SSR/common/network/ciphers"
+	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/proxy/client"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
 	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"testing"
 	"time"
 )
 
@@ -42,3 +50,147 @@ func ExampleShadowsocksR() {
 	fmt.Println(string(text))
 	//Output:
 }
+
+type onlineRecorder struct {
+	sync.Mutex
+	ips map[int][]string
+}
+
+func (r *onlineRecorder) Online(uid int, ip string) {
+	r.Lock()
+	defer r.Unlock()
+	r.ips[uid] = append(r.ips[uid], ip)
+}
+
+func TestShadowsocksRProxyProtocol(t *testing.T) {
+	echoTCP, echoUDP := echo.Start(t)
+	defer echoTCP.Close()
+	defer echoUDP.Close()
+	recorder := &onlineRecorder{ips: make(map[int][]string)}
+	start := func(trusted string) *ShadowsocksRProxy {
+		ssr := &ShadowsocksRProxy{
+			Host:             "127.0.0.1",
+			Port:             echo.FreePort(t),
+			Method:           "aes-128-cfb",
+			Password:         "killer",
+			Protocol:         "origin",
+			Obfs:             "plain",
+			ProxyProtocol:    true,
+			TrustedProxies:   []string{trusted},
+			OnlineReport:     recorder,
+			ShadowsocksRArgs: &ShadowsocksRArgs{UDPSwitch: "false"},
+		}
+		if err := ssr.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return ssr
+	}
+	ssr := start("127.0.0.0/8")
+	defer ssr.Close()
+
+	dial := func(ssr *ShadowsocksRProxy, header string) ([]byte, error) {
+		con, err := net.Dial("tcp", net.JoinHostPort(ssr.Host, strconv.Itoa(ssr.Port)))
+		if err != nil {
+			return nil, err
+		}
+		defer con.Close()
+		_ = con.SetDeadline(time.Now().Add(3 * time.Second))
+		if _, err := con.Write([]byte(header)); err != nil {
+			return nil, err
+		}
+		c, err := ciphers.CipherDecorate(ssr.Password, ssr.Method, con)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := c.Write(append(socksproxy.ParseAddr(echoTCP.Addr().String()).Raw, "hello"...)); err != nil {
+			return nil, err
+		}
+		result := make([]byte, 5)
+		_, err = io.ReadFull(c, result)
+		return result, err
+	}
+	if result, err := dial(ssr, "PROXY TCP4 203.0.113.7 127.0.0.1 12345 443\r\n"); err != nil || string(result) != "hello" {
+		t.Fatalf("connection through trusted proxy should work: %q %v", result, err)
+	}
+	recorder.Lock()
+	ips := recorder.ips[ssr.Port]
+	recorder.Unlock()
+	if len(ips) != 1 || ips[0] != "203.0.113.7:12345" {
+		t.Fatalf("client in proxy header should be reported: %v", ips)
+	}
+	if _, err := dial(ssr, ""); err == nil {
+		t.Fatal("connection without proxy header should be rejected")
+	}
+
+	untrusted := start("10.0.0.0/8")
+	defer untrusted.Close()
+	if _, err := dial(untrusted, "PROXY TCP4 203.0.113.7 127.0.0.1 12345 443\r\n"); err == nil {
+		t.Fatal("connection from untrusted proxy should be rejected")
+	}
+}
+
+func TestShadowsocksRUsersChange(t *testing.T) {
+	tcpEcho := echo.StartTCP(t)
+	defer tcpEcho.Close()
+	ssr := &ShadowsocksRProxy{
+		Host:             "127.0.0.1",
+		Port:             echo.FreePort(t),
+		Method:           "aes-128-cfb",
+		Password:         "killer",
+		Protocol:         "auth_aes128_md5",
+		Obfs:             "plain",
+		Single:           1,
+		ShadowsocksRArgs: &ShadowsocksRArgs{},
+	}
+	if core.GetApp().GetObfsProtocolService() == nil {
+		core.GetApp().SetObfsProtocolService(obfs.NewObfsAuthChainData(ssr.Protocol))
+	}
+	ssr.AddUser(10001, "p1")
+	if err := ssr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ssr.Close()
+
+	// users change while connections look them up
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			ssr.AddUser(20000+i%100, "p2")
+			ssr.DelUser(20000 + (i+50)%100)
+		}
+	}()
+	ssrClient := &client.ShadowsocksClient{
+		Host:          ssr.Host,
+		Port:          ssr.Port,
+		Passwd:        ssr.Password,
+		Method:        ssr.Method,
+		Protocol:      ssr.Protocol,
+		ProtocolParam: "10001:p1",
+		Obfs:          ssr.Obfs,
+	}
+	for i := 0; i < 10; i++ {
+		conn, err := ssrClient.Dial(tcpEcho.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := []byte("hello " + strconv.Itoa(i))
+		_ = conn.SetDeadline(time.Now().Add(3 * time.Second))
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, len(data))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != string(data) {
+			t.Fatalf("user should be authenticated while users change: %q %v", buf, err)
+		}
+		_ = conn.Close()
+	}
+	if ssr.GetUsers()["\x11\x27\x00\x00"] != "p1" {
+		t.Fatal("users should keep the user which is not changed")
+	}
+}
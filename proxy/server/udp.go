@@ -0,0 +1,194 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/ciphers/aead"
+	"github.com/ProxyPanel/VNet-SSR/common/dns"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/common/replay"
+	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
+	"github.com/ProxyPanel/VNet-SSR/utils/goroutine"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultUDPTimeout is how long a udp session is kept without packets in either direction
+	DefaultUDPTimeout = 60 * time.Second
+)
+
+// ErrUDPSessionLimit is returned when a user already has the max number of udp sessions on a port
+var ErrUDPSessionLimit = errors.New("too many udp sessions")
+
+// udpSessionKey identify a udp session, a client shares its session between all targets
+type udpSessionKey struct {
+	client string
+	uid    int
+	// session is the client session id of shadowsocks 2022, a client may start a new session with the same address
+	session string
+	// outbound is the name of the outbound packets of the session are sent through
+	outbound string
+}
+
+// ShadowsocksRUDPMapItem is a udp session, packets of a client are sent to targets from PacketConn
+type ShadowsocksRUDPMapItem struct {
+	net.PacketConn
+	Uid []byte
+	// Key is the key of plain shadowsocks user
+	Key []byte
+	// Session is the server session of shadowsocks 2022 udp
+	Session *aead.Session2022
+	// Window is the packet ids of the client session of shadowsocks 2022 udp which have been seen
+	Window replay.Window
+	// lastActive is unix nano of the last packet in either direction
+	lastActive int64
+}
+
+func (item *ShadowsocksRUDPMapItem) touch() {
+	atomic.StoreInt64(&item.lastActive, time.Now().UnixNano())
+}
+
+func (item *ShadowsocksRUDPMapItem) expireAt(timeout time.Duration) time.Time {
+	return time.Unix(0, atomic.LoadInt64(&item.lastActive)).Add(timeout)
+}
+
+// ShadowsocksRUDPMap is the udp NAT table of a port, sessions are keyed by client address and uid
+type ShadowsocksRUDPMap struct {
+	sync.Mutex
+	m     map[udpSessionKey]*ShadowsocksRUDPMapItem
+	users map[int]int
+	// clients is the uid of the latest session of client addresses
+	clients map[string]int
+	timeout time.Duration
+	// maxUserSessions is the max number of sessions of a user, zero means unlimited
+	maxUserSessions int
+	port            string
+}
+
+func NewShadowsocksRUDPMap(port int, timeout time.Duration, maxUserSessions int) *ShadowsocksRUDPMap {
+	if timeout <= 0 {
+		timeout = DefaultUDPTimeout
+	}
+	return &ShadowsocksRUDPMap{
+		m:               make(map[udpSessionKey]*ShadowsocksRUDPMapItem),
+		users:           make(map[int]int),
+		clients:         make(map[string]int),
+		timeout:         timeout,
+		maxUserSessions: maxUserSessions,
+		port:            strconv.Itoa(port),
+	}
+}
+
+// Open return the session of key, a new session is created on the packet connection of listen
+// when there is none, created is true for it and the caller should start its relay with Relay
+func (m *ShadowsocksRUDPMap) Open(key udpSessionKey, listen func() (net.PacketConn, error)) (item *ShadowsocksRUDPMapItem, created bool, err error) {
+	m.Lock()
+	defer m.Unlock()
+	if item = m.m[key]; item != nil {
+		item.touch()
+		return item, false, nil
+	}
+	if m.maxUserSessions > 0 && m.users[key.uid] >= m.maxUserSessions {
+		return nil, false, ErrUDPSessionLimit
+	}
+	pc, err := listen()
+	if err != nil {
+		return nil, false, err
+	}
+	item = &ShadowsocksRUDPMapItem{
+		PacketConn: pc,
+		Uid:        binaryx.LEUint32ToBytes(uint32(key.uid)),
+	}
+	item.touch()
+	m.m[key] = item
+	m.users[key.uid]++
+	m.clients[key.client] = key.uid
+	metrics.UDPNatEntries.Inc(m.port)
+	return item, true, nil
+}
+
+// Relay run relay in a new goroutine, the session is closed when relay returns
+func (m *ShadowsocksRUDPMap) Relay(key udpSessionKey, item *ShadowsocksRUDPMapItem, relay func(item *ShadowsocksRUDPMapItem) error) {
+	go goroutine.Protect(func() {
+		defer m.close(key, item)
+		_ = relay(item)
+	})
+}
+
+// ReadFrom read a packet sent back to the session, it fails with a timeout only when
+// there is no packet in either direction for the timeout of the map
+func (m *ShadowsocksRUDPMap) ReadFrom(item *ShadowsocksRUDPMapItem, buf []byte) (int, net.Addr, error) {
+	for {
+		_ = item.SetReadDeadline(item.expireAt(m.timeout))
+		n, addr, err := item.PacketConn.ReadFrom(buf)
+		if err == nil {
+			item.touch()
+			return n, addr, nil
+		}
+		if e, ok := errors.Cause(err).(net.Error); ok && e.Timeout() && time.Now().Before(item.expireAt(m.timeout)) {
+			continue
+		}
+		return n, addr, err
+	}
+}
+
+// Resolve return the udp address of target with the resolver of node, local is the address
+// the session sends packets from, nil means the default source
+func (m *ShadowsocksRUDPMap) Resolve(target string, local net.IP) (*net.UDPAddr, error) {
+	return dns.GetResolver().ResolveUDPAddr(target, local)
+}
+
+// Len return the number of sessions
+func (m *ShadowsocksRUDPMap) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.m)
+}
+
+// ClientUser return the uid of the latest session of client
+func (m *ShadowsocksRUDPMap) ClientUser(client string) (int, bool) {
+	m.Lock()
+	defer m.Unlock()
+	uid, ok := m.clients[client]
+	return uid, ok
+}
+
+// UserSessions return the number of sessions of uid
+func (m *ShadowsocksRUDPMap) UserSessions(uid int) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.users[uid]
+}
+
+func (m *ShadowsocksRUDPMap) close(key udpSessionKey, item *ShadowsocksRUDPMapItem) {
+	m.Lock()
+	if m.m[key] == item {
+		delete(m.m, key)
+		if m.users[key.uid]--; m.users[key.uid] <= 0 {
+			delete(m.users, key.uid)
+		}
+		if m.clients[key.client] == key.uid {
+			delete(m.clients, key.client)
+		}
+		metrics.UDPNatEntries.Dec(m.port)
+	}
+	m.Unlock()
+	_ = item.Close()
+}
+
+// CloseAll close all sessions, their relays return soon after
+func (m *ShadowsocksRUDPMap) CloseAll() {
+	m.Lock()
+	items := make([]*ShadowsocksRUDPMapItem, 0, len(m.m))
+	for _, item := range m.m {
+		items = append(items, item)
+	}
+	m.Unlock()
+	for _, item := range items {
+		_ = item.Close()
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/dns"
+	"github.com/ProxyPanel/VNet-SSR/common/network/ciphers"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+)
+
+// hostBlacklist reject hosts in it
+type hostBlacklist map[string]bool
+
+func (h hostBlacklist) JudgeHostWithReport(ipOrDomain string, uid int) bool {
+	return !h[ipOrDomain]
+}
+
+type udpClient struct {
+	t      *testing.T
+	pc     net.PacketConn
+	c      net.PacketConn
+	server net.Addr
+}
+
+func newUDPClient(t *testing.T, port int, method, password string) *udpClient {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ciphers.CipherPacketDecorate(password, method, pc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &udpClient{t: t, pc: pc, c: c, server: &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port}}
+}
+
+func (u *udpClient) send(target string, data []byte) {
+	if _, err := u.c.WriteTo(append(socksproxy.ParseAddr(target).Raw, data...), u.server); err != nil {
+		u.t.Fatal(err)
+	}
+}
+
+// echo send data to target and wait for it, it return false when nothing comes back in timeout
+func (u *udpClient) echo(target string, data []byte, timeout time.Duration) bool {
+	u.send(target, data)
+	_ = u.c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := u.c.ReadFrom(buf)
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(buf[:n], append(socksproxy.ParseAddr(target).Raw, data...)) {
+			return true
+		}
+	}
+}
+
+func (u *udpClient) Close() {
+	_ = u.pc.Close()
+}
+
+func startShadowsocksRUDP(t *testing.T, firewall hostBlacklist, timeout time.Duration, sessionLimit int) *ShadowsocksRProxy {
+	ssr := &ShadowsocksRProxy{
+		Host:             "127.0.0.1",
+		Port:             echo.FreePort(t),
+		Method:           "aes-128-cfb",
+		Password:         "killer",
+		Protocol:         "origin",
+		Obfs:             "plain",
+		HostFirewall:     firewall,
+		UDPTimeout:       timeout,
+		UDPSessionLimit:  sessionLimit,
+		ShadowsocksRArgs: &ShadowsocksRArgs{TCPSwitch: "false"},
+	}
+	if err := ssr.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return ssr
+}
+
+func TestShadowsocksRUDPFirewall(t *testing.T) {
+	_, allowed := echo.Start(t)
+	defer allowed.Close()
+	_, rejected := echo.Start(t)
+	defer rejected.Close()
+	// both echo servers are on 127.0.0.1, so the rejected one is reached through localhost
+	_, port, _ := net.SplitHostPort(rejected.LocalAddr().String())
+	ssr := startShadowsocksRUDP(t, hostBlacklist{"localhost": true}, time.Minute, 0)
+	defer ssr.Close()
+
+	client := newUDPClient(t, ssr.Port, ssr.Method, ssr.Password)
+	defer client.Close()
+	if !client.echo(allowed.LocalAddr().String(), []byte("hello udp"), 3*time.Second) {
+		t.Fatal("udp packet to allowed target should be relayed")
+	}
+	if client.echo(net.JoinHostPort("localhost", port), []byte("rejected"), 500*time.Millisecond) {
+		t.Fatal("udp packet to rejected target should be dropped")
+	}
+	// a rejected packet must not stop the relay of the port
+	if !client.echo(allowed.LocalAddr().String(), []byte("hello again"), 3*time.Second) {
+		t.Fatal("udp relay should go on after a packet is rejected")
+	}
+}
+
+func TestShadowsocksRUDPSessions(t *testing.T) {
+	udpEcho := echo.StartUDP(t)
+	defer udpEcho.Close()
+	ssr := startShadowsocksRUDP(t, nil, 300*time.Millisecond, 1)
+	defer ssr.Close()
+
+	first := newUDPClient(t, ssr.Port, ssr.Method, ssr.Password)
+	defer first.Close()
+	second := newUDPClient(t, ssr.Port, ssr.Method, ssr.Password)
+	defer second.Close()
+	if !first.echo(udpEcho.LocalAddr().String(), []byte("first"), 3*time.Second) {
+		t.Fatal("first session should be relayed")
+	}
+	if second.echo(udpEcho.LocalAddr().String(), []byte("second"), 200*time.Millisecond) {
+		t.Fatal("session over the limit of user should be dropped")
+	}
+	// the first session is expired after it is idle, so the second one can be opened
+	time.Sleep(500 * time.Millisecond)
+	if !second.echo(udpEcho.LocalAddr().String(), []byte("second"), 3*time.Second) {
+		t.Fatal("session should be opened after the idle one is expired")
+	}
+}
+
+func TestShadowsocksRUDPMap(t *testing.T) {
+	udpEcho := echo.StartUDP(t)
+	defer udpEcho.Close()
+	m := NewShadowsocksRUDPMap(0, 200*time.Millisecond, 2)
+	defer m.CloseAll()
+
+	key := udpSessionKey{client: "127.0.0.1:1", uid: 1}
+	item, created, err := m.Open(key, direct.ListenPacket)
+	if err != nil || !created {
+		t.Fatalf("session should be created: %v", err)
+	}
+	if again, created, _ := m.Open(key, direct.ListenPacket); again != item || created {
+		t.Fatal("session should be reused for the same client and uid")
+	}
+	if _, created, _ := m.Open(udpSessionKey{client: "127.0.0.1:1", uid: 2}, direct.ListenPacket); !created {
+		t.Fatal("session should be separated by uid")
+	}
+	if _, created, _ := m.Open(udpSessionKey{client: "127.0.0.1:2", uid: 1}, direct.ListenPacket); !created {
+		t.Fatal("session should be separated by client")
+	}
+	if _, _, err := m.Open(udpSessionKey{client: "127.0.0.1:3", uid: 1}, direct.ListenPacket); err != ErrUDPSessionLimit {
+		t.Fatalf("session over the limit should fail: %v", err)
+	}
+
+	// packets in either direction keep the session alive
+	done := make(chan error, 1)
+	m.Relay(key, item, func(item *ShadowsocksRUDPMapItem) error {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := m.ReadFrom(item, buf); err != nil {
+				done <- err
+				return err
+			}
+		}
+	})
+	target, err := m.Resolve(udpEcho.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := item.WriteTo([]byte("ping"), target); err != nil {
+			t.Fatal(err)
+		}
+	}
+	select {
+	case err := <-done:
+		if time.Since(start) < 500*time.Millisecond {
+			t.Fatalf("session should be kept while it is active: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("idle session should be expired")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if m.Len() != 2 || m.UserSessions(1) != 1 {
+		t.Fatalf("expired session should be removed, sessions: %v", m.Len())
+	}
+}
+
+func TestShadowsocksRUDPMapResolve(t *testing.T) {
+	r, err := dns.NewResolver(dns.Config{Hosts: map[string][]net.IP{"echo.test": {net.ParseIP("::1"), net.ParseIP("127.0.0.1")}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns.SetResolver(r)
+	defer dns.SetResolver(nil)
+	m := NewShadowsocksRUDPMap(0, time.Minute, 0)
+	addr, err := m.Resolve("127.0.0.1:53", nil)
+	if err != nil || addr.Port != 53 || !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("ip should be parsed: %v %v", addr, err)
+	}
+	if addr, err := m.Resolve("echo.test:53", nil); err != nil || !addr.IP.Equal(net.ParseIP("::1")) {
+		t.Fatalf("domain should be resolved by the resolver of node: %v %v", addr, err)
+	}
+	if addr, err := m.Resolve("echo.test:53", net.ParseIP("127.0.0.2")); err != nil || !addr.IP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("address of the source family should be chosen: %v %v", addr, err)
+	}
+	if _, err := m.Resolve("localhost", nil); err == nil {
+		t.Fatal("address without port should fail")
+	}
+}
@@ -0,0 +1,38 @@
+package service
+
+import (
+	"sort"
+
+	"github.com/ProxyPanel/VNet-SSR/common/ciphers/aead"
+	"github.com/ProxyPanel/VNet-SSR/common/ciphers/block"
+	"github.com/ProxyPanel/VNet-SSR/common/ciphers/stream"
+	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/ProxyPanel/VNet-SSR/proxy/server"
+)
+
+// GetCapabilities return registered ciphers, protocols, obfs and modes
+func GetCapabilities() *model.Capabilities {
+	result := &model.Capabilities{
+		Protocols: obfs.GetSupportProtocols(),
+		Obfs:      obfs.GetSupportObfs(),
+		Modes:     []string{server.ModeShadowsocksR, server.ModeShadowsocks},
+	}
+	for method := range stream.GetStreamCiphers() {
+		result.Ciphers.Stream = append(result.Ciphers.Stream, method)
+	}
+	for method := range aead.GetAEADCiphers() {
+		result.Ciphers.AEAD = append(result.Ciphers.AEAD, method)
+	}
+	for method := range aead.GetAEAD2022Ciphers() {
+		result.Ciphers.AEAD2022 = append(result.Ciphers.AEAD2022, method)
+	}
+	for method := range block.GetBlockCiphers() {
+		result.Ciphers.Block = append(result.Ciphers.Block, method)
+	}
+	sort.Strings(result.Ciphers.Stream)
+	sort.Strings(result.Ciphers.AEAD)
+	sort.Strings(result.Ciphers.AEAD2022)
+	sort.Strings(result.Ciphers.Block)
+	return result
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	GetSSRManager().RegisterAddUserHandle(setUserClientLimit)
+
+	GetSSRManager().RegisterDelUserHandle(func(user *model.UserInfo) {
+		if tracker := deviceTracker(); tracker != nil {
+			tracker.SetUserMaxClient(user.Port, 0)
+		}
+	})
+}
+
+// deviceTracker return the tracker of clients of the auth protocols, it is nil before node info is set
+func deviceTracker() *obfs.ObfsAuthChainData {
+	tracker, _ := core.GetApp().GetObfsProtocolService().(*obfs.ObfsAuthChainData)
+	return tracker
+}
+
+// setUserClientLimit apply client limit of user, uid of user in protocol is its port
+func setUserClientLimit(user *model.UserInfo) {
+	if tracker := deviceTracker(); tracker != nil {
+		tracker.SetUserMaxClient(user.Port, user.ClientLimit)
+	}
+}
+
+// UserDevices return clients of user seen by the auth protocols
+func (s *SSRManager) UserDevices(uid int) ([]*obfs.Device, error) {
+	port := s.UIDToPort(uid)
+	if port == 0 {
+		return nil, errors.New(fmt.Sprintf("user %v doesn't exist", uid))
+	}
+	tracker := deviceTracker()
+	if tracker == nil {
+		return []*obfs.Device{}, nil
+	}
+	devices := tracker.Devices(port)
+	for _, device := range devices {
+		device.UID = uid
+	}
+	return devices, nil
+}
+
+// EvictDevice forget a client of user, so another client can take its place
+func (s *SSRManager) EvictDevice(uid, clientID int) error {
+	port := s.UIDToPort(uid)
+	if port == 0 {
+		return errors.New(fmt.Sprintf("user %v doesn't exist", uid))
+	}
+	tracker := deviceTracker()
+	if tracker == nil || !tracker.Evict(port, clientID) {
+		return errors.New(fmt.Sprintf("client %v of user %v doesn't exist", clientID, uid))
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
+)
+
+func TestUserDevices(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	dir, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	config := fmt.Sprintf(`{
+    "node": {"port": "0", "method": "aes-128-cfb", "protocol": "auth_chain_a", "obfs": "plain", "single": 0, "client_limit": 1},
+    "users": [
+        {"uid": 1, "port": %v, "passwd": "p1", "enable": 1, "client_limit": 2}
+    ]
+}`, ports[0])
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	panel, err := client.NewLocalPanel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetPanel(panel)
+	defer client.SetPanel(new(client.WebApi))
+	core.GetApp().SetHost("127.0.0.1")
+	nodeInfo, _ := panel.GetNodeInfo()
+	SetNodeInfo(nodeInfo)
+	manager := NewShadowsocksrService()
+	manager.RegisterAddUserHandle(setUserClientLimit)
+	if err := manager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	tracker := deviceTracker()
+	user := binaryx.LEUint32ToBytes(uint32(ports[0]))
+	if !tracker.Insert(user, ports[0], 1, 100) || !tracker.Insert(user, ports[0], 2, 100) {
+		t.Fatal("client limit of user should override the node's")
+	}
+	if tracker.Insert(user, ports[0], 3, 100) {
+		t.Fatal("client over the user's limit should be rejected")
+	}
+
+	devices, err := manager.UserDevices(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 || devices[0].UID != 1 || devices[0].ClientID != 1 || !devices[0].Active {
+		t.Fatalf("devices are wrong: %+v", devices)
+	}
+	if _, err := manager.UserDevices(2); err == nil {
+		t.Fatal("devices of unknown user should fail")
+	}
+
+	if err := manager.EvictDevice(1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.EvictDevice(1, 2); err == nil {
+		t.Fatal("evicting an unknown client should fail")
+	}
+	if !tracker.Insert(user, ports[0], 3, 100) {
+		t.Fatal("evicted client should give way to a new client")
+	}
+}
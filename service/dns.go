@@ -0,0 +1,74 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/ProxyPanel/VNet-SSR/common/dns"
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/pkg/errors"
+)
+
+var (
+	// resolverKey identify the dns config of node the resolver is created with, so the cache
+	// is kept when node info is reloaded without dns changes
+	resolverKey  string
+	resolverLock sync.Mutex
+)
+
+// resolverConfig return the resolver config of node
+func resolverConfig(nodeInfo *model.NodeInfo) (dns.Config, error) {
+	config := dns.Config{
+		Servers: splitList(nodeInfo.DNSServers),
+		Hosts:   make(map[string][]net.IP, len(nodeInfo.DNSHosts)),
+		Prefer:  nodeInfo.DNSPrefer,
+	}
+	for host, addresses := range nodeInfo.DNSHosts {
+		for _, address := range splitList(addresses) {
+			ip := net.ParseIP(strings.TrimSpace(address))
+			if ip == nil {
+				return config, errors.New(fmt.Sprintf("dns host %s address %s format error", host, address))
+			}
+			config.Hosts[host] = append(config.Hosts[host], ip)
+		}
+	}
+	return config, nil
+}
+
+// dnsKey return the dns config of node as a string
+func dnsKey(nodeInfo *model.NodeInfo) string {
+	hosts := make([]string, 0, len(nodeInfo.DNSHosts))
+	for host, addresses := range nodeInfo.DNSHosts {
+		hosts = append(hosts, host+"="+addresses)
+	}
+	sort.Strings(hosts)
+	return strings.Join([]string{nodeInfo.DNSServers, nodeInfo.DNSPrefer, strings.Join(hosts, ";")}, "|")
+}
+
+// setResolver apply the dns config of node to the resolver targets are resolved with, the
+// system resolver is kept when the config is not valid
+func setResolver(nodeInfo *model.NodeInfo) {
+	resolverLock.Lock()
+	defer resolverLock.Unlock()
+	key := dnsKey(nodeInfo)
+	if key == resolverKey {
+		return
+	}
+	config, err := resolverConfig(nodeInfo)
+	if err == nil {
+		var r *dns.Resolver
+		if r, err = dns.NewResolver(config); err == nil {
+			dns.SetResolver(r)
+			resolverKey = key
+			log.Info("set dns servers: %v, prefer: %s, hosts: %v", config.Servers, config.Prefer, len(config.Hosts))
+			return
+		}
+	}
+	log.Error("dns config error, use the system resolver: %s", err.Error())
+	dns.SetResolver(nil)
+	resolverKey = ""
+}
@@ -0,0 +1,39 @@
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ProxyPanel/VNet-SSR/common/dns"
+	"github.com/ProxyPanel/VNet-SSR/model"
+)
+
+func TestSetResolver(t *testing.T) {
+	defer dns.SetResolver(nil)
+	nodeInfo := &model.NodeInfo{
+		DNSServers: "127.0.0.1:5353, tcp://127.0.0.1:5353",
+		DNSHosts:   map[string]string{"static.test": "10.0.0.1, 2001:db8::1"},
+		DNSPrefer:  dns.PreferIPv6,
+	}
+	setResolver(nodeInfo)
+	r := dns.GetResolver()
+	if ips, err := r.LookupIP("static.test"); err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("2001:db8::1")) {
+		t.Fatalf("dns hosts and preference of node should be applied: %v %v", ips, err)
+	}
+	reloaded := *nodeInfo
+	reloaded.Port = "443"
+	setResolver(&reloaded)
+	if dns.GetResolver() != r {
+		t.Fatal("resolver should be kept when dns config is not changed")
+	}
+	reloaded.DNSHosts = map[string]string{"static.test": "10.0.0.2"}
+	setResolver(&reloaded)
+	if ips, _ := dns.GetResolver().LookupIP("static.test"); len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("changed dns hosts should be applied: %v", ips)
+	}
+	reloaded.DNSPrefer = "ipv5"
+	setResolver(&reloaded)
+	if _, err := dns.GetResolver().LookupIP("static.test"); err == nil {
+		t.Fatal("system resolver should be used when dns config is not valid")
+	}
+}
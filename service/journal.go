@@ -0,0 +1,315 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	JournalTraffic = "traffic"
+	JournalOnline  = "online"
+
+	journalFileName = "report.journal"
+	// entries which can not be posted are moved to dead letter file, so they don't block later reports
+	journalDeadFileName = "report.dead"
+	// an entry is given up after this many transport failures
+	journalMaxAttempts = 100
+	// rewrite journal file when it has too many acknowledged records
+	journalCompactRecords = 1024
+	journalMinBackoff     = 5 * time.Second
+	journalMaxBackoff     = 5 * time.Minute
+)
+
+// JournalEntry is a batch of report which is waiting for panel acknowledge
+type JournalEntry struct {
+	Seq     uint64               `json:"seq"`
+	Type    string               `json:"type"`
+	Time    int64                `json:"time"`
+	Traffic []*model.UserTraffic `json:"traffic,omitempty"`
+	Online  []*model.NodeOnline  `json:"online,omitempty"`
+}
+
+// journalDeadRecord is a line of dead letter file
+type journalDeadRecord struct {
+	Entry    *JournalEntry `json:"entry"`
+	Error    string        `json:"error"`
+	Attempts int           `json:"attempts"`
+	Time     int64         `json:"time"`
+}
+
+// journalRecord is a line of journal file, it is either an entry or an ack of entry
+type journalRecord struct {
+	Entry *JournalEntry `json:"entry,omitempty"`
+	Ack   uint64        `json:"ack,omitempty"`
+}
+
+// Journal is a write-ahead log of reports, entries are kept until they are acknowledged,
+// so reports will not be lost when panel is unreachable or node is restarted.
+// journal only keep entries in memory when dir is empty.
+type Journal struct {
+	sync.Mutex
+	// replayLock make sure only one replay is posting
+	replayLock sync.Mutex
+	path       string
+	deadPath   string
+	file       *os.File
+	seq        uint64
+	pending    []*JournalEntry
+	records    int
+	failures   int
+	// attempts is the number of failed posts of entries
+	attempts  map[uint64]int
+	nextRetry time.Time
+	now       func() time.Time
+}
+
+// OpenJournal open journal in dir and load entries which are not acknowledged
+func OpenJournal(dir string) (*Journal, error) {
+	j := &Journal{now: time.Now, attempts: make(map[uint64]int)}
+	if dir == "" {
+		return j, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "create journal dir error")
+	}
+	j.path = filepath.Join(dir, journalFileName)
+	j.deadPath = filepath.Join(dir, journalDeadFileName)
+	if err := j.load(); err != nil {
+		return nil, err
+	}
+	// rewrite file with pending entries only, it also drop broken tail of last crash
+	if err := j.compact(); err != nil {
+		return nil, err
+	}
+	if len(j.pending) > 0 {
+		log.Info("journal %s loaded %v pending report", j.path, len(j.pending))
+	}
+	return j, nil
+}
+
+func (j *Journal) load() error {
+	file, err := os.Open(j.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "open journal error")
+	}
+	defer file.Close()
+	entries := make(map[uint64]*JournalEntry)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		record := new(journalRecord)
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			log.Warn("journal %s skip broken record: %s", j.path, err.Error())
+			continue
+		}
+		if record.Entry != nil {
+			entries[record.Entry.Seq] = record.Entry
+			j.pending = append(j.pending, record.Entry)
+			if record.Entry.Seq > j.seq {
+				j.seq = record.Entry.Seq
+			}
+		}
+		if record.Ack != 0 {
+			delete(entries, record.Ack)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "read journal error")
+	}
+	pending := make([]*JournalEntry, 0, len(entries))
+	for _, entry := range j.pending {
+		if entries[entry.Seq] == entry {
+			pending = append(pending, entry)
+		}
+	}
+	j.pending = pending
+	return nil
+}
+
+func (j *Journal) write(record *journalRecord) error {
+	if j.file == nil {
+		return nil
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "write journal error")
+	}
+	if err := j.file.Sync(); err != nil {
+		return errors.Wrap(err, "sync journal error")
+	}
+	j.records++
+	return nil
+}
+
+// compact rewrite journal file with pending entries
+func (j *Journal) compact() error {
+	if j.path == "" {
+		return nil
+	}
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+	tmp := j.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "create journal error")
+	}
+	j.file = file
+	j.records = 0
+	for _, entry := range j.pending {
+		if err := j.write(&journalRecord{Entry: entry}); err != nil {
+			_ = file.Close()
+			j.file = nil
+			return err
+		}
+	}
+	if err := file.Sync(); err != nil {
+		_ = file.Close()
+		j.file = nil
+		return errors.Wrap(err, "sync journal error")
+	}
+	_ = file.Close()
+	if err := os.Rename(tmp, j.path); err != nil {
+		j.file = nil
+		return errors.Wrap(err, "replace journal error")
+	}
+	j.file, err = os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open journal error")
+	}
+	return nil
+}
+
+// Append add entry to journal, the entry is kept in memory even if it fail to write file
+func (j *Journal) Append(entry *JournalEntry) error {
+	j.Lock()
+	defer j.Unlock()
+	j.seq++
+	entry.Seq = j.seq
+	if entry.Time == 0 {
+		entry.Time = j.now().Unix()
+	}
+	j.pending = append(j.pending, entry)
+	return j.write(&journalRecord{Entry: entry})
+}
+
+// Ack remove entry from journal
+func (j *Journal) Ack(seq uint64) error {
+	j.Lock()
+	defer j.Unlock()
+	for i, entry := range j.pending {
+		if entry.Seq == seq {
+			j.pending = append(j.pending[:i], j.pending[i+1:]...)
+			delete(j.attempts, seq)
+			break
+		}
+	}
+	if j.file != nil && (len(j.pending) == 0 || j.records > journalCompactRecords) {
+		return j.compact()
+	}
+	return j.write(&journalRecord{Ack: seq})
+}
+
+// Pending return entries which are not acknowledged
+func (j *Journal) Pending() []*JournalEntry {
+	j.Lock()
+	defer j.Unlock()
+	return append([]*JournalEntry{}, j.pending...)
+}
+
+// Replay post pending entries in order. A transport failure stops replay and it won't post
+// again until the backoff is passed, an entry rejected by panel or failed too many times is
+// moved to dead letter file and replay goes on to the next
+func (j *Journal) Replay(post func(entry *JournalEntry) error) error {
+	j.replayLock.Lock()
+	defer j.replayLock.Unlock()
+	for {
+		j.Lock()
+		if len(j.pending) == 0 || j.now().Before(j.nextRetry) {
+			j.Unlock()
+			return nil
+		}
+		entry := j.pending[0]
+		j.Unlock()
+
+		if err := post(entry); err != nil {
+			j.Lock()
+			j.attempts[entry.Seq]++
+			attempts := j.attempts[entry.Seq]
+			if !client.IsRejected(err) && attempts < journalMaxAttempts {
+				backoff := journalMinBackoff << uint(j.failures)
+				if backoff > journalMaxBackoff || backoff <= 0 {
+					backoff = journalMaxBackoff
+				} else {
+					j.failures++
+				}
+				j.nextRetry = j.now().Add(backoff)
+				j.Unlock()
+				return errors.Wrap(err, fmt.Sprintf("post %s report %v error, retry after %v", entry.Type, entry.Seq, backoff))
+			}
+			log.Warn("journal give up %s report %v after %v attempts: %s", entry.Type, entry.Seq, attempts, err.Error())
+			deadErr := j.writeDead(&journalDeadRecord{Entry: entry, Error: err.Error(), Attempts: attempts, Time: j.now().Unix()})
+			j.Unlock()
+			if deadErr != nil {
+				return deadErr
+			}
+		} else {
+			j.Lock()
+			j.failures = 0
+			j.nextRetry = time.Time{}
+			j.Unlock()
+		}
+		if err := j.Ack(entry.Seq); err != nil {
+			return err
+		}
+	}
+}
+
+// writeDead append record to dead letter file, the entry is only logged when journal has no dir
+func (j *Journal) writeDead(record *journalDeadRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if j.deadPath == "" {
+		log.Warn("journal drop report: %s", string(data))
+		return nil
+	}
+	file, err := os.OpenFile(j.deadPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "open journal dead letter error")
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		return errors.Wrap(err, "write journal dead letter error")
+	}
+	return errors.Wrap(file.Sync(), "sync journal dead letter error")
+}
+
+func (j *Journal) Close() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
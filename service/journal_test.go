@@ -0,0 +1,190 @@
+package service
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/model"
+)
+
+func TestJournalReplayAfterReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := journal.Append(&JournalEntry{Type: JournalTraffic, Traffic: []*model.UserTraffic{{Uid: i, Upload: int64(i)}}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := journal.Append(&JournalEntry{Type: JournalOnline, Online: []*model.NodeOnline{{Uid: 1, IP: "127.0.0.1"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.Ack(2); err != nil {
+		t.Fatal(err)
+	}
+	_ = journal.Close()
+
+	// a crash in the middle of writing leaves a broken line
+	file, err := os.OpenFile(filepath.Join(dir, journalFileName), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = file.WriteString(`{"entry":{"seq":5,"ty`)
+	_ = file.Close()
+
+	journal, err = OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	pending := journal.Pending()
+	if len(pending) != 3 || pending[0].Seq != 1 || pending[1].Seq != 3 || pending[2].Type != JournalOnline {
+		t.Fatalf("pending entries are wrong: %+v", pending)
+	}
+	if pending[1].Traffic[0].Uid != 3 || pending[1].Traffic[0].Upload != 3 {
+		t.Fatalf("traffic is wrong: %+v", pending[1].Traffic[0])
+	}
+
+	posted := make([]uint64, 0)
+	if err := journal.Replay(func(entry *JournalEntry) error {
+		posted = append(posted, entry.Seq)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 3 || len(journal.Pending()) != 0 {
+		t.Fatalf("replay result is wrong, posted: %v pending: %v", posted, len(journal.Pending()))
+	}
+	if err := journal.Append(&JournalEntry{Type: JournalTraffic}); err != nil {
+		t.Fatal(err)
+	}
+	if journal.Pending()[0].Seq != 5 {
+		t.Fatalf("seq should continue after reopen, got %v", journal.Pending()[0].Seq)
+	}
+}
+
+func TestJournalBackoff(t *testing.T) {
+	journal, err := OpenJournal("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	journal.now = func() time.Time {
+		return now
+	}
+	_ = journal.Append(&JournalEntry{Type: JournalTraffic})
+	_ = journal.Append(&JournalEntry{Type: JournalTraffic})
+
+	calls := 0
+	fail := func(entry *JournalEntry) error {
+		calls++
+		return errors.New("panel is unreachable")
+	}
+	if err := journal.Replay(fail); err == nil {
+		t.Fatal("replay should return post error")
+	}
+	if err := journal.Replay(fail); err != nil || calls != 1 {
+		t.Fatalf("replay should wait backoff, calls: %v", calls)
+	}
+	now = now.Add(journalMinBackoff)
+	_ = journal.Replay(fail)
+	if calls != 2 {
+		t.Fatalf("replay should retry after backoff, calls: %v", calls)
+	}
+	// second failure double the backoff
+	now = now.Add(journalMinBackoff)
+	_ = journal.Replay(fail)
+	if calls != 2 {
+		t.Fatalf("backoff should be doubled, calls: %v", calls)
+	}
+	now = now.Add(journalMinBackoff)
+	if err := journal.Replay(func(entry *JournalEntry) error {
+		calls++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 4 || len(journal.Pending()) != 0 {
+		t.Fatalf("all entries should be posted, calls: %v pending: %v", calls, len(journal.Pending()))
+	}
+}
+
+func TestJournalDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	journal, err := OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	now := time.Now()
+	journal.now = func() time.Time {
+		return now
+	}
+	for i := 1; i <= 3; i++ {
+		_ = journal.Append(&JournalEntry{Type: JournalTraffic, Traffic: []*model.UserTraffic{{Uid: i}}})
+	}
+
+	// entry 1 is always rejected by panel, entry 2 is the next to post
+	posted := make([]uint64, 0)
+	post := func(entry *JournalEntry) error {
+		switch entry.Seq {
+		case 1:
+			return &client.RejectedError{Message: "node not found"}
+		case 3:
+			return errors.New("panel is unreachable")
+		}
+		posted = append(posted, entry.Seq)
+		return nil
+	}
+	if err := journal.Replay(post); err == nil {
+		t.Fatal("replay should return the transport error of entry 3")
+	}
+	if len(posted) != 1 || posted[0] != 2 {
+		t.Fatalf("entry 2 should be posted after entry 1 is rejected, posted: %v", posted)
+	}
+
+	// entry 3 is given up after too many transport failures
+	for i := 0; i < journalMaxAttempts; i++ {
+		now = now.Add(journalMaxBackoff)
+		_ = journal.Replay(post)
+	}
+	if pending := journal.Pending(); len(pending) != 0 {
+		t.Fatalf("all entries should be posted or given up, pending: %v", len(pending))
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, journalDeadFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "node not found") || !strings.Contains(lines[1], "unreachable") {
+		t.Fatalf("dead letter file is wrong: %s", data)
+	}
+
+	// dead entries are not loaded again
+	_ = journal.Close()
+	journal, err = OpenJournal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending := journal.Pending(); len(pending) != 0 {
+		t.Fatalf("dead entries should not be replayed after reopen, pending: %v", len(pending))
+	}
+}
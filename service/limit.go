@@ -2,11 +2,15 @@ package service
 
 import (
 	"context"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/common/pool"
 	"github.com/ProxyPanel/VNet-SSR/core"
 	"github.com/ProxyPanel/VNet-SSR/model"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/time/rate"
+	"strconv"
 	"sync"
+	"time"
 )
 
 var (
@@ -14,77 +18,218 @@ var (
 )
 
 func GetLimitInstance() *Limit {
-	return limitInstance;
+	return limitInstance
 }
 
 func init() {
-	GetSSRManager().RegisterAddUserHandle(func(userInfo *model.UserInfo) {
-		// prefer use node limit when node limit less then user limit
-		if core.GetApp().NodeInfo().SpeedLimit == 0 ||
-			(core.GetApp().NodeInfo().SpeedLimit > userInfo.Limit && userInfo.Limit != 0) {
-			limitInstance.Set(userInfo.Port, int(userInfo.Limit))
-		} else {
-			limitInstance.Set(userInfo.Port, int(core.GetApp().NodeInfo().SpeedLimit))
-		}
-	})
+	GetSSRManager().RegisterAddUserHandle(setUserLimit)
 
-	GetSSRManager().RegisterDelUserHandle(func(uid int) {
-		limitInstance.Del(uid)
+	GetSSRManager().RegisterDelUserHandle(func(user *model.UserInfo) {
+		limitInstance.Del(user.Port)
 	})
 }
 
+// setNodeLimit apply the node wide cap
+func setNodeLimit(nodeInfo *model.NodeInfo) {
+	limitInstance.SetNode(nodeInfo.NodeUpLimit, nodeInfo.NodeDownLimit)
+}
+
+// setUserLimit prefer use node limit when node limit less then user limit,
+// direction limit of user overrides its speed limit
+func setUserLimit(userInfo *model.UserInfo) {
+	limitInstance.SetUid(userInfo.Port, userInfo.Uid)
+	limitInstance.Set(userInfo.Port, userLimit(userInfo.UpLimit, userInfo), userLimit(userInfo.DownLimit, userInfo))
+}
+
+func userLimit(directionLimit uint64, userInfo *model.UserInfo) uint64 {
+	limit := userInfo.Limit
+	if directionLimit != 0 {
+		limit = directionLimit
+	}
+	nodeLimit := core.GetApp().NodeInfo().SpeedLimit
+	if nodeLimit != 0 && (limit == 0 || limit > nodeLimit) {
+		return nodeLimit
+	}
+	return limit
+}
+
+// bucket is the up and down limiter of a user or the node
+type bucket struct {
+	up   *rate.Limiter
+	down *rate.Limiter
+}
+
+// Limit is a hierarchical shaper, traffic of a user waits its own bucket then the node bucket.
+// limiters are updated in place, so new limits apply to live connections.
 type Limit struct {
-	gLocker    sync.Locker
-	upLimits   map[int]*rate.Limiter
-	downLimits map[int]*rate.Limiter
+	gLocker sync.RWMutex
+	node    *bucket
+	users   map[int]*bucket
+	// uids label the wait metric of ports, so waits do not look up the user table
+	uids map[int]string
 }
 
 func NewLimit() *Limit {
 	return &Limit{
-		gLocker:    new(sync.Mutex),
-		upLimits:   make(map[int]*rate.Limiter),
-		downLimits: make(map[int]*rate.Limiter),
+		node:  new(bucket),
+		users: make(map[int]*bucket),
+		uids:  make(map[int]string),
 	}
 }
 
-func (l *Limit) Set(uid int, limition int) {
+// minLimitBurst is the smallest burst of limiters, a relay buffer is waited at most in one piece
+const minLimitBurst = pool.BufferSize
+
+// updateLimiter return a limiter with the limit, nil means unlimited. a limiter which exists is
+// set to unlimited instead of being dropped, so connections waiting it are not held at the old rate
+func updateLimiter(limiter *rate.Limiter, limit uint64) *rate.Limiter {
+	if limit == 0 {
+		if limiter != nil {
+			limiter.SetLimit(rate.Inf)
+		}
+		return limiter
+	}
+	burst := int(float64(limit) * core.GetApp().LimitBurst().Seconds())
+	if burst < minLimitBurst {
+		burst = minLimitBurst
+	}
+	if limiter == nil {
+		return rate.NewLimiter(rate.Limit(limit), burst)
+	}
+	limiter.SetLimit(rate.Limit(limit))
+	limiter.SetBurst(burst)
+	return limiter
+}
+
+// SetNode set the node wide cap in bytes per second, zero means unlimited
+func (l *Limit) SetNode(up, down uint64) {
 	l.gLocker.Lock()
 	defer l.gLocker.Unlock()
+	logrus.Infof("node limit up: %v down: %v", up, down)
+	l.node = &bucket{
+		up:   updateLimiter(l.node.up, up),
+		down: updateLimiter(l.node.down, down),
+	}
+}
 
-	if limition != 0 {
-		logrus.Infof("limit add %v:%v", uid, limition)
-		l.upLimits[uid] = rate.NewLimiter(rate.Limit(limition), int(limition))
-		l.downLimits[uid] = rate.NewLimiter(rate.Limit(limition), int(limition))
-	} else {
+// Set set limit of uid in bytes per second, zero means unlimited. uid is the user port
+func (l *Limit) Set(uid int, up, down uint64) {
+	l.gLocker.Lock()
+	defer l.gLocker.Unlock()
+
+	before := l.users[uid]
+	if up == 0 && down == 0 && before == nil {
 		logrus.Infof("limit ignore zero limit uid: %v", uid)
+		return
 	}
+	logrus.Infof("limit add %v up: %v down: %v", uid, up, down)
+	if before == nil {
+		before = new(bucket)
+	}
+	l.users[uid] = &bucket{
+		up:   updateLimiter(before.up, up),
+		down: updateLimiter(before.down, down),
+	}
+}
 
+// SetUid set the uid of the user on port which labels its wait metric
+func (l *Limit) SetUid(port, uid int) {
+	l.gLocker.Lock()
+	defer l.gLocker.Unlock()
+	l.uids[port] = strconv.Itoa(uid)
 }
 
 func (l *Limit) Del(uid int) {
 	l.gLocker.Lock()
 	defer l.gLocker.Unlock()
 	logrus.Infof("limit remove %v", uid)
-	delete(l.upLimits, uid)
+	// release connections which are still waiting
+	if before := l.users[uid]; before != nil {
+		updateLimiter(before.up, 0)
+		updateLimiter(before.down, 0)
+	}
+	delete(l.users, uid)
+	delete(l.uids, uid)
+}
+
+// limiters return the user limiter and the node limiter of a direction
+func (l *Limit) limiters(uid int, up bool) (user, node *rate.Limiter) {
+	l.gLocker.RLock()
+	defer l.gLocker.RUnlock()
+	return l.limitersLocked(uid, up)
+}
+
+func (l *Limit) limitersLocked(uid int, up bool) (user, node *rate.Limiter) {
+	if up {
+		if l.users[uid] != nil {
+			user = l.users[uid].up
+		}
+		return user, l.node.up
+	}
+	if l.users[uid] != nil {
+		user = l.users[uid].down
+	}
+	return user, l.node.down
+}
+
+// limitersWithUid return the limiters of a direction and the uid label of the user on port
+func (l *Limit) limitersWithUid(port int, up bool) (user, node *rate.Limiter, uid string) {
+	l.gLocker.RLock()
+	defer l.gLocker.RUnlock()
+	user, node = l.limitersLocked(port, up)
+	uid, ok := l.uids[port]
+	if !ok {
+		uid = "0"
+	}
+	return user, node, uid
 }
 
 func (l *Limit) UpLimit(uid, n int) error {
-	if l.upLimits[uid] != nil {
-		return l.upLimits[uid].WaitN(context.Background(), n)
+	user, node, label := l.limitersWithUid(uid, true)
+	if user == nil && node == nil {
+		return nil
 	}
-	return nil
+	defer observeLimiterWait(label, "up", time.Now())
+	if err := waitN(user, n); err != nil {
+		return err
+	}
+	return waitN(node, n)
 }
 
 func (l *Limit) DownLimit(uid, n int) error {
-	if l.downLimits[uid] != nil {
-		return l.downLimits[uid].WaitN(context.Background(), n)
+	user, node, label := l.limitersWithUid(uid, false)
+	if user == nil && node == nil {
+		return nil
 	}
-	return nil
+	defer observeLimiterWait(label, "down", time.Now())
+	if err := waitN(user, n); err != nil {
+		return err
+	}
+	return waitN(node, n)
 }
 
-func (l *Limit) Wait(uid, n int) error {
-	if l.upLimits[uid] != nil {
-		return l.upLimits[uid].WaitN(context.Background(), n)
+// waitN wait n tokens, n larger than burst is waited in pieces
+func waitN(limiter *rate.Limiter, n int) error {
+	if limiter == nil || limiter.Limit() == rate.Inf {
+		return nil
+	}
+	for n > 0 {
+		piece := n
+		if burst := limiter.Burst(); piece > burst {
+			piece = burst
+		}
+		if err := limiter.WaitN(context.Background(), piece); err != nil {
+			return err
+		}
+		n -= piece
 	}
 	return nil
 }
+
+func observeLimiterWait(uid, direction string, start time.Time) {
+	metrics.LimiterWait.Add(time.Since(start).Seconds(), uid, direction)
+}
+
+func (l *Limit) Wait(uid, n int) error {
+	return l.UpLimit(uid, n)
+}
@@ -0,0 +1,161 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/model"
+)
+
+// throughput push total bytes in 4KB pieces and return the time it takes
+func throughput(t *testing.T, wait func(uid, n int) error, uid, total int) time.Duration {
+	start := time.Now()
+	for total > 0 {
+		n := 4 * 1024
+		if n > total {
+			n = total
+		}
+		if err := wait(uid, n); err != nil {
+			t.Fatal(err)
+		}
+		total -= n
+	}
+	return time.Since(start)
+}
+
+// assertElapsed check the elapsed time of total bytes limited by rate, burst is free
+func assertElapsed(t *testing.T, elapsed time.Duration, total, rate int) {
+	burst := float64(rate) * core.GetApp().LimitBurst().Seconds()
+	expected := time.Duration((float64(total) - burst) / float64(rate) * float64(time.Second))
+	if elapsed < expected*8/10 || elapsed > expected*13/10 {
+		t.Fatalf("throughput of %v bytes at %v/s should take %v, took %v", total, rate, expected, elapsed)
+	}
+}
+
+func TestLimitUserThroughput(t *testing.T) {
+	core.GetApp().SetLimitBurst(100 * time.Millisecond)
+	defer core.GetApp().SetLimitBurst(0)
+	limit := NewLimit()
+	limit.Set(10001, 200*1024, 100*1024)
+
+	wg := new(sync.WaitGroup)
+	wg.Add(2)
+	var up, down time.Duration
+	go func() {
+		defer wg.Done()
+		up = throughput(t, limit.UpLimit, 10001, 100*1024)
+	}()
+	go func() {
+		defer wg.Done()
+		down = throughput(t, limit.DownLimit, 10001, 50*1024)
+	}()
+	wg.Wait()
+	assertElapsed(t, up, 100*1024, 200*1024)
+	assertElapsed(t, down, 50*1024, 100*1024)
+
+	if elapsed := throughput(t, limit.UpLimit, 10002, 10*1024*1024); elapsed > 100*time.Millisecond {
+		t.Fatalf("user without limit should not wait, took %v", elapsed)
+	}
+}
+
+func TestLimitNodeCap(t *testing.T) {
+	core.GetApp().SetLimitBurst(100 * time.Millisecond)
+	defer core.GetApp().SetLimitBurst(0)
+	limit := NewLimit()
+	limit.SetNode(200*1024, 0)
+	limit.Set(10001, 1024*1024, 0)
+	limit.Set(10002, 1024*1024, 0)
+
+	wg := new(sync.WaitGroup)
+	start := time.Now()
+	for _, uid := range []int{10001, 10002} {
+		wg.Add(1)
+		go func(uid int) {
+			defer wg.Done()
+			throughput(t, limit.UpLimit, uid, 50*1024)
+		}(uid)
+	}
+	wg.Wait()
+	assertElapsed(t, time.Since(start), 100*1024, 200*1024)
+
+	if elapsed := throughput(t, limit.DownLimit, 10001, 10*1024*1024); elapsed > 100*time.Millisecond {
+		t.Fatalf("download should not be capped, took %v", elapsed)
+	}
+}
+
+func TestLimitLiveUpdate(t *testing.T) {
+	core.GetApp().SetLimitBurst(100 * time.Millisecond)
+	defer core.GetApp().SetLimitBurst(0)
+	limit := NewLimit()
+	limit.Set(10001, 10*1024, 10*1024)
+
+	done := make(chan time.Duration)
+	go func() {
+		done <- throughput(t, limit.UpLimit, 10001, 100*1024)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	// it takes 10s with the old limit
+	limit.Set(10001, 1024*1024, 1024*1024)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("new limit should apply to the waiting connection")
+	}
+
+	limit.Del(10001)
+	if user, _ := limit.limiters(10001, true); user != nil {
+		t.Fatal("deleted limit should be removed")
+	}
+}
+
+func TestLimitRemoveLive(t *testing.T) {
+	limit := NewLimit()
+	limit.Set(10001, 2048, 2048)
+	if user, _ := limit.limiters(10001, true); user.Burst() < minLimitBurst {
+		t.Fatalf("burst should be at least a relay buffer, got %v", user.Burst())
+	}
+
+	done := make(chan time.Duration)
+	go func() {
+		done <- throughput(t, limit.UpLimit, 10001, 100*1024)
+	}()
+	time.Sleep(200 * time.Millisecond)
+	// it takes 50s with the old limit, only the piece which is waiting keeps the old rate
+	limit.Set(10001, 0, 0)
+	select {
+	case <-done:
+	case <-time.After(4 * time.Second):
+		t.Fatal("removed limit should apply to the waiting connection")
+	}
+}
+
+func TestSetUserLimit(t *testing.T) {
+	before := core.GetApp().NodeInfo()
+	defer core.GetApp().SetNodeInfo(before)
+	core.GetApp().SetNodeInfo(&model.NodeInfo{SpeedLimit: 2048})
+
+	user := &model.UserInfo{Port: 10001, Limit: 4096, DownLimit: 1024}
+	if userLimit(user.UpLimit, user) != 2048 || userLimit(user.DownLimit, user) != 1024 {
+		t.Fatal("user limit should be capped by node speed limit and overridden by direction limit")
+	}
+}
+
+func TestLimitWaitUid(t *testing.T) {
+	limit := NewLimit()
+	limit.Set(10001, 1024*1024, 1024*1024)
+	limit.SetUid(10001, 42)
+	before := metrics.LimiterWait.Get("42", "up")
+	if err := limit.UpLimit(10001, 4*1024*1024); err != nil {
+		t.Fatal(err)
+	}
+	if metrics.LimiterWait.Get("42", "up") <= before {
+		t.Fatal("wait should be labelled by the uid of port")
+	}
+	limit.Del(10001)
+	if _, _, uid := limit.limitersWithUid(10001, true); uid != "0" {
+		t.Fatalf("uid of removed port should be unknown, got %s", uid)
+	}
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"net"
+	"sync"
+
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/outbound"
+	"github.com/ProxyPanel/VNet-SSR/core"
+)
+
+var (
+	outbounds     = make(map[string]outbound.Outbound)
+	outboundsLock sync.Mutex
+	egresses      = make(map[string]*outbound.Egress)
+	egressesLock  sync.Mutex
+)
+
+// getOutbound return the outbound of url raw, outbounds are parsed once. It is nil
+// when raw is not valid, which has been reported when node, users and rules are loaded
+func getOutbound(raw string) outbound.Outbound {
+	outboundsLock.Lock()
+	defer outboundsLock.Unlock()
+	if o, ok := outbounds[raw]; ok {
+		return o
+	}
+	o, err := outbound.Parse(raw)
+	if err != nil {
+		log.Error("outbound error: %s", err.Error())
+		return nil
+	}
+	outbounds[raw] = o
+	return o
+}
+
+// Route choose the outbound of a connection of uid to host, the outbound of the first routing
+// rule host matches is used, then the outbound of user and then the outbound of node
+func (s *SSRManager) Route(uid int, host string) outbound.Outbound {
+	raw := GetRuleService().Outbound(host)
+	if raw == "" {
+		if user, ok := s.GetUserByPort(uid); ok {
+			raw = user.Outbound
+		}
+	}
+	if raw == "" && core.GetApp().NodeInfo() != nil {
+		raw = core.GetApp().NodeInfo().Outbound
+	}
+	return getOutbound(raw)
+}
+
+// getEgress return the egress of mode and ips, it is created once so round robin goes on across
+// connections. It is nil when mode is empty or not valid
+func getEgress(mode, ips string) *outbound.Egress {
+	if mode == "" {
+		return nil
+	}
+	egressesLock.Lock()
+	defer egressesLock.Unlock()
+	key := mode + "|" + ips
+	if e, ok := egresses[key]; ok {
+		return e
+	}
+	e, err := outbound.NewEgress(mode, splitList(ips))
+	if err != nil {
+		log.Error("egress error: %s", err.Error())
+		return nil
+	}
+	egresses[key] = e
+	return e
+}
+
+// Source choose the source address of direct connections of uid, the egress ip of user is used
+// first and then the egress of node
+func (s *SSRManager) Source(uid int, inbound net.IP) net.IP {
+	if user, ok := s.GetUserByPort(uid); ok && user.EgressIP != "" {
+		return net.ParseIP(user.EgressIP)
+	}
+	nodeInfo := core.GetApp().NodeInfo()
+	if nodeInfo == nil {
+		return nil
+	}
+	if e := getEgress(nodeInfo.EgressMode, nodeInfo.EgressIPs); e != nil {
+		return e.Source(uid, inbound)
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ProxyPanel/VNet-SSR/common/outbound"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/model"
+)
+
+func TestRoute(t *testing.T) {
+	before := core.GetApp().NodeInfo()
+	defer core.GetApp().SetNodeInfo(before)
+	defer GetRuleService().Load(&model.Rule{Model: RuleModeAll})
+	core.GetApp().SetNodeInfo(&model.NodeInfo{Outbound: "socks5://127.0.0.1:1080"})
+	GetRuleService().Load(&model.Rule{
+		Model: RuleModeAll,
+		Rules: []model.RuleItem{
+			{Id: 1, Type: RuleTypeDomain, Pattern: "netflix.com", Outbound: "http://127.0.0.1:8080"},
+			{Id: 2, Type: RuleTypeReg, Pattern: `\.lan$`, Outbound: "direct"},
+			{Id: 3, Type: RuleTypeDomain, Pattern: "broken.com", Outbound: "ftp://127.0.0.1:21"},
+		},
+	})
+	manager := NewShadowsocksrService()
+	manager.setUserLocked(&model.UserInfo{Uid: 1, Port: 10001, Outbound: "ss://aes-256-gcm:password@127.0.0.1:8388"})
+	manager.setUserLocked(&model.UserInfo{Uid: 2, Port: 10002})
+
+	tests := []struct {
+		port int
+		host string
+		name string
+	}{
+		{10001, "netflix.com", "http://127.0.0.1:8080"},
+		{10001, "nas.lan", outbound.SchemeDirect},
+		{10001, "google.com", "ss://aes-256-gcm@127.0.0.1:8388"},
+		{10002, "google.com", "socks5://127.0.0.1:1080"},
+		{10002, "broken.com", "socks5://127.0.0.1:1080"},
+	}
+	for _, tt := range tests {
+		if o := manager.Route(tt.port, tt.host); o == nil || o.Name() != tt.name {
+			t.Fatalf("port %v to %s should be routed to %s, got %v", tt.port, tt.host, tt.name, o)
+		}
+	}
+	if _, ok, _ := GetRuleService().judgeWithCache("netflix.com", 0); !ok {
+		t.Fatal("routing rule should not reject the host")
+	}
+	if manager.Route(10001, "google.com") != manager.Route(10001, "google.com") {
+		t.Fatal("outbound should be parsed once")
+	}
+}
+
+func TestSource(t *testing.T) {
+	before := core.GetApp().NodeInfo()
+	defer core.GetApp().SetNodeInfo(before)
+	manager := NewShadowsocksrService()
+	manager.setUserLocked(&model.UserInfo{Uid: 1, Port: 10001, EgressIP: "10.0.0.9"})
+	manager.setUserLocked(&model.UserInfo{Uid: 2, Port: 10002})
+	if source := manager.Source(10002, net.ParseIP("10.0.0.1")); source != nil {
+		t.Fatalf("source should be the default without egress, got %s", source)
+	}
+
+	core.GetApp().SetNodeInfo(&model.NodeInfo{EgressMode: outbound.EgressInbound, EgressIPs: "10.0.0.1,10.0.0.2"})
+	if source := manager.Source(10001, net.ParseIP("10.0.0.1")); !source.Equal(net.ParseIP("10.0.0.9")) {
+		t.Fatalf("egress ip of user should override node, got %s", source)
+	}
+	if source := manager.Source(10002, net.ParseIP("10.0.0.2")); !source.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("source should be the inbound ip, got %s", source)
+	}
+
+	core.GetApp().SetNodeInfo(&model.NodeInfo{EgressMode: outbound.EgressRoundRobin, EgressIPs: "10.0.0.1,10.0.0.2"})
+	first, second := manager.Source(10002, nil), manager.Source(10002, nil)
+	if first == nil || second == nil || first.Equal(second) {
+		t.Fatalf("round robin should go on across connections, got %s %s", first, second)
+	}
+}
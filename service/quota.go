@@ -0,0 +1,192 @@
+package service
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// quotaFileName is where usages are saved in journal dir, so a restart won't reset them
+const quotaFileName = "quota.json"
+
+// quotaUsage is bytes used by a user in current period
+type quotaUsage struct {
+	used  int64
+	start time.Time
+}
+
+// quotaRecord is usage of a user in quota file
+type quotaRecord struct {
+	Used  int64 `json:"used"`
+	Start int64 `json:"start"`
+}
+
+// Quota count bytes of users which have quota. a user is exhausted when it used up
+// the quota, it is recovered when the period is passed or the quota is raised.
+type Quota struct {
+	sync.Mutex
+	usages map[int]*quotaUsage
+	// path is the quota file, usages are only kept in memory when it is empty
+	path string
+	now  func() time.Time
+}
+
+func NewQuota() *Quota {
+	return &Quota{
+		usages: make(map[int]*quotaUsage),
+		now:    time.Now,
+	}
+}
+
+// usage return usage of user, used is reset when the period is passed
+func (q *Quota) usage(user *model.UserInfo) *quotaUsage {
+	now := q.now()
+	usage := q.usages[user.Uid]
+	if usage == nil {
+		usage = &quotaUsage{start: now}
+		q.usages[user.Uid] = usage
+	}
+	if user.QuotaPeriod > 0 && now.Sub(usage.start) >= time.Duration(user.QuotaPeriod)*time.Second {
+		usage.used = 0
+		usage.start = now
+	}
+	return usage
+}
+
+// Add count n bytes for user, it return true only when the quota is exhausted by these bytes
+func (q *Quota) Add(user *model.UserInfo, n int64) bool {
+	if user.Quota <= 0 {
+		return false
+	}
+	q.Lock()
+	defer q.Unlock()
+	usage := q.usage(user)
+	before := usage.used
+	usage.used += n
+	return before < user.Quota && usage.used >= user.Quota
+}
+
+func (q *Quota) Exhausted(user *model.UserInfo) bool {
+	if user.Quota <= 0 {
+		return false
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.usage(user).used >= user.Quota
+}
+
+// Used return bytes used by uid in current period
+func (q *Quota) Used(uid int) int64 {
+	q.Lock()
+	defer q.Unlock()
+	if usage := q.usages[uid]; usage != nil {
+		return usage.used
+	}
+	return 0
+}
+
+// Forget drop usage of deleted users
+func (q *Quota) Forget(uids ...int) {
+	q.Lock()
+	defer q.Unlock()
+	for _, uid := range uids {
+		delete(q.usages, uid)
+	}
+}
+
+// Load read usages saved in path, later Save write to the same path
+func (q *Quota) Load(path string) error {
+	q.Lock()
+	defer q.Unlock()
+	q.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "read quota error")
+	}
+	records := make(map[int]*quotaRecord)
+	if err := json.Unmarshal(data, &records); err != nil {
+		return errors.Wrap(err, "parse quota error")
+	}
+	for uid, record := range records {
+		q.usages[uid] = &quotaUsage{used: record.Used, start: time.Unix(record.Start, 0)}
+	}
+	return nil
+}
+
+// Save write usages to the file of Load
+func (q *Quota) Save() error {
+	q.Lock()
+	if q.path == "" {
+		q.Unlock()
+		return nil
+	}
+	path := q.path
+	records := make(map[int]*quotaRecord, len(q.usages))
+	for uid, usage := range q.usages {
+		records[uid] = &quotaRecord{Used: usage.used, Start: usage.start.Unix()}
+	}
+	q.Unlock()
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return errors.Wrap(err, "write quota error")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "replace quota error")
+}
+
+// useQuota count traffic of user, connections are closed when the quota is exhausted
+func (s *SSRManager) useQuota(user *model.UserInfo, n int64) {
+	if user == nil || !s.quota.Add(user, n) {
+		return
+	}
+	go s.exhaustQuota(user)
+}
+
+func (s *SSRManager) exhaustQuota(user *model.UserInfo) {
+	logrus.Infof("user %v exhausted quota %v", user.Uid, user.Quota)
+	s.userTableLock.Lock()
+	s.killUserLocked(user)
+	s.userTableLock.Unlock()
+	if err := s.quota.Save(); err != nil {
+		logrus.Error(err)
+	}
+	s.reportQuota(&model.UserQuota{
+		Uid:    user.Uid,
+		Quota:  user.Quota,
+		Used:   s.quota.Used(user.Uid),
+		Period: user.QuotaPeriod,
+		Time:   time.Now().Unix(),
+	})
+}
+
+// reportQuota tell panel a user exhausted quota. it is best-effort and not journaled, so traffic
+// reports are never blocked by it, it is turned off once panel rejects it, eg: panel has no quota endpoint
+func (s *SSRManager) reportQuota(quota *model.UserQuota) {
+	if atomic.LoadInt32(&s.quotaReportOff) == 1 {
+		return
+	}
+	err := client.PostUserQuota([]*model.UserQuota{quota})
+	if err == nil {
+		return
+	}
+	if client.IsRejected(err) {
+		atomic.StoreInt32(&s.quotaReportOff, 1)
+		logrus.Warnf("panel does not accept quota report, it is turned off: %s", err.Error())
+		return
+	}
+	logrus.Warnf("report quota of user %v error: %s", quota.Uid, err.Error())
+}
@@ -0,0 +1,164 @@
+package service
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apiclient "github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/ProxyPanel/VNet-SSR/proxy/client"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+)
+
+func TestQuota(t *testing.T) {
+	now := time.Unix(1000, 0)
+	quota := NewQuota()
+	quota.now = func() time.Time { return now }
+	user := &model.UserInfo{Uid: 1, Quota: 100, QuotaPeriod: 60}
+
+	if quota.Add(user, 60) || quota.Exhausted(user) {
+		t.Fatal("quota should not be exhausted")
+	}
+	if !quota.Add(user, 40) || !quota.Exhausted(user) {
+		t.Fatal("quota should be exhausted")
+	}
+	if quota.Add(user, 10) {
+		t.Fatal("exhausted should be reported only once")
+	}
+	// raise quota recover the user
+	raised := *user
+	raised.Quota = 200
+	if quota.Exhausted(&raised) {
+		t.Fatal("raised quota should not be exhausted")
+	}
+
+	now = now.Add(60 * time.Second)
+	if quota.Exhausted(user) || quota.Used(1) != 0 {
+		t.Fatal("quota should be reset after period")
+	}
+	if quota.Add(&model.UserInfo{Uid: 2}, 1<<40) {
+		t.Fatal("user without quota should not be exhausted")
+	}
+	quota.Forget(1)
+	if len(quota.usages) != 0 {
+		t.Fatal("forgot usage should be removed")
+	}
+}
+
+func TestQuotaExhausted(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+	panel := &quotaPanel{Panel: apiclient.GetPanel(), reported: make(chan *model.UserQuota, 1)}
+	apiclient.SetPanel(panel)
+	echoServer := echo.StartTCP(t)
+	defer echoServer.Close()
+
+	if err := manager.EditUser(&model.UserInfo{Uid: 1, Port: 10001, Passwd: "p1", Enable: 1, Quota: 64 * 1024}); err != nil {
+		t.Fatal(err)
+	}
+	ssrClient := &client.ShadowsocksClient{
+		Host:          "127.0.0.1",
+		Port:          ports[0],
+		Passwd:        "killer",
+		Method:        "aes-128-cfb",
+		Protocol:      "auth_aes128_md5",
+		ProtocolParam: "10001:p1",
+		Obfs:          "plain",
+	}
+	con, err := ssrClient.Dial(echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	for i := 0; i < 16; i++ {
+		if !echo.Echo(con, bytes.Repeat([]byte{'a'}, 8*1024)) {
+			break
+		}
+	}
+	if echo.Echo(con, []byte("killed")) {
+		t.Fatal("connection should be killed when quota is exhausted")
+	}
+	refused, err := ssrClient.Dial(echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	if echo.Echo(refused, []byte("refused")) {
+		t.Fatal("user exhausted quota should be refused")
+	}
+
+	select {
+	case reported := <-panel.reported:
+		if reported.Uid != 1 || reported.Used < reported.Quota {
+			t.Fatalf("exhausted quota is reported wrong: %+v", reported)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("exhausted quota should be reported")
+	}
+	for _, entry := range manager.journal.Pending() {
+		if entry.Type != JournalTraffic && entry.Type != JournalOnline {
+			t.Fatalf("quota report should not be journaled, got %s", entry.Type)
+		}
+	}
+}
+
+// quotaPanel record quota reports, it rejects them when reject is set
+type quotaPanel struct {
+	apiclient.Panel
+	reject   bool
+	reported chan *model.UserQuota
+}
+
+func (p *quotaPanel) PostUserQuota(userQuota []*model.UserQuota) error {
+	if p.reject {
+		return &apiclient.RejectedError{Message: "not found"}
+	}
+	p.reported <- userQuota[0]
+	return nil
+}
+
+func TestQuotaReportRejected(t *testing.T) {
+	panel := &quotaPanel{Panel: apiclient.GetPanel(), reject: true, reported: make(chan *model.UserQuota, 1)}
+	apiclient.SetPanel(panel)
+	defer apiclient.SetPanel(panel.Panel)
+	manager := NewShadowsocksrService()
+	manager.reportQuota(&model.UserQuota{Uid: 1})
+	panel.reject = false
+	manager.reportQuota(&model.UserQuota{Uid: 1})
+	if len(panel.reported) != 0 {
+		t.Fatal("quota report should be turned off after panel rejects it")
+	}
+}
+
+func TestQuotaSaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quota")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, quotaFileName)
+	user := &model.UserInfo{Uid: 1, Quota: 100}
+
+	quota := NewQuota()
+	if err := quota.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	quota.Add(user, 100)
+	if err := quota.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a total quota is still exhausted after restart
+	restarted := NewQuota()
+	if err := restarted.Load(path); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.Exhausted(user) || restarted.Used(1) != 100 {
+		t.Fatalf("usage should be loaded, used: %v", restarted.Used(1))
+	}
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/ProxyPanel/VNet-SSR/proxy/server"
+	"github.com/pkg/errors"
+)
+
+const defaultClientLimit = 64
+
+// serverSwap is a server which is replaced while reloading, old is nil when port is new
+// and new is nil when port is removed
+type serverSwap struct {
+	port int
+	old  *server.ShadowsocksRProxy
+	new  *server.ShadowsocksRProxy
+}
+
+// clientLimit is the max client of node, zero means the default
+func clientLimit(nodeInfo *model.NodeInfo) int {
+	if nodeInfo.ClientLimit == 0 {
+		return defaultClientLimit
+	}
+	return nodeInfo.ClientLimit
+}
+
+func parseNodePorts(port string) ([]int, error) {
+	ports := make([]int, 0)
+	for _, item := range strings.Split(port, ",") {
+		convertPort, err := strconv.Atoi(strings.TrimSpace(item))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("port format error: %s", port))
+		}
+		ports = append(ports, convertPort)
+	}
+	return ports, nil
+}
+
+// listenerChanged report whether servers must be restarted to apply the new node info
+func listenerChanged(before, after *model.NodeInfo) bool {
+	return before.Mode != after.Mode ||
+		before.Method != after.Method ||
+		before.Protocol != after.Protocol ||
+		before.ProtocolParam != after.ProtocolParam ||
+		before.Obfs != after.Obfs ||
+		before.ObfsParam != after.ObfsParam ||
+		before.IsUDP != after.IsUDP ||
+		before.Fallback != after.Fallback ||
+		before.UDPTimeout != after.UDPTimeout ||
+		before.UDPSessionLimit != after.UDPSessionLimit ||
+		before.ProxyProtocol != after.ProxyProtocol ||
+		before.TrustedProxies != after.TrustedProxies ||
+		(after.Single == 1 && before.Passwd != after.Passwd)
+}
+
+// userListenerChanged report whether the server of user must be restarted in multi port mode
+func userListenerChanged(before, after *model.UserInfo) bool {
+	return before.Mode != after.Mode ||
+		before.Method != after.Method ||
+		before.Protocol != after.Protocol ||
+		before.ProtocolParam != after.ProtocolParam ||
+		before.Obfs != after.Obfs ||
+		before.ObfsParam != after.ObfsParam
+}
+
+// ReloadWithNodeInfo apply nodeInfo with the least restart, limits and client
+// limit are applied in place, only servers whose listener parameters changed are
+// restarted. when a server fail to restart, all servers are rolled back and the
+// old node info is kept.
+func (s *SSRManager) ReloadWithNodeInfo(nodeInfo *model.NodeInfo) error {
+	if err := ValidateNodeInfo(nodeInfo); err != nil {
+		return err
+	}
+	before := core.GetApp().NodeInfo()
+	if before == nil || s.cancel == nil || before.Single != nodeInfo.Single {
+		log.Info("node mode changed, restart all servers")
+		return s.restart(nodeInfo)
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.userTableLock.Lock()
+	defer s.userTableLock.Unlock()
+
+	beforeObfsProtocolService := core.GetApp().GetObfsProtocolService()
+	if before.Protocol != nodeInfo.Protocol {
+		SetNodeInfo(nodeInfo)
+	} else {
+		core.GetApp().SetNodeInfo(nodeInfo)
+		if clientLimit(before) != clientLimit(nodeInfo) {
+			log.Info("set client limit with %v", clientLimit(nodeInfo))
+			beforeObfsProtocolService.SetMaxClient(clientLimit(nodeInfo))
+		}
+		if tracker := deviceTracker(); tracker != nil && before.ClientLimitPerPort != nodeInfo.ClientLimitPerPort {
+			tracker.SetPerPort(nodeInfo.ClientLimitPerPort == 1)
+		}
+		setResolver(nodeInfo)
+	}
+
+	swaps, err := s.planSwaps(before, nodeInfo)
+	if err == nil {
+		err = s.applySwaps(swaps)
+	}
+	if err != nil {
+		core.GetApp().SetNodeInfo(before)
+		beforeObfsProtocolService.SetMaxClient(clientLimit(before))
+		if tracker := deviceTracker(); tracker != nil {
+			tracker.SetName(before.Protocol)
+			tracker.SetPerPort(before.ClientLimitPerPort == 1)
+		}
+		setNodeLimit(before)
+		setResolver(before)
+		return errors.Wrap(err, "reload node error, rollback to the old node info")
+	}
+
+	if before.NodeUpLimit != nodeInfo.NodeUpLimit || before.NodeDownLimit != nodeInfo.NodeDownLimit {
+		setNodeLimit(nodeInfo)
+	}
+	if before.SpeedLimit != nodeInfo.SpeedLimit {
+		for _, user := range s.userTable {
+			setUserLimit(user)
+		}
+	}
+	return nil
+}
+
+func (s *SSRManager) planSwaps(before, after *model.NodeInfo) ([]*serverSwap, error) {
+	changed := listenerChanged(before, after)
+	swaps := make([]*serverSwap, 0)
+	if after.Single != 1 {
+		if !changed {
+			return swaps, nil
+		}
+		for port, old := range s.Shadowsocksrs {
+			user := s.userTable[s.portToUidLocked(port)]
+			if user == nil {
+				user = &model.UserInfo{Port: port, Passwd: old.Password}
+			}
+			swaps = append(swaps, &serverSwap{
+				port: port,
+				old:  old,
+				new:  s.buildUserProxy(user, after),
+			})
+		}
+		return swaps, nil
+	}
+
+	ports, err := parseNodePorts(after.Port)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		latest[port] = true
+		old := s.Shadowsocksrs[port]
+		if old != nil && !changed {
+			continue
+		}
+		swap := &serverSwap{
+			port: port,
+			old:  old,
+			new:  s.buildShadowsocksRProxy(port, after.Method, after.Passwd, after.Protocol, after.ProtocolParam, after.Obfs, after.ObfsParam, after.Single, &server.ShadowsocksRArgs{}),
+		}
+		for _, user := range s.userTable {
+			swap.new.AddUser(user.Port, user.Passwd)
+		}
+		swaps = append(swaps, swap)
+	}
+	for port, old := range s.Shadowsocksrs {
+		if !latest[port] {
+			swaps = append(swaps, &serverSwap{port: port, old: old})
+		}
+	}
+	return swaps, nil
+}
+
+// applySwaps restart servers one by one, it rolls back all swapped servers when one of them fail
+func (s *SSRManager) applySwaps(swaps []*serverSwap) error {
+	done := make([]*serverSwap, 0, len(swaps))
+	for _, swap := range swaps {
+		if swap.new == nil {
+			continue
+		}
+		if swap.old != nil {
+			if err := swap.old.Listener.Close(); err != nil {
+				log.Err(err)
+			}
+		}
+		if err := swap.new.Start(); err != nil {
+			if swap.new.Listener != nil {
+				_ = swap.new.Listener.Close()
+			}
+			s.rollbackSwaps(append(done, &serverSwap{port: swap.port, old: swap.old}))
+			return errors.Wrap(err, fmt.Sprintf("restart server %v error", swap.port))
+		}
+		log.Info("server %v restarted", swap.port)
+		done = append(done, swap)
+	}
+
+	olds := make([]*server.ShadowsocksRProxy, 0, len(swaps))
+	for _, swap := range swaps {
+		if swap.old != nil {
+			olds = append(olds, swap.old)
+		}
+		if swap.new == nil {
+			if err := swap.old.Listener.Close(); err != nil {
+				log.Err(err)
+			}
+			delete(s.Shadowsocksrs, swap.port)
+			log.Info("server %v removed", swap.port)
+			continue
+		}
+		s.Shadowsocksrs[swap.port] = swap.new
+	}
+	go s.drain(olds, core.GetApp().DrainTimeout())
+	return nil
+}
+
+// rollbackSwaps close new servers and listen old servers again on their own listeners,
+// so live connections of old servers are still tracked for drain and kill
+func (s *SSRManager) rollbackSwaps(swaps []*serverSwap) {
+	for _, swap := range swaps {
+		if swap.new != nil && swap.new.Listener != nil {
+			_ = swap.new.Listener.Close()
+		}
+		if swap.old == nil {
+			continue
+		}
+		if err := swap.old.Relisten(); err != nil {
+			log.Error("rollback server %v error: %s", swap.port, err.Error())
+			continue
+		}
+		log.Info("server %v rolled back", swap.port)
+	}
+}
@@ -0,0 +1,223 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/common/network/ciphers"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/proxy/server"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+	"github.com/ProxyPanel/VNet-SSR/utils/binaryx"
+	"github.com/ProxyPanel/VNet-SSR/utils/socksproxy"
+)
+
+// startReloadManager start a single port manager with users from a standalone config file
+func startReloadManager(t *testing.T, port int) (*SSRManager, string, func()) {
+	dir, err := ioutil.TempDir("", "reload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	users := `{"uid": 1, "port": 10001, "passwd": "p1", "speed_limit": 2048, "enable": 1}`
+	if err := ioutil.WriteFile(path, []byte(standaloneConfig(port, users)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	panel, err := client.NewLocalPanel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetPanel(panel)
+	core.GetApp().SetHost("127.0.0.1")
+	nodeInfo, _ := panel.GetNodeInfo()
+	SetNodeInfo(nodeInfo)
+	manager := NewShadowsocksrService()
+	if err := manager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return manager, path, func() {
+		_ = manager.Close()
+		client.SetPanel(new(client.WebApi))
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestReloadInPlace(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+	before := manager.Shadowsocksrs[ports[0]]
+	obfsProtocolService := core.GetApp().GetObfsProtocolService()
+
+	nodeInfo := *core.GetApp().NodeInfo()
+	nodeInfo.SpeedLimit = 1024
+	nodeInfo.ClientLimit = 8
+	if err := manager.ReloadWithNodeInfo(&nodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	if manager.Shadowsocksrs[ports[0]] != before {
+		t.Fatal("server should not restart when only limits changed")
+	}
+	if core.GetApp().GetObfsProtocolService() != obfsProtocolService {
+		t.Fatal("obfs protocol service should be kept when protocol is not changed")
+	}
+	if user, _ := GetLimitInstance().limiters(10001, true); user == nil || user.Limit() != 1024 {
+		t.Fatal("node speed limit should be applied to user")
+	}
+}
+
+func TestReloadRestartChangedPorts(t *testing.T) {
+	ports := echo.FreePorts(t, 2)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+	before := manager.Shadowsocksrs[ports[0]]
+
+	nodeInfo := *core.GetApp().NodeInfo()
+	nodeInfo.Obfs = "http_simple"
+	nodeInfo.Port = fmt.Sprintf("%v,%v", ports[0], ports[1])
+	if err := manager.ReloadWithNodeInfo(&nodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	after := manager.Shadowsocksrs[ports[0]]
+	if after == before || after.Obfs != "http_simple" {
+		t.Fatal("server should restart when obfs changed")
+	}
+	if manager.Shadowsocksrs[ports[1]] == nil || len(manager.Shadowsocksrs[ports[1]].Users) != 1 {
+		t.Fatal("new port should be started with users")
+	}
+	for _, port := range ports {
+		con, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", port))
+		if err != nil {
+			t.Fatalf("port %v should be listened: %v", port, err)
+		}
+		_ = con.Close()
+	}
+
+	// remove a port
+	nodeInfo.Port = fmt.Sprintf("%v", ports[1])
+	if err := manager.ReloadWithNodeInfo(&nodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	if manager.Shadowsocksrs[ports[0]] != nil || len(manager.Shadowsocksrs) != 1 {
+		t.Fatal("removed port should be closed")
+	}
+}
+
+func TestReloadRollback(t *testing.T) {
+	ports := echo.FreePorts(t, 2)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+	before := core.GetApp().NodeInfo()
+
+	occupied, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%v", ports[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+	// a live connection of the old server, it is waiting for the handshake
+	live, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", ports[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer live.Close()
+	oldServer := manager.Shadowsocksrs[ports[0]]
+	oldListener := oldServer.Listener
+	deadline := time.Now().Add(3 * time.Second)
+	for oldListener.Active() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	nodeInfo := *before
+	nodeInfo.Method = "aes-256-cfb"
+	nodeInfo.Port = fmt.Sprintf("%v,%v", ports[0], ports[1])
+	if err := manager.ReloadWithNodeInfo(&nodeInfo); err == nil {
+		t.Fatal("reload should fail when port is occupied")
+	}
+	if core.GetApp().NodeInfo() != before {
+		t.Fatal("node info should be rolled back")
+	}
+	if len(manager.Shadowsocksrs) != 1 || manager.Shadowsocksrs[ports[0]].Method != before.Method {
+		t.Fatalf("servers should be rolled back: %+v", manager.Shadowsocksrs)
+	}
+	if manager.Shadowsocksrs[ports[0]] != oldServer || oldServer.Listener != oldListener || oldListener.Active() != 1 {
+		t.Fatal("rolled back server should keep tracking its live connections")
+	}
+	con, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", ports[0]))
+	if err != nil {
+		t.Fatalf("old server should be listened again: %v", err)
+	}
+	_ = con.Close()
+}
+
+func TestReloadMode(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+	echoServer := echo.StartTCP(t)
+	defer echoServer.Close()
+
+	nodeInfo := *core.GetApp().NodeInfo()
+	nodeInfo.Method = "aes-128-gcm"
+	if err := manager.ReloadWithNodeInfo(&nodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	before := manager.Shadowsocksrs[ports[0]]
+	ssNodeInfo := nodeInfo
+	ssNodeInfo.Mode = server.ModeShadowsocks
+	if err := manager.ReloadWithNodeInfo(&ssNodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	if manager.Shadowsocksrs[ports[0]] == before {
+		t.Fatal("server should restart when mode changed")
+	}
+
+	con, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%v", ports[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	ssCon, err := ciphers.CipherDecorate("p1", nodeInfo.Method, con)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ssCon.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := ssCon.Write(socksproxy.ParseAddr(echoServer.Addr().String()).Raw); err != nil {
+		t.Fatal(err)
+	}
+	if !echo.Echo(ssCon, []byte("plain shadowsocks")) {
+		t.Fatal("port should speak plain shadowsocks after mode changed")
+	}
+}
+
+func TestReloadProtocolKeepDevices(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+	tracker := deviceTracker()
+	userID := binaryx.LEUint32ToBytes(10001)
+	tracker.SetUserMaxClient(10001, 1)
+	if !tracker.Insert(userID, ports[0], 1, 100) {
+		t.Fatal("first client should be inserted")
+	}
+
+	nodeInfo := *core.GetApp().NodeInfo()
+	nodeInfo.Protocol = "auth_chain_a"
+	if err := manager.ReloadWithNodeInfo(&nodeInfo); err != nil {
+		t.Fatal(err)
+	}
+	if deviceTracker() != tracker || tracker.Name != "auth_chain_a" {
+		t.Fatal("obfs protocol service should be reset in place when protocol changed")
+	}
+	if devices, _ := manager.UserDevices(1); len(devices) != 1 || devices[0].ClientID != 1 {
+		t.Fatalf("devices should be kept when protocol changed: %+v", devices)
+	}
+	if tracker.Insert(userID, ports[0], 2, 200) {
+		t.Fatal("client limit of user should be kept when protocol changed")
+	}
+}
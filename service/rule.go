@@ -4,9 +4,14 @@ import (
 	"fmt"
 	"github.com/ProxyPanel/VNet-SSR/api/client"
 	"github.com/ProxyPanel/VNet-SSR/common/cache"
+	"github.com/ProxyPanel/VNet-SSR/common/dns"
 	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/common/outbound"
 	"github.com/ProxyPanel/VNet-SSR/model"
+	"net"
 	"regexp"
+	"strconv"
 	"time"
 )
 
@@ -35,7 +40,9 @@ type RuleItemComiled struct {
 type RuleService struct {
 	mode  string
 	rules []*RuleItemComiled
-	cache *cache.LRU
+	// routes are rules with an outbound, they route targets instead of allowing or rejecting them
+	routes []*RuleItemComiled
+	cache  *cache.LRU
 }
 
 func NewRuleService() *RuleService {
@@ -48,6 +55,7 @@ func NewRuleService() *RuleService {
 func (r *RuleService) Reset() {
 	r.cache = cache.NewLruCache(5 * time.Second)
 	r.rules = make([]*RuleItemComiled, 0, 256)
+	r.routes = nil
 	r.mode = RuleModeAll
 }
 
@@ -65,6 +73,7 @@ func (r *RuleService) Load(rule *model.Rule) {
 	r.Reset()
 	r.mode = rule.Model
 	for _, item := range rule.Rules {
+		var compiled *RuleItemComiled
 		switch item.Type {
 		case RuleTypeReg:
 			regexCompiled, err := regexp.Compile(item.Pattern)
@@ -73,27 +82,41 @@ func (r *RuleService) Load(rule *model.Rule) {
 				continue
 			}
 
-			r.rules = append(r.rules, &RuleItemComiled{
+			compiled = &RuleItemComiled{
 				RuleItem: item,
 				compile:  regexCompiled,
-			})
+			}
 		case RuleTypeIp:
-			r.rules = append(r.rules, &RuleItemComiled{
+			compiled = &RuleItemComiled{
 				RuleItem: item,
 				compile:  item.Pattern,
-			})
+			}
 		case RuleTypeDomain:
-			r.rules = append(r.rules, &RuleItemComiled{
+			compiled = &RuleItemComiled{
 				RuleItem: item,
 				compile:  item.Pattern,
-			})
+			}
+		default:
+			continue
 		}
+		if item.Outbound == "" {
+			r.rules = append(r.rules, compiled)
+			continue
+		}
+		if _, err := outbound.Parse(item.Outbound); err != nil {
+			log.Error("outbound of rule %v error: %s", item.Id, err.Error())
+			continue
+		}
+		r.routes = append(r.routes, compiled)
 	}
 	log.Info("loaded rule set: %+v", *rule)
 }
 
 func (r *RuleService) JudgeHostWithReport(ipOrDomain string, port int) bool {
 	ruleId, result, isFromCache := r.judgeWithCache(ipOrDomain, port)
+	if !result {
+		metrics.RuleRejections.Inc(strconv.Itoa(ruleId))
+	}
 
 	if isFromCache {
 		return result
@@ -139,12 +162,71 @@ func (r *RuleService) judgeWithCache(ipOrDomain string, port int) (ruleId int, r
 	return ruleId, result, isFromCache
 }
 
+// Outbound return the outbound of the first routing rule host matches, it is empty when there is none
+func (r *RuleService) Outbound(host string) string {
+	target := &ruleTarget{host: host}
+	for _, route := range r.routes {
+		if route.match(target) {
+			return route.Outbound
+		}
+	}
+	return ""
+}
+
+// ruleTarget is the host a rule is judged with, a domain is resolved once when an ip rule
+// is judged, so ip rules also match the addresses of domains
+type ruleTarget struct {
+	host     string
+	ips      []net.IP
+	resolved bool
+}
+
+func (t *ruleTarget) matchIP(pattern string) bool {
+	if pattern == t.host {
+		return true
+	}
+	ip := net.ParseIP(pattern)
+	if ip == nil || net.ParseIP(t.host) != nil {
+		return false
+	}
+	if !t.resolved {
+		t.resolved = true
+		ips, err := dns.GetResolver().LookupIP(t.host)
+		if err != nil {
+			log.Debug("rule resolve %s error: %s", t.host, err.Error())
+		}
+		t.ips = ips
+	}
+	for _, item := range t.ips {
+		if item.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// match report whether target matches the rule
+func (r *RuleItemComiled) match(target *ruleTarget) bool {
+	switch r.Type {
+	case RuleTypeReg:
+		regexCompiled, ok := r.compile.(*regexp.Regexp)
+		return ok && regexCompiled.Match([]byte(target.host))
+	case RuleTypeDomain:
+		return r.Pattern == target.host
+	case RuleTypeIp:
+		return target.matchIP(r.Pattern)
+	default:
+		return false
+	}
+}
+
 func (r *RuleService) judge(host string) (int, bool) {
 	// check if cache have value then return cache value
 	if r.mode == RuleModeAll {
 		return 0, true
 	}
 
+	target := &ruleTarget{host: host}
 	for _, regexItem := range r.rules {
 		switch regexItem.Type {
 		case RuleTypeReg:
@@ -163,11 +245,12 @@ func (r *RuleService) judge(host string) (int, bool) {
 			}
 
 		case RuleTypeDomain, RuleTypeIp:
-			if r.mode == RuleModeAllow && regexItem.Pattern == host {
+			matched := regexItem.match(target)
+			if r.mode == RuleModeAllow && matched {
 				return 0, true
 			}
 
-			if r.mode == RuleModeReject && regexItem.Pattern == host {
+			if r.mode == RuleModeReject && matched {
 				return regexItem.Id, false
 			}
 		default:
@@ -3,8 +3,10 @@ package service
 import (
 	"encoding/json"
 	"fmt"
+	"github.com/ProxyPanel/VNet-SSR/common/dns"
 	"github.com/ProxyPanel/VNet-SSR/model"
 	"github.com/tidwall/gjson"
+	"net"
 	"regexp"
 	"testing"
 )
@@ -200,3 +202,32 @@ func TestJudgeCache(t *testing.T){
 		t.Fatal("ntd.tv  cache test fail")
 	}
 }
+
+func TestRuleResolvedIP(t *testing.T) {
+	r, err := dns.NewResolver(dns.Config{Hosts: map[string][]net.IP{
+		"blocked.test": {net.ParseIP("10.1.1.1")},
+		"routed.test":  {net.ParseIP("10.2.2.2")},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dns.SetResolver(r)
+	defer dns.SetResolver(nil)
+	defer GetRuleService().Load(&model.Rule{Model: RuleModeAll})
+	GetRuleService().Load(&model.Rule{
+		Model: RuleModeReject,
+		Rules: []model.RuleItem{
+			{Id: 1, Type: RuleTypeIp, Pattern: "10.1.1.1"},
+			{Id: 2, Type: RuleTypeIp, Pattern: "10.2.2.2", Outbound: "socks5://127.0.0.1:1080"},
+		},
+	})
+	if id, ok := GetRuleService().judge("blocked.test"); ok || id != 1 {
+		t.Fatal("domain should be rejected by the rule of its address")
+	}
+	if _, ok := GetRuleService().judge("allowed.test"); !ok {
+		t.Fatal("domain which can not be resolved should be allowed")
+	}
+	if outbound := GetRuleService().Outbound("routed.test"); outbound != "socks5://127.0.0.1:1080" {
+		t.Fatalf("domain should be routed by the rule of its address, got %s", outbound)
+	}
+}
@@ -1,5 +1,16 @@
 package service
 
+import (
+	"context"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/pkg/errors"
+)
+
 func Start() (err error) {
 	if err = GetSSRManager().Start(); err != nil {
 		return err
@@ -21,3 +32,44 @@ func Reload() error {
 	}
 	return nil
 }
+
+// SetNodeInfo set node info and the obfs protocol service and resolver which depend on it,
+// the obfs protocol service is reused so clients and limits of users are kept
+func SetNodeInfo(nodeInfo *model.NodeInfo) {
+	core.GetApp().SetNodeInfo(nodeInfo)
+	tracker := deviceTracker()
+	if tracker == nil {
+		tracker = obfs.NewObfsAuthChainData(nodeInfo.Protocol)
+		core.GetApp().SetObfsProtocolService(tracker)
+	}
+	tracker.SetName(nodeInfo.Protocol)
+	tracker.SetPerPort(nodeInfo.ClientLimitPerPort == 1)
+	setNodeLimit(nodeInfo)
+	setResolver(nodeInfo)
+	if nodeInfo.ClientLimit != 0 {
+		log.Info("set client limit with %v", nodeInfo.ClientLimit)
+	} else {
+		log.Info("ignore client limit, because client_limit is zero, use default limit is 64")
+	}
+	tracker.SetMaxClient(clientLimit(nodeInfo))
+}
+
+// ReloadWithNodeInfo apply new node info, then sync users and rules from panel
+func ReloadWithNodeInfo(nodeInfo *model.NodeInfo) error {
+	if err := GetSSRManager().ReloadWithNodeInfo(nodeInfo); err != nil {
+		return err
+	}
+	users, err := client.GetUserList()
+	if err != nil {
+		return errors.Wrap(err, "reload get user list error")
+	}
+	if err := GetSSRManager().SyncUsers(users); err != nil {
+		return err
+	}
+	return GetRuleService().LoadFromApi()
+}
+
+// Shutdown drain connections until ctx is done and flush reports
+func Shutdown(ctx context.Context) error {
+	return GetSSRManager().Shutdown(ctx)
+}
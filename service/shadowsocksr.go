@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/ProxyPanel/VNet-SSR/api/client"
 	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
 	"github.com/ProxyPanel/VNet-SSR/core"
+	"path/filepath"
 	"runtime/debug"
 	"strconv"
 	"strings"
@@ -31,7 +33,7 @@ func GetSSRManager() *SSRManager {
 }
 
 type AddUserHandle func(*model.UserInfo)
-type DelUserHandle func(int)
+type DelUserHandle func(*model.UserInfo)
 
 func NewShadowsocksrService() *SSRManager {
 	return &SSRManager{
@@ -43,22 +45,35 @@ func NewShadowsocksrService() *SSRManager {
 		onlineLock:    new(sync.Mutex),
 		userTable:     make(map[int]*model.UserInfo),
 		userTableLock: new(sync.Mutex),
+		portTable:     make(map[int]*model.UserInfo),
+		suspended:     make(map[int]bool),
+		quota:         NewQuota(),
 		UpTime:        time.Now(),
 	}
 }
 
 type SSRManager struct {
 	sync.Locker
-	Shadowsocksrs  map[int]*server.ShadowsocksRProxy
-	traffic        map[int]*model.UserTraffic
-	trafficLock    *sync.Mutex
-	online         map[int]*model.NodeOnline
-	onlineLock     *sync.Mutex
-	userTable      map[int]*model.UserInfo
-	userTableLock  *sync.Mutex
+	Shadowsocksrs map[int]*server.ShadowsocksRProxy
+	traffic       map[int]*model.UserTraffic
+	trafficLock   *sync.Mutex
+	online        map[int]*model.NodeOnline
+	onlineLock    *sync.Mutex
+	userTable     map[int]*model.UserInfo
+	userTableLock *sync.Mutex
+	// portTable index users of userTable by port, it is written with userTableLock held
+	// and read with its own lock, so traffic of a port is counted without userTableLock
+	portTable     map[int]*model.UserInfo
+	portTableLock sync.RWMutex
+	// suspended is uids disabled locally, it is guarded by userTableLock
+	suspended      map[int]bool
 	UpTime         time.Time
 	addUserHandles []AddUserHandle
 	delUserHanelds []DelUserHandle
+	journal        *Journal
+	quota          *Quota
+	// quotaReportOff is set to 1 when panel rejects quota report
+	quotaReportOff int32
 	context.Context
 	cancel context.CancelFunc
 }
@@ -78,14 +93,40 @@ func (s *SSRManager) UIDToPort(uid int) int {
 }
 
 func (s *SSRManager) portToUidLocked(port int) int {
-	for _, value := range s.userTable {
-		if value.Port == port {
-			return value.Uid
-		}
+	if user := s.userByPort(port); user != nil {
+		return user.Uid
 	}
 	return 0
 }
 
+func (s *SSRManager) userByPort(port int) *model.UserInfo {
+	s.portTableLock.RLock()
+	defer s.portTableLock.RUnlock()
+	return s.portTable[port]
+}
+
+// setUserLocked put user to userTable and portTable
+func (s *SSRManager) setUserLocked(user *model.UserInfo) {
+	s.userTable[user.Uid] = user
+	s.portTableLock.Lock()
+	s.portTable[user.Port] = user
+	s.portTableLock.Unlock()
+}
+
+// removeUserLocked delete user of uid from userTable and portTable
+func (s *SSRManager) removeUserLocked(uid int) *model.UserInfo {
+	user := s.userTable[uid]
+	delete(s.userTable, uid)
+	if user != nil {
+		s.portTableLock.Lock()
+		if s.portTable[user.Port] == user {
+			delete(s.portTable, user.Port)
+		}
+		s.portTableLock.Unlock()
+	}
+	return user
+}
+
 func (s *SSRManager) PortToUid(port int) int {
 	s.userTableLock.Lock()
 	result := s.portToUidLocked(port)
@@ -93,9 +134,33 @@ func (s *SSRManager) PortToUid(port int) int {
 	return result
 }
 
+func init() {
+	GetSSRManager().RegisterDelUserHandle(deleteUserMetrics)
+}
+
+// deleteUserMetrics drop metric samples of a deleted user, so samples don't pile up with user churn.
+// port samples belong to the user only when the user has its own port
+func deleteUserMetrics(user *model.UserInfo) {
+	uid := strconv.Itoa(user.Uid)
+	for _, direction := range []string{"up", "down"} {
+		metrics.UserBytes.Delete(uid, direction)
+		metrics.LimiterWait.Delete(uid, direction)
+	}
+	if core.GetApp().NodeInfo().Single != 1 {
+		port := strconv.Itoa(user.Port)
+		metrics.ActiveTCP.Delete(port)
+		metrics.UDPNatEntries.Delete(port)
+	}
+}
+
 func (s *SSRManager) Upload(port int, n int64) {
+	user := s.userByPort(port)
+	uid := 0
+	if user != nil {
+		uid = user.Uid
+	}
 	s.trafficLock.Lock()
-	uid := s.PortToUid(port)
+	metrics.UserBytes.Add(float64(n), strconv.Itoa(uid), "up")
 	if s.traffic[uid] != nil {
 		s.traffic[uid].Upload += n
 	} else {
@@ -105,11 +170,17 @@ func (s *SSRManager) Upload(port int, n int64) {
 		s.traffic[uid] = traffic
 	}
 	s.trafficLock.Unlock()
+	s.useQuota(user, n)
 }
 
 func (s *SSRManager) Download(port int, n int64) {
+	user := s.userByPort(port)
+	uid := 0
+	if user != nil {
+		uid = user.Uid
+	}
 	s.trafficLock.Lock()
-	uid := s.PortToUid(port)
+	metrics.UserBytes.Add(float64(n), strconv.Itoa(uid), "down")
 	if s.traffic[uid] != nil {
 		s.traffic[uid].Download += n
 	} else {
@@ -119,6 +190,7 @@ func (s *SSRManager) Download(port int, n int64) {
 		s.traffic[uid] = traffic
 	}
 	s.trafficLock.Unlock()
+	s.useQuota(user, n)
 }
 
 func (s *SSRManager) ReportTraffic() []*model.UserTraffic {
@@ -128,15 +200,29 @@ func (s *SSRManager) ReportTraffic() []*model.UserTraffic {
 	convertReportData := make([]*model.UserTraffic, 0, len(reportData))
 	for key, value := range reportData {
 		if value.Download+value.Upload < 50*1024 {
+			// keep small traffic until next report
+			s.traffic[key] = value
 			continue
 		}
 		convertReportData = append(convertReportData, value)
-		delete(s.traffic, key)
 	}
 	s.trafficLock.Unlock()
 	return convertReportData
 }
 
+// ReportAllTraffic is the same as ReportTraffic but include small traffic
+func (s *SSRManager) ReportAllTraffic() []*model.UserTraffic {
+	s.trafficLock.Lock()
+	reportData := s.traffic
+	s.traffic = make(map[int]*model.UserTraffic)
+	s.trafficLock.Unlock()
+	convertReportData := make([]*model.UserTraffic, 0, len(reportData))
+	for _, value := range reportData {
+		convertReportData = append(convertReportData, value)
+	}
+	return convertReportData
+}
+
 func (s *SSRManager) Online(port int, ip string) {
 	s.onlineLock.Lock()
 	defer s.onlineLock.Unlock()
@@ -182,6 +268,13 @@ func (s *SSRManager) ReportNodeStatus() model.NodeStatus {
 }
 
 func (s *SSRManager) NewShadowsocksRProxy(port int, method, passwd, protocol, protocolParam, obfs, obfsParam string, single int, args *server.ShadowsocksRArgs) *server.ShadowsocksRProxy {
+	shadowsocksRProxy := s.buildShadowsocksRProxy(port, method, passwd, protocol, protocolParam, obfs, obfsParam, single, args)
+	s.Shadowsocksrs[port] = shadowsocksRProxy
+	return shadowsocksRProxy
+}
+
+// buildShadowsocksRProxy is the same as NewShadowsocksRProxy but it is not registered
+func (s *SSRManager) buildShadowsocksRProxy(port int, method, passwd, protocol, protocolParam, obfs, obfsParam string, single int, args *server.ShadowsocksRArgs) *server.ShadowsocksRProxy {
 	host := core.GetApp().Host()
 	shadowsocksRProxy := new(server.ShadowsocksRProxy)
 	shadowsocksRProxy.Host = host
@@ -200,12 +293,42 @@ func (s *SSRManager) NewShadowsocksRProxy(port int, method, passwd, protocol, pr
 	shadowsocksRProxy.ILimiter = GetLimitInstance()
 	shadowsocksRProxy.Users = make(map[string]string)
 	shadowsocksRProxy.HostFirewall = GetRuleService()
+	shadowsocksRProxy.UserFirewall = s
+	shadowsocksRProxy.Router = s
+	shadowsocksRProxy.SourceSelector = s
+	shadowsocksRProxy.Mode = core.GetApp().NodeInfo().Mode
+	shadowsocksRProxy.Fallback = core.GetApp().NodeInfo().Fallback
+	shadowsocksRProxy.UDPTimeout = time.Duration(core.GetApp().NodeInfo().UDPTimeout) * time.Second
+	shadowsocksRProxy.UDPSessionLimit = core.GetApp().NodeInfo().UDPSessionLimit
+	shadowsocksRProxy.ProxyProtocol = core.GetApp().NodeInfo().ProxyProtocol == 1
+	shadowsocksRProxy.TrustedProxies = splitList(core.GetApp().NodeInfo().TrustedProxies)
 	if core.GetApp().NodeInfo().IsUDP == 1 {
 		shadowsocksRProxy.UDPSwitch = "true"
 	} else {
 		shadowsocksRProxy.UDPSwitch = "false"
 	}
-	s.Shadowsocksrs[port] = shadowsocksRProxy
+	return shadowsocksRProxy
+}
+
+// buildUserProxy build the server of user in multi port mode, it is not registered. method, protocol,
+// obfs and mode of user override the node's
+func (s *SSRManager) buildUserProxy(user *model.UserInfo, nodeInfo *model.NodeInfo) *server.ShadowsocksRProxy {
+	method := nodeInfo.Method
+	if user.Method != "" {
+		method = user.Method
+	}
+	protocol, protocolParam := nodeInfo.Protocol, nodeInfo.ProtocolParam
+	if user.Protocol != "" {
+		protocol, protocolParam = user.Protocol, user.ProtocolParam
+	}
+	obfs, obfsParam := nodeInfo.Obfs, nodeInfo.ObfsParam
+	if user.Obfs != "" {
+		obfs, obfsParam = user.Obfs, user.ObfsParam
+	}
+	shadowsocksRProxy := s.buildShadowsocksRProxy(user.Port, method, user.Passwd, protocol, protocolParam, obfs, obfsParam, nodeInfo.Single, &server.ShadowsocksRArgs{})
+	if user.Mode != "" {
+		shadowsocksRProxy.Mode = user.Mode
+	}
 	return shadowsocksRProxy
 }
 
@@ -228,8 +351,26 @@ func (s *SSRManager) AddUsers(users []*model.UserInfo) error {
 }
 
 func (s *SSRManager) DelUsers(uids []int) error {
+	if err := s.delUsers(uids); err != nil {
+		return err
+	}
+	s.quota.Forget(uids...)
+	s.userTableLock.Lock()
+	for _, uid := range uids {
+		delete(s.suspended, uid)
+	}
+	s.userTableLock.Unlock()
+	return nil
+}
+
+// delUsers is the same as DelUsers but quota usages and suspensions are kept, eg: restart
+func (s *SSRManager) delUsers(uids []int) error {
 	s.userTableLock.Lock()
 	defer s.userTableLock.Unlock()
+	return s.delUsersLocked(uids)
+}
+
+func (s *SSRManager) delUsersLocked(uids []int) error {
 	users := make([]*model.UserInfo, 0, len(uids))
 	for _, uid := range uids {
 		item, err := s.delUserReturl(uid)
@@ -248,11 +389,8 @@ func (s *SSRManager) DelUsers(uids []int) error {
 }
 
 func (s *SSRManager) GetUserByPort(port int) (user *model.UserInfo, exist bool) {
-	s.userTableLock.Lock()
-	defer s.userTableLock.Unlock()
-	uid := s.PortToUid(port)
-	user, exist = s.userTable[uid]
-	return
+	user = s.userByPort(port)
+	return user, user != nil
 }
 
 func (s *SSRManager) AddUser(user *model.UserInfo) error {
@@ -267,6 +405,9 @@ func (s *SSRManager) addUser(user *model.UserInfo) error {
 	if user2 := s.userTable[user.Uid]; user2 != nil {
 		return errors.New(fmt.Sprintf("user %v already exist", user2.Uid))
 	}
+	if err := validateUser(user); err != nil {
+		return err
+	}
 	if nodeInfo.Single == 1 {
 		for _, server := range s.Shadowsocksrs {
 			server.AddUser(user.Port, user.Passwd)
@@ -275,21 +416,18 @@ func (s *SSRManager) addUser(user *model.UserInfo) error {
 		if s.Shadowsocksrs[user.Port] != nil {
 			return errors.New(fmt.Sprintf("add user port %v is used by %v", user.Port, s.portToUidLocked(user.Port)))
 		}
-		server := s.NewShadowsocksRProxy(
-			user.Port,
-			nodeInfo.Method,
-			user.Passwd,
-			nodeInfo.Protocol,
-			nodeInfo.ProtocolParam,
-			nodeInfo.Obfs,
-			nodeInfo.ObfsParam,
-			nodeInfo.Single,
-			&server.ShadowsocksRArgs{})
+		server := s.buildUserProxy(user, nodeInfo)
+		s.Shadowsocksrs[user.Port] = server
 		if err := server.Start(); err != nil {
+			delete(s.Shadowsocksrs, user.Port)
+			_ = server.Close()
 			return errors.Wrap(err, "add user error")
 		}
 	}
-	s.userTable[user.Uid] = user
+	s.setUserLocked(user)
+	if !userEnabled(user) {
+		logrus.Infof("user %v is disabled, port %v is reserved", user.Uid, user.Port)
+	}
 	// deal with all add users handles
 	for _, handle := range s.addUserHandles {
 		handle(user)
@@ -315,6 +453,14 @@ func (s *SSRManager) editUserReturn(user *model.UserInfo) (before *model.UserInf
 	if nodeInfo.Single != 1 && user.Port != before.Port && s.Shadowsocksrs[user.Port] != nil {
 		return nil, errors.New(fmt.Sprintf("port %v used by user %v", user.Port, s.portToUidLocked(user.Port)))
 	}
+	// listener and password are unchanged, so connections are kept
+	if before.Port == user.Port && before.Passwd == user.Passwd && !userListenerChanged(before, user) {
+		s.setUserLocked(user)
+		for _, handle := range s.addUserHandles {
+			handle(user)
+		}
+		return before, nil
+	}
 	if _, err := s.delUserReturl(user.Uid); err != nil {
 		return nil, errors.Wrap(err, "edit user del user error")
 	}
@@ -328,8 +474,12 @@ func (s *SSRManager) DelUser(uid int) error {
 	s.userTableLock.Lock()
 	defer s.userTableLock.Unlock()
 	logrus.Infof("del uid: %v \n", uid)
-	_, err := s.delUserReturl(uid)
-	return err
+	if _, err := s.delUserReturl(uid); err != nil {
+		return err
+	}
+	s.quota.Forget(uid)
+	delete(s.suspended, uid)
+	return nil
 }
 
 func (s *SSRManager) delUserReturl(uid int) (user *model.UserInfo, err error) {
@@ -345,8 +495,7 @@ func (s *SSRManager) delUserReturl(uid int) (user *model.UserInfo, err error) {
 			server.DelUser(port)
 			logrus.Infof("server %v del %v success", server.Port, port)
 		}
-		user = s.userTable[uid]
-		delete(s.userTable, uid)
+		user = s.removeUserLocked(uid)
 	} else {
 		server := s.Shadowsocksrs[port]
 		if server == nil {
@@ -359,24 +508,18 @@ func (s *SSRManager) delUserReturl(uid int) (user *model.UserInfo, err error) {
 		if err := server.Close(); err != nil {
 			return nil, err
 		}
-		user = s.userTable[uid]
+		user = s.removeUserLocked(uid)
 		delete(s.Shadowsocksrs, port)
-		delete(s.userTable, uid)
 	}
-	// deal with all add users handles
+	// deal with all del users handles
 	for _, handle := range s.delUserHanelds {
-		handle(uid)
+		handle(user)
 	}
 	return user, nil
 }
 
 func (s *SSRManager) GetUserFromPort(port int) *model.UserInfo {
-	for _, value := range s.userTable {
-		if value.Port == port {
-			return value
-		}
-	}
-	return nil
+	return s.userByPort(port)
 }
 
 func (s *SSRManager) GetUserList() []*model.UserInfo {
@@ -434,27 +577,47 @@ func (s *SSRManager) ReportTask() {
 			traffic := s.ReportTraffic()
 			log.Info("prepare report traffic data, data length: %v", len(traffic))
 			if len(traffic) > 0 {
-				if err := client.PostAllUserTraffic(traffic); err != nil {
+				if err := s.journal.Append(&JournalEntry{Type: JournalTraffic, Traffic: traffic}); err != nil {
 					logrus.Error(err)
 				}
 			}
 			online := s.ReportOnline()
 			log.Info("prepare report online data, data length: %v", len(online))
 			if len(online) > 0 {
-				if err := client.PostNodeOnline(online); err != nil {
+				if err := s.journal.Append(&JournalEntry{Type: JournalOnline, Online: online}); err != nil {
 					logrus.Error(err)
 				}
 			}
 
+			if err := s.quota.Save(); err != nil {
+				logrus.Error(err)
+			}
+
 			log.Info("post node status")
 			if err := client.PostNodeStatus(s.ReportNodeStatus()); err != nil {
 				logrus.Error(err)
 			}
 		}
+		// journal replay is backoff when panel is unreachable
+		if err := s.journal.Replay(postJournalEntry); err != nil {
+			logrus.Error(err)
+		}
 		tick++
 	}
 }
 
+func postJournalEntry(entry *JournalEntry) error {
+	switch entry.Type {
+	case JournalTraffic:
+		return client.PostAllUserTraffic(entry.Traffic)
+	case JournalOnline:
+		return client.PostNodeOnline(entry.Online)
+	default:
+		log.Error("unknown journal entry type %s", entry.Type)
+		return nil
+	}
+}
+
 func (s *SSRManager) GetUids() []int {
 	uids := make([]int, 0, len(s.userTable))
 	for key := range s.userTable {
@@ -466,19 +629,26 @@ func (s *SSRManager) GetUids() []int {
 func (s *SSRManager) Start() error {
 	s.Lock()
 	defer s.Unlock()
+	if s.journal == nil {
+		journal, err := OpenJournal(core.GetApp().JournalDir())
+		if err != nil {
+			return err
+		}
+		s.journal = journal
+		if dir := core.GetApp().JournalDir(); dir != "" {
+			if err := s.quota.Load(filepath.Join(dir, quotaFileName)); err != nil {
+				return err
+			}
+		}
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	s.Context = ctx
 	s.cancel = cancel
 	nodeInfo := core.GetApp().NodeInfo()
 	if nodeInfo.Single == 1 {
-		portStrArray := strings.Split(nodeInfo.Port, ",")
-		ports := []int{}
-		for _, item := range portStrArray {
-			convertPort, err := strconv.Atoi(item)
-			if err != nil {
-				panic(fmt.Sprintf("port format error: %s", nodeInfo.Port))
-			}
-			ports = append(ports, convertPort)
+		ports, err := parseNodePorts(nodeInfo.Port)
+		if err != nil {
+			panic(err)
 		}
 
 		for _, port := range ports {
@@ -515,6 +685,7 @@ func (s *SSRManager) Start() error {
 		}
 	}
 	go s.ReportTask()
+	go s.SyncTask(core.GetApp().SyncInterval())
 	return nil
 }
 
@@ -523,11 +694,23 @@ func (s *SSRManager) Close() error {
 	defer s.Unlock()
 	if s.cancel == nil {
 		log.Error("service is not start. so it can't be close")
+		return nil
 	}
 	s.cancel()
+	// keep traffic which is not reported yet, it will be posted after start
+	if traffic := s.ReportAllTraffic(); len(traffic) > 0 {
+		if err := s.journal.Append(&JournalEntry{Type: JournalTraffic, Traffic: traffic}); err != nil {
+			logrus.Error(err)
+		}
+	}
+	if err := s.quota.Save(); err != nil {
+		logrus.Error(err)
+	}
+	// users are taken and deleted under the same lock, so a user added meanwhile is not left behind
 	s.userTableLock.Lock()
+	err := s.delUsersLocked(s.GetUids())
 	s.userTableLock.Unlock()
-	if err := s.DelUsers(s.GetUids()); err != nil {
+	if err != nil {
 		return err
 	}
 	if core.GetApp().NodeInfo().Single == 1 {
@@ -541,12 +724,83 @@ func (s *SSRManager) Close() error {
 	return nil
 }
 
+// Reload restart all servers, connections of old servers are drained in background
 func (s *SSRManager) Reload() error {
+	return s.restart(nil)
+}
+
+// restart is the same as Reload but apply nodeInfo before start
+func (s *SSRManager) restart(nodeInfo *model.NodeInfo) error {
+	servers := s.servers()
 	if err := s.Close(); err != nil {
 		return err
 	}
-	if err := s.Start(); err != nil {
+	if nodeInfo != nil {
+		SetNodeInfo(nodeInfo)
+	}
+	go s.drain(servers, core.GetApp().DrainTimeout())
+	return s.Start()
+}
+
+// Shutdown stop accepting, wait connections to finish until ctx is done,
+// then close all servers and flush traffic to panel
+func (s *SSRManager) Shutdown(ctx context.Context) error {
+	servers := s.servers()
+	// udp is served until connections are drained, it is closed with servers
+	for _, item := range servers {
+		if err := item.Listener.CloseTCP(); err != nil {
+			log.Err(err)
+		}
+	}
+	if err := s.drainContext(ctx, servers); err != nil {
+		log.Warn("shutdown drain error: %s", err.Error())
+	}
+	if err := s.Close(); err != nil {
 		return err
 	}
-	return nil
+	if s.journal == nil {
+		return nil
+	}
+	if err := s.journal.Replay(postJournalEntry); err != nil {
+		return err
+	}
+	return s.journal.Close()
+}
+
+func (s *SSRManager) servers() []*server.ShadowsocksRProxy {
+	s.userTableLock.Lock()
+	defer s.userTableLock.Unlock()
+	servers := make([]*server.ShadowsocksRProxy, 0, len(s.Shadowsocksrs))
+	for _, item := range s.Shadowsocksrs {
+		servers = append(servers, item)
+	}
+	return servers
+}
+
+func (s *SSRManager) drain(servers []*server.ShadowsocksRProxy, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.drainContext(ctx, servers); err != nil {
+		log.Warn("drain error: %s", err.Error())
+	}
+}
+
+func (s *SSRManager) drainContext(ctx context.Context, servers []*server.ShadowsocksRProxy) error {
+	wg := new(sync.WaitGroup)
+	errs := make(chan error, len(servers))
+	for _, item := range servers {
+		if active := item.Listener.Active(); active > 0 {
+			log.Info("server %v drain %v connections", item.Port, active)
+		}
+		wg.Add(1)
+		go func(item *server.ShadowsocksRProxy) {
+			defer wg.Done()
+			if err := item.Listener.Drain(ctx); err != nil {
+				errs <- errors.Wrap(err, fmt.Sprintf("server %v drain error", item.Port))
+			}
+		}(item)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
 }
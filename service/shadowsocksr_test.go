@@ -1,6 +1,145 @@
 package service
 
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/common/metrics"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+)
+
 func ExampleS(){
 
 	//Output:
 }
+
+func TestUserOverrides(t *testing.T) {
+	ports := echo.FreePorts(t, 3)
+	dir, err := ioutil.TempDir("", "overrides")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	config := fmt.Sprintf(`{
+    "node": {"port": "0", "method": "aes-128-cfb", "protocol": "auth_aes128_md5", "protocol_param": "8", "obfs": "plain", "single": 0},
+    "users": [
+        {"uid": 1, "port": %v, "passwd": "p1", "enable": 1},
+        {"uid": 2, "port": %v, "passwd": "p2", "enable": 1, "method": "chacha20-ietf", "protocol": "origin", "obfs": "http_simple", "obfs_param": "example.com"}
+    ]
+}`, ports[0], ports[1])
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	panel, err := client.NewLocalPanel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetPanel(panel)
+	defer client.SetPanel(new(client.WebApi))
+	core.GetApp().SetHost("127.0.0.1")
+	nodeInfo, _ := panel.GetNodeInfo()
+	SetNodeInfo(nodeInfo)
+	manager := NewShadowsocksrService()
+	if err := manager.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer manager.Close()
+
+	if s := manager.Shadowsocksrs[ports[0]]; s.Method != "aes-128-cfb" || s.Protocol != "auth_aes128_md5" || s.ProtocolParam != "8" {
+		t.Fatalf("user without overrides should use the node's settings: %+v", s)
+	}
+	s := manager.Shadowsocksrs[ports[1]]
+	if s.Method != "chacha20-ietf" || s.Protocol != "origin" || s.ProtocolParam != "" || s.Obfs != "http_simple" || s.ObfsParam != "example.com" {
+		t.Fatalf("user overrides should be applied: %+v", s)
+	}
+
+	for _, user := range []*model.UserInfo{
+		{Uid: 3, Port: ports[2], Passwd: "p3", Method: "rot13"},
+		{Uid: 3, Port: ports[2], Passwd: "p3", Protocol: "http_simple"},
+		{Uid: 3, Port: ports[2], Passwd: "p3", Obfs: "auth_chain_a"},
+		{Uid: 3, Port: ports[2], Passwd: "p3", Mode: "v2ray"},
+	} {
+		if err := manager.AddUser(user); err == nil {
+			t.Fatalf("invalid user should be rejected: %+v", user)
+		}
+	}
+	if manager.Shadowsocksrs[ports[2]] != nil {
+		t.Fatal("server of invalid user should not be started")
+	}
+
+	// overrides are kept when the node is reloaded
+	after := *nodeInfo
+	after.Method = "aes-256-cfb"
+	if err := manager.ReloadWithNodeInfo(&after); err != nil {
+		t.Fatal(err)
+	}
+	if manager.Shadowsocksrs[ports[0]].Method != "aes-256-cfb" || manager.Shadowsocksrs[ports[1]].Method != "chacha20-ietf" {
+		t.Fatal("node method should not replace method of user")
+	}
+
+	// changing an override restarts the server of user
+	before := manager.Shadowsocksrs[ports[1]]
+	edit := *manager.GetUserFromPort(ports[1])
+	edit.Obfs = "tls1.2_ticket_auth"
+	if err := manager.EditUser(&edit); err != nil {
+		t.Fatal(err)
+	}
+	if s := manager.Shadowsocksrs[ports[1]]; s == before || s.Obfs != "tls1.2_ticket_auth" {
+		t.Fatal("server should restart when obfs of user changed")
+	}
+}
+
+func TestDeleteUserMetrics(t *testing.T) {
+	before := core.GetApp().NodeInfo()
+	defer core.GetApp().SetNodeInfo(before)
+	core.GetApp().SetNodeInfo(&model.NodeInfo{Single: 0})
+
+	metrics.UserBytes.Add(100, "90001", "up")
+	metrics.LimiterWait.Add(1, "90001", "down")
+	metrics.ActiveTCP.Inc("60001")
+	metrics.UDPNatEntries.Inc("60001")
+	deleteUserMetrics(&model.UserInfo{Uid: 90001, Port: 60001})
+	output := new(strings.Builder)
+	if _, err := metrics.WriteTo(output); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(output.String(), "90001") || strings.Contains(output.String(), "60001") {
+		t.Fatalf("samples of deleted user should be removed:\n%s", output.String())
+	}
+}
+
+func TestPortTable(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+
+	manager.Upload(10001, 100)
+	user, _ := manager.GetUserByPort(10001)
+	edited := *user
+	edited.Port = 10002
+	if err := manager.EditUser(&edited); err != nil {
+		t.Fatal(err)
+	}
+	manager.Upload(10002, 10)
+	manager.Download(10001, 1)
+	if manager.traffic[1].Upload != 110 || manager.traffic[0].Download != 1 {
+		t.Fatalf("traffic should follow the port of user: %+v %+v", manager.traffic[1], manager.traffic[0])
+	}
+	if manager.PortToUid(10001) != 0 || manager.PortToUid(10002) != 1 {
+		t.Fatal("old port should be removed from port table")
+	}
+	if err := manager.DelUser(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, exist := manager.GetUserByPort(10002); exist {
+		t.Fatal("deleted user should be removed from port table")
+	}
+}
@@ -0,0 +1,34 @@
+package service
+
+import (
+	"reflect"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+)
+
+// WatchLocalPanel apply standalone config to running services when it is changed.
+// node changes restart all servers, user and rule changes are applied in place.
+func WatchLocalPanel(panel *client.LocalPanel) error {
+	panel.OnChange(func(before, after *client.LocalConfig) {
+		if !reflect.DeepEqual(before.Node, after.Node) {
+			nodeInfo, _ := panel.GetNodeInfo()
+			log.Info("standalone node info changed, restart all servers")
+			if err := ReloadWithNodeInfo(nodeInfo); err != nil {
+				log.Error("standalone reload node error: %s", err.Error())
+			}
+			return
+		}
+		if !reflect.DeepEqual(before.Users, after.Users) {
+			users, _ := panel.GetUserList()
+			if err := GetSSRManager().SyncUsers(users); err != nil {
+				log.Error("standalone sync users error: %s", err.Error())
+			}
+		}
+		if !reflect.DeepEqual(before.Rule, after.Rule) {
+			rule, _ := panel.GetNodeRule()
+			GetRuleService().Load(rule)
+		}
+	})
+	return panel.Watch()
+}
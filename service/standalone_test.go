@@ -0,0 +1,77 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+)
+
+func standaloneConfig(port int, users string) string {
+	return fmt.Sprintf(`{
+    "node": {"port": "%v", "passwd": "killer", "method": "aes-128-cfb", "protocol": "auth_aes128_md5", "obfs": "plain", "single": 1},
+    "users": [%s]
+}`, port, users)
+}
+
+func TestWatchLocalPanel(t *testing.T) {
+	port := echo.FreePort(t)
+
+	dir, err := ioutil.TempDir("", "standalone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	users := `{"uid": 1, "port": 10001, "passwd": "p1", "enable": 1}, {"uid": 2, "port": 10002, "passwd": "p2", "enable": 1}`
+	if err := ioutil.WriteFile(path, []byte(standaloneConfig(port, users)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	panel, err := client.NewLocalPanel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetPanel(panel)
+	defer client.SetPanel(new(client.WebApi))
+
+	core.GetApp().SetHost("127.0.0.1")
+	nodeInfo, _ := panel.GetNodeInfo()
+	SetNodeInfo(nodeInfo)
+	if err := Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer GetSSRManager().Close()
+	if err := WatchLocalPanel(panel); err != nil {
+		t.Fatal(err)
+	}
+
+	users = `{"uid": 2, "port": 10002, "passwd": "changed", "enable": 1}, {"uid": 3, "port": 10003, "passwd": "p3", "enable": 1}`
+	if err := ioutil.WriteFile(path, []byte(standaloneConfig(port, users)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		GetSSRManager().userTableLock.Lock()
+		uids := GetSSRManager().GetUids()
+		var passwd string
+		if user := GetSSRManager().userTable[2]; user != nil {
+			passwd = user.Passwd
+		}
+		GetSSRManager().userTableLock.Unlock()
+		sort.Ints(uids)
+		if fmt.Sprint(uids) == "[2 3]" && passwd == "changed" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("users are not synced, uids: %v, passwd: %s", uids, passwd)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
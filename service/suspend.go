@@ -0,0 +1,67 @@
+package service
+
+import (
+	"fmt"
+
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// userEnabled report whether the user is allowed to connect, panel send 1 for enabled user
+// and a user without enable is decoded as enabled
+func userEnabled(user *model.UserInfo) bool {
+	return user.Enable == 1
+}
+
+// JudgeUser reject disabled, suspended users and users who exhausted quota, uid is the user port. connections
+// without a user (single port without multi user protocol) are allowed
+func (s *SSRManager) JudgeUser(uid int) bool {
+	s.userTableLock.Lock()
+	defer s.userTableLock.Unlock()
+	user := s.GetUserFromPort(uid)
+	return user == nil || (userEnabled(user) && !s.suspended[user.Uid] && !s.quota.Exhausted(user))
+}
+
+// EnableUser resume a suspended user, a user disabled by panel stays disabled
+func (s *SSRManager) EnableUser(uid int) error {
+	s.userTableLock.Lock()
+	defer s.userTableLock.Unlock()
+	if s.userTable[uid] == nil {
+		return errors.New(fmt.Sprintf("user %v dosen't exist", uid))
+	}
+	delete(s.suspended, uid)
+	logrus.Infof("enable user %v", uid)
+	return nil
+}
+
+// DisableUser suspend user without deleting it, new connections are refused while its
+// port and limiter are kept. existing connections are closed when kill is true.
+// suspension is kept apart from the user info, so syncing users with panel doesn't resume it.
+func (s *SSRManager) DisableUser(uid int, kill bool) error {
+	s.userTableLock.Lock()
+	defer s.userTableLock.Unlock()
+	user := s.userTable[uid]
+	if user == nil {
+		return errors.New(fmt.Sprintf("user %v dosen't exist", uid))
+	}
+	s.suspended[uid] = true
+	logrus.Infof("disable user %v", uid)
+	if kill {
+		s.killUserLocked(user)
+	}
+	return nil
+}
+
+func (s *SSRManager) killUserLocked(user *model.UserInfo) {
+	killed := 0
+	if core.GetApp().NodeInfo().Single == 1 {
+		for _, item := range s.Shadowsocksrs {
+			killed += item.KillUser(user.Port)
+		}
+	} else if item := s.Shadowsocksrs[user.Port]; item != nil {
+		killed += item.KillUser(user.Port)
+	}
+	logrus.Infof("kill %v connections of user %v", killed, user.Uid)
+}
@@ -0,0 +1,111 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/ProxyPanel/VNet-SSR/proxy/client"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+)
+
+func TestDisableUser(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+	echoServer := echo.StartTCP(t)
+	defer echoServer.Close()
+
+	ssrClient := &client.ShadowsocksClient{
+		Host:          "127.0.0.1",
+		Port:          ports[0],
+		Passwd:        "killer",
+		Method:        "aes-128-cfb",
+		Protocol:      "auth_aes128_md5",
+		ProtocolParam: "10001:p1",
+		Obfs:          "plain",
+	}
+	con, err := ssrClient.Dial(echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer con.Close()
+	if !echo.Echo(con, []byte("before")) {
+		t.Fatal("enabled user should connect")
+	}
+
+	if err := manager.DisableUser(1, true); err != nil {
+		t.Fatal(err)
+	}
+	if echo.Echo(con, []byte("killed")) {
+		t.Fatal("connection of disabled user should be killed")
+	}
+	refused, err := ssrClient.Dial(echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer refused.Close()
+	if echo.Echo(refused, []byte("refused")) {
+		t.Fatal("disabled user should be refused")
+	}
+	if manager.Shadowsocksrs[ports[0]].Users["\x11\x27\x00\x00"] != "p1" || manager.UIDToPort(1) != 10001 {
+		t.Fatal("disabled user should keep its port")
+	}
+
+	if err := manager.EnableUser(1); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := ssrClient.Dial(echoServer.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resumed.Close()
+	if !echo.Echo(resumed, []byte("after")) {
+		t.Fatal("enabled user should connect again")
+	}
+}
+
+func TestDisableUserKeptAfterSync(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+
+	if err := manager.DisableUser(1, false); err != nil {
+		t.Fatal(err)
+	}
+	// panel still sends the user as enabled
+	if err := manager.SyncUsers([]*model.UserInfo{{Uid: 1, Port: 10001, Passwd: "p1", Limit: 2048, Enable: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if diff := manager.DiffUsers([]*model.UserInfo{{Uid: 1, Port: 10001, Passwd: "p1", Limit: 2048, Enable: 1}}); !diff.Empty() {
+		t.Fatalf("suspended user should not differ from panel, diff: %s", diff.String())
+	}
+	if manager.JudgeUser(10001) {
+		t.Fatal("suspended user should stay suspended after sync")
+	}
+
+	if err := manager.EnableUser(1); err != nil {
+		t.Fatal(err)
+	}
+	if !manager.JudgeUser(10001) {
+		t.Fatal("enabled user should be allowed")
+	}
+}
+
+func TestUserWithoutEnable(t *testing.T) {
+	ports := echo.FreePorts(t, 1)
+	manager, _, closer := startReloadManager(t, ports[0])
+	defer closer()
+
+	// panel which doesn't send enable
+	var users []*model.UserInfo
+	if err := json.Unmarshal([]byte(`[{"uid": 1, "port": 10001, "passwd": "p1", "speed_limit": 2048}]`), &users); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.SyncUsers(users); err != nil {
+		t.Fatal(err)
+	}
+	if !manager.JudgeUser(10001) {
+		t.Fatal("user without enable should be allowed")
+	}
+}
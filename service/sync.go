@@ -0,0 +1,119 @@
+package service
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/common/log"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/pkg/errors"
+)
+
+// UserDiff is the difference between running users and the latest users
+type UserDiff struct {
+	Adds  []*model.UserInfo
+	Edits []*model.UserInfo
+	Dels  []int
+}
+
+func (d *UserDiff) Empty() bool {
+	return len(d.Adds) == 0 && len(d.Edits) == 0 && len(d.Dels) == 0
+}
+
+func (d *UserDiff) String() string {
+	uids := func(users []*model.UserInfo) []int {
+		result := make([]int, 0, len(users))
+		for _, user := range users {
+			result = append(result, user.Uid)
+		}
+		return result
+	}
+	return fmt.Sprintf("add: %v, edit: %v, del: %v", uids(d.Adds), uids(d.Edits), d.Dels)
+}
+
+// DiffUsers compare users with running users
+func (s *SSRManager) DiffUsers(users []*model.UserInfo) *UserDiff {
+	s.userTableLock.Lock()
+	defer s.userTableLock.Unlock()
+	diff := new(UserDiff)
+	latest := make(map[int]*model.UserInfo, len(users))
+	for _, user := range users {
+		latest[user.Uid] = user
+		before := s.userTable[user.Uid]
+		if before == nil {
+			diff.Adds = append(diff.Adds, user)
+		} else if *before != *user {
+			diff.Edits = append(diff.Edits, user)
+		}
+	}
+	for uid := range s.userTable {
+		if latest[uid] == nil {
+			diff.Dels = append(diff.Dels, uid)
+		}
+	}
+	sort.Ints(diff.Dels)
+	return diff
+}
+
+// SyncUsers make running users the same as users, users not in it are deleted,
+// new users are added and changed users are edited. a failed user doesn't stop the others.
+func (s *SSRManager) SyncUsers(users []*model.UserInfo) error {
+	diff := s.DiffUsers(users)
+	if diff.Empty() {
+		return nil
+	}
+	log.Info("sync users %s", diff.String())
+	errs := make([]string, 0)
+	// delete first, so the ports can be reused by edited and added users
+	for _, uid := range diff.Dels {
+		if err := s.DelUser(uid); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, user := range diff.Edits {
+		if err := s.EditUser(user); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, user := range diff.Adds {
+		if err := s.AddUser(user); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(fmt.Sprintf("sync users error: %s", strings.Join(errs, "; ")))
+	}
+	return nil
+}
+
+// SyncTask pull user list from panel every interval, so users will not drift from
+// panel when a push is lost
+func (s *SSRManager) SyncTask(interval time.Duration) {
+	if interval <= 0 {
+		log.Info("SyncTask is disabled")
+		return
+	}
+	log.Info("SyncTask start, interval: %v", interval)
+	ctx := s.Context
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info("SyncTask close")
+			return
+		case <-ticker.C:
+		}
+		users, err := client.GetUserList()
+		if err != nil {
+			log.Error("sync users get user list error: %s", err.Error())
+			continue
+		}
+		if err := s.SyncUsers(users); err != nil {
+			log.Err(err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/ProxyPanel/VNet-SSR/api/client"
+	"github.com/ProxyPanel/VNet-SSR/core"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/ProxyPanel/VNet-SSR/testing/servers/echo"
+)
+
+func TestDiffUsers(t *testing.T) {
+	manager := NewShadowsocksrService()
+	manager.setUserLocked(&model.UserInfo{Uid: 1, Port: 10001, Passwd: "p1", Enable: 1})
+	manager.setUserLocked(&model.UserInfo{Uid: 2, Port: 10002, Passwd: "p2", Enable: 1})
+	manager.setUserLocked(&model.UserInfo{Uid: 3, Port: 10003, Passwd: "p3", Enable: 1})
+
+	diff := manager.DiffUsers([]*model.UserInfo{
+		{Uid: 1, Port: 10001, Passwd: "p1", Enable: 1},
+		{Uid: 2, Port: 10002, Passwd: "changed", Enable: 1},
+		{Uid: 4, Port: 10004, Passwd: "p4", Enable: 1},
+	})
+	if diff.String() != "add: [4], edit: [2], del: [3]" {
+		t.Fatalf("diff is wrong: %s", diff.String())
+	}
+	if !manager.DiffUsers(manager.GetUserList()).Empty() {
+		t.Fatal("diff with itself should be empty")
+	}
+}
+
+func TestSyncTask(t *testing.T) {
+	core.GetApp().SetSyncInterval(50 * time.Millisecond)
+	defer core.GetApp().SetSyncInterval(0)
+	ports := echo.FreePorts(t, 1)
+	manager, path, closer := startReloadManager(t, ports[0])
+	defer closer()
+
+	users := `{"uid": 2, "port": 10002, "passwd": "p2", "enable": 1}`
+	if err := ioutil.WriteFile(path, []byte(standaloneConfig(ports[0], users)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// reload file without notifying, only the sync task can find the change
+	if err := client.GetPanel().(*client.LocalPanel).Reload(); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		manager.userTableLock.Lock()
+		uids := fmt.Sprint(manager.GetUids())
+		manager.userTableLock.Unlock()
+		if uids == "[2]" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("users should be synced from panel, got %s", uids)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(manager.Shadowsocksrs[ports[0]].Users) != 1 {
+		t.Fatal("server users should be synced")
+	}
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ProxyPanel/VNet-SSR/common/ciphers/aead"
+	"github.com/ProxyPanel/VNet-SSR/common/dns"
+	"github.com/ProxyPanel/VNet-SSR/common/network"
+	"github.com/ProxyPanel/VNet-SSR/common/network/ciphers"
+	"github.com/ProxyPanel/VNet-SSR/common/obfs"
+	"github.com/ProxyPanel/VNet-SSR/common/outbound"
+	"github.com/ProxyPanel/VNet-SSR/model"
+	"github.com/ProxyPanel/VNet-SSR/proxy/server"
+	"github.com/pkg/errors"
+)
+
+// checkMethods return an error when one of method, protocol, obfs and mode is set but not supported
+func checkMethods(method, protocol, obfsMethod, mode string) error {
+	if method != "" && !ciphers.IsSupportCipher(method) {
+		return errors.New(fmt.Sprintf("method %s is not supported", method))
+	}
+	if protocol != "" && !obfs.IsProtocol(protocol) {
+		return errors.New(fmt.Sprintf("protocol %s is not supported", protocol))
+	}
+	if obfsMethod != "" && !obfs.IsObfs(obfsMethod) {
+		return errors.New(fmt.Sprintf("obfs %s is not supported", obfsMethod))
+	}
+	if mode != "" && mode != server.ModeShadowsocksR && mode != server.ModeShadowsocks {
+		return errors.New(fmt.Sprintf("mode %s is not supported", mode))
+	}
+	return nil
+}
+
+// ValidateNodeInfo check nodeInfo against the registered ciphers, protocols and obfs,
+// it must pass before nodeInfo is applied, so a bad setting never reaches a connection
+func ValidateNodeInfo(nodeInfo *model.NodeInfo) error {
+	if nodeInfo == nil {
+		return errors.New("node info is empty")
+	}
+	if err := validateNodeInfo(nodeInfo); err != nil {
+		return errors.Wrap(err, "invalid node info")
+	}
+	return nil
+}
+
+func validateNodeInfo(nodeInfo *model.NodeInfo) error {
+	if nodeInfo.Method == "" {
+		return errors.New("method is empty")
+	}
+	if nodeInfo.Mode != server.ModeShadowsocks {
+		if nodeInfo.Protocol == "" {
+			return errors.New("protocol is empty")
+		}
+		if nodeInfo.Obfs == "" {
+			return errors.New("obfs is empty")
+		}
+	}
+	if err := checkMethods(nodeInfo.Method, nodeInfo.Protocol, nodeInfo.Obfs, nodeInfo.Mode); err != nil {
+		return err
+	}
+	isAEAD := aead.GetAEADCipher(nodeInfo.Method) != nil
+	is2022 := aead.GetAEAD2022Cipher(nodeInfo.Method) != nil
+	if nodeInfo.Mode == server.ModeShadowsocks && !isAEAD && !is2022 {
+		return errors.New(fmt.Sprintf("method %s is not an aead cipher required by shadowsocks mode", nodeInfo.Method))
+	}
+	if nodeInfo.Mode != server.ModeShadowsocks && is2022 {
+		return errors.New(fmt.Sprintf("method %s is only supported in shadowsocks mode", nodeInfo.Method))
+	}
+	if nodeInfo.Single == 1 {
+		if _, err := parseNodePorts(nodeInfo.Port); err != nil {
+			return err
+		}
+	}
+	if nodeInfo.Fallback != "" {
+		if _, _, err := net.SplitHostPort(nodeInfo.Fallback); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("fallback %s is not a valid address", nodeInfo.Fallback))
+		}
+	}
+	if nodeInfo.UDPTimeout < 0 || nodeInfo.UDPSessionLimit < 0 {
+		return errors.New("udp_timeout and udp_session_limit can not be negative")
+	}
+	if _, err := outbound.Parse(nodeInfo.Outbound); err != nil {
+		return err
+	}
+	if nodeInfo.EgressMode != "" {
+		if _, err := outbound.NewEgress(nodeInfo.EgressMode, splitList(nodeInfo.EgressIPs)); err != nil {
+			return err
+		}
+	}
+	config, err := resolverConfig(nodeInfo)
+	if err != nil {
+		return err
+	}
+	if _, err := dns.NewResolver(config); err != nil {
+		return err
+	}
+	if nodeInfo.ProxyProtocol == 1 {
+		if _, err := network.NewProxyProtocol(splitList(nodeInfo.TrustedProxies)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitList split comma separated items of node config such as trusted proxies, egress ips and dns servers
+func splitList(list string) []string {
+	if strings.TrimSpace(list) == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
+
+// validateUser check the overrides of user
+func validateUser(user *model.UserInfo) error {
+	if err := checkMethods(user.Method, user.Protocol, user.Obfs, user.Mode); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("user %v", user.Uid))
+	}
+	if _, err := outbound.Parse(user.Outbound); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("user %v", user.Uid))
+	}
+	if user.EgressIP != "" && net.ParseIP(user.EgressIP) == nil {
+		return errors.New(fmt.Sprintf("user %v egress ip %s format error", user.Uid, user.EgressIP))
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/ProxyPanel/VNet-SSR/model"
+)
+
+func TestValidateNodeInfo(t *testing.T) {
+	valid := model.NodeInfo{Port: "443", Method: "aes-128-cfb", Protocol: "auth_chain_a", Obfs: "tls1.2_ticket_auth", Single: 1}
+	if err := ValidateNodeInfo(&valid); err != nil {
+		t.Fatal(err)
+	}
+	ss := model.NodeInfo{Port: "443,8443", Method: "2022-blake3-aes-128-gcm", Mode: "ss", Single: 1, Fallback: "127.0.0.1:80"}
+	if err := ValidateNodeInfo(&ss); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, edit := range map[string]func(n *model.NodeInfo){
+		"empty method":      func(n *model.NodeInfo) { n.Method = "" },
+		"unknown method":    func(n *model.NodeInfo) { n.Method = "rot13" },
+		"empty protocol":    func(n *model.NodeInfo) { n.Protocol = "" },
+		"unknown protocol":  func(n *model.NodeInfo) { n.Protocol = "auth_chain_z" },
+		"obfs as protocol":  func(n *model.NodeInfo) { n.Protocol = "http_simple" },
+		"unknown obfs":      func(n *model.NodeInfo) { n.Obfs = "tls1.3" },
+		"protocol as obfs":  func(n *model.NodeInfo) { n.Obfs = "origin" },
+		"unknown mode":      func(n *model.NodeInfo) { n.Mode = "v2ray" },
+		"stream in ss mode": func(n *model.NodeInfo) { n.Mode = "ss" },
+		"2022 in ssr mode":  func(n *model.NodeInfo) { n.Method = "2022-blake3-aes-128-gcm" },
+		"bad port":          func(n *model.NodeInfo) { n.Port = "443,abc" },
+		"bad fallback":      func(n *model.NodeInfo) { n.Fallback = "127.0.0.1" },
+		"negative timeout":  func(n *model.NodeInfo) { n.UDPTimeout = -1 },
+		"untrusted proxy":   func(n *model.NodeInfo) { n.ProxyProtocol = 1 },
+		"bad proxy":         func(n *model.NodeInfo) { n.ProxyProtocol, n.TrustedProxies = 1, "10.0.0.0/8,lb" },
+		"bad outbound":      func(n *model.NodeInfo) { n.Outbound = "ftp://127.0.0.1:21" },
+		"bad egress":        func(n *model.NodeInfo) { n.EgressMode, n.EgressIPs = "fixed", "" },
+		"bad dns server":    func(n *model.NodeInfo) { n.DNSServers = "8.8.8.8,tls://1.1.1.1" },
+		"bad dns host":      func(n *model.NodeInfo) { n.DNSHosts = map[string]string{"example.com": "10.0.0.1,example"} },
+		"bad dns prefer":    func(n *model.NodeInfo) { n.DNSPrefer = "ipv5" },
+	} {
+		nodeInfo := valid
+		edit(&nodeInfo)
+		if err := ValidateNodeInfo(&nodeInfo); err == nil {
+			t.Fatalf("%s should be rejected", name)
+		}
+	}
+	if err := ValidateNodeInfo(nil); err == nil {
+		t.Fatal("nil node info should be rejected")
+	}
+}
+
+func TestGetCapabilities(t *testing.T) {
+	c := GetCapabilities()
+	contains := func(list []string, item string) bool {
+		for _, v := range list {
+			if v == item {
+				return true
+			}
+		}
+		return false
+	}
+	if !contains(c.Ciphers.Stream, "aes-128-cfb") || !contains(c.Ciphers.AEAD, "aes-128-gcm") ||
+		!contains(c.Ciphers.AEAD2022, "2022-blake3-aes-128-gcm") || !contains(c.Ciphers.Block, "aes-128-cbc") {
+		t.Fatalf("ciphers are not listed: %+v", c.Ciphers)
+	}
+	if !contains(c.Protocols, "auth_chain_a") || contains(c.Protocols, "http_simple") {
+		t.Fatalf("protocols are wrong: %v", c.Protocols)
+	}
+	if !contains(c.Obfs, "http_simple") || contains(c.Obfs, "origin") {
+		t.Fatalf("obfs are wrong: %v", c.Obfs)
+	}
+	for _, protocol := range c.Protocols {
+		nodeInfo := model.NodeInfo{Port: "443", Method: "aes-128-cfb", Protocol: protocol, Obfs: "plain", Single: 1}
+		if err := ValidateNodeInfo(&nodeInfo); err != nil {
+			t.Fatalf("listed protocol %s should be valid: %s", protocol, err)
+		}
+	}
+}
+
+func TestValidateUser(t *testing.T) {
+	for name, user := range map[string]*model.UserInfo{
+		"bad method":    {Uid: 1, Method: "unknown"},
+		"bad outbound":  {Uid: 1, Outbound: "ftp://127.0.0.1:21"},
+		"bad egress ip": {Uid: 1, EgressIP: "10.0.0"},
+	} {
+		if err := validateUser(user); err == nil {
+			t.Fatalf("%s should be rejected", name)
+		}
+	}
+	if err := validateUser(&model.UserInfo{Uid: 1, Outbound: "socks5://127.0.0.1:1080", EgressIP: "2001:db8::1"}); err != nil {
+		t.Fatal(err)
+	}
+}
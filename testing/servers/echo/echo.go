@@ -0,0 +1,92 @@
+package echo
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// FreePort return a tcp port on 127.0.0.1 which is free at the moment
+func FreePort(t testing.TB) int {
+	return FreePorts(t, 1)[0]
+}
+
+// FreePorts return n different tcp ports on 127.0.0.1 which are free at the moment
+func FreePorts(t testing.TB, n int) []int {
+	ports := make([]int, 0, n)
+	listeners := make([]net.Listener, 0, n)
+	defer func() {
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+	}()
+	for i := 0; i < n; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners = append(listeners, l)
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports
+}
+
+// StartTCP start a tcp echo server on 127.0.0.1, close the listener to stop it
+func StartTCP(t testing.TB) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			con, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer con.Close()
+				_, _ = io.Copy(con, con)
+			}()
+		}
+	}()
+	return l
+}
+
+// StartUDP start a udp echo server on 127.0.0.1, close the conn to stop it
+func StartUDP(t testing.TB) net.PacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+	return pc
+}
+
+// Start start a tcp and a udp echo server on 127.0.0.1
+func Start(t testing.TB) (net.Listener, net.PacketConn) {
+	return StartTCP(t), StartUDP(t)
+}
+
+// Echo write data through con and report whether the same data is read back
+func Echo(con net.Conn, data []byte) bool {
+	_ = con.SetDeadline(time.Now().Add(3 * time.Second))
+	if _, err := con.Write(data); err != nil {
+		return false
+	}
+	result := make([]byte, len(data))
+	if _, err := io.ReadFull(con, result); err != nil {
+		return false
+	}
+	return bytes.Equal(data, result)
+}
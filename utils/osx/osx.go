@@ -3,14 +3,41 @@ package osx
 import (
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 )
 
-func WaitSignal()os.Signal{
-	signalChan := make(chan os.Signal,1)
-	signal.Notify(signalChan,syscall.SIGINT, syscall.SIGTERM,syscall.SIGQUIT,syscall.SIGKILL,syscall.SIGHUP)
-	if sig,ok := <- signalChan;ok{
-		return sig
+var (
+	shutdownHooks     []func(os.Signal)
+	shutdownHooksLock sync.Mutex
+)
+
+// OnShutdown register hook which is called by WaitSignal before it return,
+// hooks are called in the order they are registered
+func OnShutdown(hook func(os.Signal)) {
+	shutdownHooksLock.Lock()
+	defer shutdownHooksLock.Unlock()
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// WaitSignal block until a terminate signal is received and run shutdown hooks,
+// process exit immediately when another signal is received while hooks are running
+func WaitSignal() os.Signal {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGKILL, syscall.SIGHUP)
+	sig, ok := <-signalChan
+	if !ok {
+		return nil
+	}
+	go func() {
+		<-signalChan
+		os.Exit(1)
+	}()
+	shutdownHooksLock.Lock()
+	hooks := append([]func(os.Signal){}, shutdownHooks...)
+	shutdownHooksLock.Unlock()
+	for _, hook := range hooks {
+		hook(sig)
 	}
-	return nil
+	return sig
 }
@@ -266,3 +266,51 @@ func ParseAddr(s string) *Socks5Addr {
 
 	return NewSocks5Addr(addr, aType)
 }
+
+// Handshake fast-tracks SOCKS initialization to get target address to connect.
+// when the command is udp associate, the returned error is InfoUDPAssociate
+// and caller should keep the tcp connection open until the client close it.
+func Handshake(rw net.Conn) (*Socks5Addr, error) {
+	buf := make([]byte, MaxAddrLen)
+	// read VER, NMETHODS, METHODS
+	if _, err := io.ReadFull(rw, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != 5 {
+		return nil, errors.New(fmt.Sprintf("socks version %v is not supported", buf[0]))
+	}
+	nmethods := buf[1]
+	if _, err := io.ReadFull(rw, buf[:nmethods]); err != nil {
+		return nil, err
+	}
+	// write VER METHOD
+	if _, err := rw.Write([]byte{5, 0}); err != nil {
+		return nil, err
+	}
+	// read VER CMD RSV ATYP DST.ADDR DST.PORT
+	if _, err := io.ReadFull(rw, buf[:3]); err != nil {
+		return nil, err
+	}
+	cmd := buf[1]
+	addr, err := readAddr(rw, buf)
+	if err != nil {
+		return nil, err
+	}
+	switch cmd {
+	case CmdConnect:
+		_, err = rw.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}) // SOCKS v5, reply succeeded
+	case CmdUDPAssociate:
+		if !UDPEnabled {
+			return nil, ErrCommandNotSupported
+		}
+		listenAddr := ParseAddr(rw.LocalAddr().String())
+		_, err = rw.Write(append([]byte{5, 0, 0}, listenAddr.Raw...)) // SOCKS v5, reply succeeded
+		if err != nil {
+			return nil, ErrCommandNotSupported
+		}
+		err = InfoUDPAssociate
+	default:
+		return nil, ErrCommandNotSupported
+	}
+	return addr, err
+}